@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	"github.com/ristomcgehee/lyncser/filestore"
+)
+
+// addAuthModeFlag adds the flag that chooses how the machine is authorized to use Google Drive.
+func addAuthModeFlag(cmd *cobra.Command) {
+	cmd.Flags().String("mode", string(filestore.AuthModeBrowser), fmt.Sprintf("How to authorize. One of: %s (the "+
+		"browser must run on this machine), %s (open the link on any machine and paste back the address it "+
+		"redirects to), %s (enter a code on any machine; needs a client for TVs and limited input devices)",
+		filestore.AuthModeBrowser, filestore.AuthModeManual, filestore.AuthModeDevice))
+}
+
+// getAuthMode returns the authorization mode chosen by the mode flag.
+func getAuthMode(cmd *cobra.Command) (filestore.AuthMode, error) {
+	mode, err := cmd.Flags().GetString("mode")
+	return filestore.AuthMode(mode), err
+}
+
+func authCmd(cmd *cobra.Command, args []string) {
+	logger, err := getLogger(cmd)
+	if err != nil {
+		exitWithoutLogger(err)
+	}
+	authMode, err := getAuthMode(cmd)
+	if err != nil {
+		logger.Warn("error getting mode flag", zap.Error(err))
+	}
+	importToken, err := cmd.Flags().GetString("import-token")
+	if err != nil {
+		logger.Warn("error getting import-token flag", zap.Error(err))
+	}
+	serviceAccount, err := cmd.Flags().GetString("service-account")
+	if err != nil {
+		logger.Warn("error getting service-account flag", zap.Error(err))
+	}
+	configFiles, err := getConfigFiles(cmd)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	tokens, err := getTokenStore(configFiles)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+
+	switch {
+	case importToken != "":
+		var data []byte
+		if importToken == "-" {
+			data, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			data, err = ioutil.ReadFile(importToken)
+		}
+		if err == nil {
+			err = filestore.ImportToken(tokens, data)
+		}
+	case serviceAccount != "":
+		err = filestore.ImportServiceAccount(configFiles.Dir, serviceAccount)
+	default:
+		err = filestore.Authorize(tokens, authMode, os.Stdin)
+	}
+	if err != nil {
+		exitWithError(logger, err)
+	}
+
+	// Check that the new authorization works.
+	remoteFileStore, err := getRemoteFileStore(logger, configFiles)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	if _, err := remoteFileStore.GetFiles(); err != nil {
+		exitWithError(logger, err)
+	}
+	fmt.Println("This machine is authorized to use Google Drive.")
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/ristomcgehee/lyncser/sync"
+)
+
+func validateConfigCmd(cmd *cobra.Command, args []string) {
+	logger, err := getLogger(cmd)
+	if err != nil {
+		exitWithoutLogger(err)
+	}
+	configFiles, err := getConfigFiles(cmd)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	problems, err := configFiles.ValidateConfig()
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	hasErrors := false
+	for _, problem := range problems {
+		fmt.Println(problem)
+		if problem.Severity == sync.SeverityError {
+			hasErrors = true
+		}
+	}
+	if len(problems) == 0 {
+		fmt.Println("No problems found.")
+	}
+	if hasErrors {
+		os.Exit(exitConfigError)
+	}
+}
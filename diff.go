@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/ristomcgehee/lyncser/filestore"
+	"github.com/ristomcgehee/lyncser/sync"
+	"github.com/ristomcgehee/lyncser/utils"
+)
+
+func diffCmd(cmd *cobra.Command, args []string) {
+	logger, err := getLogger(cmd)
+	if err != nil {
+		exitWithoutLogger(err)
+	}
+	configFiles, err := getConfigFiles(cmd)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	remoteFileStore, err := getRemoteFileStore(logger, configFiles)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	encryptor, err := getEncryptor(cmd, logger, configFiles)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	syncer := sync.Syncer{
+		RemoteFileStore: remoteFileStore,
+		LocalFileStore:  &filestore.LocalFileStore{},
+		Logger:          logger,
+		Config:          configFiles,
+		Encryptor:       encryptor,
+	}
+	diffs, err := syncer.GetFileDiffs(args[0])
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	if len(diffs) == 0 {
+		logger.Warnf("No synced files found at '%s'", args[0])
+	}
+	for _, diff := range diffs {
+		printDiff(os.Stdout, diff)
+	}
+}
+
+// printDiff writes a unified diff from the local file to the remote file, or a summary if either is binary.
+func printDiff(writer io.Writer, diff *sync.FileDiff) {
+	localName, remoteName := "local/"+diff.Path, "remote/"+diff.Path
+	if !diff.LocalExists {
+		localName = "/dev/null"
+	}
+	if !diff.RemoteExists {
+		remoteName = "/dev/null"
+	}
+	if utils.IsBinary(diff.LocalContents) || utils.IsBinary(diff.RemoteContents) {
+		if string(diff.LocalContents) == string(diff.RemoteContents) {
+			return
+		}
+		fmt.Fprintf(writer, "Binary files %s and %s differ\n", localName, remoteName)
+		fmt.Fprintf(writer, "  local:  %s\n", binarySummary(diff.LocalExists, diff.LocalContents))
+		fmt.Fprintf(writer, "  remote: %s\n", binarySummary(diff.RemoteExists, diff.RemoteContents))
+		return
+	}
+	fmt.Fprint(writer, utils.UnifiedDiff(localName, remoteName, diff.LocalContents, diff.RemoteContents))
+}
+
+func binarySummary(exists bool, contents []byte) string {
+	if !exists {
+		return "does not exist"
+	}
+	return fmt.Sprintf("%d bytes, sha256 %x", len(contents), sha256.Sum256(contents))
+}
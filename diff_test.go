@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"testing"
+
+	"github.com/ristomcgehee/lyncser/sync"
+)
+
+func TestPrintDiff(t *testing.T) {
+	t.Parallel()
+	binary := []byte{0, 1, 2}
+	tests := []struct {
+		name     string
+		diff     *sync.FileDiff
+		expected string
+	}{
+		{
+			name: "text",
+			diff: &sync.FileDiff{Path: "~/notes", LocalExists: true, RemoteExists: true,
+				LocalContents: []byte("v1\n"), RemoteContents: []byte("v2\n")},
+			expected: "--- local/~/notes\n+++ remote/~/notes\n@@ -1,1 +1,1 @@\n-v1\n+v2\n",
+		},
+		{
+			name: "binary",
+			diff: &sync.FileDiff{Path: "~/image", LocalExists: true, RemoteExists: true,
+				LocalContents: binary, RemoteContents: []byte("text")},
+			expected: "Binary files local/~/image and remote/~/image differ\n" +
+				fmt.Sprintf("  local:  3 bytes, sha256 %x\n", sha256.Sum256(binary)) +
+				fmt.Sprintf("  remote: 4 bytes, sha256 %x\n", sha256.Sum256([]byte("text"))),
+		},
+		{
+			name: "binary only remotely",
+			diff: &sync.FileDiff{Path: "~/image", RemoteExists: true, RemoteContents: binary},
+			expected: "Binary files /dev/null and remote/~/image differ\n  local:  does not exist\n" +
+				fmt.Sprintf("  remote: 3 bytes, sha256 %x\n", sha256.Sum256(binary)),
+		},
+		{
+			name: "same binary",
+			diff: &sync.FileDiff{Path: "~/image", LocalExists: true, RemoteExists: true,
+				LocalContents: binary, RemoteContents: binary},
+			expected: "",
+		},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		printDiff(&buf, test.diff)
+		if buf.String() != test.expected {
+			t.Errorf("%s: expected\n%s\ngot\n%s", test.name, test.expected, buf.String())
+		}
+	}
+}
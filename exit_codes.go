@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"go.uber.org/zap"
+
+	"github.com/ristomcgehee/lyncser/filestore"
+	"github.com/ristomcgehee/lyncser/sync"
+	"github.com/ristomcgehee/lyncser/utils"
+)
+
+// Exit codes returned by lyncser. These are documented in the README so that scripts and service managers can tell
+// the different kinds of failure apart.
+const (
+	exitSuccess = 0
+	// An unexpected error occurred.
+	exitError = 1
+	// The sync ran, but some files could not be synced.
+	exitPartialFailure = 2
+	// Lyncser is not authorized to use the remote file store, or the authorization was rejected.
+	exitAuthFailure = 3
+	// A config file is invalid.
+	exitConfigError = 4
+	// Another lyncser process is already syncing the same profile.
+	exitLockContention = 5
+)
+
+// getExitCode returns the exit code for an error that stopped a command.
+func getExitCode(err error) int {
+	var configErr *sync.ConfigError
+	switch {
+	case err == nil:
+		return exitSuccess
+	case filestore.IsAuthError(err):
+		return exitAuthFailure
+	case errors.As(err, &configErr), errors.Is(err, utils.ErrInvalidProfile), errors.Is(err, errUnsupportedBackend),
+		errors.Is(err, errInvalidReportFormat):
+		return exitConfigError
+	case errors.Is(err, sync.ErrLocked), errors.Is(err, sync.ErrRemoteLocked), errors.Is(err, sync.ErrRemoteLockLost):
+		return exitLockContention
+	}
+	return exitError
+}
+
+// exitWithError logs an error that stopped a command and exits with the matching exit code. Unlike logger.Panic, it
+// does not print a stack trace.
+func exitWithError(logger *zap.SugaredLogger, err error) {
+	logger.Error(err)
+	//nolint:errcheck
+	logger.Sync()
+	os.Exit(getExitCode(err))
+}
+
+// exitWithoutLogger reports an error that stopped a command before its logger could be created, such as an invalid
+// log level, and exits with the matching exit code.
+func exitWithoutLogger(err error) {
+	fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	os.Exit(getExitCode(err))
+}
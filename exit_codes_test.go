@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+
+	"github.com/ristomcgehee/lyncser/filestore"
+	"github.com/ristomcgehee/lyncser/sync"
+	"github.com/ristomcgehee/lyncser/utils"
+)
+
+var (
+	errDiskFull = errors.New("disk full")
+	errBadYAML  = errors.New("bad yaml")
+)
+
+func TestGetExitCode(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		err      error
+		expected int
+	}{
+		{"no error", nil, exitSuccess},
+		{"unexpected error", errDiskFull, exitError},
+		{"not authorized", fmt.Errorf("listing files: %w", filestore.ErrNotAuthorized), exitAuthFailure},
+		{"token refresh rejected", &oauth2.RetrieveError{}, exitAuthFailure},
+		{"unauthorized response", &googleapi.Error{Code: http.StatusUnauthorized}, exitAuthFailure},
+		{"other response", &googleapi.Error{Code: http.StatusInternalServerError}, exitError},
+		{"invalid config file", &sync.ConfigError{Path: "globalConfig.yaml", Err: errBadYAML},
+			exitConfigError},
+		{"invalid profile", fmt.Errorf("%w: .work", utils.ErrInvalidProfile), exitConfigError},
+		{"unsupported backend", fmt.Errorf("%w: dropbox", errUnsupportedBackend), exitConfigError},
+		{"invalid report format", fmt.Errorf("%w: xml", errInvalidReportFormat), exitConfigError},
+		{"locked on this machine", sync.ErrLocked, exitLockContention},
+		{"locked by another machine", fmt.Errorf("%w: 'laptop' holds the lock", sync.ErrRemoteLocked),
+			exitLockContention},
+		{"lock lost", sync.ErrRemoteLockLost, exitLockContention},
+	}
+	for _, test := range tests {
+		if exitCode := getExitCode(test.err); exitCode != test.expected {
+			t.Errorf("%s: expected exit code %d, got %d", test.name, test.expected, exitCode)
+		}
+	}
+}
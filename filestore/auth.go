@@ -0,0 +1,268 @@
+package filestore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/drive/v3"
+
+	"github.com/ristomcgehee/lyncser/utils"
+)
+
+// AuthMode is a way of authorizing lyncser to use Google Drive.
+type AuthMode string
+
+const (
+	// The browser is sent back to a server lyncser runs on localhost, so it must run on this machine.
+	AuthModeBrowser AuthMode = "browser"
+	// The authorization URL can be opened on any machine. The browser is then sent to a localhost page that fails to
+	// load, and its address is pasted back into lyncser.
+	AuthModeManual AuthMode = "manual"
+	// A code is entered on Google's device page on any machine. This needs an OAuth client of the "TVs and Limited
+	// Input devices" type.
+	AuthModeDevice AuthMode = "device"
+)
+
+const (
+	// Name of the file in the config directory where an imported service account key is stored.
+	//nolint:gosec // Not hardcoded credentials
+	serviceAccountFileName = "serviceAccount.json"
+	// The redirect URL for AuthModeManual. Nothing listens on it, so the code stays in the browser's address bar.
+	manualRedirectURL = "http://localhost:1"
+	// The grant type for polling the token endpoint in the device flow.
+	deviceGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+)
+
+var (
+	errUnknownAuthMode = errors.New("unknown authorization mode")
+	errNoToken         = errors.New("no token has been saved; run `lyncser auth` to authorize this machine")
+	errNoRefreshToken  = errors.New("the token has no refresh token; run `lyncser auth` to authorize this machine again")
+	errNoAuthCode      = errors.New("no authorization code found")
+	errAuthDenied      = errors.New("authorization was denied")
+	errDeviceAuth      = errors.New("device authorization failed")
+	errDeviceCodeTimed = errors.New("the code expired before it was entered")
+)
+
+// The endpoint that starts the device flow. Replaced in tests.
+var deviceAuthURL = "https://oauth2.googleapis.com/device/code"
+
+// Waits between polls of the token endpoint in the device flow. Replaced in tests.
+var devicePollSleep = time.Sleep
+
+// Authorize runs the authorization flow for mode and saves the new token in tokens. Input that the flow needs from the
+// user is read from in.
+func Authorize(tokens *TokenStore, mode AuthMode, in io.Reader) error {
+	config, err := getOAuthConfig(tokens.ConfigDir)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNotAuthorized, err)
+	}
+	var tok *oauth2.Token
+	switch mode {
+	case AuthModeBrowser:
+		tok, err = getTokenFromWeb(config)
+	case AuthModeManual:
+		tok, err = getTokenManually(config, in)
+	case AuthModeDevice:
+		tok, err = getTokenWithDeviceCode(config)
+	default:
+		return fmt.Errorf("%w: %s", errUnknownAuthMode, mode)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNotAuthorized, err)
+	}
+	fmt.Printf("Saving the token in: %s\n", tokens.ConfigDir)
+	return tokens.Save(tok)
+}
+
+// getOAuthConfig reads the OAuth client credentials in configDir.
+func getOAuthConfig(configDir string) (*oauth2.Config, error) {
+	b, err := ioutil.ReadFile(filepath.Join(configDir, credentialsFileName))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read credentials: %w", err)
+	}
+	// If modifying these scopes, delete the previously saved token.json.
+	config, err := google.ConfigFromJSON(b, drive.DriveFileScope)
+	if err != nil {
+		return nil, fmt.Errorf("invalid credentials: %w", err)
+	}
+	return config, nil
+}
+
+// getServiceAccountClient returns a client authorized as the service account imported into configDir. The error wraps
+// os.ErrNotExist if no service account was imported.
+func getServiceAccountClient(configDir string) (*http.Client, error) {
+	data, err := ioutil.ReadFile(filepath.Join(configDir, serviceAccountFileName))
+	if err != nil {
+		return nil, err
+	}
+	jwtConfig, err := google.JWTConfigFromJSON(data, drive.DriveFileScope)
+	if err != nil {
+		return nil, fmt.Errorf("invalid service account key: %w", err)
+	}
+	return jwtConfig.Client(context.Background()), nil
+}
+
+// getTokenManually prints the authorization URL and reads back the address the browser was sent to afterwards, for
+// when the browser runs on a different machine.
+func getTokenManually(config *oauth2.Config, in io.Reader) (*oauth2.Token, error) {
+	config.RedirectURL = manualRedirectURL
+	stateToken, err := utils.GenerateRandomHexString(128)
+	if err != nil {
+		return nil, err
+	}
+	authURL := config.AuthCodeURL(stateToken, oauth2.AccessTypeOffline)
+	fmt.Printf("Go to the following link in a browser on any machine:\n%v\n", authURL)
+	fmt.Println("After you allow access, the browser is sent to a localhost page that fails to load. Paste the " +
+		"address of that page here:")
+	address, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && (!errors.Is(err, io.EOF) || address == "") {
+		return nil, err
+	}
+	code, state, err := parseRedirectAddress(strings.TrimSpace(address))
+	if err != nil {
+		return nil, err
+	}
+	if state != stateToken {
+		return nil, ErrStateTokenMismatch
+	}
+	return config.Exchange(context.Background(), code)
+}
+
+// parseRedirectAddress returns the authorization code and state token in the address the browser was redirected to.
+func parseRedirectAddress(address string) (code, state string, err error) {
+	redirectURL, err := url.Parse(address)
+	if err != nil {
+		return "", "", err
+	}
+	query := redirectURL.Query()
+	if authErr := query.Get("error"); authErr != "" {
+		return "", "", fmt.Errorf("%w: %s", errAuthDenied, authErr)
+	}
+	if query.Get("code") == "" {
+		return "", "", errNoAuthCode
+	}
+	return query.Get("code"), query.Get("state"), nil
+}
+
+// deviceAuthResponse is a response from the device authorization endpoint or, while polling, the token endpoint.
+type deviceAuthResponse struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURL string `json:"verification_url"`
+	Interval        int    `json:"interval"`
+	AccessToken     string `json:"access_token"`
+	RefreshToken    string `json:"refresh_token"`
+	TokenType       string `json:"token_type"`
+	ExpiresIn       int    `json:"expires_in"`
+	Error           string `json:"error"`
+}
+
+// getTokenWithDeviceCode runs the OAuth device flow: it prints a code for the user to enter on Google's device page and
+// polls until they have done so.
+func getTokenWithDeviceCode(config *oauth2.Config) (*oauth2.Token, error) {
+	device, err := postForm(deviceAuthURL, url.Values{
+		"client_id": {config.ClientID},
+		"scope":     {strings.Join(config.Scopes, " ")},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if device.DeviceCode == "" {
+		return nil, fmt.Errorf("%w: %s", errDeviceAuth, device.Error)
+	}
+	fmt.Printf("On any machine, go to %s and enter the code %s\n", device.VerificationURL, device.UserCode)
+
+	interval := time.Duration(device.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(device.ExpiresIn) * time.Second)
+	for time.Now().Before(deadline) {
+		devicePollSleep(interval)
+		res, err := postForm(config.Endpoint.TokenURL, url.Values{
+			"client_id":     {config.ClientID},
+			"client_secret": {config.ClientSecret},
+			"device_code":   {device.DeviceCode},
+			"grant_type":    {deviceGrantType},
+		})
+		if err != nil {
+			return nil, err
+		}
+		switch res.Error {
+		case "":
+			return &oauth2.Token{
+				AccessToken:  res.AccessToken,
+				RefreshToken: res.RefreshToken,
+				TokenType:    res.TokenType,
+				Expiry:       time.Now().Add(time.Duration(res.ExpiresIn) * time.Second),
+			}, nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		case "access_denied":
+			return nil, errAuthDenied
+		default:
+			return nil, fmt.Errorf("%w: %s", errDeviceAuth, res.Error)
+		}
+	}
+	return nil, errDeviceCodeTimed
+}
+
+// postForm posts the form and decodes the JSON response. OAuth endpoints describe errors in the body, so it is
+// decoded whatever the status code.
+func postForm(address string, form url.Values) (*deviceAuthResponse, error) {
+	//nolint:gosec,noctx // The address is one of Google's OAuth endpoints.
+	res, err := http.PostForm(address, form)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	result := &deviceAuthResponse{}
+	if err := json.NewDecoder(res.Body).Decode(result); err != nil {
+		return nil, fmt.Errorf("%w: unexpected response with status %d: %v", errDeviceAuth, res.StatusCode, err)
+	}
+	return result, nil
+}
+
+// ImportToken saves a token copied from a machine that is already authorized, such as the token.json in its config
+// directory. The token must have a refresh token.
+func ImportToken(tokens *TokenStore, data []byte) error {
+	tok := &oauth2.Token{}
+	if err := json.Unmarshal(data, tok); err != nil {
+		return fmt.Errorf("invalid token: %w", err)
+	}
+	if tok.RefreshToken == "" {
+		return errNoRefreshToken
+	}
+	return tokens.Save(tok)
+}
+
+// ImportServiceAccount copies the service account key at srcPath into configDir. From then on, lyncser acts as the
+// service account instead of using an OAuth token.
+func ImportServiceAccount(configDir, srcPath string) error {
+	data, err := ioutil.ReadFile(srcPath)
+	if err != nil {
+		return err
+	}
+	if _, err = google.JWTConfigFromJSON(data, drive.DriveFileScope); err != nil {
+		return fmt.Errorf("invalid service account key: %w", err)
+	}
+	if err := os.MkdirAll(configDir, 0o700); err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(filepath.Join(configDir, serviceAccountFileName), bytes.NewReader(data), 0o600)
+}
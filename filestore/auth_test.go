@@ -0,0 +1,79 @@
+package filestore
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+//nolint:paralleltest // Replaces deviceAuthURL and devicePollSleep.
+func TestDeviceFlow(t *testing.T) {
+	polls := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/device/code", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("client_id") != "client" {
+			t.Errorf("unexpected client id %s", r.FormValue("client_id"))
+		}
+		fmt.Fprint(w, `{"device_code": "device", "user_code": "ABC-DEF", "verification_url": "https://example.com",
+			"expires_in": 1800, "interval": 5}`)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		polls++
+		if r.FormValue("device_code") != "device" || r.FormValue("grant_type") != deviceGrantType {
+			t.Errorf("unexpected token request %v", r.Form)
+		}
+		if polls < 3 {
+			w.WriteHeader(http.StatusPreconditionRequired)
+			fmt.Fprint(w, `{"error": "authorization_pending"}`)
+			return
+		}
+		fmt.Fprint(w, `{"access_token": "access", "refresh_token": "refresh", "token_type": "Bearer",
+			"expires_in": 3600}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	originalURL, originalSleep := deviceAuthURL, devicePollSleep
+	defer func() {
+		deviceAuthURL, devicePollSleep = originalURL, originalSleep
+	}()
+	deviceAuthURL = server.URL + "/device/code"
+	var slept time.Duration
+	devicePollSleep = func(d time.Duration) {
+		slept += d
+	}
+
+	config := &oauth2.Config{
+		ClientID:     "client",
+		ClientSecret: "secret",
+		Endpoint:     oauth2.Endpoint{TokenURL: server.URL + "/token"},
+	}
+	tok, err := getTokenWithDeviceCode(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != "access" || tok.RefreshToken != "refresh" {
+		t.Errorf("unexpected token %v", tok)
+	}
+	if polls != 3 || slept != 15*time.Second {
+		t.Errorf("expected 3 polls 5s apart, got %d polls and %v", polls, slept)
+	}
+}
+
+func TestParseRedirectAddress(t *testing.T) {
+	t.Parallel()
+	code, state, err := parseRedirectAddress("http://localhost:1/?state=abc&code=4/xyz&scope=drive.file")
+	if err != nil || code != "4/xyz" || state != "abc" {
+		t.Errorf("unexpected code %s, state %s and error %v", code, state, err)
+	}
+	if _, _, err := parseRedirectAddress("http://localhost:1/?error=access_denied"); !errors.Is(err, errAuthDenied) {
+		t.Errorf("expected the authorization to be denied, got %v", err)
+	}
+	if _, _, err := parseRedirectAddress("http://localhost:1/"); !errors.Is(err, errNoAuthCode) {
+		t.Errorf("expected no code to be found, got %v", err)
+	}
+}
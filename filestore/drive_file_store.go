@@ -1,9 +1,18 @@
 package filestore
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"google.golang.org/api/drive/v3"
@@ -11,10 +20,44 @@ import (
 	"github.com/ristomcgehee/lyncser/utils"
 )
 
+// Keys of the appProperties that hold a file's FileMetadata in Google Drive. Keys and values must fit in 124 bytes.
+const (
+	appPropertyContentHash       = "contentHash"
+	appPropertyModTime           = "mtime"
+	appPropertyMode              = "mode"
+	appPropertyMachineID         = "machineId"
+	appPropertyEncryptionVersion = "encVersion"
+	appPropertyKeyID             = "keyId"
+)
+
 // File store that uses Google Drive.
 type DriveFileStore struct {
-	Logger  utils.Logger
-	service *drive.Service
+	Logger utils.Logger
+	// The real path of the directory containing the OAuth credentials and token.
+	ConfigDir string
+	// Name of the top-level folder where lyncser files are stored.
+	RootName string
+	// The id of the shared drive the top-level folder is in. Empty if it is in My Drive.
+	SharedDriveID string
+	// Keeps the OAuth token. If nil, the token is kept unencrypted in ConfigDir.
+	Tokens *TokenStore
+	// Files larger than this many bytes are uploaded in chunks of this size in resumable sessions. Must be a multiple
+	// of 256 KiB. Defaults to DefaultUploadChunkSize.
+	UploadChunkSize int64
+	// Connects to Google Drive. If nil, the credentials and token in ConfigDir are used. Set it to connect to another
+	// server, such as a fake one in tests.
+	NewService func(tokens *TokenStore) (*drive.Service, *http.Client, error)
+	service    *drive.Service
+	// The authorized HTTP client used by service, for the requests that service can't make.
+	httpClient *http.Client
+	// Keeps the sessions of unfinished uploads. May be nil.
+	uploadSessions UploadSessionStore
+	// Limits the rate at which file contents are sent. May be nil.
+	uploadLimiter *utils.RateLimiter
+	// Guards mapPathToFileID and mapIDToFile while files are synced in parallel.
+	mu sync.RWMutex
+	// Held while directories are created, so that two files in a new directory don't both create it.
+	dirMu sync.Mutex
 	// Key is the file's friendly name. Value is Google Drive file id. Contains an entry for each file/directory
 	// in Google Drive that was created by lyncser.
 	mapPathToFileID map[string]string
@@ -23,89 +66,119 @@ type DriveFileStore struct {
 	mapIDToFile map[string]*drive.File
 	// The Google Drive file id of the top-level folder where lyncser files are stored.
 	lyncserRootID string
+	// The ids of other top-level folders named RootName, which can be created when two machines sync for the first
+	// time at once. Their contents are treated as if they were in the lyncser root folder.
+	extraRootIDs []string
+	// The Google Drive file id of the folder that duplicate files are moved to. Empty if it doesn't exist yet.
+	conflictsDirID string
+	// Key is the path of a file or directory that has more than one entry in Google Drive. Value is the ids of the
+	// entries that are not used.
+	duplicates map[string][]string
+	// Key is the id of a file with more than one parent. Value is the id of the parent its path was found through.
+	multiParentFiles map[string]string
 }
 
 func (d *DriveFileStore) GetFiles() ([]*StoredFile, error) {
-	// This is the name of the top-level folder where all files created by lyncser will be stored.
-	const lyncserRootName = "Lyncser-Root"
 	var err error
-	d.service, err = getService(false)
+	d.service, d.httpClient, err = d.newService()
 	if err != nil {
 		return nil, err
 	}
-	d.lyncserRootID = ""
-	fileList, err := getFileList(d.service)
+	fileList, err := getFileList(d.service, d.SharedDriveID)
 	if err != nil {
 		return nil, err
 	}
 	d.Logger.Debugf("Found %d files in Google Drive", len(fileList))
 
+	// Only folders at the top of My Drive, or of the shared drive, are root folders. A folder with the same name
+	// anywhere else, such as a synced directory, is an ordinary file.
+	roots, err := findFilesInDir(d.service, d.SharedDriveID, d.RootName, d.topLevelID())
+	if err != nil {
+		return nil, err
+	}
+	roots = onlyDirs(roots)
+	rootIDs := make(map[string]bool, len(roots))
+	for _, root := range roots {
+		rootIDs[root.Id] = true
+	}
+
 	// Populate d.mapIdToFile and storedFiles with the files we got from the cloud.
 	d.mapIDToFile = make(map[string]*drive.File)
+	d.conflictsDirID = ""
 	for _, file := range fileList {
-		if file.Name == lyncserRootName {
-			d.lyncserRootID = file.Id
+		if rootIDs[file.Id] {
 			continue
 		}
+		if file.Name == d.conflictsDirName() && len(roots) > 0 && isInSameDir(file, roots[0]) {
+			d.conflictsDirID = file.Id
+		}
 		d.mapIDToFile[file.Id] = file
 	}
 
-	if d.lyncserRootID == "" {
-		d.lyncserRootID, err = createDir(d.service, lyncserRootName, "")
+	d.extraRootIDs = nil
+	if len(roots) == 0 {
+		d.lyncserRootID, err = createDir(d.service, d.RootName, d.SharedDriveID)
 		if err != nil {
 			return nil, err
 		}
-		d.Logger.Debugf("New %s with id %s created", lyncserRootName, d.lyncserRootID)
-	}
-
-	// Populate d.mapPathTofileID with the files that we can trace back to d.lyncserRootID
-	d.mapPathToFileID = make(map[string]string)
-	for id, file := range d.mapIDToFile {
-		parentID := file.Parents[0]
-		path := file.Name
-		foundParent := false
-		for {
-			if parentID == d.lyncserRootID {
-				foundParent = true
-				break
-			}
-			parentDir, ok := d.mapIDToFile[parentID]
-			if !ok {
-				// We can't find this file's parent. We'll act as if it doesn't exist in the cloud.
-				break
-			}
-			foundParent = true
-			path = parentDir.Name + "/" + path
-			parentID = parentDir.Parents[0]
-		}
-		if foundParent {
-			if !strings.HasPrefix(path, "~") {
-				// When stored in Google Drive, file names do not start with '/'. We make up for that here.
-				path = "/" + path
-			}
-			d.mapPathToFileID[path] = id
+		d.Logger.Debugf("New %s with id %s created", d.RootName, d.lyncserRootID)
+	} else {
+		// The oldest root folder is used so that every machine picks the same one.
+		sort.Slice(roots, func(i, j int) bool {
+			return isCreatedBefore(roots[i], roots[j])
+		})
+		d.lyncserRootID = roots[0].Id
+		for _, root := range roots[1:] {
+			d.extraRootIDs = append(d.extraRootIDs, root.Id)
+		}
+		if len(d.extraRootIDs) > 0 {
+			d.Logger.Warnf("Found %d folders named %s in Google Drive. The next sync or `lyncser repair` will merge them.",
+				len(roots), d.RootName)
 		}
 	}
 
+	d.resolvePaths()
+
 	storedFiles := make([]*StoredFile, 0, len(d.mapPathToFileID))
 	for path, fileID := range d.mapPathToFileID {
 		file := d.mapIDToFile[fileID]
+		//nolint:errcheck // Callers that need an exact time use GetModifiedTime.
+		modifiedTime, _ := time.Parse(utils.TimeFormat, file.ModifiedTime)
 		storedFiles = append(storedFiles, &StoredFile{
-			Path:  path,
-			IsDir: file.MimeType == mimeTypeFolder,
+			Path:         path,
+			IsDir:        file.MimeType == mimeTypeFolder,
+			ModifiedTime: modifiedTime,
+			Size:         file.Size,
+			Metadata:     metadataFromDriveFile(file),
 		})
 	}
 	return storedFiles, nil
 }
 
+// Authenticate runs the OAuth authorization flow if there is no saved token or if forceNewToken is true.
+// Authenticate connects to Google Drive. If there is no saved token or forceNewToken is set, it runs the authorization
+// flow for mode first. Unlike the other methods, it may prompt the user.
+func (d *DriveFileStore) Authenticate(mode AuthMode, forceNewToken bool) error {
+	var err error
+	if !forceNewToken {
+		if d.service, d.httpClient, err = d.newService(); err == nil {
+			return nil
+		}
+	}
+	if err := Authorize(d.tokenStore(), mode, os.Stdin); err != nil {
+		return err
+	}
+	d.service, d.httpClient, err = d.newService()
+	return err
+}
+
 func (d *DriveFileStore) GetFileContents(path string) (io.ReadCloser, error) {
 	fileID, _ := d.getFileID(path)
 	return downloadFileContents(d.service, fileID)
 }
 
 func (d *DriveFileStore) GetModifiedTime(path string) (time.Time, error) {
-	fileID, _ := d.getFileID(path)
-	driveFile := d.mapIDToFile[fileID]
+	driveFile, _ := d.getDriveFile(path)
 	modTimeCloud, err := time.Parse(utils.TimeFormat, driveFile.ModifiedTime)
 	if err != nil {
 		return time.Now(), err
@@ -113,14 +186,119 @@ func (d *DriveFileStore) GetModifiedTime(path string) (time.Time, error) {
 	return modTimeCloud, nil
 }
 
-func (d *DriveFileStore) WriteFileContents(path string, reader io.Reader) error {
-	fileID, exists := d.getFileID(path)
+// GetMetadata returns the metadata stored in the file's appProperties. Files uploaded by older versions of lyncser
+// have none, so only their modified time is set.
+func (d *DriveFileStore) GetMetadata(path string) (*FileMetadata, error) {
+	driveFile, _ := d.getDriveFile(path)
+	return metadataFromDriveFile(driveFile), nil
+}
+
+// tokenStore returns the store that keeps the OAuth token.
+func (d *DriveFileStore) tokenStore() *TokenStore {
+	if d.Tokens != nil {
+		return d.Tokens
+	}
+	return &TokenStore{ConfigDir: d.ConfigDir}
+}
+
+// newService connects to Google Drive with NewService, or with the credentials in ConfigDir if it isn't set.
+func (d *DriveFileStore) newService() (*drive.Service, *http.Client, error) {
+	if d.NewService != nil {
+		return d.NewService(d.tokenStore())
+	}
+	return newDriveService(d.tokenStore())
+}
+
+// SetUploadSessionStore implements ResumableFileStore.
+func (d *DriveFileStore) SetUploadSessionStore(sessions UploadSessionStore) {
+	d.uploadSessions = sessions
+}
+
+// SetUploadLimiter implements RateLimitedFileStore.
+func (d *DriveFileStore) SetUploadLimiter(limiter *utils.RateLimiter) {
+	d.uploadLimiter = limiter
+}
+
+// WriteFileContents writes the file. Files up to the upload chunk size are kept in memory so that they can be sent
+// again if the upload is retried. Larger files are read as they are uploaded in a resumable session.
+func (d *DriveFileStore) WriteFileContents(path string, reader io.Reader, metadata *FileMetadata) error {
+	existingFile, exists := d.getDriveFile(path)
 	if !exists {
-		return d.createFile(path, reader)
+		return d.createFile(path, reader, metadata)
 	}
-	driveFile := d.mapIDToFile[fileID]
-	_, err := updateFileContents(d.service, driveFile, fileID, reader)
-	return err
+	data, source, err := d.readFirstChunk(reader)
+	if err != nil {
+		return err
+	}
+	fileID := existingFile.Id
+	update := &drive.File{
+		MimeType:      existingFile.MimeType,
+		Name:          existingFile.Name,
+		ModifiedTime:  formatDriveTime(metadata.ModTime),
+		AppProperties: metadataToAppProperties(metadata),
+	}
+	var driveFile *drive.File
+	if source != nil {
+		driveFile, err = d.newResumableUpload(path, fileID, update, source, metadata).run()
+	} else {
+		driveFile, err = updateFileContents(d.service, update, fileID, data, d.uploadLimiter)
+	}
+	if err != nil {
+		return err
+	}
+	d.setDriveFile(path, driveFile)
+	return nil
+}
+
+// readFirstChunk reads the contents if they fit in one upload chunk. Otherwise it returns a reader for all of the
+// contents, which are uploaded in a resumable session.
+func (d *DriveFileStore) readFirstChunk(reader io.Reader) ([]byte, io.Reader, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(reader, d.uploadChunkSize()+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if int64(len(data)) <= d.uploadChunkSize() {
+		return data, nil, nil
+	}
+	return nil, io.MultiReader(bytes.NewReader(data), reader), nil
+}
+
+// newResumableUpload returns a resumable upload of the file. fileID is empty if the file is being created.
+func (d *DriveFileStore) newResumableUpload(path, fileID string, driveFile *drive.File, source io.Reader,
+	metadata *FileMetadata) *resumableUpload {
+	return &resumableUpload{
+		client:    d.httpClient,
+		service:   d.service,
+		path:      path,
+		fileID:    fileID,
+		create:    fileID == "",
+		metadata:  driveFile,
+		source:    bufio.NewReader(source),
+		contentID: UploadContentID(metadata),
+		nonce:     metadata.UploadNonce,
+		chunkSize: d.uploadChunkSize(),
+		sessions:  d.uploadSessions,
+		limiter:   d.uploadLimiter,
+	}
+}
+
+// UploadContentID identifies the contents of an upload by the hash of the unencrypted contents and the format they are
+// encrypted in. Contents with the same id that are encrypted with the same nonce are the same bytes, so an upload
+// session can be resumed without reading them first. Returns an empty string if the hash isn't known.
+func UploadContentID(metadata *FileMetadata) string {
+	if metadata.ContentHash == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d:%s", metadata.ContentHash, metadata.EncryptionVersion, metadata.KeyID)
+}
+
+// uploadChunkSize returns the configured upload chunk size, rounded down to a multiple of 256 KiB.
+func (d *DriveFileStore) uploadChunkSize() int64 {
+	chunkSize := d.UploadChunkSize - d.UploadChunkSize%uploadChunkAlignment
+	if chunkSize <= 0 {
+		return DefaultUploadChunkSize
+	}
+	return chunkSize
 }
 
 func (d *DriveFileStore) DeleteFile(file string) error {
@@ -140,16 +318,327 @@ func (d *DriveFileStore) FileExists(path string) (bool, error) {
 	return ok, nil
 }
 
+// resolvePaths populates d.mapPathToFileID with the files that can be traced back to the lyncser root folder. When
+// several entries have the same path, the oldest directory or the most recently modified file is used, and the others
+// are recorded in d.duplicates.
+func (d *DriveFileStore) resolvePaths() {
+	resolved := map[string]string{}
+	visiting := map[string]bool{}
+	var resolve func(id string) (string, bool)
+	resolve = func(id string) (string, bool) {
+		if id == d.lyncserRootID || utils.InSlice(id, d.extraRootIDs) {
+			return "", true
+		}
+		if path, ok := resolved[id]; ok {
+			return path, true
+		}
+		file, ok := d.mapIDToFile[id]
+		if !ok || visiting[id] {
+			// We can't find this file's parent. We'll act as if it doesn't exist in the cloud.
+			return "", false
+		}
+		visiting[id] = true
+		defer delete(visiting, id)
+		// Files with several parents are found through the first parent, in id order, that leads to the root.
+		parents := append([]string{}, file.Parents...)
+		sort.Strings(parents)
+		for _, parentID := range parents {
+			parentPath, ok := resolve(parentID)
+			if !ok {
+				continue
+			}
+			path := file.Name
+			if parentPath != "" {
+				path = parentPath + "/" + file.Name
+			}
+			resolved[id] = path
+			if len(parents) > 1 {
+				d.multiParentFiles[id] = parentID
+			}
+			return path, true
+		}
+		return "", false
+	}
+
+	d.multiParentFiles = map[string]string{}
+	entriesByPath := map[string][]*drive.File{}
+	for id, file := range d.mapIDToFile {
+		path, ok := resolve(id)
+		if !ok {
+			continue
+		}
+		if !strings.HasPrefix(path, "~") {
+			// When stored in Google Drive, file names do not start with '/'. We make up for that here.
+			path = "/" + path
+		}
+		entriesByPath[path] = append(entriesByPath[path], file)
+	}
+
+	d.mapPathToFileID = make(map[string]string)
+	d.duplicates = map[string][]string{}
+	for path, entries := range entriesByPath {
+		sort.Slice(entries, func(i, j int) bool {
+			return isPreferredEntry(entries[i], entries[j])
+		})
+		d.mapPathToFileID[path] = entries[0].Id
+		if len(entries) == 1 {
+			continue
+		}
+		for _, entry := range entries[1:] {
+			d.duplicates[path] = append(d.duplicates[path], entry.Id)
+		}
+		d.Logger.Warnf("Found %d copies of '%s' in Google Drive. Using the newest. The next sync or `lyncser repair` "+
+			"will move the others to %s.", len(entries), path, d.conflictsDirName())
+	}
+}
+
+// isPreferredEntry returns true if a should be used rather than b when both have the same path. Directories are
+// preferred over files, older directories over newer ones, and more recently modified files over older ones.
+func isPreferredEntry(a, b *drive.File) bool {
+	aIsDir, bIsDir := a.MimeType == mimeTypeFolder, b.MimeType == mimeTypeFolder
+	switch {
+	case aIsDir != bIsDir:
+		return aIsDir
+	case aIsDir:
+		return isCreatedBefore(a, b)
+	case a.ModifiedTime != b.ModifiedTime:
+		return a.ModifiedTime > b.ModifiedTime
+	case a.CreatedTime != b.CreatedTime:
+		return a.CreatedTime > b.CreatedTime
+	}
+	return a.Id < b.Id
+}
+
+// onlyDirs returns the folders among files.
+func onlyDirs(files []*drive.File) []*drive.File {
+	var dirs []*drive.File
+	for _, file := range files {
+		if file.MimeType == mimeTypeFolder {
+			dirs = append(dirs, file)
+		}
+	}
+	return dirs
+}
+
+// isInSameDir returns true if a and b have the same parents.
+func isInSameDir(a, b *drive.File) bool {
+	if len(a.Parents) != len(b.Parents) {
+		return false
+	}
+	for _, parentID := range a.Parents {
+		if !utils.InSlice(parentID, b.Parents) {
+			return false
+		}
+	}
+	return true
+}
+
+// isCreatedBefore returns true if a was created before b, using the id to break ties.
+func isCreatedBefore(a, b *drive.File) bool {
+	if a.CreatedTime != b.CreatedTime {
+		return a.CreatedTime < b.CreatedTime
+	}
+	return a.Id < b.Id
+}
+
+// NeedsRepair implements RepairableFileStore.
+func (d *DriveFileStore) NeedsRepair() bool {
+	return len(d.extraRootIDs) > 0 || len(d.duplicates) > 0 || len(d.multiParentFiles) > 0
+}
+
+// Repair implements RepairableFileStore. Extra root folders and duplicate directories are merged into the ones in use
+// by moving their contents. Duplicate files are moved to the conflicts folder and named after their path and modified
+// time. Files with several parents are removed from all but the one their path was found through.
+func (d *DriveFileStore) Repair() ([]string, error) {
+	var repairs []string
+	// Merging directories can create new duplicates among their contents, so this repeats until nothing is merged.
+	for {
+		if _, err := d.GetFiles(); err != nil {
+			return repairs, err
+		}
+		merged, err := d.mergeDuplicateDirs()
+		repairs = append(repairs, merged...)
+		if err != nil {
+			return repairs, err
+		}
+		if len(merged) == 0 {
+			break
+		}
+	}
+	moved, err := d.moveDuplicateFiles()
+	repairs = append(repairs, moved...)
+	if err != nil {
+		return repairs, err
+	}
+	fixed, err := d.removeExtraParents()
+	return append(repairs, fixed...), err
+}
+
+// mergeDuplicateDirs moves the contents of extra root folders and duplicate directories into the ones in use, then
+// deletes the empty duplicates.
+func (d *DriveFileStore) mergeDuplicateDirs() ([]string, error) {
+	type merge struct {
+		fromID string
+		toID   string
+		name   string
+	}
+	var merges []merge
+	for _, rootID := range d.extraRootIDs {
+		merges = append(merges, merge{fromID: rootID, toID: d.lyncserRootID, name: d.RootName})
+	}
+	for _, path := range d.sortedDuplicatePaths() {
+		dirID := d.mapPathToFileID[path]
+		if d.mapIDToFile[dirID].MimeType != mimeTypeFolder {
+			continue
+		}
+		for _, id := range d.duplicates[path] {
+			if d.mapIDToFile[id].MimeType == mimeTypeFolder {
+				merges = append(merges, merge{fromID: id, toID: dirID, name: path})
+			}
+		}
+	}
+
+	var repairs []string
+	for _, m := range merges {
+		for id, file := range d.mapIDToFile {
+			if !utils.InSlice(m.fromID, file.Parents) {
+				continue
+			}
+			if err := moveFile(d.service, id, "", m.toID, m.fromID); err != nil {
+				return repairs, err
+			}
+		}
+		if err := deleteFile(d.service, m.fromID); err != nil {
+			return repairs, err
+		}
+		repairs = append(repairs, fmt.Sprintf("Merged a duplicate of folder '%s' into the one in use", m.name))
+	}
+	return repairs, nil
+}
+
+// moveDuplicateFiles moves the duplicate files that are not in use to the conflicts folder.
+func (d *DriveFileStore) moveDuplicateFiles() ([]string, error) {
+	var repairs []string
+	for _, path := range d.sortedDuplicatePaths() {
+		for _, id := range d.duplicates[path] {
+			file := d.mapIDToFile[id]
+			if file.MimeType == mimeTypeFolder {
+				continue
+			}
+			conflictsDirID, err := d.getConflictsDirID()
+			if err != nil {
+				return repairs, err
+			}
+			name := fmt.Sprintf("%s (conflict %s)", path, file.ModifiedTime)
+			if err := moveFile(d.service, id, name, conflictsDirID, strings.Join(file.Parents, ",")); err != nil {
+				return repairs, err
+			}
+			repairs = append(repairs, fmt.Sprintf("Moved a copy of '%s' modified at %s to %s", path,
+				file.ModifiedTime, d.conflictsDirName()))
+		}
+	}
+	return repairs, nil
+}
+
+// removeExtraParents removes files with several parents from all but the one their path was found through.
+func (d *DriveFileStore) removeExtraParents() ([]string, error) {
+	pathsByID := make(map[string]string, len(d.mapPathToFileID))
+	for path, id := range d.mapPathToFileID {
+		pathsByID[id] = path
+	}
+	var repairs []string
+	for id, parentID := range d.multiParentFiles {
+		var otherParents []string
+		for _, otherParentID := range d.mapIDToFile[id].Parents {
+			if otherParentID != parentID {
+				otherParents = append(otherParents, otherParentID)
+			}
+		}
+		if err := moveFile(d.service, id, "", "", strings.Join(otherParents, ",")); err != nil {
+			return repairs, err
+		}
+		path, ok := pathsByID[id]
+		if !ok {
+			path = d.mapIDToFile[id].Name
+		}
+		repairs = append(repairs, fmt.Sprintf("Removed '%s' from %d other folders", path, len(otherParents)))
+	}
+	return repairs, nil
+}
+
+// getConflictsDirID returns the id of the conflicts folder, creating it if necessary.
+func (d *DriveFileStore) getConflictsDirID() (string, error) {
+	if d.conflictsDirID != "" {
+		return d.conflictsDirID, nil
+	}
+	var err error
+	d.conflictsDirID, err = createDir(d.service, d.conflictsDirName(), d.SharedDriveID)
+	return d.conflictsDirID, err
+}
+
+// sortedDuplicatePaths returns the paths in d.duplicates in order.
+func (d *DriveFileStore) sortedDuplicatePaths() []string {
+	paths := make([]string, 0, len(d.duplicates))
+	for path := range d.duplicates {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// topLevelID returns the id of the folder that holds the root folder: the shared drive, or the root of My Drive.
+func (d *DriveFileStore) topLevelID() string {
+	if d.SharedDriveID != "" {
+		return d.SharedDriveID
+	}
+	return myDriveRootID
+}
+
+// conflictsDirName returns the name of the top-level folder that duplicate files are moved to.
+func (d *DriveFileStore) conflictsDirName() string {
+	return d.RootName + "-Conflicts"
+}
+
 // getFileID returns the Google Drive file id for the given path if it exists, otherwise it returns false for
 // the second return value.
 func (d *DriveFileStore) getFileID(path string) (string, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 	fileID, ok := d.mapPathToFileID[path]
 	return fileID, ok
 }
 
+// getDriveFile returns the Google Drive file for the given path if it exists, otherwise it returns false for the
+// second return value.
+func (d *DriveFileStore) getDriveFile(path string) (*drive.File, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	fileID, ok := d.mapPathToFileID[path]
+	if !ok {
+		return nil, false
+	}
+	driveFile, ok := d.mapIDToFile[fileID]
+	return driveFile, ok
+}
+
+// setDriveFile records that the Google Drive file is at the given path.
+func (d *DriveFileStore) setDriveFile(path string, driveFile *drive.File) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.mapPathToFileID[path] = driveFile.Id
+	d.mapIDToFile[driveFile.Id] = driveFile
+}
+
 // Creates this directory and any parent directories if they do not exist.
 // Returns the Google Drive file id for the directory.
 func (d *DriveFileStore) createDirIfNecessary(dirName string) (string, error) {
+	d.dirMu.Lock()
+	defer d.dirMu.Unlock()
+	return d.createDirLocked(dirName)
+}
+
+// createDirLocked is createDirIfNecessary for when d.dirMu is held.
+func (d *DriveFileStore) createDirLocked(dirName string) (string, error) {
 	if dirName == "" || dirName == "." || dirName == "/" {
 		return d.lyncserRootID, nil
 	}
@@ -162,7 +651,7 @@ func (d *DriveFileStore) createDirIfNecessary(dirName string) (string, error) {
 	parentID, ok := d.getFileID(parent)
 	if !ok {
 		// The parent directory does not exist either. Recursively create it.
-		parentID, err = d.createDirIfNecessary(parent)
+		parentID, err = d.createDirLocked(parent)
 		if err != nil {
 			return "", err
 		}
@@ -172,21 +661,158 @@ func (d *DriveFileStore) createDirIfNecessary(dirName string) (string, error) {
 		return "", err
 	}
 	d.Logger.Debugf("Directory '%s' successfully created", dirName)
+	d.mu.Lock()
 	d.mapPathToFileID[dirName] = dirID
+	d.mu.Unlock()
 	return dirID, nil
 }
 
-func (d *DriveFileStore) createFile(path string, reader io.Reader) error {
+func (d *DriveFileStore) createFile(path string, reader io.Reader, metadata *FileMetadata) error {
+	data, source, err := d.readFirstChunk(reader)
+	if err != nil {
+		return err
+	}
 	dirID, err := d.createDirIfNecessary(filepath.Dir(path))
 	if err != nil {
 		return err
 	}
 	baseName := filepath.Base(path)
-	driveFile, err := createFile(d.service, baseName, "text/plain", reader, dirID)
+	var driveFile *drive.File
+	if source != nil {
+		driveFile, err = d.newResumableUpload(path, "", &drive.File{
+			MimeType:      mimeTypeFile,
+			Name:          baseName,
+			Parents:       []string{dirID},
+			ModifiedTime:  formatDriveTime(metadata.ModTime),
+			AppProperties: metadataToAppProperties(metadata),
+		}, source, metadata).run()
+	} else {
+		driveFile, err = createFile(d.service, baseName, mimeTypeFile, data, dirID, formatDriveTime(metadata.ModTime),
+			metadataToAppProperties(metadata), d.uploadLimiter)
+	}
 	if err != nil {
 		return err
 	}
-	d.mapPathToFileID[path] = driveFile.Id
-	d.mapIDToFile[driveFile.Id] = driveFile
+	d.setDriveFile(path, driveFile)
+	return nil
+}
+
+// GetVersionedFileContents implements VersionedFileStore. The version is the file's Google Drive version number,
+// which increases every time the file changes.
+func (d *DriveFileStore) GetVersionedFileContents(path string) (io.ReadCloser, string, error) {
+	driveFile, err := d.findCurrentFile(path)
+	if err != nil || driveFile == nil {
+		return nil, "", err
+	}
+	contents, err := downloadFileContents(d.service, driveFile.Id)
+	if err != nil {
+		return nil, "", err
+	}
+	return contents, strconv.FormatInt(driveFile.Version, 10), nil
+}
+
+// WriteFileContentsIfVersion implements VersionedFileStore. Google Drive cannot make an update conditional, so the
+// version is checked immediately before writing. When two machines create the file at the same time, the one created
+// first wins and the other is deleted.
+func (d *DriveFileStore) WriteFileContentsIfVersion(path string, reader io.Reader, version string) error {
+	driveFile, err := d.findCurrentFile(path)
+	if err != nil {
+		return err
+	}
+	switch {
+	case driveFile == nil && version != "":
+		return ErrVersionMismatch
+	case driveFile != nil && strconv.FormatInt(driveFile.Version, 10) != version:
+		return ErrVersionMismatch
+	case driveFile != nil:
+		d.setDriveFile(path, driveFile)
+		return d.WriteFileContents(path, reader, &FileMetadata{ModTime: time.Now()})
+	}
+
+	d.mu.Lock()
+	delete(d.mapPathToFileID, path)
+	d.mu.Unlock()
+	if err := d.createFile(path, reader, &FileMetadata{ModTime: time.Now()}); err != nil {
+		return err
+	}
+	createdID, _ := d.getFileID(path)
+	winner, err := d.findCurrentFile(path)
+	if err != nil {
+		return err
+	}
+	if winner != nil && winner.Id != createdID {
+		d.setDriveFile(path, winner)
+		if err := deleteFile(d.service, createdID); err != nil {
+			return err
+		}
+		return ErrVersionMismatch
+	}
 	return nil
 }
+
+// findCurrentFile looks up the file in Google Drive rather than in the list fetched by GetFiles. If there is more than
+// one file at the path, the oldest is returned. Returns nil if the file does not exist.
+func (d *DriveFileStore) findCurrentFile(path string) (*drive.File, error) {
+	dirID, ok := d.getFileID(filepath.Dir(path))
+	if filepath.Dir(path) == "/" {
+		dirID, ok = d.lyncserRootID, true
+	}
+	if !ok {
+		return nil, nil
+	}
+	files, err := findFilesInDir(d.service, d.SharedDriveID, filepath.Base(path), dirID)
+	if err != nil || len(files) == 0 {
+		return nil, err
+	}
+	return files[0], nil
+}
+
+// metadataToAppProperties converts the metadata to the appProperties stored with the file. Empty fields are left out.
+func metadataToAppProperties(metadata *FileMetadata) map[string]string {
+	appProperties := map[string]string{
+		appPropertyModTime: metadata.ModTime.UTC().Format(time.RFC3339Nano),
+	}
+	if metadata.ContentHash != "" {
+		appProperties[appPropertyContentHash] = metadata.ContentHash
+	}
+	if metadata.Mode != 0 {
+		appProperties[appPropertyMode] = strconv.FormatUint(uint64(metadata.Mode.Perm()), 8)
+	}
+	if metadata.MachineID != "" {
+		appProperties[appPropertyMachineID] = metadata.MachineID
+	}
+	if metadata.EncryptionVersion != 0 {
+		appProperties[appPropertyEncryptionVersion] = strconv.Itoa(metadata.EncryptionVersion)
+	}
+	if metadata.KeyID != "" {
+		appProperties[appPropertyKeyID] = metadata.KeyID
+	}
+	return appProperties
+}
+
+// metadataFromDriveFile reads the metadata from the file's appProperties. Properties that are missing or can't be
+// parsed are left empty, except for the modified time, which falls back to the Google Drive modified time.
+func metadataFromDriveFile(driveFile *drive.File) *FileMetadata {
+	metadata := &FileMetadata{}
+	if driveFile == nil {
+		return metadata
+	}
+	appProperties := driveFile.AppProperties
+	var err error
+	metadata.ModTime, err = time.Parse(time.RFC3339Nano, appProperties[appPropertyModTime])
+	if err != nil {
+		//nolint:errcheck // Left as the zero time if Google Drive returns an invalid time.
+		metadata.ModTime, _ = time.Parse(utils.TimeFormat, driveFile.ModifiedTime)
+	}
+	metadata.ContentHash = appProperties[appPropertyContentHash]
+	if mode, err := strconv.ParseUint(appProperties[appPropertyMode], 8, 32); err == nil {
+		metadata.Mode = os.FileMode(mode).Perm()
+	}
+	metadata.MachineID = appProperties[appPropertyMachineID]
+	if version, err := strconv.Atoi(appProperties[appPropertyEncryptionVersion]); err == nil {
+		metadata.EncryptionVersion = version
+	}
+	metadata.KeyID = appProperties[appPropertyKeyID]
+	metadata.Size = driveFile.Size
+	return metadata
+}
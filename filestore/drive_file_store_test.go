@@ -0,0 +1,481 @@
+package filestore
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/api/drive/v3"
+
+	"github.com/ristomcgehee/lyncser/filestore/fakedrive"
+	"github.com/ristomcgehee/lyncser/utils"
+)
+
+// newFakeDriveStore returns a DriveFileStore that uses fake instead of Google Drive. Retries don't sleep.
+func newFakeDriveStore(t *testing.T, fake *fakedrive.Server) *DriveFileStore {
+	t.Helper()
+	return newDriveStoreWithHandler(t, fake)
+}
+
+// newDriveStoreWithHandler returns a DriveFileStore that sends its requests to handler. Retries don't sleep.
+func newDriveStoreWithHandler(t *testing.T, handler http.Handler) *DriveFileStore {
+	t.Helper()
+	service, _ := newTestService(t, handler)
+	originalNewService := newDriveService
+	newDriveService = func(*TokenStore) (*drive.Service, *http.Client, error) {
+		return service, http.DefaultClient, nil
+	}
+	t.Cleanup(func() {
+		newDriveService = originalNewService
+	})
+	return &DriveFileStore{
+		Logger:   zap.NewNop().Sugar(),
+		RootName: "Lyncser-Root",
+	}
+}
+
+// storedPaths returns the sorted paths of the files.
+func storedPaths(files []*StoredFile) []string {
+	paths := make([]string, 0, len(files))
+	for _, file := range files {
+		paths = append(paths, file.Path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func readContents(t *testing.T, store FileStore, path string) string {
+	t.Helper()
+	reader, err := store.GetFileContents(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+//nolint:paralleltest // Replaces newDriveService and driveRetryPolicy.
+func TestDriveFileStoreWriteAndRead(t *testing.T) {
+	fake := fakedrive.New()
+	store := newFakeDriveStore(t, fake)
+	if _, err := store.GetFiles(); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	metadata := &FileMetadata{ContentHash: "hash", ModTime: modTime, Mode: 0o640, MachineID: "machine"}
+	if err := store.WriteFileContents("~/dir/sub/file1", strings.NewReader("contents"), metadata); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second machine sees the file and its metadata.
+	other := newFakeDriveStore(t, fake)
+	files, err := other.GetFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paths := strings.Join(storedPaths(files), ","); paths != "~,~/dir,~/dir/sub,~/dir/sub/file1" {
+		t.Fatalf("unexpected paths %s", paths)
+	}
+	got, err := other.GetMetadata("~/dir/sub/file1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.ModTime.Equal(modTime) || got.ContentHash != "hash" || got.Mode != 0o640 || got.MachineID != "machine" ||
+		got.Size != int64(len("contents")) {
+		t.Errorf("unexpected metadata %+v", got)
+	}
+	if contents := readContents(t, other, "~/dir/sub/file1"); contents != "contents" {
+		t.Errorf("unexpected contents %s", contents)
+	}
+
+	if err := other.WriteFileContents("~/dir/sub/file1", strings.NewReader("changed"), metadata); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if contents := readContents(t, store, "~/dir/sub/file1"); contents != "changed" {
+		t.Errorf("unexpected contents %s", contents)
+	}
+	if err := store.DeleteFile("~/dir/sub/file1"); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := other.FileExists("~/dir/sub/file1"); !exists {
+		t.Error("the file should still be in the other machine's list until it lists the files again")
+	}
+	if files, err = other.GetFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if paths := strings.Join(storedPaths(files), ","); paths != "~,~/dir,~/dir/sub" {
+		t.Errorf("unexpected paths %s", paths)
+	}
+}
+
+//nolint:paralleltest // Replaces newDriveService and driveRetryPolicy.
+func TestDriveFileStoreListsEveryPage(t *testing.T) {
+	fake := fakedrive.New()
+	fake.PageSize = 2
+	root := fake.AddFile(&drive.File{Name: "Lyncser-Root", MimeType: mimeTypeFolder}, nil)
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		fake.AddFile(&drive.File{Name: name, MimeType: mimeTypeFile, Parents: []string{root.Id}}, []byte(name))
+	}
+	// The first request for the list fails.
+	fake.InjectFault(&fakedrive.Fault{Method: http.MethodGet, Path: "/files", Status: http.StatusServiceUnavailable,
+		Times: 1})
+	store := newFakeDriveStore(t, fake)
+	files, err := store.GetFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paths := strings.Join(storedPaths(files), ","); paths != "/a,/b,/c,/d,/e" {
+		t.Errorf("unexpected paths %s", paths)
+	}
+}
+
+//nolint:paralleltest // Replaces newDriveService and driveRetryPolicy.
+func TestDriveFileStoreLargeUploadSurvivesLostResponse(t *testing.T) {
+	fake := fakedrive.New()
+	store := newFakeDriveStore(t, fake)
+	store.UploadChunkSize = uploadChunkAlignment
+	if _, err := store.GetFiles(); err != nil {
+		t.Fatal(err)
+	}
+	// The response to the first chunk is lost, so the upload asks how much was received before going on.
+	fake.InjectFault(&fakedrive.Fault{Method: http.MethodPut, Path: "/upload/drive/v3/files", Times: 1,
+		Status: http.StatusBadGateway, AfterHandling: true})
+	data := bytes.Repeat([]byte("0123456789"), uploadChunkAlignment/4)
+	for _, contents := range [][]byte{data, append(data, data...)} {
+		err := store.WriteFileContents("/big", bytes.NewReader(contents), &FileMetadata{ModTime: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fileID, _ := store.getFileID("/big")
+		if stored, _ := fake.Contents(fileID); !bytes.Equal(stored, contents) {
+			t.Errorf("expected %d bytes, got %d", len(contents), len(stored))
+		}
+	}
+	// 3 chunks and a query for the new file, then 5 chunks for the update.
+	puts := 0
+	for _, request := range fake.Requests() {
+		if strings.HasPrefix(request, http.MethodPut) {
+			puts++
+		}
+	}
+	if puts != 9 {
+		t.Errorf("expected 9 requests to the upload sessions, got %d", puts)
+	}
+}
+
+// countingReader counts the bytes read from the reader.
+type countingReader struct {
+	reader io.Reader
+	read   int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.read += int64(n)
+	return n, err
+}
+
+//nolint:paralleltest // Replaces newDriveService and driveRetryPolicy.
+func TestDriveFileStoreLargeUploadIsStreamed(t *testing.T) {
+	fake := fakedrive.New()
+	source := &countingReader{reader: bytes.NewReader(bytes.Repeat([]byte("s"), 10*uploadChunkAlignment+1))}
+	received := int64(0)
+	mux := http.NewServeMux()
+	mux.Handle("/", fake)
+	mux.HandleFunc("/upload/drive/v3/files", func(w http.ResponseWriter, r *http.Request) {
+		// The contents are read at most a chunk ahead of what has been sent.
+		if r.Method == http.MethodPut {
+			received += r.ContentLength
+			if source.read > received+2*uploadChunkAlignment {
+				t.Errorf("%d bytes were read when %d had been sent", source.read, received)
+			}
+		}
+		fake.ServeHTTP(w, r)
+	})
+	store := newDriveStoreWithHandler(t, mux)
+	store.UploadChunkSize = uploadChunkAlignment
+	if _, err := store.GetFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WriteFileContents("/stream", source, &FileMetadata{ModTime: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	fileID, _ := store.getFileID("/stream")
+	if stored, _ := fake.Contents(fileID); int64(len(stored)) != source.read || received != source.read {
+		t.Errorf("read %d bytes, sent %d and stored %d", source.read, received, len(stored))
+	}
+}
+
+//nolint:paralleltest // Replaces newDriveService and driveRetryPolicy.
+func TestDriveFileStoreRepairMergesRoots(t *testing.T) {
+	fake := fakedrive.New()
+	for i, name := range []string{"a", "b"} {
+		root := fake.AddFile(&drive.File{Name: "Lyncser-Root", MimeType: mimeTypeFolder,
+			CreatedTime: time.Date(2021, 1, i+1, 0, 0, 0, 0, time.UTC).Format(time.RFC3339)}, nil)
+		fake.AddFile(&drive.File{Name: name, MimeType: mimeTypeFile, Parents: []string{root.Id}}, []byte(name))
+	}
+	store := newFakeDriveStore(t, fake)
+	if _, err := store.GetFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if !store.NeedsRepair() {
+		t.Fatal("two root folders should need repair")
+	}
+	if _, err := store.Repair(); err != nil {
+		t.Fatal(err)
+	}
+	files, err := store.GetFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paths := strings.Join(storedPaths(files), ","); paths != "/a,/b" || store.NeedsRepair() {
+		t.Errorf("unexpected paths %s after repair", paths)
+	}
+	roots := 0
+	for _, file := range fake.Files() {
+		if file.Name == "Lyncser-Root" {
+			roots++
+		}
+	}
+	if roots != 1 {
+		t.Errorf("expected 1 root folder, got %d", roots)
+	}
+}
+
+//nolint:paralleltest // Replaces newDriveService and driveRetryPolicy.
+func TestDriveFileStoreResolvesPaths(t *testing.T) {
+	fake := fakedrive.New()
+	root := fake.AddFile(&drive.File{Name: "Lyncser-Root", MimeType: mimeTypeFolder}, nil)
+	home := fake.AddFile(&drive.File{Name: "~", MimeType: mimeTypeFolder, Parents: []string{root.Id}}, nil)
+	projects := fake.AddFile(&drive.File{Name: "projects", MimeType: mimeTypeFolder, Parents: []string{home.Id}}, nil)
+	// A synced directory that has the same name as the root folder is not a root folder.
+	nested := fake.AddFile(&drive.File{Name: "Lyncser-Root", MimeType: mimeTypeFolder, Parents: []string{projects.Id}},
+		nil)
+	fake.AddFile(&drive.File{Name: "notes", MimeType: mimeTypeFile, Parents: []string{nested.Id}}, []byte("notes"))
+	// Neither is a folder with the root's name that isn't at the top of My Drive.
+	backup := fake.AddFile(&drive.File{Name: "Backup", MimeType: mimeTypeFolder}, nil)
+	oldRoot := fake.AddFile(&drive.File{Name: "Lyncser-Root", MimeType: mimeTypeFolder, Parents: []string{backup.Id}},
+		nil)
+	fake.AddFile(&drive.File{Name: "old", MimeType: mimeTypeFile, Parents: []string{oldRoot.Id}}, []byte("old"))
+	// Files that can't be traced back to the root are left out.
+	fake.AddFile(&drive.File{Name: "orphan", MimeType: mimeTypeFile, Parents: []string{"missing"}}, nil)
+	fake.AddFile(&drive.File{Id: "loopA", Name: "a", MimeType: mimeTypeFolder, Parents: []string{"loopB"}}, nil)
+	fake.AddFile(&drive.File{Id: "loopB", Name: "b", MimeType: mimeTypeFolder, Parents: []string{"loopA"}}, nil)
+	// Of two copies of a file, the most recently modified is used.
+	for _, modifiedTime := range []string{"2021-01-02T00:00:00.000Z", "2021-01-01T00:00:00.000Z"} {
+		fake.AddFile(&drive.File{Name: ".bashrc", MimeType: mimeTypeFile, Parents: []string{home.Id},
+			ModifiedTime: modifiedTime}, []byte(modifiedTime))
+	}
+
+	store := newFakeDriveStore(t, fake)
+	files, err := store.GetFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "~,~/.bashrc,~/projects,~/projects/Lyncser-Root,~/projects/Lyncser-Root/notes"
+	if paths := strings.Join(storedPaths(files), ","); paths != expected {
+		t.Errorf("expected paths %s, got %s", expected, paths)
+	}
+	if contents := readContents(t, store, "~/.bashrc"); contents != "2021-01-02T00:00:00.000Z" {
+		t.Errorf("expected the newest copy of ~/.bashrc to be used, got the one modified at %s", contents)
+	}
+	if len(store.extraRootIDs) != 0 || len(store.duplicates) != 1 {
+		t.Errorf("expected only ~/.bashrc to need repair, got extra roots %v and duplicates %v", store.extraRootIDs,
+			store.duplicates)
+	}
+}
+
+//nolint:paralleltest // Replaces newDriveService and driveRetryPolicy.
+func TestDriveFileStoreRepair(t *testing.T) {
+	fake := fakedrive.New()
+	fake.AddSharedDrive("shared")
+	root := fake.AddFile(&drive.File{Name: "Lyncser-Root", MimeType: mimeTypeFolder, Parents: []string{"shared"}}, nil)
+	addDuplicate := func(modifiedTime string) {
+		fake.AddFile(&drive.File{Name: "a", MimeType: mimeTypeFile, Parents: []string{root.Id},
+			ModifiedTime: modifiedTime}, []byte(modifiedTime))
+	}
+	addDuplicate("2021-01-02T00:00:00.000Z")
+	addDuplicate("2021-01-01T00:00:00.000Z")
+	for i, name := range []string{"x", "y"} {
+		dir := fake.AddFile(&drive.File{Name: "dir", MimeType: mimeTypeFolder, Parents: []string{root.Id},
+			CreatedTime: time.Date(2021, 1, i+1, 0, 0, 0, 0, time.UTC).Format(time.RFC3339)}, nil)
+		fake.AddFile(&drive.File{Name: name, MimeType: mimeTypeFile, Parents: []string{dir.Id}}, []byte(name))
+	}
+	other := fake.AddFile(&drive.File{Name: "other", MimeType: mimeTypeFolder, Parents: []string{root.Id}}, nil)
+	shared := fake.AddFile(&drive.File{Name: "shared", MimeType: mimeTypeFile, Parents: []string{root.Id, other.Id}},
+		nil)
+
+	store := newFakeDriveStore(t, fake)
+	store.SharedDriveID = "shared"
+	if _, err := store.GetFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if !store.NeedsRepair() {
+		t.Fatal("duplicates and a file with two parents should need repair")
+	}
+	if _, err := store.Repair(); err != nil {
+		t.Fatal(err)
+	}
+	files, err := store.GetFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paths := strings.Join(storedPaths(files), ","); !strings.HasPrefix(paths, "/a,/dir,/dir/x,/dir/y,/other,") ||
+		store.NeedsRepair() {
+		t.Errorf("unexpected paths %s after repair", paths)
+	}
+	if contents := readContents(t, store, "/a"); contents != "2021-01-02T00:00:00.000Z" {
+		t.Errorf("expected the newest copy of /a to be kept, got the one modified at %s", contents)
+	}
+
+	// A second repair uses the conflicts folder the first one created.
+	addDuplicate("2021-01-03T00:00:00.000Z")
+	if _, err := store.Repair(); err != nil {
+		t.Fatal(err)
+	}
+	var conflictsDirs []*drive.File
+	moved := map[string]string{}
+	for _, file := range fake.Files() {
+		switch {
+		case file.Name == "Lyncser-Root-Conflicts":
+			conflictsDirs = append(conflictsDirs, file)
+		case strings.HasPrefix(file.Name, "/a (conflict "):
+			moved[file.Name] = strings.Join(file.Parents, ",")
+		case file.Id == shared.Id && len(file.Parents) != 1:
+			t.Errorf("expected the file with two parents to be left in one, got %v", file.Parents)
+		}
+	}
+	if len(conflictsDirs) != 1 {
+		t.Fatalf("expected 1 conflicts folder, got %d", len(conflictsDirs))
+	}
+	if conflictsDir := conflictsDirs[0]; conflictsDir.DriveId != "shared" ||
+		strings.Join(conflictsDir.Parents, ",") != "shared" {
+		t.Errorf("expected the conflicts folder next to the root folder in the shared drive, got %+v", conflictsDir)
+	}
+	for _, name := range []string{"/a (conflict 2021-01-01T00:00:00.000Z)", "/a (conflict 2021-01-02T00:00:00.000Z)"} {
+		if parent, ok := moved[name]; !ok || parent != conflictsDirs[0].Id {
+			t.Errorf("expected %s in the conflicts folder, got %v", name, moved)
+		}
+	}
+}
+
+//nolint:paralleltest // Replaces newDriveService and driveRetryPolicy.
+func TestDriveFileStoreSharedDrive(t *testing.T) {
+	fake := fakedrive.New()
+	fake.AddSharedDrive("shared")
+	// A folder with the same name in My Drive is not used.
+	fake.AddFile(&drive.File{Name: "Lyncser-Root", MimeType: mimeTypeFolder}, nil)
+	store := newFakeDriveStore(t, fake)
+	store.SharedDriveID = "shared"
+	if _, err := store.GetFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WriteFileContents("/file1", strings.NewReader("contents"), &FileMetadata{}); err != nil {
+		t.Fatal(err)
+	}
+	fileID, _ := store.getFileID("/file1")
+	for _, file := range fake.Files() {
+		if file.Id == fileID && file.DriveId != "shared" {
+			t.Errorf("the file should be in the shared drive, got %+v", file)
+		}
+	}
+}
+
+//nolint:paralleltest // Replaces newDriveService and driveRetryPolicy.
+func TestDriveFileStoreWriteIfVersion(t *testing.T) {
+	fake := fakedrive.New()
+	store := newFakeDriveStore(t, fake)
+	if _, err := store.GetFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WriteFileContentsIfVersion("/lock", strings.NewReader("first"), ""); err != nil {
+		t.Fatal(err)
+	}
+	err := store.WriteFileContentsIfVersion("/lock", strings.NewReader("second"), "")
+	if !errors.Is(err, ErrVersionMismatch) {
+		t.Fatalf("expected a version mismatch, got %v", err)
+	}
+	reader, version, err := store.GetVersionedFileContents("/lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.Close()
+	if err := store.WriteFileContentsIfVersion("/lock", strings.NewReader("third"), version); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WriteFileContentsIfVersion("/lock", strings.NewReader("fourth"), version); !errors.Is(err,
+		ErrVersionMismatch) {
+		t.Errorf("expected a version mismatch, got %v", err)
+	}
+}
+
+// bodyTimer passes requests on to next once their body has been received, and records how long the bodies of uploads
+// took to arrive and how large they were.
+type bodyTimer struct {
+	next      http.Handler
+	mu        sync.Mutex
+	bytes     int64
+	durations time.Duration
+}
+
+func (b *bodyTimer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/upload/") {
+		b.mu.Lock()
+		b.bytes += int64(len(body))
+		b.durations += time.Since(start)
+		b.mu.Unlock()
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	b.next.ServeHTTP(w, r)
+}
+
+//nolint:paralleltest // Replaces newDriveService and driveRetryPolicy.
+func TestDriveFileStoreLimitsUploadRate(t *testing.T) {
+	const bytesPerSecond = 1 << 20
+	timer := &bodyTimer{next: fakedrive.New()}
+	store := newDriveStoreWithHandler(t, timer)
+	store.UploadChunkSize = uploadChunkAlignment
+	store.SetUploadLimiter(utils.NewRateLimiter(bytesPerSecond))
+	if _, err := store.GetFiles(); err != nil {
+		t.Fatal(err)
+	}
+	// A file sent in one request, and one sent in chunks.
+	small := bytes.Repeat([]byte("s"), uploadChunkAlignment)
+	large := bytes.Repeat([]byte("l"), 3*uploadChunkAlignment)
+	for path, contents := range map[string][]byte{"/small": small, "/large": large} {
+		err := store.WriteFileContents(path, bytes.NewReader(contents), &FileMetadata{ModTime: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if timer.bytes < int64(len(small)+len(large)) {
+		t.Fatalf("only %d bytes were uploaded", timer.bytes)
+	}
+	// Each request's first read isn't delayed, so allow some slack.
+	rate := float64(timer.bytes) / timer.durations.Seconds()
+	if rate > 1.5*bytesPerSecond {
+		t.Errorf("the uploads arrived at %.0f bytes per second, more than the limit of %d", rate, bytesPerSecond)
+	}
+}
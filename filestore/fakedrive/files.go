@@ -0,0 +1,385 @@
+package fakedrive
+
+import (
+	"crypto/md5" //nolint:gosec // Google Drive reports MD5 checksums.
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// The largest page size Google Drive allows.
+const maxPageSize = 1000
+
+func (s *Server) handleGenerateIDs(w http.ResponseWriter, r *http.Request) {
+	count := 10
+	if value := r.URL.Query().Get("count"); value != "" {
+		var err error
+		if count, err = strconv.Atoi(value); err != nil || count < 1 || count > maxPageSize {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid count %s", value))
+			return
+		}
+	}
+	ids := make([]string, count)
+	for i := range ids {
+		ids[i] = s.newID()
+	}
+	writeJSON(w, &drive.GeneratedIds{Ids: ids, Kind: "drive#generatedIds", Space: "drive"})
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	matches, err := parseQuery(params.Get("q"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	driveID := ""
+	if params.Get("corpora") == "drive" {
+		driveID = params.Get("driveId")
+	}
+	var files []*drive.File
+	for _, f := range s.files {
+		if f.meta.DriveId == driveID && matches(f.meta) {
+			files = append(files, f.meta)
+		}
+	}
+	if err := sortFiles(files, params.Get("orderBy")); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	pageSize := s.PageSize
+	if pageSize == 0 {
+		pageSize = defaultPageSize
+	}
+	if value := params.Get("pageSize"); value != "" {
+		if pageSize, err = strconv.Atoi(value); err != nil || pageSize < 1 || pageSize > maxPageSize {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid pageSize %s", value))
+			return
+		}
+	}
+	start := 0
+	if token := params.Get("pageToken"); token != "" {
+		if start, err = strconv.Atoi(token); err != nil || start < 0 || start > len(files) {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid pageToken %s", token))
+			return
+		}
+	}
+	list := &drive.FileList{Kind: "drive#fileList"}
+	end := start + pageSize
+	if end < len(files) {
+		list.NextPageToken = strconv.Itoa(end)
+	} else {
+		end = len(files)
+	}
+	for _, f := range files[start:end] {
+		list.Files = append(list.Files, copyFile(f))
+	}
+	writeJSON(w, list)
+}
+
+// sortFiles sorts the files by orderBy, a comma-separated list of fields that may each be followed by "desc". Files
+// that are equal in every field are sorted by id.
+func sortFiles(files []*drive.File, orderBy string) error {
+	type key struct {
+		field string
+		desc  bool
+	}
+	var keys []key
+	for _, term := range strings.Split(orderBy, ",") {
+		fields := strings.Fields(term)
+		if len(fields) == 0 {
+			continue
+		}
+		k := key{field: fields[0], desc: len(fields) == 2 && fields[1] == "desc"}
+		if len(fields) > 2 || (len(fields) == 2 && !k.desc) {
+			return fmt.Errorf("%w: orderBy %s", errInvalidQuery, orderBy)
+		}
+		switch k.field {
+		case "createdTime", "modifiedTime", "name":
+		default:
+			return fmt.Errorf("%w: orderBy %s", errInvalidQuery, orderBy)
+		}
+		keys = append(keys, k)
+	}
+	value := func(f *drive.File, field string) string {
+		switch field {
+		case "createdTime":
+			return f.CreatedTime
+		case "modifiedTime":
+			return f.ModifiedTime
+		}
+		return f.Name
+	}
+	sort.Slice(files, func(i, j int) bool {
+		for _, k := range keys {
+			a, b := value(files[i], k.field), value(files[j], k.field)
+			if a != b {
+				return (a < b) != k.desc
+			}
+		}
+		return files[i].Id < files[j].Id
+	})
+	return nil
+}
+
+func (s *Server) handleGet(w http.ResponseWriter, r *http.Request, id string) {
+	f, ok := s.files[id]
+	if !ok {
+		writeNotFound(w, id)
+		return
+	}
+	if r.URL.Query().Get("alt") != "media" {
+		writeJSON(w, copyFile(f.meta))
+		return
+	}
+	if f.meta.MimeType == mimeTypeFolder {
+		writeError(w, http.StatusForbidden, "Only files with binary content can be downloaded.")
+		return
+	}
+	w.Header().Set("Content-Type", f.meta.MimeType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(f.contents)))
+	//nolint:errcheck // The client sees a truncated download.
+	w.Write(f.contents)
+}
+
+func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request) {
+	uploadType := r.URL.Query().Get("uploadType")
+	if uploadType == "resumable" {
+		s.startUploadSession(w, r, "")
+		return
+	}
+	meta, contents, err := readUpload(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if meta.Id == "" {
+		meta.Id = s.newID()
+	}
+	if status, err := s.createFile(meta, contents); err != nil {
+		writeError(w, status, err.Error())
+		return
+	}
+	writeJSON(w, copyFile(s.files[meta.Id].meta))
+}
+
+// createFile checks that meta can be created, then adds it. It returns the status code to respond with if it can't.
+func (s *Server) createFile(meta *drive.File, contents []byte) (int, error) {
+	if _, exists := s.files[meta.Id]; exists {
+		return http.StatusConflict, errFileExists
+	}
+	for _, parentID := range meta.Parents {
+		if _, exists := s.files[parentID]; !exists && parentID != rootID && !s.sharedDrives[parentID] {
+			return http.StatusNotFound, fmt.Errorf("%w: %s", errFileNotFound, parentID)
+		}
+	}
+	s.insertFile(meta, contents)
+	return http.StatusOK, nil
+}
+
+// insertFile adds the file, filling in the fields Google Drive sets.
+func (s *Server) insertFile(meta *drive.File, contents []byte) {
+	now := s.now()
+	if len(meta.Parents) == 0 {
+		meta.Parents = []string{rootID}
+	}
+	for _, parentID := range meta.Parents {
+		if s.sharedDrives[parentID] {
+			meta.DriveId = parentID
+		} else if parent, ok := s.files[parentID]; ok {
+			meta.DriveId = parent.meta.DriveId
+		}
+	}
+	if meta.Name == "" {
+		meta.Name = "Untitled"
+	}
+	if meta.MimeType == "" {
+		meta.MimeType = "application/octet-stream"
+	}
+	if meta.CreatedTime == "" {
+		meta.CreatedTime = now
+	}
+	if meta.ModifiedTime == "" {
+		meta.ModifiedTime = now
+	}
+	if meta.Version == 0 {
+		meta.Version = 1
+	}
+	meta.Kind = "drive#file"
+	setContents(meta, contents)
+	s.files[meta.Id] = &file{meta: meta, contents: contents}
+}
+
+func (s *Server) handleUpdate(w http.ResponseWriter, r *http.Request, id string) {
+	if _, ok := s.files[id]; !ok {
+		writeNotFound(w, id)
+		return
+	}
+	if r.URL.Query().Get("uploadType") == "resumable" {
+		s.startUploadSession(w, r, id)
+		return
+	}
+	update, contents, err := readUpload(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	params := r.URL.Query()
+	var addParents, removeParents []string
+	if value := params.Get("addParents"); value != "" {
+		addParents = strings.Split(value, ",")
+	}
+	if value := params.Get("removeParents"); value != "" {
+		removeParents = strings.Split(value, ",")
+	}
+	if status, err := s.updateFile(id, update, contents, addParents, removeParents); err != nil {
+		writeError(w, status, err.Error())
+		return
+	}
+	writeJSON(w, copyFile(s.files[id].meta))
+}
+
+// updateFile applies the fields set in update to the file. contents replace the file's contents unless they are nil.
+// It returns the status code to respond with if the update can't be made.
+func (s *Server) updateFile(id string, update *drive.File, contents []byte, addParents,
+	removeParents []string) (int, error) {
+	f := s.files[id]
+	if len(update.Parents) > 0 {
+		return http.StatusForbidden, errParentsNotWritable
+	}
+	for _, parentID := range addParents {
+		if _, exists := s.files[parentID]; !exists && parentID != rootID && !s.sharedDrives[parentID] {
+			return http.StatusNotFound, fmt.Errorf("%w: %s", errFileNotFound, parentID)
+		}
+	}
+	meta := f.meta
+	for _, parentID := range removeParents {
+		for i, existing := range meta.Parents {
+			if existing == parentID {
+				meta.Parents = append(meta.Parents[:i], meta.Parents[i+1:]...)
+				break
+			}
+		}
+	}
+	for _, parentID := range addParents {
+		if !containsString(meta.Parents, parentID) {
+			meta.Parents = append(meta.Parents, parentID)
+		}
+	}
+	if update.Name != "" {
+		meta.Name = update.Name
+	}
+	if update.MimeType != "" {
+		meta.MimeType = update.MimeType
+	}
+	meta.ModifiedTime = s.now()
+	if update.ModifiedTime != "" {
+		meta.ModifiedTime = update.ModifiedTime
+	}
+	for key, value := range update.AppProperties {
+		if meta.AppProperties == nil {
+			meta.AppProperties = map[string]string{}
+		}
+		meta.AppProperties[key] = value
+	}
+	if contents != nil {
+		f.contents = contents
+		setContents(meta, contents)
+	}
+	meta.Version++
+	return http.StatusOK, nil
+}
+
+func (s *Server) handleDelete(w http.ResponseWriter, id string) {
+	if _, ok := s.files[id]; !ok {
+		writeNotFound(w, id)
+		return
+	}
+	s.deleteFile(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteFile deletes the file. The contents of a folder are deleted too, unless they are also in another folder.
+func (s *Server) deleteFile(id string) {
+	delete(s.files, id)
+	for childID, child := range s.files {
+		if !containsString(child.meta.Parents, id) {
+			continue
+		}
+		if len(child.meta.Parents) == 1 {
+			s.deleteFile(childID)
+			continue
+		}
+		for i, parentID := range child.meta.Parents {
+			if parentID == id {
+				child.meta.Parents = append(child.meta.Parents[:i], child.meta.Parents[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// readUpload reads the metadata and contents of a create or update request. uploadType is empty for a request
+// without contents, in which case the returned contents are nil.
+func readUpload(r *http.Request) (*drive.File, []byte, error) {
+	meta := &drive.File{}
+	switch uploadType := r.URL.Query().Get("uploadType"); uploadType {
+	case "":
+		if err := decodeMetadata(r.Body, meta); err != nil {
+			return nil, nil, err
+		}
+		return meta, nil, nil
+	case "media":
+		contents, err := io.ReadAll(r.Body)
+		return meta, contents, err
+	case "multipart":
+		return readMultipartUpload(r)
+	default:
+		return nil, nil, fmt.Errorf("%w: uploadType %s", errInvalidUpload, uploadType)
+	}
+}
+
+// decodeMetadata decodes the JSON file metadata in body into meta. An empty body leaves meta unchanged.
+func decodeMetadata(body io.Reader, meta *drive.File) error {
+	err := json.NewDecoder(body).Decode(meta)
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidUpload, err)
+	}
+	return nil
+}
+
+// setContents sets the fields of meta that describe the contents.
+func setContents(meta *drive.File, contents []byte) {
+	if meta.MimeType == mimeTypeFolder {
+		return
+	}
+	hash := md5.Sum(contents) //nolint:gosec // Google Drive reports MD5 checksums.
+	meta.Md5Checksum = hex.EncodeToString(hash[:])
+	meta.Size = int64(len(contents))
+}
+
+// writeNotFound writes the error Google Drive returns for a file that doesn't exist.
+func writeNotFound(w http.ResponseWriter, id string) {
+	writeError(w, http.StatusNotFound, fmt.Sprintf("File not found: %s.", id))
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
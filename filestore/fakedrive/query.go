@@ -0,0 +1,128 @@
+package fakedrive
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"google.golang.org/api/drive/v3"
+)
+
+var (
+	errInvalidQuery       = errors.New("invalid query")
+	errInvalidUpload      = errors.New("invalid upload")
+	errFileExists         = errors.New("a file already exists with the provided id")
+	errFileNotFound       = errors.New("file not found")
+	errParentsNotWritable = errors.New("the parents field is not directly writable in update requests")
+)
+
+// parseQuery parses the q parameter of a files list request and returns a function that reports whether a file
+// matches it. Only the terms lyncser uses are supported: "name", "mimeType" and "trashed" compared with = or !=, and
+// "'<id>' in parents", joined by "and".
+func parseQuery(q string) (func(*drive.File) bool, error) {
+	tokens, err := tokenizeQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	var terms []func(*drive.File) bool
+	for len(tokens) > 0 {
+		if len(tokens) < 3 {
+			return nil, fmt.Errorf("%w: %s", errInvalidQuery, q)
+		}
+		term, err := parseTerm(tokens[0], tokens[1], tokens[2])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", err, q)
+		}
+		terms = append(terms, term)
+		tokens = tokens[3:]
+		if len(tokens) > 0 {
+			if tokens[0].value != "and" || tokens[0].quoted || len(tokens) == 1 {
+				return nil, fmt.Errorf("%w: %s", errInvalidQuery, q)
+			}
+			tokens = tokens[1:]
+		}
+	}
+	return func(f *drive.File) bool {
+		for _, term := range terms {
+			if !term(f) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// parseTerm parses a term of three tokens, such as "name = 'x'".
+func parseTerm(left, operator, right queryToken) (func(*drive.File) bool, error) {
+	if left.quoted && operator.value == "in" && right.value == "parents" && !right.quoted {
+		return func(f *drive.File) bool {
+			return containsString(f.Parents, left.value)
+		}, nil
+	}
+	if left.quoted || (operator.value != "=" && operator.value != "!=") {
+		return nil, errInvalidQuery
+	}
+	negate := operator.value == "!="
+	var field func(*drive.File) string
+	switch {
+	case left.value == "name" && right.quoted:
+		field = func(f *drive.File) string { return f.Name }
+	case left.value == "mimeType" && right.quoted:
+		field = func(f *drive.File) string { return f.MimeType }
+	case left.value == "trashed" && !right.quoted && (right.value == "true" || right.value == "false"):
+		// Files are deleted rather than trashed, so no file is trashed.
+		field = func(*drive.File) string { return "false" }
+	default:
+		return nil, errInvalidQuery
+	}
+	return func(f *drive.File) bool {
+		return (field(f) == right.value) != negate
+	}, nil
+}
+
+// queryToken is a word, operator or quoted string in a query.
+type queryToken struct {
+	value  string
+	quoted bool
+}
+
+// tokenizeQuery splits a query into tokens. Quoted strings are unescaped.
+func tokenizeQuery(q string) ([]queryToken, error) {
+	var tokens []queryToken
+	for i := 0; i < len(q); {
+		switch c := q[i]; {
+		case c == ' ':
+			i++
+		case c == '\'':
+			var value strings.Builder
+			i++
+			for ; i < len(q) && q[i] != '\''; i++ {
+				if q[i] == '\\' && i+1 < len(q) {
+					i++
+				}
+				value.WriteByte(q[i])
+			}
+			if i == len(q) {
+				return nil, fmt.Errorf("%w: unterminated string in %s", errInvalidQuery, q)
+			}
+			i++
+			tokens = append(tokens, queryToken{value: value.String(), quoted: true})
+		case c == '=':
+			tokens = append(tokens, queryToken{value: "="})
+			i++
+		case c == '!' && strings.HasPrefix(q[i:], "!="):
+			tokens = append(tokens, queryToken{value: "!="})
+			i += 2
+		default:
+			start := i
+			for i < len(q) && q[i] != ' ' && q[i] != '=' && q[i] != '!' && q[i] != '\'' {
+				i++
+			}
+			if i == start {
+				return nil, fmt.Errorf("%w: unexpected '%c' in %s", errInvalidQuery, c, q)
+			}
+			tokens = append(tokens, queryToken{value: q[start:i]})
+		}
+	}
+	return tokens, nil
+}
@@ -0,0 +1,281 @@
+// Package fakedrive is an in-process fake of the parts of the Google Drive v3 REST API that lyncser uses. It keeps
+// files in memory and can be told to fail requests, so that DriveFileStore can be tested without Google credentials.
+//
+// Serve it with httptest.NewServer and point drive.NewService at it with option.WithEndpoint(server.URL + "/").
+package fakedrive
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+)
+
+const (
+	mimeTypeFolder = "application/vnd.google-apps.folder"
+	// The id of the root folder of My Drive.
+	rootID = "root"
+	// The number of files in a page of results when the request doesn't say.
+	defaultPageSize = 100
+	// The format of times in Google Drive.
+	timeFormat = "2006-01-02T15:04:05.000Z"
+)
+
+// Server is a fake Google Drive. Its zero value is not usable; create one with New.
+type Server struct {
+	// The number of files in a page of results when the request doesn't set pageSize. Defaults to 100.
+	PageSize int
+	// Returns the time recorded when files are created or changed. Defaults to time.Now.
+	Now func() time.Time
+
+	mu sync.Mutex
+	// Key is file id.
+	files map[string]*file
+	// The ids of the shared drives that files can be created in.
+	sharedDrives map[string]bool
+	// Key is the upload_id of a resumable upload session.
+	sessions map[string]*uploadSession
+	faults   []*Fault
+	requests []string
+	lastID   int
+}
+
+// file is a file or folder in the fake Google Drive.
+type file struct {
+	meta     *drive.File
+	contents []byte
+}
+
+// Fault makes the server fail the requests that match it.
+type Fault struct {
+	// The method and a prefix of the URL path of the requests to fail. Empty strings match every request.
+	Method string
+	Path   string
+	// The number of requests to fail. 0 fails every matching request.
+	Times int
+	// The number of matching requests to let through before failing.
+	After int
+	// The status code and extra headers of the failure.
+	Status int
+	Header http.Header
+	// If set, the request takes effect before the failure is returned, as if the response was lost on the way back.
+	AfterHandling bool
+	seen          int
+	failed        int
+}
+
+// New returns an empty fake Google Drive.
+func New() *Server {
+	return &Server{
+		files:        map[string]*file{},
+		sharedDrives: map[string]bool{},
+		sessions:     map[string]*uploadSession{},
+	}
+}
+
+// InjectFault makes the server fail the requests that match fault. Faults are checked in the order they were
+// injected, and the first one that matches is used.
+func (s *Server) InjectFault(fault *Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, fault)
+}
+
+// AddSharedDrive makes id the id of a shared drive that files can be created in.
+func (s *Server) AddSharedDrive(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sharedDrives[id] = true
+}
+
+// AddFile adds a file directly, without a request. Fields that are empty in meta are filled in as if the file was
+// created by a request. Returns the file that was added.
+func (s *Server) AddFile(meta *drive.File, contents []byte) *drive.File {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	meta = copyFile(meta)
+	if meta.Id == "" {
+		meta.Id = s.newID()
+	}
+	s.insertFile(meta, contents)
+	return copyFile(meta)
+}
+
+// Files returns every file, oldest first.
+func (s *Server) Files() []*drive.File {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files := make([]*drive.File, 0, len(s.files))
+	for _, f := range s.files {
+		files = append(files, copyFile(f.meta))
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return isCreatedBefore(files[i], files[j])
+	})
+	return files
+}
+
+// Contents returns the contents of the file with the given id, and false if there is no such file.
+func (s *Server) Contents(id string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[id]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte{}, f.contents...), true
+}
+
+// UploadSessions returns the number of resumable upload sessions that have been started.
+func (s *Server) UploadSessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
+
+// Requests returns the method and path of every request received so far, such as "GET /files".
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fault := s.matchFault(r)
+	if fault != nil {
+		if fault.AfterHandling {
+			s.handle(httptest.NewRecorder(), r)
+		}
+		for key, values := range fault.Header {
+			w.Header()[key] = values
+		}
+		writeError(w, fault.Status, "injected failure")
+		return
+	}
+	s.handle(w, r)
+}
+
+// matchFault records the request and returns the fault that makes it fail, or nil if it should be handled.
+func (s *Server) matchFault(r *http.Request) *Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+	for _, fault := range s.faults {
+		if (fault.Method != "" && fault.Method != r.Method) || !strings.HasPrefix(r.URL.Path, fault.Path) ||
+			(fault.Times != 0 && fault.failed >= fault.Times) {
+			continue
+		}
+		if fault.seen++; fault.seen <= fault.After {
+			continue
+		}
+		fault.failed++
+		return fault
+	}
+	return nil
+}
+
+// handle routes the request to the handler for its endpoint.
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/drive/v3")
+	query := r.URL.Query()
+	switch {
+	case query.Get("upload_id") != "":
+		s.handleUploadChunk(w, r)
+	case path == "/files/generateIds" && r.Method == http.MethodGet:
+		s.handleGenerateIDs(w, r)
+	case path == "/files" && r.Method == http.MethodGet:
+		s.handleList(w, r)
+	case (path == "/files" || path == "/upload/drive/v3/files") && r.Method == http.MethodPost:
+		s.handleCreate(w, r)
+	case strings.HasPrefix(path, "/upload/drive/v3/files/") && r.Method == http.MethodPatch:
+		s.handleUpdate(w, r, strings.TrimPrefix(path, "/upload/drive/v3/files/"))
+	case strings.HasPrefix(path, "/files/"):
+		s.handleFile(w, r, strings.TrimPrefix(path, "/files/"))
+	default:
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown endpoint %s %s", r.Method, r.URL.Path))
+	}
+}
+
+// handleFile handles the requests for a single file.
+func (s *Server) handleFile(w http.ResponseWriter, r *http.Request, id string) {
+	switch r.Method {
+	case http.MethodGet:
+		s.handleGet(w, r, id)
+	case http.MethodPatch:
+		s.handleUpdate(w, r, id)
+	case http.MethodDelete:
+		s.handleDelete(w, id)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("unsupported method %s", r.Method))
+	}
+}
+
+// newID returns an unused file id.
+func (s *Server) newID() string {
+	for {
+		s.lastID++
+		id := fmt.Sprintf("fake%d", s.lastID)
+		if _, exists := s.files[id]; !exists {
+			return id
+		}
+	}
+}
+
+// now returns the current time as formatted by Google Drive.
+func (s *Server) now() string {
+	now := time.Now
+	if s.Now != nil {
+		now = s.Now
+	}
+	return now().UTC().Format(timeFormat)
+}
+
+// writeJSON writes value as the JSON response body.
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	//nolint:errcheck // The client sees a truncated response.
+	json.NewEncoder(w).Encode(value)
+}
+
+// writeError writes an error response in the format Google APIs use.
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	//nolint:errcheck // The client sees a truncated response.
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    status,
+			"message": message,
+			"errors":  []map[string]string{{"message": message}},
+		},
+	})
+}
+
+// copyFile returns a copy of meta that can be changed without changing meta.
+func copyFile(meta *drive.File) *drive.File {
+	c := *meta
+	c.Parents = append([]string(nil), meta.Parents...)
+	if meta.AppProperties != nil {
+		c.AppProperties = make(map[string]string, len(meta.AppProperties))
+		for key, value := range meta.AppProperties {
+			c.AppProperties[key] = value
+		}
+	}
+	return &c
+}
+
+// isCreatedBefore returns true if a was created before b, using the id to break ties.
+func isCreatedBefore(a, b *drive.File) bool {
+	if a.CreatedTime != b.CreatedTime {
+		return a.CreatedTime < b.CreatedTime
+	}
+	return a.Id < b.Id
+}
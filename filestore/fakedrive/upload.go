@@ -0,0 +1,178 @@
+package fakedrive
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// The status code of a response to a chunk when the upload is not complete yet.
+const statusResumeIncomplete = 308
+
+// uploadSession is a resumable upload that has been started.
+type uploadSession struct {
+	// The id of the file, and whether the upload creates it.
+	fileID string
+	create bool
+	// The metadata sent when the session was started.
+	metadata *drive.File
+	received []byte
+	// Set once the upload is complete.
+	done bool
+}
+
+// readMultipartUpload reads a request whose body has the metadata and the contents as parts of a multipart/related
+// message.
+func readMultipartUpload(r *http.Request) (*drive.File, []byte, error) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return nil, nil, fmt.Errorf("%w: content type %s", errInvalidUpload, r.Header.Get("Content-Type"))
+	}
+	reader := multipart.NewReader(r.Body, params["boundary"])
+	metadataPart, err := reader.NextPart()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", errInvalidUpload, err)
+	}
+	meta := &drive.File{}
+	if err := decodeMetadata(metadataPart, meta); err != nil {
+		return nil, nil, err
+	}
+	mediaPart, err := reader.NextPart()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", errInvalidUpload, err)
+	}
+	contents, err := io.ReadAll(mediaPart)
+	if err != nil {
+		return nil, nil, err
+	}
+	if meta.MimeType == "" {
+		meta.MimeType = mediaPart.Header.Get("Content-Type")
+	}
+	return meta, contents, nil
+}
+
+// startUploadSession starts a resumable upload of the file with the given id, or of a new file if id is empty.
+func (s *Server) startUploadSession(w http.ResponseWriter, r *http.Request, id string) {
+	meta := &drive.File{}
+	if err := decodeMetadata(r.Body, meta); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	session := &uploadSession{fileID: id, create: id == "", metadata: meta}
+	if session.create {
+		session.fileID = meta.Id
+		if session.fileID == "" {
+			session.fileID = s.newID()
+		}
+		meta.Id = session.fileID
+	}
+	s.lastID++
+	uploadID := strconv.Itoa(s.lastID)
+	s.sessions[uploadID] = session
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	location := url.URL{
+		Scheme:   scheme,
+		Host:     r.Host,
+		Path:     r.URL.Path,
+		RawQuery: url.Values{"uploadType": {"resumable"}, "upload_id": {uploadID}}.Encode(),
+	}
+	w.Header().Set("Location", location.String())
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleUploadChunk handles a chunk of a resumable upload, or a request for how much of it was received.
+func (s *Server) handleUploadChunk(w http.ResponseWriter, r *http.Request) {
+	session, ok := s.sessions[r.URL.Query().Get("upload_id")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "upload session not found")
+		return
+	}
+	start, total, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if session.done {
+		writeJSON(w, copyFile(s.files[session.fileID].meta))
+		return
+	}
+	if start >= 0 {
+		if start > int64(len(session.received)) {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("chunk starts at %d, but only %d bytes were received",
+				start, len(session.received)))
+			return
+		}
+		chunk, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		session.received = append(session.received[:start], chunk...)
+	}
+	if total < 0 || int64(len(session.received)) < total {
+		if len(session.received) > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(session.received)-1))
+		}
+		w.WriteHeader(statusResumeIncomplete)
+		return
+	}
+	s.finishUpload(w, session)
+}
+
+// finishUpload creates or updates the file once all of its contents have been received.
+func (s *Server) finishUpload(w http.ResponseWriter, session *uploadSession) {
+	var status int
+	var err error
+	if session.create {
+		status, err = s.createFile(copyFile(session.metadata), session.received)
+	} else if _, ok := s.files[session.fileID]; !ok {
+		status, err = http.StatusNotFound, fmt.Errorf("%w: %s", errFileNotFound, session.fileID)
+	} else {
+		status, err = s.updateFile(session.fileID, session.metadata, session.received, nil, nil)
+	}
+	if err != nil {
+		writeError(w, status, err.Error())
+		return
+	}
+	session.done = true
+	writeJSON(w, copyFile(s.files[session.fileID].meta))
+}
+
+// parseContentRange parses a Content-Range header of the form "bytes <first>-<last>/<total>" or "bytes */<total>".
+// start is -1 if the range is "*", and total is -1 if it is "*".
+func parseContentRange(header string) (start, total int64, err error) {
+	invalid := fmt.Errorf("%w: Content-Range %s", errInvalidUpload, header)
+	byteRange := strings.TrimPrefix(header, "bytes ")
+	slash := strings.LastIndex(byteRange, "/")
+	if byteRange == header || slash < 0 {
+		return 0, 0, invalid
+	}
+	total = -1
+	if totalValue := byteRange[slash+1:]; totalValue != "*" {
+		if total, err = strconv.ParseInt(totalValue, 10, 64); err != nil {
+			return 0, 0, invalid
+		}
+	}
+	start = -1
+	if firstLast := byteRange[:slash]; firstLast != "*" {
+		dash := strings.Index(firstLast, "-")
+		if dash < 0 {
+			return 0, 0, invalid
+		}
+		if start, err = strconv.ParseInt(firstLast[:dash], 10, 64); err != nil {
+			return 0, 0, invalid
+		}
+	}
+	return start, total, nil
+}
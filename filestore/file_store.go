@@ -1,29 +1,112 @@
 package filestore
 
 import (
+	"errors"
 	"io"
+	"os"
 	"time"
+
+	"github.com/ristomcgehee/lyncser/utils"
 )
 
+// FileStore is a place where files are stored. Apart from GetFiles and DeleteAllFiles, its methods may be called from
+// several goroutines at once.
 type FileStore interface {
 	// GetFiles returns the list of file that are stored in this file store.
 	GetFiles() ([]*StoredFile, error)
 	// GetFileContents returns the contents of the file that are stored in this file store.
 	GetFileContents(path string) (io.ReadCloser, error)
-	// WriteFileContents writes the contents to the file store. Creates the file if it doesn't exist. Also creates any
-	// parent directories that do not exist.
-	WriteFileContents(path string, contentReader io.Reader) error
+	// WriteFileContents writes the contents to the file store along with the metadata. The file's modified time is set
+	// to metadata.ModTime. Creates the file if it doesn't exist. Also creates any parent directories that do not exist.
+	WriteFileContents(path string, contentReader io.Reader, metadata *FileMetadata) error
 	// DeleteFile deletes the file in this file store.
 	DeleteFile(path string) error
 	// DeleteAllFiles deletes all files in this file store.
 	DeleteAllFiles() error
 	// GetModifiedTime returns the time the file was last modified.
 	GetModifiedTime(path string) (time.Time, error)
+	// GetMetadata returns the metadata of the file. Fields that this file store doesn't have for the file are empty.
+	GetMetadata(path string) (*FileMetadata, error)
 	// FileExists returns true if the file exists in this file store.
 	FileExists(path string) (bool, error)
 }
 
+// VersionedFileStore is implemented by file stores that can detect when a file was changed by someone else between
+// reading and writing it. Both methods bypass any file list cached by GetFiles.
+type VersionedFileStore interface {
+	// GetVersionedFileContents returns the current contents of the file along with an opaque version. If the file does
+	// not exist, it returns a nil reader and an empty version.
+	GetVersionedFileContents(path string) (io.ReadCloser, string, error)
+	// WriteFileContentsIfVersion writes the contents only if the file's version is still version. An empty version
+	// means the file must not exist yet. Returns ErrVersionMismatch if the file has changed.
+	WriteFileContentsIfVersion(path string, contentReader io.Reader, version string) error
+}
+
+// RepairableFileStore is implemented by file stores that can end up with inconsistencies, such as two files at the
+// same path.
+type RepairableFileStore interface {
+	// NeedsRepair returns true if the last call to GetFiles found inconsistencies.
+	NeedsRepair() bool
+	// Repair lists the files again and fixes any inconsistencies. It returns a description of each fix. GetFiles must
+	// be called again afterwards.
+	Repair() ([]string, error)
+}
+
+// ResumableFileStore is implemented by file stores that upload large files in resumable sessions. Unfinished sessions
+// are kept in the given store so that an interrupted upload can continue in a later run.
+type ResumableFileStore interface {
+	SetUploadSessionStore(sessions UploadSessionStore)
+}
+
+// RateLimitedFileStore is implemented by file stores that limit the rate of their uploads themselves, so that the limit
+// applies to the bytes as they are sent rather than as they are read from the reader passed to WriteFileContents.
+type RateLimitedFileStore interface {
+	// SetUploadLimiter limits the rate of later uploads. A nil limiter means no limit.
+	SetUploadLimiter(limiter *utils.RateLimiter)
+}
+
+// WalkableFileStore is implemented by file stores that can list the files under a directory, such as local file
+// stores.
+type WalkableFileStore interface {
+	// WalkFiles returns the paths of the regular files at or under root, and whether root is a directory. The paths
+	// start with root even if root is a symbolic link. If root doesn't exist, no paths are returned. If some files
+	// can't be listed, the ones that could are returned along with the error.
+	WalkFiles(root string) (paths []string, isDir bool, err error)
+}
+
+// Returned by VersionedFileStore.WriteFileContentsIfVersion when the file was changed by someone else.
+var ErrVersionMismatch = errors.New("the file was changed by someone else")
+
 type StoredFile struct {
 	Path  string
 	IsDir bool
+	// The time the file was last modified. May be zero if the file store does not provide it when listing files.
+	ModifiedTime time.Time
+	// The size of the file in bytes as it is stored in this file store.
+	Size int64
+	// The metadata stored with the file. Nil if the file store does not provide it when listing files.
+	Metadata *FileMetadata
+}
+
+// FileMetadata is the information lyncser keeps about a file in addition to its contents. File stores that can't hold
+// some of it ignore those fields when writing and leave them empty when reading.
+type FileMetadata struct {
+	// Hash of the unencrypted contents. See utils.EncryptionFormat.
+	ContentHash string
+	// The modified time of the original file.
+	ModTime time.Time
+	// The permission bits of the original file.
+	Mode os.FileMode
+	// Identifies the machine that uploaded the file.
+	MachineID string
+	// The format the contents are encrypted in. Zero if they are not encrypted.
+	EncryptionVersion int
+	// Identifies the key the contents are encrypted with. Empty if they are not encrypted.
+	KeyID string
+	// The size of the contents in this file store in bytes. Set when reading and ignored when writing.
+	Size int64
+	// The nonce the contents are encrypted with, in hex, if the encryptor implements utils.NonceEncryptor. It is saved
+	// with an upload session so that the contents can be encrypted the same way if the upload is resumed. Set when
+	// writing and not stored.
+	UploadNonce string
 }
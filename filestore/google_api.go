@@ -1,8 +1,8 @@
 package filestore
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -11,24 +11,33 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
 
 	"github.com/ristomcgehee/lyncser/utils"
 )
 
 const (
-	// Path where OAuth client credentials are stored.
+	// Name of the file in the config directory where OAuth client credentials are stored.
 	//nolint:gosec // Not hardcoded credentials
-	credentialsFilePath = "~/.config/lyncser/credentials.json"
-	// Path where the OAuth token will be stored.
+	credentialsFileName = "credentials.json"
+	// Name of the file in the config directory where the OAuth token will be stored.
 	//nolint:gosec // Not hardcoded credentials
-	tokenFilePath = "~/.config/lyncser/token.json"
+	tokenFileName = "token.json"
 	// Mime type for files that are actually folders.
 	mimeTypeFolder = "application/vnd.google-apps.folder"
+	// Mime type for files uploaded by lyncser. Their contents are usually encrypted.
+	mimeTypeFile = "application/octet-stream"
+	// The alias Google Drive accepts for the id of the root folder of My Drive.
+	myDriveRootID = "root"
+	// The fields requested for each file when listing files.
+	fileFields = "name, id, parents, createdTime, modifiedTime, mimeType, size, appProperties"
 )
 
 // authHandlerResult contains the results of the OAuth authorization code handler.
@@ -38,31 +47,34 @@ type authHandlerResult struct {
 	Err        error
 }
 
-var ErrStateTokenMismatch = errors.New("state token mismatch")
+var (
+	ErrStateTokenMismatch = errors.New("state token mismatch")
+	// Returned when lyncser is not authorized to use Google Drive.
+	ErrNotAuthorized = errors.New("not authorized to use Google Drive")
+	errNoGeneratedID = errors.New("no file id was generated by Google Drive")
+)
 
-// getClient retrieves a token, saves the token, then returns the generated client.
-func getClient(config *oauth2.Config, forceNewToken bool) (*http.Client, error) {
-	// The file token.json stores the user's access and refresh tokens, and is
-	// created automatically when the authorization flow completes for the first
-	// time.
-	tokFile, err := utils.RealPath(tokenFilePath)
-	if err != nil {
-		return nil, err
+// IsAuthError returns true if err was caused by missing or rejected Google Drive credentials.
+func IsAuthError(err error) bool {
+	if errors.Is(err, ErrNotAuthorized) {
+		return true
 	}
-	var tok *oauth2.Token
-	if !forceNewToken {
-		tok, err = tokenFromFile(tokFile)
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		return true
 	}
-	if err != nil || forceNewToken {
-		tok, err = getTokenFromWeb(config)
-		if err != nil {
-			return nil, err
-		}
-		if err := saveToken(tokFile, tok); err != nil {
-			return nil, err
-		}
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusUnauthorized
+}
+
+// getClient returns a client authorized with the saved token. It never prompts, so that a sync run from a timer fails
+// instead of waiting for input. The token is saved by Authorize or ImportToken, and again whenever it is refreshed.
+func getClient(config *oauth2.Config, tokens *TokenStore) (*http.Client, error) {
+	tokenSource, err := tokens.tokenSource(config)
+	if err != nil {
+		return nil, err
 	}
-	return config.Client(context.Background(), tok), nil
+	return oauth2.NewClient(context.Background(), tokenSource), nil
 }
 
 // getTokenFromWeb requests a token from the web, then returns the retrieved token.
@@ -143,66 +155,92 @@ func makeAuthCodeHandler(codeChan chan authHandlerResult) func(http.ResponseWrit
 	}
 }
 
-// tokenFromFile retrieves a token from a local file.
-func tokenFromFile(file string) (*oauth2.Token, error) {
-	f, err := os.Open(file)
+// Returns the service used by DriveFileStore and its HTTP client. Replaced in tests.
+var newDriveService = getService
+
+// getService returns a service that can be used to make API calls, along with the authorized HTTP client it uses. A
+// service account is used if one was imported into the config directory, otherwise the OAuth token in tokens.
+func getService(tokens *TokenStore) (*drive.Service, *http.Client, error) {
+	client, err := getServiceAccountClient(tokens.ConfigDir)
+	if errors.Is(err, os.ErrNotExist) {
+		var clientConfig *oauth2.Config
+		if clientConfig, err = getOAuthConfig(tokens.ConfigDir); err == nil {
+			client, err = getClient(clientConfig, tokens)
+		}
+	}
 	if err != nil {
-		return nil, err
+		return nil, nil, fmt.Errorf("%w: %v", ErrNotAuthorized, err)
 	}
-	defer f.Close()
-	tok := &oauth2.Token{}
-	err = json.NewDecoder(f).Decode(tok)
-	return tok, err
-}
-
-// saveToken saves a token to a file path.
-func saveToken(path string, token *oauth2.Token) error {
-	fmt.Printf("Saving credential file to: %s\n", path)
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	ctx := context.Background()
+	service, err := drive.NewService(ctx, option.WithHTTPClient(client))
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	defer f.Close()
-	err = json.NewEncoder(f).Encode(token)
-	return err
+	return service, client, nil
 }
 
-// getService returns a service that can be used to make API calls.
-func getService(forceNewToken bool) (*drive.Service, error) {
-	realPath, err := utils.RealPath(credentialsFilePath)
-	if err != nil {
-		return nil, err
-	}
-	b, err := ioutil.ReadFile(realPath)
-	if err != nil {
-		return nil, err
+// HasCredentials returns true if the OAuth client credentials file exists in configDir.
+func HasCredentials(configDir string) (bool, error) {
+	return utils.PathExists(filepath.Join(configDir, credentialsFileName))
+}
+
+// HasEncryptedToken returns true if the OAuth token in configDir is saved encrypted.
+func HasEncryptedToken(configDir string) (bool, error) {
+	return utils.PathExists(filepath.Join(configDir, encryptedTokenFileName))
+}
+
+// HasToken returns true if an OAuth token has already been saved in configDir, encrypted or not.
+func HasToken(configDir string) (bool, error) {
+	hasToken, err := utils.PathExists(filepath.Join(configDir, tokenFileName))
+	if err != nil || hasToken {
+		return hasToken, err
 	}
+	return utils.PathExists(filepath.Join(configDir, encryptedTokenFileName))
+}
 
-	// If modifying these scopes, delete the previously saved token.json.
-	clientConfig, err := google.ConfigFromJSON(b, drive.DriveFileScope)
+// ImportCredentials copies the OAuth client credentials file at srcPath into configDir.
+func ImportCredentials(configDir, srcPath string) error {
+	data, err := ioutil.ReadFile(srcPath)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	client, err := getClient(clientConfig, forceNewToken)
-	if err != nil {
-		return nil, err
+	if _, err = google.ConfigFromJSON(data, drive.DriveFileScope); err != nil {
+		return fmt.Errorf("invalid credentials file: %w", err)
 	}
-	ctx := context.Background()
-	service, err := drive.NewService(ctx, option.WithHTTPClient(client))
-	if err != nil {
-		return nil, err
+	if err := os.MkdirAll(configDir, 0o700); err != nil {
+		return err
 	}
-	return service, nil
+	return utils.WriteFileAtomic(filepath.Join(configDir, credentialsFileName), bytes.NewReader(data), 0o600)
 }
 
-// getFileList gets the list of file that this app has access to.
-func getFileList(service *drive.Service) ([]*drive.File, error) {
+// formatDriveTime formats a time as an RFC 3339 timestamp as used by Google Drive.
+func formatDriveTime(t time.Time) string {
+	return t.UTC().Format(utils.TimeFormat)
+}
+
+// newListCall returns a call that lists the files in My Drive, or in the shared drive with id sharedDriveID if it is
+// set.
+func newListCall(service *drive.Service, sharedDriveID string) *drive.FilesListCall {
 	listFilesCall := service.Files.List()
-	listFilesCall.Fields("files(name, id, parents, modifiedTime, mimeType), nextPageToken")
+	if sharedDriveID != "" {
+		listFilesCall.Corpora("drive").DriveId(sharedDriveID).IncludeItemsFromAllDrives(true).SupportsAllDrives(true)
+	}
+	return listFilesCall
+}
+
+// getFileList gets the list of file that this app has access to, in the shared drive if sharedDriveID is set.
+func getFileList(service *drive.Service, sharedDriveID string) ([]*drive.File, error) {
+	listFilesCall := newListCall(service, sharedDriveID)
+	listFilesCall.Fields(googleapi.Field("files(" + fileFields + "), nextPageToken"))
 	listFilesCall.Q("trashed=false")
 	var files []*drive.File
 	for {
-		driveFileList, err := listFilesCall.Do()
+		var driveFileList *drive.FileList
+		err := driveRetryPolicy.do(func(int) error {
+			var err error
+			driveFileList, err = listFilesCall.Do()
+			return err
+		})
 		if err != nil {
 			return nil, fmt.Errorf("error getting file list from Google Drive: %w", err)
 		}
@@ -215,9 +253,48 @@ func getFileList(service *drive.Service) ([]*drive.File, error) {
 	return files, nil
 }
 
+// generateFileID returns a new id for a file that is about to be created. Creating a file with an id chosen in advance
+// makes it safe to retry: if an earlier attempt took effect even though it failed, the retry fails with a conflict.
+func generateFileID(service *drive.Service) (string, error) {
+	var generatedIDs *drive.GeneratedIds
+	err := driveRetryPolicy.do(func(int) error {
+		var err error
+		generatedIDs, err = service.Files.GenerateIds().Count(1).Space("drive").Do()
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("error generating a file id in Google Drive: %w", err)
+	}
+	if len(generatedIDs.Ids) == 0 {
+		return "", errNoGeneratedID
+	}
+	return generatedIDs.Ids[0], nil
+}
+
+// createWithID calls create until it succeeds. If a retry finds that an earlier attempt already created the file
+// with the given id, that file is returned instead.
+func createWithID(service *drive.Service, fileID string, create func() (*drive.File, error)) (*drive.File, error) {
+	var file *drive.File
+	err := driveRetryPolicy.do(func(attempt int) error {
+		var err error
+		file, err = create()
+		var apiErr *googleapi.Error
+		if attempt > 1 && errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict {
+			file, err = service.Files.Get(fileID).SupportsAllDrives(true).Fields(fileFields).Do()
+		}
+		return err
+	})
+	return file, err
+}
+
 // createDir creates a directory in Google Drive. Returns the Id of the directory created.
 func createDir(service *drive.Service, name, parentID string) (string, error) {
+	fileID, err := generateFileID(service)
+	if err != nil {
+		return "", err
+	}
 	d := &drive.File{
+		Id:       fileID,
 		Name:     filepath.Base(name),
 		MimeType: mimeTypeFolder,
 	}
@@ -225,58 +302,136 @@ func createDir(service *drive.Service, name, parentID string) (string, error) {
 		d.Parents = []string{parentID}
 	}
 
-	file, err := service.Files.Create(d).Do()
+	file, err := createWithID(service, fileID, func() (*drive.File, error) {
+		return service.Files.Create(d).SupportsAllDrives(true).Do()
+	})
 	if err != nil {
 		return "", fmt.Errorf("error creating directory in Google Drive: %w", err)
 	}
 	return file.Id, nil
 }
 
-// createFile creates the file in Google Drive.
-func createFile(service *drive.Service, name, mimeType string, content io.Reader, parentID string) (*drive.File,
-	error) {
+// createFile creates the file in Google Drive, uploading the contents in a single request.
+func createFile(service *drive.Service, name, mimeType string, data []byte, parentID,
+	modifiedTime string, appProperties map[string]string, limiter *utils.RateLimiter) (*drive.File, error) {
+	fileID, err := generateFileID(service)
+	if err != nil {
+		return nil, err
+	}
 	f := &drive.File{
-		MimeType: mimeType,
-		Name:     name,
-		Parents:  []string{parentID},
+		Id:            fileID,
+		MimeType:      mimeType,
+		Name:          name,
+		Parents:       []string{parentID},
+		ModifiedTime:  modifiedTime,
+		AppProperties: appProperties,
 	}
-	file, err := service.Files.Create(f).Media(content).Do()
+	file, err := createWithID(service, fileID, func() (*drive.File, error) {
+		return service.Files.Create(f).SupportsAllDrives(true).Fields(fileFields).Media(mediaReader(data, limiter),
+			googleapi.ChunkSize(0)).Do()
+	})
 	if err != nil {
 		return nil, fmt.Errorf("error creating file in Google Drive: %w", err)
 	}
 	return file, nil
 }
 
-// downloadFileContents returns the contents of the file as an io.ReadCloser.
+// findFilesInDir returns the files named name in the directory with id parentID, oldest first. Unlike the file list
+// returned by getFileList, this reflects changes made since then.
+func findFilesInDir(service *drive.Service, sharedDriveID, name, parentID string) ([]*drive.File, error) {
+	listFilesCall := newListCall(service, sharedDriveID)
+	listFilesCall.Fields(googleapi.Field("files(" + fileFields + ", version)"))
+	listFilesCall.Q(fmt.Sprintf("name = '%s' and '%s' in parents and trashed = false",
+		escapeQueryValue(name), escapeQueryValue(parentID)))
+	listFilesCall.OrderBy("createdTime")
+	var driveFileList *drive.FileList
+	err := driveRetryPolicy.do(func(int) error {
+		var err error
+		driveFileList, err = listFilesCall.Do()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error finding file in Google Drive: %w", err)
+	}
+	return driveFileList.Files, nil
+}
+
+// escapeQueryValue escapes a value for use inside single quotes in a Google Drive query.
+func escapeQueryValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value)
+}
+
+// downloadFileContents returns the contents of the file as an io.ReadCloser. Only starting the download is retried,
+// not reading the contents.
 func downloadFileContents(service *drive.Service, fileID string) (io.ReadCloser, error) {
-	fileGetCall := service.Files.Get(fileID)
-	resp, err := fileGetCall.Download()
+	var resp *http.Response
+	err := driveRetryPolicy.do(func(int) error {
+		var err error
+		resp, err = service.Files.Get(fileID).SupportsAllDrives(true).Download()
+		return err
+	})
 	if err != nil {
 		return nil, fmt.Errorf("error downloading file contents from Google Drive: %w", err)
 	}
 	return resp.Body, nil
 }
 
-// updateFileContents uploads the contents from the io.Reader.
-func updateFileContents(service *drive.Service, driveFile *drive.File, fileID string, r io.Reader) (*drive.File,
-	error) {
-	driveFile = &drive.File{
-		MimeType: driveFile.MimeType,
-		Name:     driveFile.Name,
-	}
-	fileUpdateCall := service.Files.Update(fileID, driveFile)
-	fileUpdateCall.Media(r)
-	file, err := fileUpdateCall.Do()
+// updateFileContents uploads the contents in a single request. driveFile holds the metadata to update, and its
+// appProperties replace the file's existing ones with the same keys.
+func updateFileContents(service *drive.Service, driveFile *drive.File, fileID string, data []byte,
+	limiter *utils.RateLimiter) (*drive.File, error) {
+	var file *drive.File
+	err := driveRetryPolicy.do(func(int) error {
+		var err error
+		file, err = service.Files.Update(fileID, driveFile).SupportsAllDrives(true).Fields(fileFields).
+			Media(mediaReader(data, limiter), googleapi.ChunkSize(0)).Do()
+		return err
+	})
 	if err != nil {
 		return nil, fmt.Errorf("error updating file contents from Google Drive: %w", err)
 	}
 	return file, nil
 }
 
+// mediaReader returns the reader for the contents of an upload. The upload must not be chunked, as it is with
+// googleapi.ChunkSize(0), so that the contents are read while they are sent and limiter limits the rate they are sent
+// at rather than the rate they are buffered at.
+func mediaReader(data []byte, limiter *utils.RateLimiter) io.Reader {
+	return utils.LimitReader(bytes.NewReader(data), limiter)
+}
+
+// moveFile renames the file and moves it from the parents in removeParents to the parents in addParents. Both are
+// comma-separated lists of ids and may be empty. The name is left unchanged if it is empty.
+func moveFile(service *drive.Service, fileID, name, addParents, removeParents string) error {
+	err := driveRetryPolicy.do(func(int) error {
+		fileUpdateCall := service.Files.Update(fileID, &drive.File{Name: name}).SupportsAllDrives(true)
+		if addParents != "" {
+			fileUpdateCall.AddParents(addParents)
+		}
+		if removeParents != "" {
+			fileUpdateCall.RemoveParents(removeParents)
+		}
+		_, err := fileUpdateCall.Do()
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error moving file in Google Drive: %w", err)
+	}
+	return nil
+}
+
 // deleteFile deletes the file in Google Drive.
 func deleteFile(service *drive.Service, fileID string) error {
-	fileDeleteCall := service.Files.Delete(fileID)
-	if err := fileDeleteCall.Do(); err != nil {
+	err := driveRetryPolicy.do(func(attempt int) error {
+		err := service.Files.Delete(fileID).SupportsAllDrives(true).Do()
+		var apiErr *googleapi.Error
+		if attempt > 1 && errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			// An earlier attempt deleted the file even though it failed.
+			return nil
+		}
+		return err
+	})
+	if err != nil {
 		return fmt.Errorf("error deleting file from Google Drive: %w", err)
 	}
 	return nil
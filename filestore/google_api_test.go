@@ -0,0 +1,240 @@
+package filestore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+)
+
+// newTestService returns a Drive service whose requests are handled by handler. The retry policy is replaced with one
+// that records its delays instead of sleeping.
+func newTestService(t *testing.T, handler http.Handler) (*drive.Service, *[]time.Duration) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	service, err := drive.NewService(context.Background(), option.WithEndpoint(server.URL+"/"),
+		option.WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var delays []time.Duration
+	originalPolicy := driveRetryPolicy
+	policy := *driveRetryPolicy
+	policy.sleep = func(delay time.Duration) {
+		delays = append(delays, delay)
+	}
+	driveRetryPolicy = &policy
+	t.Cleanup(func() {
+		driveRetryPolicy = originalPolicy
+	})
+	return service, &delays
+}
+
+// failingHandler returns the status code and headers in failure for the first failures requests, and passes the rest
+// to next. It counts every request it receives.
+type failingHandler struct {
+	failures int
+	status   int
+	header   http.Header
+	next     http.HandlerFunc
+	requests int
+}
+
+func (h *failingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.requests++
+	if h.requests <= h.failures {
+		for key, values := range h.header {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(h.status)
+		fmt.Fprintf(w, `{"error": {"code": %d, "message": "injected failure"}}`, h.status)
+		return
+	}
+	h.next(w, r)
+}
+
+func fileListHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, `{"files": [{"id": "1", "name": "file1", "parents": ["root"]}]}`)
+}
+
+//nolint:paralleltest // Replaces driveRetryPolicy.
+func TestRetryServerErrors(t *testing.T) {
+	handler := &failingHandler{failures: 2, status: http.StatusServiceUnavailable, next: fileListHandler}
+	service, delays := newTestService(t, handler)
+	files, err := getFileList(service, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Id != "1" {
+		t.Errorf("unexpected files %v", files)
+	}
+	if handler.requests != 3 || len(*delays) != 2 {
+		t.Errorf("expected 3 requests and 2 delays, got %d and %d", handler.requests, len(*delays))
+	}
+}
+
+//nolint:paralleltest // Replaces driveRetryPolicy.
+func TestRetryAfter(t *testing.T) {
+	handler := &failingHandler{
+		failures: 1,
+		status:   http.StatusTooManyRequests,
+		header:   http.Header{"Retry-After": []string{"42"}},
+		next:     fileListHandler,
+	}
+	service, delays := newTestService(t, handler)
+	if _, err := getFileList(service, ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(*delays) != 1 || (*delays)[0] != 42*time.Second {
+		t.Errorf("expected a delay of 42s, got %v", *delays)
+	}
+}
+
+//nolint:paralleltest // Replaces driveRetryPolicy.
+func TestRetryGivesUp(t *testing.T) {
+	handler := &failingHandler{failures: 100, status: http.StatusInternalServerError}
+	service, _ := newTestService(t, handler)
+	if _, err := getFileList(service, ""); err == nil {
+		t.Fatal("expected an error")
+	}
+	if handler.requests != driveRetryPolicy.maxAttempts {
+		t.Errorf("expected %d requests, got %d", driveRetryPolicy.maxAttempts, handler.requests)
+	}
+}
+
+//nolint:paralleltest // Replaces driveRetryPolicy.
+func TestNoRetryForClientErrors(t *testing.T) {
+	handler := &failingHandler{failures: 100, status: http.StatusNotFound}
+	service, _ := newTestService(t, handler)
+	if _, err := downloadFileContents(service, "1"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if handler.requests != 1 {
+		t.Errorf("expected 1 request, got %d", handler.requests)
+	}
+}
+
+//nolint:paralleltest // Replaces driveRetryPolicy.
+func TestCreateFileRetryIsIdempotent(t *testing.T) {
+	var uploads int
+	var uploadedContents []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/files/generateIds", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"ids": ["generated"]}`)
+	})
+	mux.HandleFunc("/upload/drive/v3/files", func(w http.ResponseWriter, r *http.Request) {
+		uploads++
+		body, _ := io.ReadAll(r.Body)
+		uploadedContents = append(uploadedContents, string(body))
+		if uploads == 1 {
+			// The file is created, but the response is lost.
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, `{"error": {"code": 409, "message": "A file already exists with the provided ID."}}`)
+	})
+	mux.HandleFunc("/files/generated", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"id": "generated", "name": "file1"}`)
+	})
+	service, _ := newTestService(t, mux)
+	file, err := createFile(service, "file1", mimeTypeFile, []byte("contents"), "parent", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.Id != "generated" || uploads != 2 {
+		t.Errorf("expected the generated file after 2 uploads, got %v after %d", file, uploads)
+	}
+	for _, contents := range uploadedContents {
+		if !strings.Contains(contents, "contents") {
+			t.Errorf("upload is missing the contents: %s", contents)
+		}
+	}
+}
+
+// memorySessionStore keeps upload sessions in memory.
+type memorySessionStore map[string]*UploadSession
+
+func (m memorySessionStore) GetUploadSession(path string) *UploadSession {
+	return m[path]
+}
+
+func (m memorySessionStore) SaveUploadSession(path string, session *UploadSession) error {
+	if session == nil {
+		delete(m, path)
+	} else {
+		m[path] = session
+	}
+	return nil
+}
+
+//nolint:paralleltest // Replaces driveRetryPolicy.
+func TestResumableUploadResumesSavedSession(t *testing.T) {
+	data := []byte(strings.Repeat("x", 2*uploadChunkAlignment+100))
+	var received []string
+	receivedBytes := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/session", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		contentRange := r.Header.Get("Content-Range")
+		received = append(received, contentRange)
+		switch {
+		case strings.HasPrefix(contentRange, "bytes */"):
+			// The first chunk was received before the upload was interrupted.
+			receivedBytes = uploadChunkAlignment
+		case len(body) == uploadChunkAlignment:
+			receivedBytes += len(body)
+		default:
+			fmt.Fprint(w, `{"id": "file1", "name": "file1"}`)
+			return
+		}
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", receivedBytes-1))
+		w.WriteHeader(statusResumeIncomplete)
+	})
+	service, _ := newTestService(t, mux)
+	sessions := memorySessionStore{"path/file1": {
+		URI:         service.BasePath + "session",
+		FileID:      "file1",
+		ContentHash: "hash",
+		StartedAt:   time.Now(),
+	}}
+	upload := &resumableUpload{
+		client:    http.DefaultClient,
+		service:   service,
+		path:      "path/file1",
+		fileID:    "file1",
+		metadata:  &drive.File{Name: "file1", MimeType: mimeTypeFile},
+		source:    bufio.NewReader(bytes.NewReader(data)),
+		contentID: "hash",
+		chunkSize: uploadChunkAlignment,
+		sessions:  sessions,
+	}
+	file, err := upload.run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.Id != "file1" {
+		t.Errorf("unexpected file %v", file)
+	}
+	expected := []string{
+		"bytes */*",
+		fmt.Sprintf("bytes %d-%d/*", uploadChunkAlignment, 2*uploadChunkAlignment-1),
+		fmt.Sprintf("bytes %d-%d/%d", 2*uploadChunkAlignment, len(data)-1, len(data)),
+	}
+	if strings.Join(received, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected requests %v, got %v", expected, received)
+	}
+	if len(sessions) != 0 {
+		t.Errorf("the session should be removed after the upload, got %v", sessions)
+	}
+}
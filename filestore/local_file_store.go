@@ -1,9 +1,12 @@
 package filestore
 
 import (
+	"errors"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/ristomcgehee/lyncser/utils"
@@ -28,7 +31,22 @@ func (l *LocalFileStore) GetModifiedTime(path string) (time.Time, error) {
 	return fileStats.ModTime(), nil
 }
 
-func (l *LocalFileStore) WriteFileContents(path string, contentReader io.Reader) error {
+// GetMetadata returns the modified time and permission bits of the file.
+func (l *LocalFileStore) GetMetadata(path string) (*FileMetadata, error) {
+	fileStats, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return &FileMetadata{
+		ModTime: fileStats.ModTime(),
+		Mode:    fileStats.Mode().Perm(),
+		Size:    fileStats.Size(),
+	}, nil
+}
+
+// WriteFileContents writes the file and sets its modified time. A new file is given the permission bits from the
+// metadata, and an existing file keeps its own.
+func (l *LocalFileStore) WriteFileContents(path string, contentReader io.Reader, metadata *FileMetadata) error {
 	dirName := filepath.Dir(path)
 	pathExists, err := utils.PathExists(dirName)
 	if err != nil {
@@ -40,19 +58,50 @@ func (l *LocalFileStore) WriteFileContents(path string, contentReader io.Reader)
 			return err
 		}
 	}
-	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
-	if err != nil {
-		return err
+	perm := os.FileMode(0o600)
+	if metadata.Mode != 0 {
+		perm = metadata.Mode.Perm()
 	}
-	defer out.Close()
-	if _, err = io.Copy(out, contentReader); err != nil {
+	if err := utils.WriteFileAtomic(path, contentReader, perm); err != nil {
 		return err
 	}
-	return nil
+	return os.Chtimes(path, metadata.ModTime, metadata.ModTime)
+}
+
+// WalkFiles implements WalkableFileStore. Symbolic links under root are not followed, and only regular files are
+// returned.
+func (l *LocalFileStore) WalkFiles(root string) ([]string, bool, error) {
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	rootStats, err := os.Stat(resolvedRoot)
+	if err != nil {
+		return nil, false, err
+	}
+	var paths []string
+	err = filepath.WalkDir(resolvedRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if d == nil || d.IsDir() || !d.Type().IsRegular() {
+			return nil
+		}
+		paths = append(paths, root+strings.TrimPrefix(path, resolvedRoot))
+		return nil
+	})
+	return paths, rootStats.IsDir(), err
 }
 
+// DeleteFile deletes the file. It is not an error if the file doesn't exist.
 func (l *LocalFileStore) DeleteFile(path string) error {
-	panic("not implemented")
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
 }
 
 func (l *LocalFileStore) DeleteAllFiles() error {
@@ -0,0 +1,200 @@
+package filestore
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryFileStore keeps files in memory. It can stand in for the local or the remote file store in tests, and is
+// safe to use from several goroutines at once.
+type MemoryFileStore struct {
+	// Returns the modified time given to files written without one. Defaults to time.Now.
+	Now func() time.Time
+
+	mu sync.Mutex
+	// Key is the path of the file.
+	files map[string]*memoryFile
+}
+
+// memoryFile is a file in a MemoryFileStore.
+type memoryFile struct {
+	contents []byte
+	metadata FileMetadata
+}
+
+// NewMemoryFileStore returns an empty MemoryFileStore whose modified times come from now.
+func NewMemoryFileStore(now func() time.Time) *MemoryFileStore {
+	return &MemoryFileStore{
+		Now:   now,
+		files: map[string]*memoryFile{},
+	}
+}
+
+// GetFiles returns the files sorted by path, along with the directories they are in. Like the directories in Google
+// Drive, a directory exists as long as it has files in it.
+func (m *MemoryFileStore) GetFiles() ([]*StoredFile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	files := make([]*StoredFile, 0, len(m.files))
+	dirs := map[string]bool{}
+	for path, file := range m.files {
+		metadata := file.metadata
+		files = append(files, &StoredFile{
+			Path:         path,
+			ModifiedTime: metadata.ModTime,
+			Size:         metadata.Size,
+			Metadata:     &metadata,
+		})
+		for dir := filepath.Dir(path); dir != "/" && dir != "." && !dirs[dir]; dir = filepath.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+	for dir := range dirs {
+		files = append(files, &StoredFile{Path: dir, IsDir: true, ModifiedTime: m.dirModTime(dir)})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	return files, nil
+}
+
+func (m *MemoryFileStore) GetFileContents(path string) (io.ReadCloser, error) {
+	file, err := m.getFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(file.contents)), nil
+}
+
+// WriteFileContents writes the file. A zero modified time in metadata is replaced with the current time. A new file
+// is given the permission bits from the metadata, and an existing file keeps its own.
+func (m *MemoryFileStore) WriteFileContents(path string, contentReader io.Reader, metadata *FileMetadata) error {
+	contents, err := ioutil.ReadAll(contentReader)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	file := &memoryFile{contents: contents, metadata: *metadata}
+	if file.metadata.ModTime.IsZero() {
+		file.metadata.ModTime = m.now()
+	}
+	switch existing, ok := m.files[path]; {
+	case ok:
+		file.metadata.Mode = existing.metadata.Mode
+	case file.metadata.Mode == 0:
+		file.metadata.Mode = 0o600
+	}
+	file.metadata.Size = int64(len(contents))
+	m.files[path] = file
+	return nil
+}
+
+// DeleteFile deletes the file, or the directory and everything in it.
+func (m *MemoryFileStore) DeleteFile(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for filePath := range m.files {
+		if filePath == path || strings.HasPrefix(filePath, path+"/") {
+			delete(m.files, filePath)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryFileStore) DeleteAllFiles() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files = map[string]*memoryFile{}
+	return nil
+}
+
+// GetModifiedTime returns the modified time of the file. The modified time of a directory is the latest modified
+// time of the files in it.
+func (m *MemoryFileStore) GetModifiedTime(path string) (time.Time, error) {
+	if paths, isDir := m.walk(path); isDir && len(paths) > 0 {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return m.dirModTime(path), nil
+	}
+	file, err := m.getFile(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return file.metadata.ModTime, nil
+}
+
+func (m *MemoryFileStore) GetMetadata(path string) (*FileMetadata, error) {
+	file, err := m.getFile(path)
+	if err != nil {
+		return nil, err
+	}
+	metadata := file.metadata
+	return &metadata, nil
+}
+
+// FileExists returns true if path is a file, or a directory with files in it.
+func (m *MemoryFileStore) FileExists(path string) (bool, error) {
+	paths, isDir := m.walk(path)
+	return isDir || len(paths) > 0, nil
+}
+
+// WalkFiles implements WalkableFileStore.
+func (m *MemoryFileStore) WalkFiles(root string) ([]string, bool, error) {
+	paths, isDir := m.walk(root)
+	return paths, isDir, nil
+}
+
+// walk returns the files at or under root, sorted by path, and whether root is a directory.
+func (m *MemoryFileStore) walk(root string) ([]string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[root]; ok {
+		return []string{root}, false
+	}
+	var paths []string
+	for path := range m.files {
+		if strings.HasPrefix(path, strings.TrimSuffix(root, "/")+"/") {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths, len(paths) > 0
+}
+
+// dirModTime returns the latest modified time of the files in dir. m.mu must be held.
+func (m *MemoryFileStore) dirModTime(dir string) time.Time {
+	var modTime time.Time
+	for path, file := range m.files {
+		if strings.HasPrefix(path, dir+"/") && file.metadata.ModTime.After(modTime) {
+			modTime = file.metadata.ModTime
+		}
+	}
+	return modTime
+}
+
+// getFile returns the file at path, or an error that wraps os.ErrNotExist if there is none.
+func (m *MemoryFileStore) getFile(path string) (*memoryFile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	file, ok := m.files[path]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+	return file, nil
+}
+
+// now returns the current time according to m.Now.
+func (m *MemoryFileStore) now() time.Time {
+	if m.Now != nil {
+		return m.Now()
+	}
+	return time.Now()
+}
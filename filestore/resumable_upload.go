@@ -0,0 +1,345 @@
+package filestore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+
+	"github.com/ristomcgehee/lyncser/utils"
+)
+
+const (
+	// The chunk size used when none is configured.
+	DefaultUploadChunkSize = 8 << 20
+	// Google Drive requires every chunk but the last to be a multiple of this size.
+	uploadChunkAlignment = 256 << 10
+	// Google Drive expires upload sessions after a week. Older sessions are not resumed.
+	maxUploadSessionAge = 6 * 24 * time.Hour
+	// The status code Google Drive uses for a chunk that was received when the upload is not complete yet.
+	statusResumeIncomplete = 308
+)
+
+var (
+	errNoUploadSession = errors.New("no upload session was returned by Google Drive")
+	// Returned when a saved session is resumed but the contents are shorter than what Google Drive received.
+	errUploadContentsChanged = errors.New("the contents are shorter than what was already uploaded")
+	// Returned when Google Drive asks for bytes that are no longer in memory, or hasn't finished the upload after
+	// receiving all of it.
+	errUnexpectedUploadOffset = errors.New("unexpected offset in upload session")
+)
+
+// UploadSession is a resumable upload that was started but has not finished.
+type UploadSession struct {
+	// The session URI returned by Google Drive.
+	URI string `json:"uri"`
+	// The id of the file being uploaded, and whether the upload creates it.
+	FileID string `json:"fileId"`
+	Create bool   `json:"create"`
+	// Identifies the contents being uploaded, see UploadContentID, and the nonce they are encrypted with. The session
+	// is only resumed if both match.
+	ContentHash string    `json:"contentHash"`
+	Nonce       string    `json:"nonce,omitempty"`
+	StartedAt   time.Time `json:"startedAt"`
+}
+
+// UploadSessionStore keeps the sessions of unfinished uploads between runs. Key is the path of the file.
+type UploadSessionStore interface {
+	GetUploadSession(path string) *UploadSession
+	// SaveUploadSession saves the session. A nil session removes the saved one.
+	SaveUploadSession(path string, session *UploadSession) error
+}
+
+// resumableUpload uploads a file in chunks in a resumable upload session. The contents are read from source as they
+// are sent, and only the chunk being sent is kept in memory. The session is saved before the first chunk is sent, so an
+// upload interrupted by a crash or a lost connection continues from the last chunk Google Drive received the next time
+// the same contents are uploaded with the same nonce.
+type resumableUpload struct {
+	client  *http.Client
+	service *drive.Service
+	// The path of the file, used as the key in sessions.
+	path string
+	// The id and metadata of the file. create is true if the file does not exist yet, in which case the id is
+	// generated when the upload starts.
+	fileID   string
+	create   bool
+	metadata *drive.File
+	source   *bufio.Reader
+	// Identify the contents, see UploadContentID, and the nonce they are encrypted with. If contentID is empty, the
+	// session is not saved.
+	contentID string
+	nonce     string
+	// Must be a multiple of uploadChunkAlignment.
+	chunkSize int64
+	// May be nil, in which case the upload can only be resumed within this run.
+	sessions UploadSessionStore
+	session  *UploadSession
+	// The chunk read from source most recently, and its offset. last is true if it is the end of the contents.
+	chunk      []byte
+	chunkStart int64
+	last       bool
+	// Limits the rate at which chunks are sent. May be nil.
+	limiter *utils.RateLimiter
+}
+
+// run uploads the file and returns the file Google Drive created or updated.
+func (u *resumableUpload) run() (*drive.File, error) {
+	offset := int64(0)
+	if u.sessions != nil && u.contentID != "" {
+		u.session = u.sessions.GetUploadSession(u.path)
+	}
+	if u.session != nil {
+		if u.session.Create == u.create && (u.create || u.session.FileID == u.fileID) &&
+			u.session.ContentHash == u.contentID && u.session.Nonce == u.nonce &&
+			time.Since(u.session.StartedAt) < maxUploadSessionAge {
+			u.fileID = u.session.FileID
+			var file *drive.File
+			err := driveRetryPolicy.do(func(int) error {
+				var err error
+				offset, file, err = u.queryOffset()
+				return err
+			})
+			switch {
+			case isSessionGone(err):
+				// Google Drive forgot the session, so the upload starts over.
+				offset, u.session = 0, nil
+			case file != nil || err != nil:
+				return file, u.finish(err)
+			}
+		} else {
+			u.session = nil
+		}
+	}
+	if u.session == nil {
+		if err := u.start(); err != nil {
+			return nil, err
+		}
+	}
+	// The bytes Google Drive already has are skipped.
+	if skipped, err := io.CopyN(ioutil.Discard, u.source, offset); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = fmt.Errorf("%w: %d of %d bytes", errUploadContentsChanged, skipped, offset)
+		}
+		return nil, u.finish(err)
+	}
+	u.chunkStart = offset
+	if err := u.readChunk(); err != nil {
+		return nil, u.finish(err)
+	}
+
+	for {
+		var file *drive.File
+		err := driveRetryPolicy.do(func(attempt int) error {
+			var err error
+			if attempt > 1 {
+				// The failed attempt may have been received, so ask how much Google Drive has.
+				if offset, file, err = u.queryOffset(); file != nil || err != nil {
+					return err
+				}
+			}
+			offset, file, err = u.sendChunk(offset)
+			return err
+		})
+		if file != nil || err != nil {
+			return file, u.finish(err)
+		}
+		if chunkEnd := u.chunkStart + int64(len(u.chunk)); offset >= chunkEnd {
+			if u.last {
+				return nil, u.finish(fmt.Errorf("%w: %d bytes were received, but the upload isn't complete",
+					errUnexpectedUploadOffset, offset))
+			}
+			u.chunkStart = chunkEnd
+			if err := u.readChunk(); err != nil {
+				return nil, u.finish(err)
+			}
+		}
+	}
+}
+
+// readChunk reads the next chunk from source into chunk.
+func (u *resumableUpload) readChunk() error {
+	if u.chunk == nil {
+		u.chunk = make([]byte, u.chunkSize)
+	}
+	n, err := io.ReadFull(u.source, u.chunk[:cap(u.chunk)])
+	u.chunk = u.chunk[:n]
+	switch {
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		u.last = true
+		return nil
+	case err != nil:
+		return err
+	}
+	if _, err := u.source.Peek(1); errors.Is(err, io.EOF) {
+		u.last = true
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// totalSize returns the size of the contents for a Content-Range header, or "*" if the end hasn't been read yet.
+func (u *resumableUpload) totalSize() string {
+	if !u.last {
+		return "*"
+	}
+	return strconv.FormatInt(u.chunkStart+int64(len(u.chunk)), 10)
+}
+
+// start starts a new upload session and saves it.
+func (u *resumableUpload) start() error {
+	metadata := u.metadata
+	if u.create {
+		// As in createFile, the id is chosen in advance so that a retry can't create the file twice.
+		fileID, err := generateFileID(u.service)
+		if err != nil {
+			return err
+		}
+		u.fileID = fileID
+		withID := *u.metadata
+		withID.Id = fileID
+		metadata = &withID
+	}
+	body, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	method, uploadURL := http.MethodPost, googleapi.ResolveRelative(u.service.BasePath, "/upload/drive/v3/files")
+	if !u.create {
+		method = http.MethodPatch
+		uploadURL += "/" + url.PathEscape(u.fileID)
+	}
+	uploadURL += "?" + url.Values{
+		"uploadType":        {"resumable"},
+		"fields":            {fileFields},
+		"supportsAllDrives": {"true"},
+	}.Encode()
+
+	var sessionURI string
+	err = driveRetryPolicy.do(func(int) error {
+		req, err := http.NewRequest(method, uploadURL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+		req.Header.Set("X-Upload-Content-Type", u.metadata.MimeType)
+		res, err := u.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer googleapi.CloseBody(res)
+		if err := googleapi.CheckResponse(res); err != nil {
+			return err
+		}
+		sessionURI = res.Header.Get("Location")
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error starting upload to Google Drive: %w", err)
+	}
+	if sessionURI == "" {
+		return errNoUploadSession
+	}
+	u.session = &UploadSession{
+		URI:         sessionURI,
+		FileID:      u.fileID,
+		Create:      u.create,
+		ContentHash: u.contentID,
+		Nonce:       u.nonce,
+		StartedAt:   time.Now().UTC(),
+	}
+	if u.sessions != nil && u.contentID != "" {
+		return u.sessions.SaveUploadSession(u.path, u.session)
+	}
+	return nil
+}
+
+// sendChunk sends the rest of the current chunk from start. It returns the offset Google Drive expects next, or the
+// uploaded file if the upload is complete.
+func (u *resumableUpload) sendChunk(start int64) (int64, *drive.File, error) {
+	chunkEnd := u.chunkStart + int64(len(u.chunk))
+	if start < u.chunkStart || start > chunkEnd {
+		return start, nil, fmt.Errorf("%w: %d is outside of the chunk from %d to %d", errUnexpectedUploadOffset, start,
+			u.chunkStart, chunkEnd)
+	}
+	if start == chunkEnd {
+		// Google Drive already has the whole chunk.
+		return start, nil, nil
+	}
+	chunk := u.chunk[start-u.chunkStart:]
+	req, err := http.NewRequest(http.MethodPut, u.session.URI, utils.LimitReader(bytes.NewReader(chunk), u.limiter))
+	if err != nil {
+		return start, nil, err
+	}
+	// The limited reader hides the length, which Google Drive needs.
+	req.ContentLength = int64(len(chunk))
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", start, chunkEnd-1, u.totalSize()))
+	return u.doSessionRequest(req, start)
+}
+
+// queryOffset asks Google Drive how much of the upload it has received. It returns the offset it expects next, or the
+// uploaded file if the upload is complete.
+func (u *resumableUpload) queryOffset() (int64, *drive.File, error) {
+	req, err := http.NewRequest(http.MethodPut, u.session.URI, http.NoBody)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Range", "bytes */"+u.totalSize())
+	return u.doSessionRequest(req, 0)
+}
+
+// doSessionRequest sends a request to the session URI and interprets the response. offset is returned if the
+// response doesn't say how much was received.
+func (u *resumableUpload) doSessionRequest(req *http.Request, offset int64) (int64, *drive.File, error) {
+	res, err := u.client.Do(req)
+	if err != nil {
+		return offset, nil, err
+	}
+	defer googleapi.CloseBody(res)
+	if res.StatusCode == statusResumeIncomplete {
+		// The Range header is "bytes=0-<last byte received>", and it is missing if nothing was received.
+		received := strings.TrimPrefix(res.Header.Get("Range"), "bytes=0-")
+		if lastByte, err := strconv.ParseInt(received, 10, 64); err == nil {
+			return lastByte + 1, nil, nil
+		}
+		return 0, nil, nil
+	}
+	if err := googleapi.CheckResponse(res); err != nil {
+		return offset, nil, err
+	}
+	file := &drive.File{}
+	if err := json.NewDecoder(res.Body).Decode(file); err != nil && !errors.Is(err, io.EOF) {
+		return offset, nil, err
+	}
+	return offset, file, nil
+}
+
+// finish removes the saved session if the upload completed or the session can't be resumed, and wraps err.
+func (u *resumableUpload) finish(err error) error {
+	if u.sessions != nil && (err == nil || isSessionGone(err) || errors.Is(err, errUploadContentsChanged)) {
+		if saveErr := u.sessions.SaveUploadSession(u.path, nil); saveErr != nil && err == nil {
+			return saveErr
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error uploading file contents to Google Drive: %w", err)
+	}
+	return nil
+}
+
+// isSessionGone returns true if err means that the upload session has expired or doesn't exist.
+func isSessionGone(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && (apiErr.Code == http.StatusNotFound || apiErr.Code == http.StatusGone)
+}
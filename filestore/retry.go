@@ -0,0 +1,113 @@
+package filestore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// retryPolicy decides how often and how long to wait before retrying a failed Google Drive API call.
+type retryPolicy struct {
+	// The number of times a call is attempted before giving up.
+	maxAttempts int
+	// The backoff before the first retry. It doubles after every attempt up to maxDelay.
+	initialDelay time.Duration
+	maxDelay     time.Duration
+	// The longest Retry-After that is honoured. Longer ones are shortened to this.
+	maxRetryAfter time.Duration
+	// Waits between attempts. Replaced in tests.
+	sleep func(time.Duration)
+}
+
+// The retry policy used for every Google Drive API call. Replaced in tests.
+var driveRetryPolicy = &retryPolicy{
+	maxAttempts:   6,
+	initialDelay:  time.Second,
+	maxDelay:      32 * time.Second,
+	maxRetryAfter: 5 * time.Minute,
+	sleep:         time.Sleep,
+}
+
+// do calls f until it succeeds, returns an error that is not worth retrying, or maxAttempts is reached. f must be safe
+// to call again after it failed, even if the failed call took effect on the server. attempt is 1 for the first call.
+func (p *retryPolicy) do(f func(attempt int) error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = f(attempt)
+		if err == nil || !isRetryable(err) {
+			return err
+		}
+		if attempt >= p.maxAttempts {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+		p.sleep(p.delay(attempt, err))
+	}
+}
+
+// delay returns how long to wait after the given failed attempt. It is a random time up to the exponential backoff,
+// or the time the server asked for in a Retry-After header if that is longer.
+func (p *retryPolicy) delay(attempt int, err error) time.Duration {
+	backoff := p.initialDelay << (attempt - 1)
+	if backoff > p.maxDelay || backoff <= 0 {
+		backoff = p.maxDelay
+	}
+	//nolint:gosec // The jitter does not need to be cryptographically secure.
+	delay := time.Duration(rand.Int63n(int64(backoff) + 1))
+	if retryAfter := getRetryAfter(err); retryAfter > delay {
+		delay = retryAfter
+	}
+	if delay > p.maxRetryAfter {
+		delay = p.maxRetryAfter
+	}
+	return delay
+}
+
+// isRetryable returns true if err is a rate limit, a server error or a network error, which may succeed if retried.
+func isRetryable(err error) bool {
+	if IsAuthError(err) {
+		return false
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.Code {
+		case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		case http.StatusForbidden:
+			// Google Drive reports some rate limits as 403 errors.
+			for _, item := range apiErr.Errors {
+				if item.Reason == "rateLimitExceeded" || item.Reason == "userRateLimitExceeded" {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	var netErr net.Error
+	var urlErr *url.Error
+	return errors.As(err, &netErr) || errors.As(err, &urlErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// getRetryAfter returns the wait requested by the Retry-After header of err, or 0 if there is none.
+func getRetryAfter(err error) time.Duration {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Header == nil {
+		return 0
+	}
+	retryAfter := apiErr.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(retryAfter); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if retryTime, err := http.ParseTime(retryAfter); err == nil {
+		return time.Until(retryTime)
+	}
+	return 0
+}
@@ -0,0 +1,204 @@
+package filestore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/oauth2"
+
+	"github.com/ristomcgehee/lyncser/utils"
+)
+
+// Name of the file in the config directory where the OAuth token is stored when it is encrypted.
+//nolint:gosec // Not hardcoded credentials
+const encryptedTokenFileName = "token.json.enc"
+
+var (
+	errTokenEncrypted = errors.New("the saved token is encrypted, but no encryption key was given")
+	errTokenRevoked   = errors.New("the saved token has expired or been revoked; run `lyncser auth` to authorize " +
+		"this machine again")
+)
+
+// TokenStore keeps the OAuth token in the config directory, either as plain JSON in token.json or encrypted in
+// token.json.enc.
+type TokenStore struct {
+	ConfigDir string
+	// The lyncser key. It encrypts the token when it is saved if Encrypt is set, and decrypts a token that was saved
+	// encrypted. May be nil if neither is needed.
+	Key []byte
+	// Encrypt saves the token encrypted with Key. A token saved the other way is converted the next time it is loaded.
+	Encrypt bool
+}
+
+// NewTokenStore returns the store for the OAuth token in configDir. getKey is only called if the token is or should be
+// encrypted, so that a machine that doesn't use encryption never generates a key.
+func NewTokenStore(configDir string, encrypt bool, getKey func() ([]byte, error)) (*TokenStore, error) {
+	tokens := &TokenStore{
+		ConfigDir: configDir,
+		Encrypt:   encrypt,
+	}
+	hasEncryptedToken, err := HasEncryptedToken(configDir)
+	if err != nil {
+		return nil, err
+	}
+	if encrypt || hasEncryptedToken {
+		if tokens.Key, err = getKey(); err != nil {
+			return nil, err
+		}
+	}
+	return tokens, nil
+}
+
+// Load returns the saved token. The error wraps errNoToken if there is none.
+func (t *TokenStore) Load() (*oauth2.Token, error) {
+	encrypted := true
+	data, err := ioutil.ReadFile(t.encryptedPath())
+	if errors.Is(err, os.ErrNotExist) {
+		encrypted = false
+		data, err = ioutil.ReadFile(t.plainPath())
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNoToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if encrypted {
+		if data, err = t.decrypt(data); err != nil {
+			return nil, err
+		}
+	}
+	tok := &oauth2.Token{}
+	if err := json.Unmarshal(data, tok); err != nil {
+		return nil, fmt.Errorf("invalid token: %w", err)
+	}
+	if tok.RefreshToken == "" {
+		return nil, errNoRefreshToken
+	}
+	if encrypted != t.Encrypt {
+		if err := t.Save(tok); err != nil {
+			return nil, err
+		}
+	}
+	return tok, nil
+}
+
+// Save saves the token atomically, replacing the token saved the other way if there is one.
+func (t *TokenStore) Save(tok *oauth2.Token) error {
+	data, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	path, otherPath := t.plainPath(), t.encryptedPath()
+	if t.Encrypt {
+		path, otherPath = otherPath, path
+		if data, err = t.encrypt(data); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(t.ConfigDir, 0o700); err != nil {
+		return err
+	}
+	if err := utils.WriteFileAtomic(path, bytes.NewReader(data), 0o600); err != nil {
+		return err
+	}
+	if err := os.Remove(otherPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// encryptor returns the encryptor for the token. It uses the same key as the synced files.
+func (t *TokenStore) encryptor() *utils.AESGCMEncryptor {
+	return &utils.AESGCMEncryptor{Key: t.Key}
+}
+
+func (t *TokenStore) encrypt(data []byte) ([]byte, error) {
+	if t.Key == nil {
+		return nil, errTokenEncrypted
+	}
+	reader, err := t.encryptor().EncryptReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(reader)
+}
+
+func (t *TokenStore) decrypt(data []byte) ([]byte, error) {
+	if t.Key == nil {
+		return nil, errTokenEncrypted
+	}
+	reader, err := t.encryptor().DecryptReader(ioutil.NopCloser(bytes.NewReader(data)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt the saved token: %w", err)
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+func (t *TokenStore) plainPath() string {
+	return filepath.Join(t.ConfigDir, tokenFileName)
+}
+
+func (t *TokenStore) encryptedPath() string {
+	return filepath.Join(t.ConfigDir, encryptedTokenFileName)
+}
+
+// tokenSource returns a token source that starts from the saved token and saves every refreshed token.
+func (t *TokenStore) tokenSource(config *oauth2.Config) (oauth2.TokenSource, error) {
+	tok, err := t.Load()
+	if err != nil {
+		return nil, err
+	}
+	return &savingTokenSource{
+		base:  config.TokenSource(context.Background(), tok),
+		store: t,
+		last:  tok,
+	}, nil
+}
+
+// savingTokenSource saves the token whenever it is refreshed, so that the next run can use the new access token.
+type savingTokenSource struct {
+	base  oauth2.TokenSource
+	store *TokenStore
+	mu    sync.Mutex
+	last  *oauth2.Token
+}
+
+func (s *savingTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := s.base.Token()
+	if err != nil {
+		return nil, describeTokenError(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tok.AccessToken != s.last.AccessToken {
+		s.last = tok
+		//nolint:errcheck // The token still works for this run, and the next run refreshes it again.
+		s.store.Save(tok)
+	}
+	return tok, nil
+}
+
+// describeTokenError returns an error that says how to fix it if err means that the refresh token has expired or been
+// revoked.
+func describeTokenError(err error) error {
+	var retrieveErr *oauth2.RetrieveError
+	if !errors.As(err, &retrieveErr) {
+		return err
+	}
+	var body struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(retrieveErr.Body, &body) == nil && body.Error == "invalid_grant" {
+		return fmt.Errorf("%w: %v", ErrNotAuthorized, errTokenRevoked)
+	}
+	return err
+}
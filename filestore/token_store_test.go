@@ -0,0 +1,190 @@
+package filestore
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/ristomcgehee/lyncser/utils"
+)
+
+func TestRefreshedTokenIsSaved(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token": "new", "token_type": "Bearer", "expires_in": 3600}`)
+	}))
+	defer server.Close()
+	tokens := &TokenStore{ConfigDir: t.TempDir()}
+	if err := tokens.Save(&oauth2.Token{AccessToken: "old", RefreshToken: "refresh", Expiry: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: server.URL}}
+	tokenSource, err := tokens.tokenSource(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tokenSource.Token(); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := tokens.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.AccessToken != "new" || saved.RefreshToken != "refresh" {
+		t.Errorf("unexpected saved token %v", saved)
+	}
+}
+
+func TestRevokedTokenIsNotAuthorized(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error": "invalid_grant", "error_description": "Token has been expired or revoked."}`)
+	}))
+	defer server.Close()
+	tokens := &TokenStore{ConfigDir: t.TempDir()}
+	if err := tokens.Save(&oauth2.Token{AccessToken: "old", RefreshToken: "refresh", Expiry: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: server.URL}}
+	tokenSource, err := tokens.tokenSource(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tokenSource.Token()
+	if !errors.Is(err, ErrNotAuthorized) || !strings.Contains(err.Error(), "lyncser auth") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestEncryptedToken(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	plain := &TokenStore{ConfigDir: dir}
+	if err := plain.Save(&oauth2.Token{AccessToken: "access", RefreshToken: "refresh"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Loading with Encrypt set converts the plain token.
+	encrypted := &TokenStore{ConfigDir: dir, Key: make([]byte, 32), Encrypt: true}
+	if _, err := encrypted.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if hasPlain, _ := utils.PathExists(filepath.Join(dir, tokenFileName)); hasPlain {
+		t.Error("the plain token was not removed")
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, encryptedTokenFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "refresh") {
+		t.Error("the saved token is not encrypted")
+	}
+	tok, err := encrypted.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.RefreshToken != "refresh" {
+		t.Errorf("unexpected token %v", tok)
+	}
+
+	if _, err := plain.Load(); !errors.Is(err, errTokenEncrypted) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestNewTokenStore(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token": "new", "token_type": "Bearer", "expires_in": 3600}`)
+	}))
+	defer server.Close()
+	keyRequests := 0
+	getKey := func() ([]byte, error) {
+		keyRequests++
+		return make([]byte, 32), nil
+	}
+
+	// Without encryption the key is never needed.
+	dir := t.TempDir()
+	if _, err := NewTokenStore(dir, false, getKey); err != nil {
+		t.Fatal(err)
+	}
+	if keyRequests != 0 {
+		t.Errorf("the key was requested %d times for an unencrypted token", keyRequests)
+	}
+
+	// A token saved encrypted is still readable after encryption is turned off, and is saved plain again.
+	encrypted := &TokenStore{ConfigDir: dir, Key: make([]byte, 32), Encrypt: true}
+	if err := encrypted.Save(&oauth2.Token{AccessToken: "old", RefreshToken: "refresh", Expiry: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := NewTokenStore(dir, false, getKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyRequests != 1 {
+		t.Errorf("expected the key to be requested once, got %d", keyRequests)
+	}
+	config := &oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: server.URL}}
+	tokenSource, err := tokens.tokenSource(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tokenSource.Token(); err != nil {
+		t.Fatal(err)
+	}
+	if hasEncrypted, _ := HasEncryptedToken(dir); hasEncrypted {
+		t.Error("the encrypted token was not converted")
+	}
+}
+
+func TestEncryptedTokenUsesRandomNonce(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	tokens := &TokenStore{ConfigDir: dir, Key: make([]byte, 32), Encrypt: true}
+	saveAndRead := func() []byte {
+		if err := tokens.Save(&oauth2.Token{AccessToken: "access", RefreshToken: "refresh"}); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, encryptedTokenFileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	// Every encryption, of the token or of a file with the same key, has its own nonce.
+	fileEncryptor := &utils.AESGCMEncryptor{Key: tokens.Key}
+	reader, err := fileEncryptor.EncryptReader(strings.NewReader("contents"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileData, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The format marker and the nonce.
+	const headerSize = 24
+	first, second := saveAndRead(), saveAndRead()
+	if string(first[:headerSize]) == string(fileData[:headerSize]) ||
+		string(first[:headerSize]) == string(second[:headerSize]) {
+		t.Error("the token was encrypted with a nonce that has been used before")
+	}
+	if _, err := tokens.Load(); err != nil {
+		t.Fatal(err)
+	}
+}
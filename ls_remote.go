@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/ristomcgehee/lyncser/sync"
+)
+
+// remoteTreeNode is a directory or file in the tree printed by ls-remote.
+type remoteTreeNode struct {
+	name     string
+	info     *sync.RemoteFileInfo
+	children map[string]*remoteTreeNode
+}
+
+func lsRemoteCmd(cmd *cobra.Command, args []string) {
+	logger, err := getLogger(cmd)
+	if err != nil {
+		exitWithoutLogger(err)
+	}
+	configFiles, err := getConfigFiles(cmd)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	remoteFileStore, err := getRemoteFileStore(logger, configFiles)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	syncer := sync.Syncer{
+		RemoteFileStore: remoteFileStore,
+		Logger:          logger,
+		Config:          configFiles,
+	}
+	infos, err := syncer.ListRemoteFiles()
+	if err != nil {
+		exitWithError(logger, err)
+	}
+
+	root := &remoteTreeNode{children: map[string]*remoteTreeNode{}}
+	for _, info := range infos {
+		node := root
+		for _, part := range strings.Split(strings.TrimPrefix(info.Path, "/"), "/") {
+			child, ok := node.children[part]
+			if !ok {
+				child = &remoteTreeNode{name: part, children: map[string]*remoteTreeNode{}}
+				node.children[part] = child
+			}
+			node = child
+		}
+		node.info = info
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "PATH\tMODIFIED\tSIZE\tTAGS\t")
+	printRemoteTree(writer, root, "", time.Now())
+	//nolint:errcheck
+	writer.Flush()
+}
+
+// printRemoteTree prints the children of node, each on its own line with the given prefix.
+func printRemoteTree(writer *tabwriter.Writer, node *remoteTreeNode, prefix string, now time.Time) {
+	names := make([]string, 0, len(node.children))
+	for name := range node.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		child := node.children[name]
+		branch, childPrefix := "├── ", "│   "
+		if i == len(names)-1 {
+			branch, childPrefix = "└── ", "    "
+		}
+		fmt.Fprintf(writer, "%s%s%s\n", prefix, branch, formatRemoteFileInfo(child, now))
+		printRemoteTree(writer, child, prefix+childPrefix, now)
+	}
+}
+
+// formatRemoteFileInfo returns the tab-separated columns printed for a node. The days until an orphaned file is
+// deleted are counted from now.
+func formatRemoteFileInfo(node *remoteTreeNode, now time.Time) string {
+	info := node.info
+	if info == nil || info.IsDir {
+		return node.name + "/\t\t\t\t"
+	}
+	modified := ""
+	if !info.ModifiedTime.IsZero() {
+		modified = info.ModifiedTime.Local().Format(displayTimeFormat)
+	}
+	orphan := ""
+	switch {
+	case info.Pinned:
+		orphan = "pinned"
+	case info.DeleteAfter != nil:
+		daysRemaining := int(math.Ceil(info.DeleteAfter.Sub(now).Hours() / 24))
+		if daysRemaining < 0 {
+			daysRemaining = 0
+		}
+		orphan = fmt.Sprintf("orphaned, deleted in %d days", daysRemaining)
+	case info.MarkDeleted != nil:
+		orphan = "orphaned, kept until pruned"
+	}
+	return fmt.Sprintf("%s\t%s\t%d\t%s\t%s", node.name, modified, info.Size, strings.Join(info.Tags, ","), orphan)
+}
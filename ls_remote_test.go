@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ristomcgehee/lyncser/filestore"
+	"github.com/ristomcgehee/lyncser/sync"
+)
+
+func TestFormatRemoteFileInfo(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2021, 10, 1, 7, 0, 0, 0, time.UTC)
+	markDeleted := now.AddDate(0, 0, -10)
+	deleteAfter := func(d time.Duration) *time.Time {
+		deleteAfter := now.Add(d)
+		return &deleteAfter
+	}
+	tests := []struct {
+		name     string
+		info     *sync.RemoteFileInfo
+		expected string
+	}{
+		{
+			name:     "directory",
+			info:     &sync.RemoteFileInfo{StoredFile: &filestore.StoredFile{IsDir: true}},
+			expected: "node/\t\t\t\t",
+		},
+		{
+			name:     "tagged file",
+			info:     &sync.RemoteFileInfo{StoredFile: &filestore.StoredFile{Size: 12}, Tags: []string{"all", "work"}},
+			expected: "node\t\t12\tall,work\t",
+		},
+		{
+			name: "pinned orphan",
+			info: &sync.RemoteFileInfo{StoredFile: &filestore.StoredFile{}, MarkDeleted: &markDeleted,
+				DeleteAfter: deleteAfter(time.Hour), Pinned: true},
+			expected: "node\t\t0\t\tpinned",
+		},
+		{
+			name: "orphan deleted in part of a day",
+			info: &sync.RemoteFileInfo{StoredFile: &filestore.StoredFile{}, MarkDeleted: &markDeleted,
+				DeleteAfter: deleteAfter(36 * time.Hour)},
+			expected: "node\t\t0\t\torphaned, deleted in 2 days",
+		},
+		{
+			name: "orphan past its deletion time",
+			info: &sync.RemoteFileInfo{StoredFile: &filestore.StoredFile{}, MarkDeleted: &markDeleted,
+				DeleteAfter: deleteAfter(-time.Hour)},
+			expected: "node\t\t0\t\torphaned, deleted in 0 days",
+		},
+		{
+			name:     "orphan kept until pruned",
+			info:     &sync.RemoteFileInfo{StoredFile: &filestore.StoredFile{}, MarkDeleted: &markDeleted},
+			expected: "node\t\t0\t\torphaned, kept until pruned",
+		},
+	}
+
+	for _, test := range tests {
+		actual := formatRemoteFileInfo(&remoteTreeNode{name: "node", info: test.info}, now)
+		if actual != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, actual)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 
@@ -14,12 +16,41 @@ import (
 
 const appVersion = "v0.1.20"
 
+// Format used when printing times for the user to read.
+const displayTimeFormat = "2006-01-02 15:04:05"
+
+var (
+	errUnsupportedBackend  = errors.New("unsupported backend")
+	errInvalidReportFormat = errors.New("invalid report format")
+)
+
 var rootCmd = &cobra.Command{
 	Use: "lyncser",
 }
 
 //nolint:gochecknoinits
 func init() {
+	initCmd := &cobra.Command{
+		Use:   "init",
+		Short: "Interactively sets up lyncser on this machine.",
+		Run:   initCmd,
+	}
+	addCommonFlags(initCmd)
+	addAuthModeFlag(initCmd)
+	rootCmd.AddCommand(initCmd)
+
+	authCmd := &cobra.Command{
+		Use:   "auth",
+		Short: "Authorizes this machine to use Google Drive, including on machines without a browser.",
+		Run:   authCmd,
+	}
+	addCommonFlags(authCmd)
+	addAuthModeFlag(authCmd)
+	authCmd.Flags().String("import-token", "", "Import the token.json of a machine that is already authorized. Use "+
+		"'-' to read it from stdin.")
+	authCmd.Flags().String("service-account", "", "Import a service account key and use it instead of an OAuth token")
+	rootCmd.AddCommand(authCmd)
+
 	syncCmd := &cobra.Command{
 		Use:   "sync",
 		Short: "Syncs the files that are configured to be synced.",
@@ -28,6 +59,11 @@ func init() {
 	addCommonFlags(syncCmd)
 	syncCmd.Flags().BoolP("force-download", "f", false, "Forces download of all files")
 	syncCmd.Flags().BoolP("dont-encrypt", "d", false, "Don't encrypt files. By default, files are encrypted.")
+	syncCmd.Flags().Bool("break-lock", false, "Take over the remote lock even if another machine's lease on it "+
+		"has not expired. Only use this if that machine's sync is no longer running.")
+	syncCmd.Flags().String("report", "", "Print a report of the sync to stdout. The only format is 'json'.")
+	syncCmd.Flags().IntP("parallelism", "j", 0, "The number of files to sync at the same time. Overrides "+
+		"'parallelism' in localConfig.yaml.")
 	rootCmd.AddCommand(syncCmd)
 	deleteFilesCmd := &cobra.Command{
 		Use:   "deleteAllRemoteFiles",
@@ -38,6 +74,157 @@ func init() {
 	deleteFilesCmd.Flags().BoolP("yes", "y", false, "Confirm deletion of all remote files")
 	rootCmd.AddCommand(deleteFilesCmd)
 
+	statusCmd := &cobra.Command{
+		Use:   "status [paths...]",
+		Short: "Shows the sync state of each synced file.",
+		Run:   statusCmd,
+	}
+	addCommonFlags(statusCmd)
+	statusCmd.Flags().Bool("json", false, "Print the status as JSON")
+	rootCmd.AddCommand(statusCmd)
+
+	diffCmd := &cobra.Command{
+		Use:   "diff <path>",
+		Short: "Shows the differences between the local and remote versions of a file or directory.",
+		Args:  cobra.ExactArgs(1),
+		Run:   diffCmd,
+	}
+	addCommonFlags(diffCmd)
+	diffCmd.Flags().BoolP("dont-encrypt", "d", false, "Remote files are not encrypted.")
+	rootCmd.AddCommand(diffCmd)
+
+	addCmd := &cobra.Command{
+		Use:   "add <path>",
+		Short: "Adds a file or directory to the global config.",
+		Args:  cobra.ExactArgs(1),
+		Run:   addPathCmd,
+	}
+	addCommonFlags(addCmd)
+	addCmd.Flags().StringP("tag", "t", "all", "The tag to add the path under")
+	addCmd.Flags().BoolP("dont-encrypt", "d", false, "Don't encrypt files. By default, files are encrypted.")
+	rootCmd.AddCommand(addCmd)
+	removeCmd := &cobra.Command{
+		Use:   "remove <path>",
+		Short: "Removes a file or directory from the global config.",
+		Args:  cobra.ExactArgs(1),
+		Run:   removePathCmd,
+	}
+	addCommonFlags(removeCmd)
+	removeCmd.Flags().StringP("tag", "t", "", "Only remove the path from this tag. By default, it's removed from all tags.")
+	removeCmd.Flags().BoolP("dont-encrypt", "d", false, "Don't encrypt files. By default, files are encrypted.")
+	rootCmd.AddCommand(removeCmd)
+	pinCmd := &cobra.Command{
+		Use:   "pin <path>",
+		Short: "Keeps a remote file or directory from being deleted when it is not in the global config.",
+		Args:  cobra.ExactArgs(1),
+		Run:   pinPathCmd,
+	}
+	addCommonFlags(pinCmd)
+	pinCmd.Flags().BoolP("dont-encrypt", "d", false, "Don't encrypt files. By default, files are encrypted.")
+	rootCmd.AddCommand(pinCmd)
+	unpinCmd := &cobra.Command{
+		Use:   "unpin <path>",
+		Short: "Removes a path from the pinned paths in the global config.",
+		Args:  cobra.ExactArgs(1),
+		Run:   unpinPathCmd,
+	}
+	addCommonFlags(unpinCmd)
+	unpinCmd.Flags().BoolP("dont-encrypt", "d", false, "Don't encrypt files. By default, files are encrypted.")
+	rootCmd.AddCommand(unpinCmd)
+	pathsCmd := &cobra.Command{
+		Use:   "paths",
+		Short: "Lists the paths in the global config for each tag.",
+		Run:   listPathsCmd,
+	}
+	addCommonFlags(pathsCmd)
+	rootCmd.AddCommand(pathsCmd)
+
+	tagsCmd := &cobra.Command{
+		Use:   "tags",
+		Short: "Manages the tags this machine is associated with.",
+	}
+	tagsListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "Lists the tags in the global config and whether this machine has them.",
+		Run:   listTagsCmd,
+	}
+	addCommonFlags(tagsListCmd)
+	tagsCmd.AddCommand(tagsListCmd)
+	tagsAddCmd := &cobra.Command{
+		Use:   "add <tag>",
+		Short: "Associates this machine with a tag.",
+		Args:  cobra.ExactArgs(1),
+		Run:   addTagCmd,
+	}
+	addCommonFlags(tagsAddCmd)
+	tagsCmd.AddCommand(tagsAddCmd)
+	tagsRemoveCmd := &cobra.Command{
+		Use:   "remove <tag>",
+		Short: "Removes a tag from this machine.",
+		Args:  cobra.ExactArgs(1),
+		Run:   removeTagCmd,
+	}
+	addCommonFlags(tagsRemoveCmd)
+	tagsCmd.AddCommand(tagsRemoveCmd)
+	rootCmd.AddCommand(tagsCmd)
+
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Commands for working with the config files.",
+	}
+	configValidateCmd := &cobra.Command{
+		Use:   "validate",
+		Short: "Checks the global and local config files for problems.",
+		Run:   validateConfigCmd,
+	}
+	addCommonFlags(configValidateCmd)
+	configCmd.AddCommand(configValidateCmd)
+	rootCmd.AddCommand(configCmd)
+
+	lsRemoteCmd := &cobra.Command{
+		Use:   "ls-remote",
+		Short: "Lists the files stored in the remote file store as a tree.",
+		Run:   lsRemoteCmd,
+	}
+	addCommonFlags(lsRemoteCmd)
+	rootCmd.AddCommand(lsRemoteCmd)
+
+	repairCmd := &cobra.Command{
+		Use:   "repair",
+		Short: "Fixes inconsistencies in the remote file store, such as duplicate files.",
+		Run:   repairCmd,
+	}
+	addCommonFlags(repairCmd)
+	repairCmd.Flags().Bool("break-lock", false, "Take over the remote lock even if another machine's lease on it "+
+		"has not expired. Only use this if that machine's sync is no longer running.")
+	rootCmd.AddCommand(repairCmd)
+
+	pruneCmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Deletes the remote files that are no longer in the global config without waiting for them to expire.",
+		Run:   pruneCmd,
+	}
+	addCommonFlags(pruneCmd)
+	pruneCmd.Flags().BoolP("yes", "y", false, "Delete the files without asking for confirmation")
+	pruneCmd.Flags().Bool("dry-run", false, "Only list the files that would be deleted")
+	pruneCmd.Flags().Bool("break-lock", false, "Take over the remote lock even if another machine's lease on it "+
+		"has not expired. Only use this if that machine's sync is no longer running.")
+	rootCmd.AddCommand(pruneCmd)
+
+	undoCmd := &cobra.Command{
+		Use:   "undo [run-id]",
+		Short: "Restores the files overwritten by the most recent sync, or by the sync with the given run ID.",
+		Args:  cobra.MaximumNArgs(1),
+		Run:   undoCmd,
+	}
+	addCommonFlags(undoCmd)
+	undoCmd.Flags().Bool("list", false, "List the syncs that can be undone")
+	undoCmd.Flags().Bool("force", false, "Restore files even if they have been modified since the sync")
+	undoCmd.Flags().BoolP("yes", "y", false, "Restore the files without asking for confirmation")
+	undoCmd.Flags().Bool("break-lock", false, "Take over the remote lock even if another machine's lease on it "+
+		"has not expired. Only use this if that machine's sync is no longer running.")
+	rootCmd.AddCommand(undoCmd)
+
 	versionCmd := &cobra.Command{
 		Use:   "version",
 		Short: "Print the version number of lyncser",
@@ -50,6 +237,30 @@ func init() {
 
 func addCommonFlags(cmd *cobra.Command) {
 	cmd.Flags().StringP("log-level", "l", "info", "The log level to use. One of: debug, info, warn, error, fatal")
+	cmd.Flags().String("config-dir", "", fmt.Sprintf("The directory containing lyncser's config files. Can also be "+
+		"set with %s. Defaults to $XDG_CONFIG_HOME/lyncser or ~/.config/lyncser", utils.ConfigDirEnvVar))
+	cmd.Flags().StringP("profile", "p", "", fmt.Sprintf("The profile to use. Each profile has its own config, "+
+		"state, encryption key and remote root. Can also be set with %s", utils.ProfileEnvVar))
+}
+
+// getConfigFiles returns the config files for the profile chosen by the config-dir and profile flags.
+func getConfigFiles(cmd *cobra.Command) (*sync.ConfigFiles, error) {
+	configDir, err := cmd.Flags().GetString("config-dir")
+	if err != nil {
+		return nil, err
+	}
+	profile, err := cmd.Flags().GetString("profile")
+	if err != nil {
+		return nil, err
+	}
+	dir, err := utils.GetConfigDir(configDir, profile)
+	if err != nil {
+		return nil, err
+	}
+	return &sync.ConfigFiles{
+		Dir:     dir,
+		Profile: utils.GetProfile(profile),
+	}, nil
 }
 
 func getLogger(cmd *cobra.Command) (*zap.SugaredLogger, error) {
@@ -62,6 +273,8 @@ func getLogger(cmd *cobra.Command) (*zap.SugaredLogger, error) {
 		return nil, err
 	}
 	cfg.Encoding = "console"
+	// Errors are reported to the user and through the exit code, so stack traces are only noise.
+	cfg.DisableStacktrace = true
 	logger, err := cfg.Build()
 	if err != nil {
 		return nil, err
@@ -75,56 +288,94 @@ func getLogger(cmd *cobra.Command) (*zap.SugaredLogger, error) {
 func syncCmd(cmd *cobra.Command, args []string) {
 	logger, err := getLogger(cmd)
 	if err != nil {
-		panic(err)
+		exitWithoutLogger(err)
 	}
 	forceDownload, err := cmd.Flags().GetBool("force-download")
 	if err != nil {
 		logger.Warn("error getting force-download flag", zap.Error(err))
 	}
-	remoteFileStore := getRemoteFileStore(logger)
+	breakLock, err := cmd.Flags().GetBool("break-lock")
 	if err != nil {
-		logger.Panic(err)
+		logger.Warn("error getting break-lock flag", zap.Error(err))
 	}
-	dontEncrypt, err := cmd.Flags().GetBool("dont-encrypt")
+	reportFormat, err := cmd.Flags().GetString("report")
 	if err != nil {
-		logger.Warn("error getting dont-encrypt flag", zap.Error(err))
+		logger.Warn("error getting report flag", zap.Error(err))
 	}
-	var encryptor utils.ReaderEncryptor
-	if dontEncrypt {
-		encryptor = &utils.NopEncryptor{}
-	} else {
-		encryptionKey, err := sync.GetEncryptionKey()
-		if err != nil {
-			logger.Panic(err)
-		}
-		encryptor = &utils.AESGCMEncryptor{
-			Key: encryptionKey,
-		}
+	parallelism, err := cmd.Flags().GetInt("parallelism")
+	if err != nil {
+		logger.Warn("error getting parallelism flag", zap.Error(err))
+	}
+	if reportFormat != "" && reportFormat != "json" {
+		exitWithError(logger, fmt.Errorf("%w: %s", errInvalidReportFormat, reportFormat))
+	}
+	configFiles, err := getConfigFiles(cmd)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	remoteFileStore, err := getRemoteFileStore(logger, configFiles)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	encryptor, err := getEncryptor(cmd, logger, configFiles)
+	if err != nil {
+		exitWithError(logger, err)
 	}
 	syncer := sync.Syncer{
 		RemoteFileStore: remoteFileStore,
 		LocalFileStore:  &filestore.LocalFileStore{},
 		Logger:          logger,
+		Config:          configFiles,
 		Encryptor:       encryptor,
 		ForceDownload:   forceDownload,
+		BreakLock:       breakLock,
+		Parallelism:     parallelism,
+	}
+	result, err := syncer.PerformSync()
+	if reportFormat == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(result.Report()); err != nil {
+			logger.Warn("error printing sync report", zap.Error(err))
+		}
 	}
-	if err = syncer.PerformSync(); err != nil {
-		logger.Panic(err)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	failures := result.Failures()
+	deferred := result.Deferred()
+	logger.Infof("Sync finished: %d uploaded, %d downloaded, %d marked deleted, %d deferred, %d failed",
+		result.Count(sync.UploadedFile), result.Count(sync.DownloadedFile), result.Count(sync.MarkedDeleted),
+		len(deferred), len(failures))
+	for _, path := range deferred {
+		logger.Warnf("Deferred '%s' to the next sync", path)
+	}
+	if len(failures) > 0 {
+		for _, failure := range failures {
+			logger.Errorf("Failed to sync '%s': %v", failure.Path, failure.Err)
+		}
+		//nolint:errcheck
+		logger.Sync()
+		os.Exit(exitPartialFailure)
 	}
 }
 
 func deleteRemoteFiles(cmd *cobra.Command, args []string) {
 	logger, err := getLogger(cmd)
 	if err != nil {
-		panic(err)
+		exitWithoutLogger(err)
+	}
+	configFiles, err := getConfigFiles(cmd)
+	if err != nil {
+		exitWithError(logger, err)
 	}
-	remoteFileStore := getRemoteFileStore(logger)
+	remoteFileStore, err := getRemoteFileStore(logger, configFiles)
 	if err != nil {
-		logger.Panic(err)
+		exitWithError(logger, err)
 	}
 	files, err := remoteFileStore.GetFiles()
 	if err != nil {
-		logger.Panic(err)
+		exitWithError(logger, err)
 	}
 	yes, err := cmd.Flags().GetBool("yes")
 	if err != nil {
@@ -140,15 +391,68 @@ func deleteRemoteFiles(cmd *cobra.Command, args []string) {
 		}
 	}
 	if err = remoteFileStore.DeleteAllFiles(); err != nil {
-		logger.Panic(err)
+		exitWithError(logger, err)
 	}
 	logger.Infof("Deleted %d files", len(files))
 }
 
-func getRemoteFileStore(logger utils.Logger) filestore.FileStore {
+// getEncryptor returns the encryptor to use for files in the remote file store based on the dont-encrypt flag.
+func getEncryptor(cmd *cobra.Command, logger *zap.SugaredLogger, configFiles *sync.ConfigFiles) (
+	utils.ReaderEncryptor, error) {
+	dontEncrypt, err := cmd.Flags().GetBool("dont-encrypt")
+	if err != nil {
+		logger.Warn("error getting dont-encrypt flag", zap.Error(err))
+	}
+	if dontEncrypt {
+		return &utils.NopEncryptor{}, nil
+	}
+	encryptionKey, err := configFiles.GetEncryptionKey()
+	if err != nil {
+		return nil, err
+	}
+	return &utils.AESGCMEncryptor{
+		Key: encryptionKey,
+	}, nil
+}
+
+// getRemoteFileStore returns the remote file store configured for the profile.
+func getRemoteFileStore(logger utils.Logger, configFiles *sync.ConfigFiles) (filestore.FileStore, error) {
+	backend, remoteRoot, err := configFiles.GetBackend()
+	if err != nil {
+		return nil, err
+	}
+	if backend != sync.BackendGoogleDrive {
+		return nil, fmt.Errorf("%w: %s", errUnsupportedBackend, backend)
+	}
+	sharedDriveID, err := configFiles.GetSharedDriveID()
+	if err != nil {
+		return nil, err
+	}
+	uploadChunkSize, err := configFiles.GetUploadChunkSize()
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := getTokenStore(configFiles)
+	if err != nil {
+		return nil, err
+	}
 	return &filestore.DriveFileStore{
-		Logger: logger,
+		Logger:          logger,
+		ConfigDir:       configFiles.Dir,
+		RootName:        remoteRoot,
+		SharedDriveID:   sharedDriveID,
+		Tokens:          tokens,
+		UploadChunkSize: uploadChunkSize,
+	}, nil
+}
+
+// getTokenStore returns the store for the Google Drive token.
+func getTokenStore(configFiles *sync.ConfigFiles) (*filestore.TokenStore, error) {
+	encryptToken, err := configFiles.GetEncryptToken()
+	if err != nil {
+		return nil, err
 	}
+	return filestore.NewTokenStore(configFiles.Dir, encryptToken, configFiles.GetEncryptionKey)
 }
 
 func main() {
@@ -158,6 +462,7 @@ func main() {
 		return
 	}
 	if err := rootCmd.Execute(); err != nil {
-		panic(err)
+		// Cobra has already printed the error and the usage.
+		os.Exit(exitError)
 	}
 }
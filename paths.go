@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	"github.com/ristomcgehee/lyncser/filestore"
+	"github.com/ristomcgehee/lyncser/sync"
+	"github.com/ristomcgehee/lyncser/utils"
+)
+
+func addPathCmd(cmd *cobra.Command, args []string) {
+	logger, err := getLogger(cmd)
+	if err != nil {
+		exitWithoutLogger(err)
+	}
+	tag, err := cmd.Flags().GetString("tag")
+	if err != nil {
+		logger.Warn("error getting tag flag", zap.Error(err))
+	}
+	configFiles, err := getConfigFiles(cmd)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	friendlyPath, err := configFiles.AddPath(args[0], tag)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	fmt.Printf("Added '%s' under tag '%s'\n", friendlyPath, tag)
+	uploadGlobalConfig(cmd, logger, configFiles)
+}
+
+func removePathCmd(cmd *cobra.Command, args []string) {
+	logger, err := getLogger(cmd)
+	if err != nil {
+		exitWithoutLogger(err)
+	}
+	tag, err := cmd.Flags().GetString("tag")
+	if err != nil {
+		logger.Warn("error getting tag flag", zap.Error(err))
+	}
+	configFiles, err := getConfigFiles(cmd)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	removedFrom, err := configFiles.RemovePath(args[0], tag)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	fmt.Printf("Removed '%s' from tags: %s\n", args[0], strings.Join(removedFrom, ", "))
+	uploadGlobalConfig(cmd, logger, configFiles)
+}
+
+func pinPathCmd(cmd *cobra.Command, args []string) {
+	logger, err := getLogger(cmd)
+	if err != nil {
+		exitWithoutLogger(err)
+	}
+	configFiles, err := getConfigFiles(cmd)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	friendlyPath, err := configFiles.PinPath(args[0])
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	fmt.Printf("Pinned '%s'. It will not be deleted remotely.\n", friendlyPath)
+	uploadGlobalConfig(cmd, logger, configFiles)
+}
+
+func unpinPathCmd(cmd *cobra.Command, args []string) {
+	logger, err := getLogger(cmd)
+	if err != nil {
+		exitWithoutLogger(err)
+	}
+	configFiles, err := getConfigFiles(cmd)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	friendlyPath, err := configFiles.UnpinPath(args[0])
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	fmt.Printf("Unpinned '%s'\n", friendlyPath)
+	uploadGlobalConfig(cmd, logger, configFiles)
+}
+
+// uploadGlobalConfig uploads the global config after it has been edited so that other machines pick up the change.
+func uploadGlobalConfig(cmd *cobra.Command, logger *zap.SugaredLogger, configFiles *sync.ConfigFiles) {
+	remoteFileStore, err := getRemoteFileStore(logger, configFiles)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	encryptor, err := getEncryptor(cmd, logger, configFiles)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	syncer := sync.Syncer{
+		RemoteFileStore: remoteFileStore,
+		LocalFileStore:  &filestore.LocalFileStore{},
+		Logger:          logger,
+		Config:          configFiles,
+		Encryptor:       encryptor,
+	}
+	handleFileOutcome, err := syncer.SyncGlobalConfig()
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	if handleFileOutcome != sync.UploadedFile {
+		logger.Warn("The global config was not uploaded. Run `lyncser sync` to sync it.")
+	}
+}
+
+func listPathsCmd(cmd *cobra.Command, args []string) {
+	logger, err := getLogger(cmd)
+	if err != nil {
+		exitWithoutLogger(err)
+	}
+	configFiles, err := getConfigFiles(cmd)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	tagPaths, err := configFiles.GetTagPaths()
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	localTags, err := configFiles.GetLocalTags()
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	tags := make([]string, 0, len(tagPaths))
+	for tag := range tagPaths {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		fmt.Println(formatTag(tag, localTags))
+		for _, path := range tagPaths[tag] {
+			fmt.Printf("  %s\n", path)
+		}
+	}
+}
+
+func listTagsCmd(cmd *cobra.Command, args []string) {
+	logger, err := getLogger(cmd)
+	if err != nil {
+		exitWithoutLogger(err)
+	}
+	configFiles, err := getConfigFiles(cmd)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	globalTags, err := configFiles.GetGlobalTags()
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	localTags, err := configFiles.GetLocalTags()
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	for _, tag := range globalTags {
+		fmt.Println(formatTag(tag, localTags))
+	}
+	for _, tag := range localTags {
+		if !utils.InSlice(tag, globalTags) {
+			fmt.Printf("%s (this machine, not in the global config)\n", tag)
+		}
+	}
+}
+
+func addTagCmd(cmd *cobra.Command, args []string) {
+	logger, err := getLogger(cmd)
+	if err != nil {
+		exitWithoutLogger(err)
+	}
+	configFiles, err := getConfigFiles(cmd)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	if err := configFiles.AddLocalTag(args[0]); err != nil {
+		exitWithError(logger, err)
+	}
+	fmt.Printf("Added tag '%s' to this machine\n", args[0])
+}
+
+func removeTagCmd(cmd *cobra.Command, args []string) {
+	logger, err := getLogger(cmd)
+	if err != nil {
+		exitWithoutLogger(err)
+	}
+	configFiles, err := getConfigFiles(cmd)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	if err := configFiles.RemoveLocalTag(args[0]); err != nil {
+		exitWithError(logger, err)
+	}
+	fmt.Printf("Removed tag '%s' from this machine\n", args[0])
+}
+
+// formatTag returns the tag name, marked if this machine has that tag.
+func formatTag(tag string, localTags []string) string {
+	if utils.InSlice(tag, localTags) {
+		return tag + " (this machine)"
+	}
+	return tag
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	"github.com/ristomcgehee/lyncser/sync"
+)
+
+func pruneCmd(cmd *cobra.Command, args []string) {
+	logger, err := getLogger(cmd)
+	if err != nil {
+		exitWithoutLogger(err)
+	}
+	yes, err := cmd.Flags().GetBool("yes")
+	if err != nil {
+		logger.Warn("error getting yes flag", zap.Error(err))
+	}
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		logger.Warn("error getting dry-run flag", zap.Error(err))
+	}
+	breakLock, err := cmd.Flags().GetBool("break-lock")
+	if err != nil {
+		logger.Warn("error getting break-lock flag", zap.Error(err))
+	}
+	configFiles, err := getConfigFiles(cmd)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	remoteFileStore, err := getRemoteFileStore(logger, configFiles)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	syncer := sync.Syncer{
+		RemoteFileStore: remoteFileStore,
+		Logger:          logger,
+		Config:          configFiles,
+		BreakLock:       breakLock,
+	}
+	orphans, err := syncer.ListOrphans()
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	if len(orphans) == 0 {
+		fmt.Println("There are no orphaned files in the remote file store.")
+		return
+	}
+	fmt.Println("These remote files are not covered by any tag's paths and are not pinned:")
+	for _, orphan := range orphans {
+		fmt.Printf("  %s\n", orphan)
+	}
+	if dryRun {
+		return
+	}
+	if !yes {
+		fmt.Printf("Delete these %d files from the remote file store now? (y/n): ", len(orphans))
+		var input string
+		fmt.Scanln(&input)
+		if input != "y" {
+			return
+		}
+	}
+	deleted, err := syncer.Prune(orphans)
+	fmt.Printf("Deleted %d files\n", len(deleted))
+	if err != nil {
+		exitWithError(logger, err)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	"github.com/ristomcgehee/lyncser/sync"
+)
+
+func repairCmd(cmd *cobra.Command, args []string) {
+	logger, err := getLogger(cmd)
+	if err != nil {
+		exitWithoutLogger(err)
+	}
+	breakLock, err := cmd.Flags().GetBool("break-lock")
+	if err != nil {
+		logger.Warn("error getting break-lock flag", zap.Error(err))
+	}
+	configFiles, err := getConfigFiles(cmd)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	remoteFileStore, err := getRemoteFileStore(logger, configFiles)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	syncer := sync.Syncer{
+		RemoteFileStore: remoteFileStore,
+		Logger:          logger,
+		Config:          configFiles,
+		BreakLock:       breakLock,
+	}
+	repairs, err := syncer.Repair()
+	for _, repair := range repairs {
+		fmt.Println(repair)
+	}
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	if len(repairs) == 0 {
+		fmt.Println("The remote file store has no inconsistencies.")
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/ristomcgehee/lyncser/filestore"
+	"github.com/ristomcgehee/lyncser/sync"
+	"github.com/ristomcgehee/lyncser/utils"
+)
+
+// Global config written when neither this machine nor the remote file store has one yet.
+const starterGlobalConfig = `paths:
+  all:
+    - "~/.gitconfig"
+`
+
+// Returned when the input ends before a question that needs an answer is answered.
+var errNoMoreInput = errors.New("the input ended before setup was complete")
+
+// setupPrompter asks the user questions on the terminal.
+type setupPrompter struct {
+	reader *bufio.Reader
+}
+
+// ask prints the question and returns the user's answer, or defaultAnswer if the answer is empty.
+func (p *setupPrompter) ask(question, defaultAnswer string) string {
+	if defaultAnswer != "" {
+		fmt.Printf("%s [%s]: ", question, defaultAnswer)
+	} else {
+		fmt.Printf("%s: ", question)
+	}
+	answer, err := p.reader.ReadString('\n')
+	answer = strings.TrimSpace(answer)
+	if answer == "" || err != nil {
+		return defaultAnswer
+	}
+	return answer
+}
+
+// askRequired asks the question until the user gives an answer. It returns errNoMoreInput if the input ends first.
+func (p *setupPrompter) askRequired(question string) (string, error) {
+	for {
+		fmt.Printf("%s: ", question)
+		answer, err := p.reader.ReadString('\n')
+		answer = strings.TrimSpace(answer)
+		switch {
+		case answer != "":
+			return answer, nil
+		case errors.Is(err, io.EOF):
+			fmt.Println()
+			return "", errNoMoreInput
+		case err != nil:
+			return "", err
+		}
+		fmt.Println("An answer is required.")
+	}
+}
+
+// confirm asks a yes/no question.
+func (p *setupPrompter) confirm(question string, defaultYes bool) bool {
+	defaultAnswer := "y/N"
+	if defaultYes {
+		defaultAnswer = "Y/n"
+	}
+	answer := strings.ToLower(p.ask(question, defaultAnswer))
+	if answer == strings.ToLower(defaultAnswer) {
+		return defaultYes
+	}
+	return answer == "y" || answer == "yes"
+}
+
+// choose asks the user to pick one of the options and returns its index.
+func (p *setupPrompter) choose(question string, options []string) int {
+	for {
+		fmt.Println(question)
+		for i, option := range options {
+			fmt.Printf("  %d) %s\n", i+1, option)
+		}
+		var choice int
+		if _, err := fmt.Sscanf(p.ask("Choice", "1"), "%d", &choice); err == nil && choice >= 1 &&
+			choice <= len(options) {
+			return choice - 1
+		}
+		fmt.Println("Invalid choice.")
+	}
+}
+
+func initCmd(cmd *cobra.Command, args []string) {
+	logger, err := getLogger(cmd)
+	if err != nil {
+		exitWithoutLogger(err)
+	}
+	prompter := &setupPrompter{reader: bufio.NewReader(os.Stdin)}
+	fmt.Println("Welcome to lyncser! This will walk you through setting up this machine.")
+	fmt.Println()
+
+	configFiles, err := getConfigFiles(cmd)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	if configFiles.Profile != utils.DefaultProfile {
+		fmt.Printf("Setting up profile '%s' in %s.\n", configFiles.Profile, configFiles.Dir)
+		fmt.Println()
+	}
+
+	prompter.choose("Where should files be synced to?", []string{"Google Drive"})
+	remoteFileStore, err := getRemoteFileStore(logger, configFiles)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	driveFileStore, ok := remoteFileStore.(*filestore.DriveFileStore)
+	if !ok {
+		exitWithError(logger, fmt.Errorf("%w: %T", errUnsupportedBackend, remoteFileStore))
+	}
+	authMode, err := getAuthMode(cmd)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	if err := setupDriveAuth(prompter, driveFileStore, authMode); err != nil {
+		exitWithError(logger, err)
+	}
+	fmt.Println()
+
+	if err := setupEncryptionKey(prompter, configFiles); err != nil {
+		exitWithError(logger, err)
+	}
+	fmt.Println()
+
+	encryptionKey, err := configFiles.GetEncryptionKey()
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	syncer := sync.Syncer{
+		RemoteFileStore: remoteFileStore,
+		LocalFileStore:  &filestore.LocalFileStore{},
+		Logger:          logger,
+		Config:          configFiles,
+		Encryptor:       &utils.AESGCMEncryptor{Key: encryptionKey},
+	}
+	globalConfigData, err := setupGlobalConfig(prompter, &syncer, configFiles)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	fmt.Println()
+
+	if err := setupLocalTags(prompter, configFiles, globalConfigData); err != nil {
+		exitWithError(logger, err)
+	}
+	fmt.Println()
+	fmt.Println("Setup is complete. Run `lyncser sync` to perform the first sync.")
+}
+
+// setupDriveAuth imports the OAuth client credentials if necessary and runs the authorization flow for authMode.
+func setupDriveAuth(prompter *setupPrompter, remoteFileStore *filestore.DriveFileStore,
+	authMode filestore.AuthMode) error {
+	hasCredentials, err := filestore.HasCredentials(remoteFileStore.ConfigDir)
+	if err != nil {
+		return err
+	}
+	for !hasCredentials {
+		fmt.Println("Lyncser needs an OAuth 2.0 Client ID from Google Cloud Platform. Create one for a desktop app and")
+		fmt.Println("download its credentials as JSON.")
+		answer, err := prompter.askRequired("Path to the downloaded credentials file")
+		if err != nil {
+			return err
+		}
+		credentialsPath, err := utils.RealPath(answer)
+		if err != nil {
+			return err
+		}
+		if err := filestore.ImportCredentials(remoteFileStore.ConfigDir, credentialsPath); err != nil {
+			fmt.Printf("Unable to import credentials: %v\n", err)
+			continue
+		}
+		hasCredentials = true
+	}
+	hasToken, err := filestore.HasToken(remoteFileStore.ConfigDir)
+	if err != nil {
+		return err
+	}
+	forceNewToken := hasToken && prompter.confirm("This machine is already authorized. Authorize again?", false)
+	return remoteFileStore.Authenticate(authMode, forceNewToken)
+}
+
+// setupEncryptionKey generates or imports the encryption key if this machine does not have one yet.
+func setupEncryptionKey(prompter *setupPrompter, configFiles *sync.ConfigFiles) error {
+	keyPath := configFiles.EncryptionKeyPath()
+	keyExists, err := configFiles.EncryptionKeyExists()
+	if err != nil {
+		return err
+	}
+	if keyExists {
+		fmt.Printf("Using the existing encryption key at %s.\n", keyPath)
+		return nil
+	}
+	choice := prompter.choose("Files are encrypted before they are uploaded. Which encryption key should be used?",
+		[]string{
+			"Generate a new key (first machine being set up)",
+			"Import the key from another machine",
+		})
+	if choice == 0 {
+		if _, err := configFiles.GetEncryptionKey(); err != nil {
+			return err
+		}
+		fmt.Printf("A new key was saved to %s. Copy it to each machine you set up after this one.\n", keyPath)
+		return nil
+	}
+	for {
+		keyHex, err := prompter.askRequired(fmt.Sprintf("Paste the contents of %s from the other machine", keyPath))
+		if err != nil {
+			return err
+		}
+		if err := configFiles.ImportEncryptionKey(keyHex); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		return nil
+	}
+}
+
+// setupGlobalConfig offers to adopt the global config stored remotely. It returns the global config that will be
+// used on this machine.
+func setupGlobalConfig(prompter *setupPrompter, syncer *sync.Syncer, configFiles *sync.ConfigFiles) ([]byte, error) {
+	localData, err := configFiles.ReadGlobalConfig()
+	if err != nil {
+		return nil, err
+	}
+	remoteData, err := syncer.GetRemoteGlobalConfig()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the remote global config (is the encryption key correct?): %w", err)
+	}
+	switch {
+	case remoteData != nil && string(remoteData) != string(localData):
+		fmt.Println("Found an existing global config in the remote file store:")
+		fmt.Println()
+		fmt.Println(string(remoteData))
+		if localData == nil || prompter.confirm("Replace this machine's global config with it?", true) {
+			return remoteData, configFiles.SaveGlobalConfig(remoteData)
+		}
+		return localData, nil
+	case localData == nil && remoteData == nil:
+		fmt.Println("No global config exists yet. A starter config was created; edit it to choose which files to sync.")
+		return []byte(starterGlobalConfig), configFiles.SaveGlobalConfig([]byte(starterGlobalConfig))
+	case localData == nil:
+		return remoteData, nil
+	}
+	return localData, nil
+}
+
+// setupLocalTags asks which of the global config's tags this machine should be associated with.
+func setupLocalTags(prompter *setupPrompter, configFiles *sync.ConfigFiles, globalConfigData []byte) error {
+	tags, err := sync.GetConfigTags(globalConfigData)
+	if err != nil {
+		return err
+	}
+	currentTags, err := configFiles.GetLocalTags()
+	if err != nil {
+		return err
+	}
+	fmt.Println("Tags choose which of the global config's paths are synced on this machine.")
+	fmt.Printf("Tags in the global config: %s\n", strings.Join(tags, ", "))
+	answer := prompter.ask("Tags for this machine (comma separated)", strings.Join(currentTags, ","))
+	var chosenTags []string
+	for _, tag := range strings.Split(answer, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || utils.InSlice(tag, chosenTags) {
+			continue
+		}
+		if !utils.InSlice(tag, tags) {
+			fmt.Printf("Note: tag '%s' is not in the global config yet.\n", tag)
+		}
+		chosenTags = append(chosenTags, tag)
+	}
+	return configFiles.SaveLocalTags(chosenTags)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/ristomcgehee/lyncser/filestore"
+	"github.com/ristomcgehee/lyncser/sync"
+)
+
+const testKeyHex = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+func newTestPrompter(input string) *setupPrompter {
+	return &setupPrompter{reader: bufio.NewReader(strings.NewReader(input))}
+}
+
+func TestSetupDriveAuthAsksAgainForEmptyPath(t *testing.T) {
+	t.Parallel()
+	configDir := t.TempDir()
+	// Two empty answers and a file that doesn't exist, then the input ends.
+	prompter := newTestPrompter("\n  \n" + filepath.Join(configDir, "missing.json") + "\n")
+	err := setupDriveAuth(prompter, &filestore.DriveFileStore{ConfigDir: configDir}, filestore.AuthModeManual)
+	if !errors.Is(err, errNoMoreInput) {
+		t.Errorf("expected %v, got %v", errNoMoreInput, err)
+	}
+}
+
+func TestSetupEncryptionKey(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name        string
+		existingKey string
+		input       string
+		expectedKey string
+		expectedErr error
+	}{
+		{
+			name:        "existing key is kept",
+			existingKey: testKeyHex,
+			expectedKey: testKeyHex,
+		},
+		{
+			name:        "import after an empty answer and an invalid key",
+			input:       "2\n\nnot-a-key\n" + testKeyHex + "\n",
+			expectedKey: testKeyHex,
+		},
+		{
+			name:        "input ends before a valid key",
+			input:       "2\nnot-a-key\n",
+			expectedErr: errNoMoreInput,
+		},
+		{
+			name:        "input ends before any answer",
+			input:       "2\n",
+			expectedErr: errNoMoreInput,
+		},
+	}
+
+	for _, test := range tests {
+		configFiles := &sync.ConfigFiles{Dir: t.TempDir()}
+		if test.existingKey != "" {
+			if err := configFiles.ImportEncryptionKey(test.existingKey); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := setupEncryptionKey(newTestPrompter(test.input), configFiles)
+		if !errors.Is(err, test.expectedErr) {
+			t.Errorf("%s: expected error %v, got %v", test.name, test.expectedErr, err)
+			continue
+		}
+		key, err := os.ReadFile(configFiles.EncryptionKeyPath())
+		if errors.Is(err, os.ErrNotExist) {
+			key = nil
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if string(key) != test.expectedKey {
+			t.Errorf("%s: expected key %q, got %q", test.name, test.expectedKey, key)
+		}
+	}
+}
+
+func TestGetRemoteFileStoreUsesLocalConfig(t *testing.T) {
+	t.Parallel()
+	configFiles := &sync.ConfigFiles{Dir: t.TempDir()}
+	localConfig := "tags:\n  - all\nsharedDriveId: drive1\nuploadChunkSizeMiB: 16\n"
+	if err := os.WriteFile(configFiles.LocalConfigPath(), []byte(localConfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	remoteFileStore, err := getRemoteFileStore(zap.NewNop().Sugar(), configFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	driveFileStore, ok := remoteFileStore.(*filestore.DriveFileStore)
+	if !ok || driveFileStore.SharedDriveID != "drive1" || driveFileStore.UploadChunkSize != 16<<20 {
+		t.Errorf("unexpected remote file store %+v", remoteFileStore)
+	}
+}
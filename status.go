@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	"github.com/ristomcgehee/lyncser/filestore"
+	"github.com/ristomcgehee/lyncser/sync"
+)
+
+func statusCmd(cmd *cobra.Command, args []string) {
+	logger, err := getLogger(cmd)
+	if err != nil {
+		exitWithoutLogger(err)
+	}
+	jsonOutput, err := cmd.Flags().GetBool("json")
+	if err != nil {
+		logger.Warn("error getting json flag", zap.Error(err))
+	}
+	configFiles, err := getConfigFiles(cmd)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	remoteFileStore, err := getRemoteFileStore(logger, configFiles)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	syncer := sync.Syncer{
+		RemoteFileStore: remoteFileStore,
+		LocalFileStore:  &filestore.LocalFileStore{},
+		Logger:          logger,
+		Config:          configFiles,
+	}
+	statuses, err := syncer.GetStatus(args)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	if jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(statuses); err != nil {
+			exitWithError(logger, err)
+		}
+		return
+	}
+	printStatuses(statuses)
+}
+
+// printStatuses prints the statuses as a human-readable table.
+func printStatuses(statuses []*sync.PathStatus) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "STATUS\tPATH\tTAGS\tLAST SYNCED")
+	for _, status := range statuses {
+		lastSynced := "never"
+		if status.LastSynced != nil {
+			lastSynced = status.LastSynced.Local().Format(displayTimeFormat)
+		}
+		if status.MarkDeleted != nil {
+			lastSynced = "marked deleted " + status.MarkDeleted.Local().Format(displayTimeFormat)
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", status.Status, status.Path, strings.Join(status.Tags, ","), lastSynced)
+	}
+	//nolint:errcheck
+	writer.Flush()
+}
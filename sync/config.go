@@ -6,10 +6,14 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
+	gosync "sync"
 	time "time"
 
 	yaml "gopkg.in/yaml.v3"
@@ -19,20 +23,92 @@ import (
 )
 
 const (
-	// Holds state that helps determine whether a file should be uploaded or downloaded.
-	stateLocalFilePath = "~/.config/lyncser/state.json"
-	// Holds state that helps determine whether a file should be deleted remotely.
+	// Holds state that helps determine whether a file should be deleted remotely. It is only stored remotely.
 	stateRemoteFilePath = "~/.config/lyncser/stateRemote.json"
-	// Contains global configuration used across all machines associated with this user.
+	// Friendly path of the global config. This is where it is stored in the remote file store, which is the same for
+	// every machine regardless of where its config directory is.
 	globalConfigPath = "~/.config/lyncser/globalConfig.yaml"
+	// Holds state that helps determine whether a file should be uploaded or downloaded.
+	stateLocalFileName = "state.json"
+	// Contains global configuration used across all machines associated with this user.
+	globalConfigFileName = "globalConfig.yaml"
 	// Contains configuration specific to this machine.
-	localConfigPath = "~/.config/lyncser/localConfig.yaml"
+	localConfigFileName = "localConfig.yaml"
 	// Key for encrypting files.
-	encryptionKeyPath = "~/.config/lyncser/encryption.key"
+	encryptionKeyFileName = "encryption.key"
+	// Holds the random ID that identifies this machine in the metadata of the files it uploads.
+	machineIDFileName = "machineID"
 	// Length of encryption key.
 	keyLengthBits = 256
+	// Number of days after a file is removed from the global config before it is deleted remotely, unless the global
+	// config sets remoteRetentionDays.
+	defaultRemoteRetentionDays = 30
+	// The only backend currently supported.
+	BackendGoogleDrive = "googleDrive"
+	// Name of the top-level folder in the remote file store for the default profile.
+	defaultRemoteRoot = "Lyncser-Root"
 )
 
+// Returned when the local state data file can't be parsed.
+var ErrCorruptState = errors.New("the state file is corrupt")
+
+// ConfigFiles locates the config and state files for a profile.
+type ConfigFiles struct {
+	// The real path of the directory containing the files.
+	Dir string
+	// The name of the profile these files belong to.
+	Profile string
+
+	// The local config as parsed by the first call to settings.
+	settingsOnce  gosync.Once
+	settingsCache *LocalConfig
+	settingsErr   error
+}
+
+// ConfigProvider loads and saves the config and state of a Syncer. ConfigFiles keeps them in the config directory;
+// other implementations let Syncer be embedded in tools and tests that keep them elsewhere.
+type ConfigProvider interface {
+	// ProfileName returns the name of the profile the config belongs to.
+	ProfileName() string
+	// GlobalConfigPath returns the real path of the local copy of the global config. It is synced with the local file
+	// store like any other file, so GlobalConfig must read the copy written there.
+	GlobalConfigPath() string
+	GlobalConfig() (*GlobalConfig, error)
+	LocalConfig() (*LocalConfig, error)
+	// LocalStateData returns the state data. recovered is true if it had to be restored from a backup.
+	LocalStateData() (stateData *LocalStateData, recovered bool, err error)
+	SaveLocalStateData(stateData *LocalStateData) error
+	// MachineID returns the ID of this machine, which is recorded in the metadata of uploaded files.
+	MachineID() (string, error)
+	// Lock keeps other syncs with the same config from running at the same time. The returned function unlocks it.
+	Lock() (unlock func(), err error)
+	// SaveSyncReport keeps the report of a finished sync.
+	SaveSyncReport(report *SyncReport) error
+	// LastSyncReport returns the report of the most recent sync, or nil if there is none.
+	LastSyncReport() (*SyncReport, error)
+	Journal
+}
+
+// ProfileName returns the name of the profile these files belong to.
+func (c *ConfigFiles) ProfileName() string {
+	return c.Profile
+}
+
+// ConfigError is returned when a config file cannot be parsed.
+type ConfigError struct {
+	// The real path of the config file.
+	Path string
+	Err  error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("error parsing %s: %v", e.Path, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
 type RemoteStateData struct {
 	// Key is file path. Value is the state data associated with that file.
 	FileStateData map[string]*RemoteFileStateData
@@ -47,31 +123,105 @@ type GlobalConfig struct {
 	// Specifies which files should be synced for machines associated with each tag. The key in this map is the tag
 	// name. The value is the list of files/directories that should be synced for that tag.
 	TagPaths map[string][]string `yaml:"paths"`
+	// The number of days to keep a remote file after no tag's paths cover it before deleting it. 0 means
+	// defaultRemoteRetentionDays. A negative number means such files are only deleted by `lyncser prune`.
+	RemoteRetentionDays int `yaml:"remoteRetentionDays,omitempty"`
+	// Remote files and directories that are never deleted, even when no tag's paths cover them.
+	Pinned []string `yaml:"pinned,omitempty"`
+}
+
+// remoteDeletionTime returns when a file that was marked deleted at markDeleted will be deleted remotely. ok is false
+// if it is never deleted automatically.
+func (c *GlobalConfig) remoteDeletionTime(markDeleted time.Time) (deleteAfter time.Time, ok bool) {
+	switch {
+	case c.RemoteRetentionDays < 0:
+		return time.Time{}, false
+	case c.RemoteRetentionDays == 0:
+		return markDeleted.AddDate(0, 0, defaultRemoteRetentionDays), true
+	}
+	return markDeleted.AddDate(0, 0, c.RemoteRetentionDays), true
+}
+
+// isPinned returns true if remotePath is pinned or is a directory containing a pinned path.
+func (c *GlobalConfig) isPinned(remotePath string) bool {
+	for _, pinnedPath := range c.Pinned {
+		if pathCovers(pinnedPath, remotePath) || pathCovers(remotePath, pinnedPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// isOrphaned returns true if remotePath would be deleted because no tag's paths cover it. lyncser's own files and
+// pinned paths are never orphaned.
+func (c *GlobalConfig) isOrphaned(remotePath string) bool {
+	switch {
+	case strings.HasPrefix(globalConfigPath, remotePath),
+		remotePath == stateRemoteFilePath,
+		remotePath == remoteLockFilePath:
+		return false
+	}
+	return len(getCoveringTags(remotePath, c)) == 0 && !c.isPinned(remotePath)
 }
 
 type LocalConfig struct {
 	// Specifies with tags this machine should be associated with.
 	Tags []string `yaml:"tags"`
+	// The remote file store to sync with. Defaults to BackendGoogleDrive.
+	Backend string `yaml:"backend,omitempty"`
+	// Name of the top-level folder in the remote file store. Defaults to "Lyncser-Root" for the default profile and
+	// "Lyncser-Root-<profile>" for other profiles.
+	RemoteRoot string `yaml:"remoteRoot,omitempty"`
+	// The id of the Google Drive shared drive to keep the remote root in. Empty for My Drive.
+	SharedDriveID string `yaml:"sharedDriveId,omitempty"`
+	// Files larger than this many MiB are uploaded in chunks of this size in resumable sessions. Defaults to 8.
+	UploadChunkSizeMiB int `yaml:"uploadChunkSizeMiB,omitempty"`
+	// The number of files synced at the same time. Defaults to DefaultParallelism.
+	Parallelism int `yaml:"parallelism,omitempty"`
+	// Limit the rate of uploads and downloads in KiB per second. 0 means no limit.
+	UploadLimitKiBps   int `yaml:"uploadLimitKiBps,omitempty"`
+	DownloadLimitKiBps int `yaml:"downloadLimitKiBps,omitempty"`
+	// The most MiB to upload and download in one sync. Files that would go over it are deferred to the next sync.
+	TransferCapMiB int `yaml:"transferCapMiB,omitempty"`
+	// Key is a path or a tag. Value is the largest file in MiB to transfer under that path or for that tag. Larger
+	// files are deferred.
+	MaxFileSizeMiB map[string]int `yaml:"maxFileSizeMiB,omitempty"`
+	// Whether to encrypt the Google Drive token with the lyncser key.
+	EncryptToken bool `yaml:"encryptToken,omitempty"`
+	// The number of days to keep the journal used to undo a sync. Defaults to 7.
+	JournalRetentionDays int `yaml:"journalRetentionDays,omitempty"`
 }
 
 type LocalStateData struct {
 	// Key is file path. Value is the state data associated with that file.
 	FileStateData map[string]*LocalFileStateData
+	// Key is file path. Value is the session of an upload that was interrupted, so that it can be resumed.
+	UploadSessions map[string]*filestore.UploadSession `json:",omitempty"`
 }
 
 type LocalFileStateData struct {
-	// The last time this file has been uploaded/downloaded from the cloud.
+	// The modified time of the file when it was last uploaded/downloaded from the cloud. Uploads and downloads keep
+	// the modified time, so after a sync both copies of the file have this modified time. It may be from another
+	// machine's clock, so it is only compared with the remote modified time.
 	LastCloudUpdate time.Time
+	// When the file was last uploaded/downloaded, by this machine's clock. The local modified time is compared with it
+	// to tell whether the file changed locally. Zero in state data saved by older versions of lyncser.
+	LastSynced time.Time
 	// Whether this file has been deleted locally.
 	DeletedLocal bool
 }
 
-// getGlobalConfig reads and parses the global config file. If it does not exist, it return an empty config object.
-func getGlobalConfig() (*GlobalConfig, error) {
-	fullConfigPath, err := utils.RealPath(globalConfigPath)
-	if err != nil {
-		return nil, err
+// lastSyncedAt returns LastSynced, or LastCloudUpdate if the state data is from before LastSynced was recorded.
+func (f *LocalFileStateData) lastSyncedAt() time.Time {
+	if f.LastSynced.IsZero() {
+		return f.LastCloudUpdate
 	}
+	return f.LastSynced
+}
+
+// GlobalConfig reads and parses the global config file. If it does not exist, it return an empty config object.
+func (c *ConfigFiles) GlobalConfig() (*GlobalConfig, error) {
+	fullConfigPath := c.GlobalConfigPath()
 	var config GlobalConfig
 	data, err := ioutil.ReadFile(fullConfigPath)
 	switch {
@@ -82,19 +232,19 @@ func getGlobalConfig() (*GlobalConfig, error) {
 	case err != nil:
 		return nil, err
 	default:
-		if err := yaml.Unmarshal(data, &config); err != nil {
-			return nil, err
+		if err := decodeConfigStrict(data, &config); err != nil {
+			return nil, &ConfigError{Path: fullConfigPath, Err: err}
 		}
 	}
+	if config.TagPaths == nil {
+		config.TagPaths = map[string][]string{}
+	}
 	return &config, nil
 }
 
-// getLocalConfig reads and parses the local config file. If it does not exist, it will create it.
-func getLocalConfig() (*LocalConfig, error) {
-	fullConfigPath, err := utils.RealPath(localConfigPath)
-	if err != nil {
-		return nil, err
-	}
+// LocalConfig reads and parses the local config file. If it does not exist, it will create it.
+func (c *ConfigFiles) LocalConfig() (*LocalConfig, error) {
+	fullConfigPath := c.LocalConfigPath()
 	data, err := ioutil.ReadFile(fullConfigPath)
 	if errors.Is(err, os.ErrNotExist) {
 		configDir := path.Dir(fullConfigPath)
@@ -102,53 +252,92 @@ func getLocalConfig() (*LocalConfig, error) {
 			return nil, err
 		}
 		data = []byte("tags:\n  - all\n")
-		err = os.WriteFile(fullConfigPath, data, 0o600)
+		err = utils.WriteFileAtomic(fullConfigPath, bytes.NewReader(data), 0o600)
 	}
 	if err != nil {
 		return nil, err
 	}
 	var config LocalConfig
-	if err := yaml.Unmarshal(data, &config); err != nil {
-		return nil, err
+	if err := decodeConfigStrict(data, &config); err != nil {
+		return nil, &ConfigError{Path: fullConfigPath, Err: err}
 	}
 	return &config, nil
 }
 
-// getLocalStateData reads and parses the state data file. If that file does not exist yet, this method will return
-// a newly initialized struct.
-func getLocalStateData() (*LocalStateData, error) {
-	var stateData LocalStateData
-	realpath, err := utils.RealPath(stateLocalFilePath)
+// decodeConfigStrict parses a YAML config file. Unlike yaml.Unmarshal, it returns an error for fields that the
+// config struct does not have so that typos are not silently ignored. Run `lyncser config validate` for the exact
+// location of each problem.
+func decodeConfigStrict(data []byte, config interface{}) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// LocalStateData reads and parses the state data file. If that file does not exist yet, this method will return
+// a newly initialized struct. If the state data file is corrupt, the backup made by the previous save is used
+// instead and recovered is true. If there is no backup either, an error wrapping ErrCorruptState is returned.
+func (c *ConfigFiles) LocalStateData() (stateData *LocalStateData, recovered bool, err error) {
+	stateData, err = readLocalStateData(c.stateLocalFilePath())
+	if !errors.Is(err, ErrCorruptState) {
+		return stateData, false, err
+	}
+	// A missing backup would be read as empty state data, which would throw away the record of every synced file.
+	backupExists, backupErr := utils.PathExists(c.stateLocalBackupFilePath())
+	if backupErr != nil || !backupExists {
+		return nil, false, err
+	}
+	backupStateData, backupErr := readLocalStateData(c.stateLocalBackupFilePath())
+	if backupErr != nil {
+		return nil, false, err
+	}
+	return backupStateData, true, nil
+}
+
+// readLocalStateData reads and parses a state data file. If the file does not exist, it returns a newly initialized
+// struct. If the file can't be parsed, it returns an error wrapping ErrCorruptState.
+func readLocalStateData(fullPath string) (*LocalStateData, error) {
+	stateData := LocalStateData{
+		FileStateData: map[string]*LocalFileStateData{},
+	}
+	data, err := ioutil.ReadFile(fullPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return &stateData, nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	data, err := ioutil.ReadFile(realpath)
-	if errors.Is(err, os.ErrNotExist) {
-		stateData = LocalStateData{
-			FileStateData: map[string]*LocalFileStateData{},
-		}
-	} else {
-		if err != nil {
-			return nil, err
-		}
-		if err := json.Unmarshal(data, &stateData); err != nil {
-			return nil, err
-		}
+	if err := json.Unmarshal(data, &stateData); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrCorruptState, fullPath, err)
+	}
+	if stateData.FileStateData == nil {
+		stateData.FileStateData = map[string]*LocalFileStateData{}
 	}
 	return &stateData, nil
 }
 
-// saveLocalStateData will save the state data to disk.
-func saveLocalStateData(stateData *LocalStateData) error {
+// SaveLocalStateData will save the state data to disk. The previous state data is kept as a backup in case the new
+// file is corrupted.
+func (c *ConfigFiles) SaveLocalStateData(stateData *LocalStateData) error {
 	data, err := json.MarshalIndent(stateData, "", " ")
 	if err != nil {
 		return err
 	}
-	realpath, err := utils.RealPath(stateLocalFilePath)
-	if err != nil {
+	previousData, err := ioutil.ReadFile(c.stateLocalFilePath())
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
 		return err
+	case json.Valid(previousData):
+		// A corrupt state file is never backed up so that it can't replace a good backup.
+		err = utils.WriteFileAtomic(c.stateLocalBackupFilePath(), bytes.NewReader(previousData), 0o600)
+		if err != nil {
+			return err
+		}
 	}
-	return ioutil.WriteFile(realpath, data, 0o600)
+	return utils.WriteFileAtomic(c.stateLocalFilePath(), bytes.NewReader(data), 0o600)
 }
 
 // getRemoteStateData returns the state data that is stored remotely.
@@ -179,21 +368,41 @@ func getRemoteStateData(remoteFileStore filestore.FileStore) (*RemoteStateData,
 	return stateData, nil
 }
 
-func saveRemoteStateData(stateData *RemoteStateData, remoteFileStore filestore.FileStore) error {
+func saveRemoteStateData(stateData *RemoteStateData, remoteFileStore filestore.FileStore, modTime time.Time) error {
 	data, err := json.MarshalIndent(stateData, "", " ")
 	if err != nil {
 		return err
 	}
 	reader := bytes.NewReader(data)
-	return remoteFileStore.WriteFileContents(stateRemoteFilePath, reader)
+	return remoteFileStore.WriteFileContents(stateRemoteFilePath, reader, &filestore.FileMetadata{
+		ModTime: modTime.UTC(),
+	})
 }
 
-func GetEncryptionKey() ([]byte, error) {
-	keyBytes := make([]byte, keyLengthBits/8)
-	fullEncryptionKeyPath, err := utils.RealPath(encryptionKeyPath)
+// MachineID returns the ID of this machine. A new ID is generated if there isn't one yet.
+func (c *ConfigFiles) MachineID() (string, error) {
+	machineIDPath := filepath.Join(c.Dir, machineIDFileName)
+	data, err := ioutil.ReadFile(machineIDPath)
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	machineID, err := utils.GenerateRandomHexString(16)
 	if err != nil {
-		return keyBytes, err
+		return "", err
 	}
+	if err := os.MkdirAll(c.Dir, 0o700); err != nil {
+		return "", err
+	}
+	return machineID, utils.WriteFileAtomic(machineIDPath, strings.NewReader(machineID), 0o600)
+}
+
+// GetEncryptionKey returns the key used to encrypt files. A new key is generated if there isn't one yet.
+func (c *ConfigFiles) GetEncryptionKey() ([]byte, error) {
+	keyBytes := make([]byte, keyLengthBits/8)
+	fullEncryptionKeyPath := c.EncryptionKeyPath()
 	var keyHex string
 	keyFileBytes, err := ioutil.ReadFile(fullEncryptionKeyPath)
 	if errors.Is(err, os.ErrNotExist) {
@@ -202,7 +411,10 @@ func GetEncryptionKey() ([]byte, error) {
 			return keyBytes, err
 		}
 		keyHex = hex.EncodeToString(keyBytes)
-		err = os.WriteFile(fullEncryptionKeyPath, []byte(keyHex), 0o600)
+		if err := os.MkdirAll(c.Dir, 0o700); err != nil {
+			return keyBytes, err
+		}
+		err = utils.WriteFileAtomic(fullEncryptionKeyPath, strings.NewReader(keyHex), 0o600)
 	} else if err == nil {
 		keyHex = string(keyFileBytes)
 	}
@@ -212,3 +424,81 @@ func GetEncryptionKey() ([]byte, error) {
 	keyBytes, err = hex.DecodeString(strings.TrimSpace(keyHex))
 	return keyBytes, err
 }
+
+// GlobalConfigPath returns the real path of the global config file.
+func (c *ConfigFiles) GlobalConfigPath() string {
+	return filepath.Join(c.Dir, globalConfigFileName)
+}
+
+// LocalConfigPath returns the real path of the local config file.
+func (c *ConfigFiles) LocalConfigPath() string {
+	return filepath.Join(c.Dir, localConfigFileName)
+}
+
+// EncryptionKeyPath returns the real path of the encryption key file.
+func (c *ConfigFiles) EncryptionKeyPath() string {
+	return filepath.Join(c.Dir, encryptionKeyFileName)
+}
+
+func (c *ConfigFiles) stateLocalFilePath() string {
+	return filepath.Join(c.Dir, stateLocalFileName)
+}
+
+func (c *ConfigFiles) stateLocalBackupFilePath() string {
+	return c.stateLocalFilePath() + ".bak"
+}
+
+// settings returns the local config for the getters of the settings that don't change while lyncser runs. It is only
+// parsed once. Unlike the tags, which are edited by lyncser itself, these settings are only read.
+func (c *ConfigFiles) settings() (*LocalConfig, error) {
+	c.settingsOnce.Do(func() {
+		c.settingsCache, c.settingsErr = c.LocalConfig()
+	})
+	return c.settingsCache, c.settingsErr
+}
+
+// GetBackend returns the remote file store to sync with and the name of its top-level folder.
+func (c *ConfigFiles) GetBackend() (backend, remoteRoot string, err error) {
+	localConfig, err := c.settings()
+	if err != nil {
+		return "", "", err
+	}
+	backend, remoteRoot = localConfig.Backend, localConfig.RemoteRoot
+	if backend == "" {
+		backend = BackendGoogleDrive
+	}
+	if remoteRoot == "" {
+		remoteRoot = defaultRemoteRoot
+		if c.Profile != "" && c.Profile != utils.DefaultProfile {
+			remoteRoot += "-" + c.Profile
+		}
+	}
+	return backend, remoteRoot, nil
+}
+
+// GetSharedDriveID returns the id of the shared drive to keep the remote root in, or "" for My Drive.
+func (c *ConfigFiles) GetSharedDriveID() (string, error) {
+	localConfig, err := c.settings()
+	if err != nil {
+		return "", err
+	}
+	return localConfig.SharedDriveID, nil
+}
+
+// GetEncryptToken returns whether the Google Drive token should be encrypted with the lyncser key.
+func (c *ConfigFiles) GetEncryptToken() (bool, error) {
+	localConfig, err := c.settings()
+	if err != nil {
+		return false, err
+	}
+	return localConfig.EncryptToken, nil
+}
+
+// GetUploadChunkSize returns the configured upload chunk size in bytes, or 0 if it is not configured.
+func (c *ConfigFiles) GetUploadChunkSize() (int64, error) {
+	localConfig, err := c.settings()
+	if err != nil {
+		return 0, err
+	}
+	return int64(localConfig.UploadChunkSizeMiB) << 20, nil
+}
@@ -0,0 +1,344 @@
+package sync
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+
+	"github.com/ristomcgehee/lyncser/utils"
+)
+
+var (
+	ErrPathNotFound       = errors.New("path not found")
+	ErrPathAlreadyCovered = errors.New("path is already covered by an entry in the global config")
+	ErrPathCoversEntry    = errors.New("path contains an entry that is already in the global config")
+	ErrNotInGlobalConfig  = errors.New("path is not in the global config")
+	ErrTagAlreadyAdded    = errors.New("this machine already has that tag")
+	ErrTagNotAdded        = errors.New("this machine does not have that tag")
+	ErrAlreadyPinned      = errors.New("path is already pinned")
+	ErrNotPinned          = errors.New("path is not pinned")
+	ErrNotAMapping        = errors.New("the top level of the config file is not a mapping")
+)
+
+// SyncGlobalConfig uploads or downloads the global config in the same way PerformSync does, without syncing any
+// other files. It takes the same locks as a sync.
+func (s *Syncer) SyncGlobalConfig() (HandleFileOutcome, error) {
+	unlock, err := s.Config.Lock()
+	if err != nil {
+		return NoChange, err
+	}
+	defer unlock()
+	defer func() {
+		if err := s.releaseRemoteLock(); err != nil {
+			s.Logger.Warnf("Unable to release the remote lock: %v", err)
+		}
+	}()
+	err = s.loadLocalStateData()
+	if err != nil {
+		return NoChange, err
+	}
+	if _, err = s.RemoteFileStore.GetFiles(); err != nil {
+		return NoChange, err
+	}
+	if err = s.acquireRemoteLock(); err != nil {
+		return NoChange, err
+	}
+	handleFileOutcome, err := s.handleSyncedFile(s.globalConfigFile(), s.Logger)
+	if err != nil {
+		return handleFileOutcome, err
+	}
+	return handleFileOutcome, s.Config.SaveLocalStateData(s.stateData)
+}
+
+// GetTagPaths returns the paths to sync for each tag in the global config.
+func (c *ConfigFiles) GetTagPaths() (map[string][]string, error) {
+	globalConfig, err := c.GlobalConfig()
+	if err != nil {
+		return nil, err
+	}
+	return globalConfig.TagPaths, nil
+}
+
+// AddPath adds pathToAdd to the global config under tag. pathToAdd may be a real path or a friendly path. It must
+// exist, must not already be covered by another entry and must not contain one. Returns the friendly path that was
+// added.
+func (c *ConfigFiles) AddPath(pathToAdd, tag string) (string, error) {
+	friendlyPath, err := utils.FriendlyPath(pathToAdd)
+	if err != nil {
+		return "", err
+	}
+	realPath, err := utils.RealPath(friendlyPath)
+	if err != nil {
+		return "", err
+	}
+	exists, err := utils.PathExists(realPath)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", fmt.Errorf("%w: %s", ErrPathNotFound, realPath)
+	}
+
+	return friendlyPath, c.editGlobalConfig(func(pathsNode *yaml.Node) error {
+		for i := 1; i < len(pathsNode.Content); i += 2 {
+			for _, pathNode := range pathsNode.Content[i].Content {
+				if pathCovers(pathNode.Value, friendlyPath) {
+					return fmt.Errorf("%w: '%s' under tag '%s'", ErrPathAlreadyCovered, pathNode.Value,
+						pathsNode.Content[i-1].Value)
+				}
+				if pathCovers(friendlyPath, pathNode.Value) {
+					return fmt.Errorf("%w: '%s' under tag '%s'", ErrPathCoversEntry, pathNode.Value,
+						pathsNode.Content[i-1].Value)
+				}
+			}
+		}
+		tagNode := getMappingValue(pathsNode, tag)
+		switch {
+		case tagNode == nil:
+			tagNode = &yaml.Node{Kind: yaml.SequenceNode}
+			pathsNode.Content = append(pathsNode.Content, newScalarNode(tag, 0), tagNode)
+		case tagNode.Kind != yaml.SequenceNode:
+			// The tag has no paths yet, e.g. "work_machines:" with nothing after it.
+			*tagNode = yaml.Node{Kind: yaml.SequenceNode}
+		}
+		tagNode.Content = append(tagNode.Content, newScalarNode(friendlyPath, yaml.DoubleQuotedStyle))
+		return nil
+	})
+}
+
+// RemovePath removes pathToRemove from the global config. If tag is empty, it is removed from every tag. Returns
+// the tags it was removed from.
+func (c *ConfigFiles) RemovePath(pathToRemove, tag string) ([]string, error) {
+	friendlyPath, err := utils.FriendlyPath(pathToRemove)
+	if err != nil {
+		return nil, err
+	}
+	removedFrom := make([]string, 0)
+	err = c.editGlobalConfig(func(pathsNode *yaml.Node) error {
+		for i := 1; i < len(pathsNode.Content); i += 2 {
+			tagName := pathsNode.Content[i-1].Value
+			if tag != "" && tagName != tag {
+				continue
+			}
+			tagNode := pathsNode.Content[i]
+			if tagNode.Kind != yaml.SequenceNode {
+				continue
+			}
+			kept := make([]*yaml.Node, 0, len(tagNode.Content))
+			for _, pathNode := range tagNode.Content {
+				if pathNode.Value == friendlyPath || pathNode.Value == pathToRemove {
+					removedFrom = append(removedFrom, tagName)
+					continue
+				}
+				kept = append(kept, pathNode)
+			}
+			tagNode.Content = kept
+		}
+		if len(removedFrom) == 0 {
+			return fmt.Errorf("%w: %s", ErrNotInGlobalConfig, friendlyPath)
+		}
+		return nil
+	})
+	return removedFrom, err
+}
+
+// PinPath adds pathToPin to the pinned paths in the global config so that it is never deleted remotely. pathToPin may
+// be a real path or a friendly path, and does not need to exist locally. Returns the friendly path that was pinned.
+func (c *ConfigFiles) PinPath(pathToPin string) (string, error) {
+	friendlyPath, err := utils.FriendlyPath(pathToPin)
+	if err != nil {
+		return "", err
+	}
+	return friendlyPath, c.editGlobalConfigKey("pinned", yaml.SequenceNode, func(pinnedNode *yaml.Node) error {
+		for _, pathNode := range pinnedNode.Content {
+			if pathCovers(pathNode.Value, friendlyPath) {
+				return fmt.Errorf("%w: '%s'", ErrAlreadyPinned, pathNode.Value)
+			}
+		}
+		pinnedNode.Content = append(pinnedNode.Content, newScalarNode(friendlyPath, yaml.DoubleQuotedStyle))
+		return nil
+	})
+}
+
+// UnpinPath removes pathToUnpin from the pinned paths in the global config.
+func (c *ConfigFiles) UnpinPath(pathToUnpin string) (string, error) {
+	friendlyPath, err := utils.FriendlyPath(pathToUnpin)
+	if err != nil {
+		return "", err
+	}
+	return friendlyPath, c.editGlobalConfigKey("pinned", yaml.SequenceNode, func(pinnedNode *yaml.Node) error {
+		for i, pathNode := range pinnedNode.Content {
+			if pathNode.Value == friendlyPath || pathNode.Value == pathToUnpin {
+				pinnedNode.Content = append(pinnedNode.Content[:i], pinnedNode.Content[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s", ErrNotPinned, friendlyPath)
+	})
+}
+
+// AddLocalTag associates this machine with tag.
+func (c *ConfigFiles) AddLocalTag(tag string) error {
+	return c.editLocalConfig(func(tagsNode *yaml.Node) error {
+		for _, tagNode := range tagsNode.Content {
+			if tagNode.Value == tag {
+				return fmt.Errorf("%w: %s", ErrTagAlreadyAdded, tag)
+			}
+		}
+		tagsNode.Content = append(tagsNode.Content, newScalarNode(tag, 0))
+		return nil
+	})
+}
+
+// RemoveLocalTag removes tag from this machine.
+func (c *ConfigFiles) RemoveLocalTag(tag string) error {
+	return c.editLocalConfig(func(tagsNode *yaml.Node) error {
+		for i, tagNode := range tagsNode.Content {
+			if tagNode.Value == tag {
+				tagsNode.Content = append(tagsNode.Content[:i], tagsNode.Content[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s", ErrTagNotAdded, tag)
+	})
+}
+
+// SaveLocalTags sets the tags this machine is associated with.
+func (c *ConfigFiles) SaveLocalTags(tags []string) error {
+	return c.editLocalConfig(func(tagsNode *yaml.Node) error {
+		tagsNode.Content = make([]*yaml.Node, 0, len(tags))
+		for _, tag := range tags {
+			tagsNode.Content = append(tagsNode.Content, newScalarNode(tag, 0))
+		}
+		return nil
+	})
+}
+
+// GetGlobalTags returns the tags defined in the global config, sorted by name.
+func (c *ConfigFiles) GetGlobalTags() ([]string, error) {
+	globalConfig, err := c.GlobalConfig()
+	if err != nil {
+		return nil, err
+	}
+	tags := make([]string, 0, len(globalConfig.TagPaths))
+	for tag := range globalConfig.TagPaths {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// pathCovers returns true if coveringPath is the same as friendlyPath or is a directory containing it.
+func pathCovers(coveringPath, friendlyPath string) bool {
+	coveringPath = strings.TrimSuffix(coveringPath, "/")
+	friendlyPath = strings.TrimSuffix(friendlyPath, "/")
+	return coveringPath == friendlyPath || strings.HasPrefix(friendlyPath, coveringPath+"/")
+}
+
+// editGlobalConfig calls edit with the "paths" mapping node of the global config, then saves the global config.
+// Comments and ordering in the file are preserved.
+func (c *ConfigFiles) editGlobalConfig(edit func(pathsNode *yaml.Node) error) error {
+	return c.editGlobalConfigKey("paths", yaml.MappingNode, edit)
+}
+
+// editGlobalConfigKey calls edit with the value of a top-level key in the global config, then saves the global config.
+// It holds the config lock so that a sync can't replace the global config in the meantime.
+func (c *ConfigFiles) editGlobalConfigKey(key string, kind yaml.Kind, edit func(node *yaml.Node) error) error {
+	unlock, err := c.Lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return editYAMLFile(c.GlobalConfigPath(), key, kind, edit)
+}
+
+// editLocalConfig calls edit with the "tags" sequence node of the local config, then saves the local config.
+// Comments and ordering in the file are preserved. Like editGlobalConfigKey, it holds the config lock.
+func (c *ConfigFiles) editLocalConfig(edit func(tagsNode *yaml.Node) error) error {
+	unlock, err := c.Lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if _, err := c.LocalConfig(); err != nil { // Creates the local config if it doesn't exist yet.
+		return err
+	}
+	return editYAMLFile(c.LocalConfigPath(), "tags", yaml.SequenceNode, edit)
+}
+
+// editYAMLFile reads the YAML file at fullPath and calls edit with the value of the top-level key, creating it if
+// necessary. The file is written back if edit does not return an error.
+func editYAMLFile(fullPath, key string, kind yaml.Kind, edit func(node *yaml.Node) error) error {
+	data, err := os.ReadFile(fullPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if doc.Kind == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	root := doc.Content[0]
+	if root.Kind == yaml.ScalarNode && root.Tag == "!!null" {
+		// The document is empty apart from comments or a "---" marker.
+		*root = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", HeadComment: root.HeadComment,
+			LineComment: root.LineComment, FootComment: root.FootComment}
+	}
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("%w: %s", ErrNotAMapping, fullPath)
+	}
+	node := getMappingValue(root, key)
+	if node == nil || node.Kind != kind {
+		newNode := &yaml.Node{Kind: kind}
+		if node == nil {
+			root.Content = append(root.Content, newScalarNode(key, 0), newNode)
+		} else {
+			*node = *newNode
+		}
+		node = getMappingValue(root, key)
+	}
+	if err := edit(node); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(fullPath), 0o700); err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(fullPath, &buf, 0o600)
+}
+
+// getMappingValue returns the value for key in a mapping node, or nil if the key is not present.
+func getMappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 1; i < len(mapping.Content); i += 2 {
+		if mapping.Content[i-1].Value == key {
+			return mapping.Content[i]
+		}
+	}
+	return nil
+}
+
+func newScalarNode(value string, style yaml.Style) *yaml.Node {
+	return &yaml.Node{
+		Kind:  yaml.ScalarNode,
+		Tag:   "!!str",
+		Value: value,
+		Style: style,
+	}
+}
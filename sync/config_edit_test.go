@@ -0,0 +1,193 @@
+package sync
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+//nolint:paralleltest // Sets HOME.
+func TestConfigEdits(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	for _, dir := range []string{"notes", "code", "photos/2021"} {
+		if err := os.MkdirAll(filepath.Join(home, dir), 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name string
+		// The file in testdata/config_edit that is edited, and the one that is expected afterwards. An empty golden
+		// file means the edit must leave the file unchanged.
+		input  string
+		golden string
+		edit   func(c *ConfigFiles) error
+		err    error
+	}{
+		{
+			name:   "add path to a tag with no paths",
+			input:  "global.yaml",
+			golden: "add_path_empty_tag.golden",
+			edit: func(c *ConfigFiles) error {
+				_, err := c.AddPath(filepath.Join(home, "code"), "work")
+				return err
+			},
+		},
+		{
+			name:   "add path to a new tag",
+			input:  "global.yaml",
+			golden: "add_path_new_tag.golden",
+			edit: func(c *ConfigFiles) error {
+				_, err := c.AddPath("~/code", "laptop")
+				return err
+			},
+		},
+		{
+			name:  "add path covered by another entry",
+			input: "global.yaml",
+			edit: func(c *ConfigFiles) error {
+				_, err := c.AddPath("~/photos/2021", "work")
+				return err
+			},
+			err: ErrPathAlreadyCovered,
+		},
+		{
+			name:  "add path containing another entry",
+			input: "global.yaml",
+			edit: func(c *ConfigFiles) error {
+				_, err := c.AddPath("~", "work")
+				return err
+			},
+			err: ErrPathCoversEntry,
+		},
+		{
+			name:   "add path to a config with only a document marker",
+			input:  "empty_document.yaml",
+			golden: "add_path_empty_document.golden",
+			edit: func(c *ConfigFiles) error {
+				_, err := c.AddPath("~/code", "work")
+				return err
+			},
+		},
+		{
+			name:  "add path to a config that is not a mapping",
+			input: "not_a_mapping.yaml",
+			edit: func(c *ConfigFiles) error {
+				_, err := c.AddPath("~/code", "work")
+				return err
+			},
+			err: ErrNotAMapping,
+		},
+		{
+			name:   "remove friendly path given as a real path",
+			input:  "global.yaml",
+			golden: "remove_path_friendly.golden",
+			edit: func(c *ConfigFiles) error {
+				_, err := c.RemovePath(filepath.Join(home, "notes"), "")
+				return err
+			},
+		},
+		{
+			name:   "remove real path",
+			input:  "global.yaml",
+			golden: "remove_path_real.golden",
+			edit: func(c *ConfigFiles) error {
+				_, err := c.RemovePath("/etc/hosts", "all")
+				return err
+			},
+		},
+		{
+			name:  "remove path that is not in the global config",
+			input: "global.yaml",
+			edit: func(c *ConfigFiles) error {
+				_, err := c.RemovePath("~/code", "")
+				return err
+			},
+			err: ErrNotInGlobalConfig,
+		},
+		{
+			name:   "pin path",
+			input:  "global.yaml",
+			golden: "pin_path.golden",
+			edit: func(c *ConfigFiles) error {
+				_, err := c.PinPath("~/photos")
+				return err
+			},
+		},
+		{
+			name:   "add local tag",
+			input:  "local.yaml",
+			golden: "add_local_tag.golden",
+			edit: func(c *ConfigFiles) error {
+				return c.AddLocalTag("work")
+			},
+		},
+		{
+			name:  "add local tag twice",
+			input: "local.yaml",
+			edit: func(c *ConfigFiles) error {
+				return c.AddLocalTag("home")
+			},
+			err: ErrTagAlreadyAdded,
+		},
+	}
+
+	for _, test := range tests {
+		configFiles := &ConfigFiles{Dir: t.TempDir()}
+		input, err := os.ReadFile(filepath.Join("testdata", "config_edit", test.input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		editedPath := configFiles.GlobalConfigPath()
+		if test.input == "local.yaml" {
+			editedPath = configFiles.LocalConfigPath()
+		}
+		if err := os.WriteFile(editedPath, input, 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := test.edit(configFiles); !errors.Is(err, test.err) {
+			t.Errorf("%s: expected error %v, got %v", test.name, test.err, err)
+			continue
+		}
+		edited, err := os.ReadFile(editedPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := input
+		if test.golden != "" {
+			goldenPath := filepath.Join("testdata", "config_edit", test.golden)
+			if *updateGolden {
+				if err := os.WriteFile(goldenPath, edited, 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if expected, err = os.ReadFile(goldenPath); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if string(edited) != string(expected) {
+			t.Errorf("%s: expected\n%s\ngot\n%s", test.name, expected, edited)
+		}
+	}
+}
+
+func TestConfigEditWaitsForSync(t *testing.T) {
+	t.Parallel()
+	configFiles := &ConfigFiles{Dir: t.TempDir()}
+	unlock, err := configFiles.Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	if _, err := configFiles.PinPath("~/archive"); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected the edit to fail while a sync holds the lock, got %v", err)
+	}
+	if err := configFiles.AddLocalTag("work"); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected the edit to fail while a sync holds the lock, got %v", err)
+	}
+}
@@ -0,0 +1,207 @@
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ristomcgehee/lyncser/filestore"
+)
+
+func TestLocalStateDataBackup(t *testing.T) {
+	t.Parallel()
+	configFiles := &ConfigFiles{Dir: t.TempDir()}
+	lastCloudUpdate := time.Date(2021, 10, 1, 7, 0, 0, 0, time.UTC)
+	stateData := &LocalStateData{
+		FileStateData: map[string]*LocalFileStateData{
+			"~/.bashrc": {LastCloudUpdate: lastCloudUpdate},
+		},
+	}
+	if err := configFiles.SaveLocalStateData(stateData); err != nil {
+		t.Fatal(err)
+	}
+	// The second save backs up the first.
+	if err := configFiles.SaveLocalStateData(stateData); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(configFiles.stateLocalFilePath(), []byte(`{"FileStateData": {`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, recovered, err := configFiles.LocalStateData()
+	if err != nil {
+		t.Fatalf("LocalStateData() error = %v", err)
+	}
+	if !recovered {
+		t.Error("LocalStateData() did not report recovering from the backup")
+	}
+	fileStateData, ok := loaded.FileStateData["~/.bashrc"]
+	if !ok || !fileStateData.LastCloudUpdate.Equal(lastCloudUpdate) {
+		t.Errorf("LocalStateData() = %+v, want the backed up state", loaded.FileStateData)
+	}
+}
+
+func TestCorruptLocalStateDataWithoutBackup(t *testing.T) {
+	t.Parallel()
+	configFiles := &ConfigFiles{Dir: t.TempDir()}
+	if err := os.WriteFile(configFiles.stateLocalFilePath(), []byte(`{"FileStateData": {`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if stateData, _, err := configFiles.LocalStateData(); !errors.Is(err, ErrCorruptState) {
+		t.Errorf("LocalStateData() = %+v, %v, want %v", stateData, err, ErrCorruptState)
+	}
+}
+
+func TestLocalConfigSettingsAreParsedOnce(t *testing.T) {
+	t.Parallel()
+	configFiles := &ConfigFiles{Dir: t.TempDir(), Profile: "work"}
+	localConfig := "tags:\n  - all\nsharedDriveId: drive1\nencryptToken: true\nuploadChunkSizeMiB: 16\n"
+	if err := os.WriteFile(configFiles.LocalConfigPath(), []byte(localConfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if backend, remoteRoot, err := configFiles.GetBackend(); err != nil || backend != BackendGoogleDrive ||
+		remoteRoot != defaultRemoteRoot+"-work" {
+		t.Fatalf("GetBackend() = %s, %s, %v", backend, remoteRoot, err)
+	}
+	// Changes to the file after the first read are not seen, and an invalid file isn't parsed again.
+	if err := os.WriteFile(configFiles.LocalConfigPath(), []byte("unknownKey: true\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if sharedDriveID, err := configFiles.GetSharedDriveID(); err != nil || sharedDriveID != "drive1" {
+		t.Errorf("GetSharedDriveID() = %s, %v", sharedDriveID, err)
+	}
+	if encryptToken, err := configFiles.GetEncryptToken(); err != nil || !encryptToken {
+		t.Errorf("GetEncryptToken() = %v, %v", encryptToken, err)
+	}
+	if chunkSize, err := configFiles.GetUploadChunkSize(); err != nil || chunkSize != 16<<20 {
+		t.Errorf("GetUploadChunkSize() = %d, %v", chunkSize, err)
+	}
+}
+
+func TestJournalRoundTrip(t *testing.T) {
+	t.Parallel()
+	configFiles := &ConfigFiles{Dir: t.TempDir()}
+	runID := newRunID(time.Date(2021, 10, 1, 7, 0, 0, 0, time.UTC))
+	entry := &JournalEntry{
+		Path:     "~/.bashrc",
+		Side:     JournalLocal,
+		Metadata: &filestore.FileMetadata{Mode: 0o644},
+	}
+	if err := configFiles.SaveJournalEntry(runID, entry, strings.NewReader("previous")); err != nil {
+		t.Fatal(err)
+	}
+
+	runIDs, err := configFiles.JournalRuns()
+	if err != nil || len(runIDs) != 1 || runIDs[0] != runID {
+		t.Fatalf("JournalRuns() = %v, %v, want [%s]", runIDs, err, runID)
+	}
+	entries, err := configFiles.JournalEntries(runID)
+	if err != nil || len(entries) != 1 || entries[0].Path != entry.Path || entries[0].Metadata.Mode != 0o644 {
+		t.Fatalf("JournalEntries() = %v, %v, want the saved entry", entries, err)
+	}
+	reader, err := configFiles.JournalContents(runID, entries[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if contents, err := io.ReadAll(reader); err != nil || string(contents) != "previous" {
+		t.Errorf("JournalContents() = %q, %v, want \"previous\"", contents, err)
+	}
+
+	if err := configFiles.DeleteJournalRun(runID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := configFiles.JournalEntries(runID); !errors.Is(err, ErrRunNotFound) {
+		t.Errorf("JournalEntries() after DeleteJournalRun error = %v, want ErrRunNotFound", err)
+	}
+	if _, err := configFiles.JournalEntries("../state.json"); !errors.Is(err, ErrRunNotFound) {
+		t.Errorf("JournalEntries() of an invalid run ID error = %v, want ErrRunNotFound", err)
+	}
+}
+
+func TestLastRunID(t *testing.T) {
+	t.Parallel()
+	configFiles := &ConfigFiles{Dir: t.TempDir()}
+	if _, err := LastRunID(configFiles); !errors.Is(err, ErrNothingToUndo) {
+		t.Errorf("LastRunID() before any sync error = %v, want ErrNothingToUndo", err)
+	}
+	changed := newRunID(time.Date(2021, 10, 1, 7, 0, 0, 0, time.UTC))
+	unchanged := newRunID(time.Date(2021, 10, 1, 8, 0, 0, 0, time.UTC))
+	entry := &JournalEntry{Path: "~/.bashrc", Side: JournalLocal, Created: true}
+	if err := configFiles.SaveJournalEntry(changed, entry, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := configFiles.SaveSyncReport(&SyncReport{RunID: changed}); err != nil {
+		t.Fatal(err)
+	}
+	if runID, err := LastRunID(configFiles); err != nil || runID != changed {
+		t.Errorf("LastRunID() = %s, %v, want %s", runID, err, changed)
+	}
+
+	// A later sync that changed nothing is not skipped in favor of the earlier one.
+	if err := configFiles.SaveSyncReport(&SyncReport{RunID: unchanged}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LastRunID(configFiles); !errors.Is(err, ErrNothingToUndo) || !strings.Contains(err.Error(), unchanged) {
+		t.Errorf("LastRunID() after a sync that changed nothing error = %v, want ErrNothingToUndo", err)
+	}
+}
+
+func TestSyncReportRotation(t *testing.T) {
+	t.Parallel()
+	configFiles := &ConfigFiles{Dir: t.TempDir()}
+	reportPath := configFiles.SyncReportPath()
+	report := &SyncReport{RunID: newRunID(time.Date(2021, 10, 1, 7, 0, 0, 0, time.UTC))}
+	line, err := json.Marshal(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line = append(line, '\n')
+	for i := 1; i <= maxSyncReportBackups; i++ {
+		if err := os.WriteFile(fmt.Sprintf("%s.%d", reportPath, i), []byte(strconv.Itoa(i)), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The report file is only rotated once the next report would make it larger than the limit.
+	earlierReports := strings.Repeat("x", maxSyncReportFileSize-len(line)-1) + "\n"
+	if err := os.WriteFile(reportPath, []byte(earlierReports), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := configFiles.SaveSyncReport(report); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(reportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != maxSyncReportFileSize {
+		t.Fatalf("report file is %d bytes, want it to be filled to the limit of %d without rotating", len(data),
+			maxSyncReportFileSize)
+	}
+
+	if err := configFiles.SaveSyncReport(report); err != nil {
+		t.Fatal(err)
+	}
+	if data, err = os.ReadFile(reportPath); err != nil || string(data) != string(line) {
+		t.Errorf("report file after rotation = %q, %v, want only the new report", data, err)
+	}
+	if data, err = os.ReadFile(reportPath + ".1"); err != nil || len(data) != maxSyncReportFileSize {
+		t.Errorf("first backup is %d bytes, %v, want the full report file", len(data), err)
+	}
+	// Every backup moves up by one, and the oldest is removed.
+	for i := 2; i <= maxSyncReportBackups; i++ {
+		data, err := os.ReadFile(fmt.Sprintf("%s.%d", reportPath, i))
+		if err != nil || string(data) != strconv.Itoa(i-1) {
+			t.Errorf("backup %d = %q, %v, want backup %d", i, data, err, i-1)
+		}
+	}
+	if _, err := os.Stat(fmt.Sprintf("%s.%d", reportPath, maxSyncReportBackups+1)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the oldest backup to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package sync
+
+import (
+	"io/ioutil"
+	"sort"
+)
+
+type FileDiff struct {
+	// The friendly path of the file, e.g. "~/.bashrc".
+	Path         string
+	LocalExists  bool
+	RemoteExists bool
+	// The local contents of the file. Nil if it does not exist locally.
+	LocalContents []byte
+	// The decrypted remote contents of the file. Nil if it does not exist remotely.
+	RemoteContents []byte
+}
+
+// GetFileDiffs returns the local and decrypted remote contents of every synced file under pathToDiff. pathToDiff may
+// be either a friendly path or a real path, and may be a directory.
+func (s *Syncer) GetFileDiffs(pathToDiff string) ([]*FileDiff, error) {
+	globalConfig, err := s.Config.GlobalConfig()
+	if err != nil {
+		return nil, err
+	}
+	remoteFiles, err := s.RemoteFileStore.GetFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	filesToDiff := map[string]SyncedFile{}
+	if globalConfigFile := s.globalConfigFile(); matchesFilterPaths(globalConfigFile, []string{pathToDiff}) {
+		filesToDiff[globalConfigPath] = globalConfigFile
+	}
+	for _, paths := range globalConfig.TagPaths {
+		for _, pathToSync := range paths {
+			filesToSync, err := s.getFilesToSync(pathToSync, remoteFiles)
+			if err != nil {
+				return nil, err
+			}
+			for _, storedFile := range filesToSync {
+				if storedFile.IsDir {
+					continue
+				}
+				file, err := newSyncedFile(storedFile.Path, false)
+				if err != nil {
+					return nil, err
+				}
+				if matchesFilterPaths(file, []string{pathToDiff}) {
+					filesToDiff[file.FriendlyPath] = file
+				}
+			}
+		}
+	}
+
+	diffs := make([]*FileDiff, 0, len(filesToDiff))
+	for _, file := range filesToDiff {
+		diff, err := s.getFileDiff(file)
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, diff)
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].Path < diffs[j].Path
+	})
+	return diffs, nil
+}
+
+// getFileDiff reads the local contents and downloads and decrypts the remote contents of a single file.
+func (s *Syncer) getFileDiff(file SyncedFile) (*FileDiff, error) {
+	var err error
+	diff := &FileDiff{
+		Path: file.FriendlyPath,
+	}
+	if diff.LocalExists, err = s.LocalFileStore.FileExists(file.RealPath); err != nil {
+		return nil, err
+	}
+	if diff.LocalExists {
+		if diff.LocalContents, err = s.readLocalFile(file); err != nil {
+			return nil, err
+		}
+	}
+	if diff.RemoteExists, err = s.RemoteFileStore.FileExists(file.FriendlyPath); err != nil {
+		return nil, err
+	}
+	if diff.RemoteExists {
+		if diff.RemoteContents, err = s.readRemoteFile(file); err != nil {
+			return nil, err
+		}
+	}
+	return diff, nil
+}
+
+func (s *Syncer) readLocalFile(file SyncedFile) ([]byte, error) {
+	contentReader, err := s.LocalFileStore.GetFileContents(file.RealPath)
+	if err != nil {
+		return nil, err
+	}
+	defer contentReader.Close()
+	return ioutil.ReadAll(contentReader)
+}
+
+func (s *Syncer) readRemoteFile(file SyncedFile) ([]byte, error) {
+	contentReader, err := s.RemoteFileStore.GetFileContents(file.FriendlyPath)
+	if err != nil {
+		return nil, err
+	}
+	defer contentReader.Close()
+	decryptedReader, err := s.Encryptor.DecryptReader(contentReader)
+	if err != nil {
+		return nil, err
+	}
+	defer decryptedReader.Close()
+	return ioutil.ReadAll(decryptedReader)
+}
@@ -0,0 +1,89 @@
+package sync
+
+import (
+	"io"
+	"testing"
+
+	"github.com/ristomcgehee/lyncser/utils"
+)
+
+func TestGetFileDiffs(t *testing.T) {
+	t.Parallel()
+	sim := newSimulation(t)
+	sim.globalConfig.TagPaths["all"] = []string{"~/docs"}
+	encryptor := &utils.AESGCMEncryptor{Key: make([]byte, 32)}
+	a, b := sim.machine("A"), sim.machine("B")
+	a.encryptor, b.encryptor = encryptor, encryptor
+	writeSimulatedFile(t, sim, a, "~/docs/notes", "v1\n")
+	writeSimulatedFile(t, sim, a, "~/docs/sub/image", "\x00\x01\x02")
+	for _, m := range []*machine{a, b} {
+		if _, err := sim.sync(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeSimulatedFile(t, sim, a, "~/docs/notes", "v2\n")
+	writeSimulatedFile(t, sim, b, "~/docs/sub/deeper/plan", "from B\n")
+	if _, err := sim.sync(b); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := sim.remote.GetFileContents("~/docs/sub/deeper/plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if stored, err := io.ReadAll(reader); err != nil || string(stored) == "from B\n" {
+		t.Fatalf("expected the remote copy to be encrypted, got %q, %v", stored, err)
+	}
+
+	type expectedDiff struct {
+		local, remote string
+		localExists   bool
+	}
+	tests := []struct {
+		pathToDiff string
+		expected   map[string]expectedDiff
+	}{
+		{
+			pathToDiff: "~/docs",
+			expected: map[string]expectedDiff{
+				"~/docs/notes":           {local: "v2\n", remote: "v1\n", localExists: true},
+				"~/docs/sub/image":       {local: "\x00\x01\x02", remote: "\x00\x01\x02", localExists: true},
+				"~/docs/sub/deeper/plan": {remote: "from B\n"},
+			},
+		},
+		{
+			pathToDiff: "~/docs/sub/",
+			expected: map[string]expectedDiff{
+				"~/docs/sub/image":       {local: "\x00\x01\x02", remote: "\x00\x01\x02", localExists: true},
+				"~/docs/sub/deeper/plan": {remote: "from B\n"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		diffs, err := sim.newSyncer(a).GetFileDiffs(test.pathToDiff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, diff := range diffs {
+			if i > 0 && diffs[i-1].Path >= diff.Path {
+				t.Errorf("%s: expected the diffs to be sorted by path, got %s before %s", test.pathToDiff,
+					diffs[i-1].Path, diff.Path)
+			}
+			expected, ok := test.expected[diff.Path]
+			if !ok {
+				t.Errorf("%s: unexpected diff for %s", test.pathToDiff, diff.Path)
+				continue
+			}
+			delete(test.expected, diff.Path)
+			if diff.LocalExists != expected.localExists || !diff.RemoteExists ||
+				string(diff.LocalContents) != expected.local || string(diff.RemoteContents) != expected.remote {
+				t.Errorf("%s: expected local %q and remote %q, got local %q (exists: %v) and remote %q", diff.Path,
+					expected.local, expected.remote, diff.LocalContents, diff.LocalExists, diff.RemoteContents)
+			}
+		}
+		for path := range test.expected {
+			t.Errorf("%s: no diff for %s", test.pathToDiff, path)
+		}
+	}
+}
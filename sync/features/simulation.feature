@@ -0,0 +1,195 @@
+Feature: Syncing several machines with one remote
+
+  Background:
+    When the global config syncs "~/docs" for tag "all"
+    And the global config syncs "~/work" for tag "work"
+    And machine "A" has tags "all"
+    And machine "B" has tags "all"
+
+  Scenario: a new file is copied to the other machines
+    When machine "A" writes "~/docs/notes" containing "v1"
+    And machine "B" syncs
+    And machine "A" syncs
+    And machine "B" syncs
+    Then machine "B" should have "~/docs/notes" containing "v1"
+    And the remote should have "~/docs/notes" containing "v1"
+    And the machines should be in sync
+
+  Scenario: an edit is copied to the other machines
+    When machine "A" writes "~/docs/notes" containing "v1"
+    And every machine syncs
+    And every machine syncs
+    And machine "B" writes "~/docs/notes" containing "v2"
+    And machine "B" syncs
+    And machine "A" syncs
+    Then machine "A" should have "~/docs/notes" containing "v2"
+    And the machines should be in sync
+
+  Scenario: edit on A, delete on B, sync B then A
+    When machine "A" writes "~/docs/notes" containing "v1"
+    And every machine syncs
+    And every machine syncs
+    And machine "A" writes "~/docs/notes" containing "v2"
+    And machine "B" deletes "~/docs/notes"
+    And machine "B" syncs
+    And machine "A" syncs
+    Then machine "B" should not have "~/docs/notes"
+    And the remote should have "~/docs/notes" containing "v2"
+    And the machines should be in sync
+
+  Scenario: the later of two edits wins
+    When machine "A" writes "~/docs/notes" containing "v1"
+    And every machine syncs
+    And every machine syncs
+    And machine "A" writes "~/docs/notes" containing "from A"
+    And machine "B" writes "~/docs/notes" containing "from B"
+    And machine "A" syncs
+    And machine "B" syncs
+    And machine "A" syncs
+    Then machine "A" should have "~/docs/notes" containing "from B"
+    And the remote should have "~/docs/notes" containing "from B"
+    And the machines should be in sync
+
+  Scenario: a later edit wins even when it is synced first
+    When machine "A" writes "~/docs/notes" containing "v1"
+    And every machine syncs
+    And every machine syncs
+    And machine "A" writes "~/docs/notes" containing "from A"
+    And machine "B" writes "~/docs/notes" containing "from B"
+    And machine "B" syncs
+    And machine "A" syncs
+    Then machine "A" should have "~/docs/notes" containing "from B"
+    And the machines should be in sync
+
+  Scenario: an edit on a machine whose clock is behind is copied to the other machines
+    When machine "A"'s clock is "60" minutes ahead
+    And machine "A" writes "~/docs/notes" containing "v1"
+    And machine "A" syncs
+    And machine "B" syncs
+    And machine "B" writes "~/docs/notes" containing "v2"
+    And machine "B" syncs
+    And machine "A" syncs
+    Then machine "A" should have "~/docs/notes" containing "v2"
+    And the remote should have "~/docs/notes" containing "v2"
+    And the machines should be in sync
+
+  Scenario: a file downloaded from a machine whose clock is ahead is not uploaded again
+    When machine "B"'s clock is "60" minutes ahead
+    And machine "B" writes "~/docs/notes" containing "v1"
+    And every machine syncs
+    And every machine syncs
+    And machine "A" writes "~/docs/notes" containing "v2"
+    And machine "A" syncs
+    And machine "B" syncs
+    Then machine "B" should have "~/docs/notes" containing "v2"
+    And the machines should be in sync
+
+  Scenario: files are only synced to machines with their tag
+    When machine "B" has tags "all,work"
+    And machine "C" has tags "work"
+    And machine "A" writes "~/docs/notes" containing "notes"
+    And machine "B" writes "~/work/plan" containing "plan"
+    And every machine syncs
+    And every machine syncs
+    Then machine "C" should have "~/work/plan" containing "plan"
+    And machine "C" should not have "~/docs/notes"
+    And machine "A" should not have "~/work/plan"
+    And machine "B" should have "~/docs/notes" containing "notes"
+    And the machines should be in sync
+
+  Scenario: files removed from the global config are deleted remotely after the retention period
+    When the global config keeps orphaned files for "7" days
+    And the global config syncs "~/old" for tag "all"
+    And machine "A" writes "~/old/plan" containing "plan"
+    And every machine syncs
+    And machine "A" stops syncing "~/old"
+    And machine "A" syncs
+    And "6" days pass
+    And machine "A" syncs
+    Then the remote should have "~/old/plan" containing "plan"
+    When "2" days pass
+    And machine "A" syncs
+    Then the remote should not have "~/old/plan"
+    And the remote should not have "~/old"
+
+  Scenario: pinned files are not deleted remotely
+    When the global config syncs "~/old" for tag "all"
+    And the global config pins "~/old/keep"
+    And machine "A" writes "~/old/keep" containing "keep"
+    And machine "A" writes "~/old/drop" containing "drop"
+    And every machine syncs
+    And machine "A" stops syncing "~/old"
+    And machine "A" syncs
+    And "31" days pass
+    And machine "A" syncs
+    Then the remote should have "~/old/keep" containing "keep"
+    And the remote should not have "~/old/drop"
+
+  Scenario: orphaned files are kept until they are pruned when retention is negative
+    When the global config keeps orphaned files for "-1" days
+    And the global config syncs "~/old" for tag "all"
+    And machine "A" writes "~/old/plan" containing "plan"
+    And every machine syncs
+    And machine "A" stops syncing "~/old"
+    And machine "A" syncs
+    And "400" days pass
+    And machine "A" syncs
+    Then the remote should have "~/old/plan" containing "plan"
+    When machine "A" prunes
+    Then the remote should not have "~/old/plan"
+
+  Scenario: undoing a download restores the previous contents on every machine
+    When machine "A" writes "~/docs/config" containing "good"
+    And every machine syncs
+    And every machine syncs
+    And machine "A" writes "~/docs/config" containing "broken"
+    And machine "A" syncs
+    And machine "B" syncs
+    And machine "B" undoes its last sync
+    Then machine "B" should have "~/docs/config" containing "good"
+    When machine "B" syncs
+    And machine "A" syncs
+    Then machine "A" should have "~/docs/config" containing "good"
+    And the remote should have "~/docs/config" containing "good"
+    And the machines should be in sync
+
+  Scenario: undoing an upload restores the previous remote contents
+    When machine "A" writes "~/docs/config" containing "good"
+    And every machine syncs
+    And every machine syncs
+    And machine "A" writes "~/docs/config" containing "broken"
+    And machine "A" syncs
+    And machine "A" undoes its last sync
+    Then the remote should have "~/docs/config" containing "good"
+    When every machine syncs
+    Then machine "A" should have "~/docs/config" containing "good"
+    And machine "B" should have "~/docs/config" containing "good"
+    And the machines should be in sync
+
+  Scenario: undoing a download of a new file deletes it
+    When every machine syncs
+    And machine "A" writes "~/docs/new" containing "new"
+    And machine "A" syncs
+    And machine "B" syncs
+    And machine "B" undoes its last sync
+    Then machine "B" should not have "~/docs/new"
+    When machine "B" syncs
+    Then machine "B" should not have "~/docs/new"
+    And the remote should have "~/docs/new" containing "new"
+
+  Scenario: undoing an upload of a new file deletes it from the remote
+    When every machine syncs
+    And machine "A" writes "~/docs/new" containing "new"
+    And machine "A" syncs
+    And machine "A" undoes its last sync
+    Then the remote should not have "~/docs/new"
+    And machine "A" should have "~/docs/new" containing "new"
+
+  Scenario: a sync that changed nothing can't be undone
+    When machine "A" writes "~/docs/config" containing "good"
+    And every machine syncs
+    And machine "A" writes "~/docs/config" containing "broken"
+    And machine "A" syncs
+    And machine "A" syncs
+    Then machine "A" should have nothing to undo
+    And the remote should have "~/docs/config" containing "broken"
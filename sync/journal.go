@@ -0,0 +1,273 @@
+package sync
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ristomcgehee/lyncser/filestore"
+	"github.com/ristomcgehee/lyncser/utils"
+)
+
+const (
+	// Directory in the config directory holding a subdirectory for each sync run in the journal.
+	journalDirName = "journal"
+	// The ID of a sync run is the time it started in this format, so that IDs sort by time.
+	runIDFormat = "20060102T150405.000000Z"
+	// Number of days the journal of a sync run is kept, unless the local config sets journalRetentionDays.
+	defaultJournalRetentionDays = 7
+)
+
+// Returned when a sync run is not in the journal.
+var ErrRunNotFound = errors.New("the sync run is not in the journal")
+
+// JournalSide is the copy of a file that a sync overwrote.
+type JournalSide string
+
+const (
+	JournalLocal  JournalSide = "local"
+	JournalRemote JournalSide = "remote"
+)
+
+// JournalEntry records the contents a file had before a sync overwrote it, or that the sync created the file.
+type JournalEntry struct {
+	// The friendly path of the file.
+	Path string      `json:"path"`
+	Side JournalSide `json:"side"`
+	// True if the file didn't exist before the sync. Undoing the sync deletes it.
+	Created bool `json:"created,omitempty"`
+	// The metadata of the previous contents, or nil if the file was created. The previous contents of a remote file
+	// are kept encrypted as they were in the remote file store.
+	Metadata *filestore.FileMetadata `json:"metadata"`
+	// The modified time the sync gave the file. Undoing the sync skips the file if it has been modified since.
+	SyncedModTime time.Time `json:"syncedModTime"`
+}
+
+// Journal keeps the previous contents of the files overwritten by each sync run so that the run can be undone.
+type Journal interface {
+	// SaveJournalEntry records entry and the previous contents of the file under runID. contents is nil if the sync
+	// created the file.
+	SaveJournalEntry(runID string, entry *JournalEntry, contents io.Reader) error
+	// JournalEntries returns the entries of a run sorted by path. It returns ErrRunNotFound if there are none.
+	JournalEntries(runID string) ([]*JournalEntry, error)
+	// JournalContents returns the previous contents of the file in entry.
+	JournalContents(runID string, entry *JournalEntry) (io.ReadCloser, error)
+	// JournalRuns returns the IDs of the runs in the journal, oldest first.
+	JournalRuns() ([]string, error)
+	DeleteJournalRun(runID string) error
+}
+
+// newRunID returns the ID of a sync run that started at startTime.
+func newRunID(startTime time.Time) string {
+	return startTime.UTC().Format(runIDFormat)
+}
+
+// journalDir returns the real path of the directory holding the journal of a run.
+func (c *ConfigFiles) journalDir(runID string) string {
+	return filepath.Join(c.Dir, journalDirName, runID)
+}
+
+// journalEntryName returns the name shared by the files holding an entry and the previous contents it records.
+func journalEntryName(entry *JournalEntry) string {
+	hash := sha256.Sum256([]byte(string(entry.Side) + ":" + entry.Path))
+	return hex.EncodeToString(hash[:8])
+}
+
+// SaveJournalEntry implements Journal. Each entry is kept in its own files so that entries can be saved while files
+// are synced in parallel.
+func (c *ConfigFiles) SaveJournalEntry(runID string, entry *JournalEntry, contents io.Reader) error {
+	dir := c.journalDir(runID)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	name := journalEntryName(entry)
+	if contents != nil {
+		if err := utils.WriteFileAtomic(filepath.Join(dir, name+".data"), contents, 0o600); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(entry, "", " ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(filepath.Join(dir, name+".json"), bytes.NewReader(data), 0o600)
+}
+
+// JournalEntries implements Journal.
+func (c *ConfigFiles) JournalEntries(runID string) ([]*JournalEntry, error) {
+	if _, err := time.Parse(runIDFormat, runID); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrRunNotFound, runID)
+	}
+	dirEntries, err := os.ReadDir(c.journalDir(runID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrRunNotFound, runID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*JournalEntry, 0, len(dirEntries)/2)
+	for _, dirEntry := range dirEntries {
+		if !strings.HasSuffix(dirEntry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(c.journalDir(runID), dirEntry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var entry JournalEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %w", dirEntry.Name(), err)
+		}
+		entries = append(entries, &entry)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrRunNotFound, runID)
+	}
+	sortJournalEntries(entries)
+	return entries, nil
+}
+
+// JournalContents implements Journal.
+func (c *ConfigFiles) JournalContents(runID string, entry *JournalEntry) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(c.journalDir(runID), journalEntryName(entry)+".data"))
+}
+
+// JournalRuns implements Journal.
+func (c *ConfigFiles) JournalRuns() ([]string, error) {
+	dirEntries, err := os.ReadDir(filepath.Join(c.Dir, journalDirName))
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	runIDs := make([]string, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		if _, err := time.Parse(runIDFormat, dirEntry.Name()); dirEntry.IsDir() && err == nil {
+			runIDs = append(runIDs, dirEntry.Name())
+		}
+	}
+	sort.Strings(runIDs)
+	return runIDs, nil
+}
+
+// DeleteJournalRun implements Journal.
+func (c *ConfigFiles) DeleteJournalRun(runID string) error {
+	if _, err := time.Parse(runIDFormat, runID); err != nil {
+		return fmt.Errorf("%w: %s", ErrRunNotFound, runID)
+	}
+	return os.RemoveAll(c.journalDir(runID))
+}
+
+// sortJournalEntries sorts entries by path, with the local side first.
+func sortJournalEntries(entries []*JournalEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Path != entries[j].Path {
+			return entries[i].Path < entries[j].Path
+		}
+		return entries[i].Side < entries[j].Side
+	})
+}
+
+// journalLocalFile saves the local copy of file in the journal before a download overwrites it, or records that the
+// download creates the file. syncedModTime is the modified time the download gives the file. Nothing is saved outside
+// of PerformSync.
+func (s *Syncer) journalLocalFile(file SyncedFile, syncedModTime time.Time) error {
+	if s.result == nil {
+		return nil
+	}
+	entry := &JournalEntry{
+		Path:          file.FriendlyPath,
+		Side:          JournalLocal,
+		SyncedModTime: syncedModTime,
+	}
+	exists, err := s.LocalFileStore.FileExists(file.RealPath)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		entry.Created = true
+		return s.Config.SaveJournalEntry(s.result.RunID, entry, nil)
+	}
+	if entry.Metadata, err = s.LocalFileStore.GetMetadata(file.RealPath); err != nil {
+		return err
+	}
+	contents, err := s.LocalFileStore.GetFileContents(file.RealPath)
+	if err != nil {
+		return err
+	}
+	defer contents.Close()
+	return s.Config.SaveJournalEntry(s.result.RunID, entry, contents)
+}
+
+// journalRemoteFile saves the remote copy of file in the journal before an upload overwrites it, or records that the
+// upload creates the file. syncedModTime is the modified time the upload gives the file. Nothing is saved outside of
+// PerformSync. The remote copy is downloaded like any other file, so it is subject to the download rate limit and the
+// transfer cap, and the returned error wraps errTransferDeferred if the cap doesn't leave room for it.
+func (s *Syncer) journalRemoteFile(file SyncedFile, syncedModTime time.Time) error {
+	if s.result == nil {
+		return nil
+	}
+	entry := &JournalEntry{
+		Path:          file.FriendlyPath,
+		Side:          JournalRemote,
+		SyncedModTime: syncedModTime,
+	}
+	exists, err := s.RemoteFileStore.FileExists(file.FriendlyPath)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		entry.Created = true
+		return s.Config.SaveJournalEntry(s.result.RunID, entry, nil)
+	}
+	if entry.Metadata, err = s.RemoteFileStore.GetMetadata(file.FriendlyPath); err != nil {
+		return err
+	}
+	if err := s.reserveCapacity(entry.Metadata.Size, "the remote copy to save in the journal"); err != nil {
+		return err
+	}
+	contents, err := s.RemoteFileStore.GetFileContents(file.FriendlyPath)
+	if err != nil {
+		return err
+	}
+	defer contents.Close()
+	countingReader := &utils.CountingReader{Reader: utils.LimitReader(contents, s.downloadLimiter)}
+	if err := s.Config.SaveJournalEntry(s.result.RunID, entry, countingReader); err != nil {
+		return err
+	}
+	s.addBytesTransferred(0, countingReader.Count)
+	return nil
+}
+
+// pruneJournal deletes the journals of the sync runs older than the retention period in the local config.
+func (s *Syncer) pruneJournal(localConfig *LocalConfig) error {
+	retentionDays := localConfig.JournalRetentionDays
+	if retentionDays == 0 {
+		retentionDays = defaultJournalRetentionDays
+	}
+	cutoff := s.now().AddDate(0, 0, -retentionDays)
+	runIDs, err := s.Config.JournalRuns()
+	if err != nil {
+		return err
+	}
+	for _, runID := range runIDs {
+		startTime, err := time.Parse(runIDFormat, runID)
+		if err != nil || !startTime.Before(cutoff) {
+			continue
+		}
+		if err := s.Config.DeleteJournalRun(runID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package sync
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ristomcgehee/lyncser/filestore"
+	"github.com/ristomcgehee/lyncser/utils"
+)
+
+const (
+	// Held while a sync is running so that two lyncser processes on this machine don't sync the same profile at once.
+	localLockFileName = "sync.lock"
+	// Holds the lease of the machine currently syncing. It is only stored remotely.
+	remoteLockFilePath = "~/.config/lyncser/lock.json"
+	// How long a remote lease lasts before other machines may take it over. It is renewed during the sync.
+	remoteLockDuration = 30 * time.Minute
+)
+
+var (
+	ErrLocked         = errors.New("another lyncser process is already syncing this profile on this machine")
+	ErrRemoteLocked   = errors.New("another machine is syncing")
+	ErrRemoteLockLost = errors.New("the remote lock was taken over by another machine")
+)
+
+// remoteLock is the contents of the remote lock file.
+type remoteLock struct {
+	// Identifies the process holding the lock.
+	ID string `json:"id"`
+	// The hostname of the machine holding the lock, for error messages.
+	Hostname   string    `json:"hostname"`
+	AcquiredAt time.Time `json:"acquiredAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+// Lock takes the local lock for the profile. The returned function releases it.
+func (c *ConfigFiles) Lock() (func(), error) {
+	if err := os.MkdirAll(c.Dir, 0o700); err != nil {
+		return nil, err
+	}
+	lockFile, err := utils.LockFile(filepath.Join(c.Dir, localLockFileName))
+	if errors.Is(err, utils.ErrFileLocked) {
+		return nil, ErrLocked
+	}
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		lockFile.Close()
+	}, nil
+}
+
+// acquireRemoteLock takes the remote lease, or renews it if this process already holds it. An unexpired lease held by
+// another machine is only taken over if BreakLock is set. GetFiles must have been called on the remote file store.
+func (s *Syncer) acquireRemoteLock() error {
+	current, version, err := s.readRemoteLock()
+	if err != nil {
+		return err
+	}
+	if s.remoteLockID == "" {
+		if s.remoteLockID, err = utils.GenerateRandomHexString(32); err != nil {
+			return err
+		}
+	}
+	now := s.now().UTC()
+	lock := &remoteLock{
+		ID:         s.remoteLockID,
+		Hostname:   getHostname(),
+		AcquiredAt: now,
+		ExpiresAt:  now.Add(remoteLockDuration),
+	}
+	switch {
+	case current == nil:
+	case current.ID == s.remoteLockID:
+		lock.AcquiredAt = current.AcquiredAt
+	case now.Before(current.ExpiresAt) && !s.BreakLock:
+		return fmt.Errorf("%w: '%s' holds the lock until %s. Use --break-lock if that sync is no longer running",
+			ErrRemoteLocked, current.Hostname, current.ExpiresAt.Local().Format(time.RFC3339))
+	default:
+		s.Logger.Warnf("Taking over the remote lock held by '%s' since %s", current.Hostname,
+			current.AcquiredAt.Local().Format(time.RFC3339))
+	}
+	if err := s.writeRemoteLock(lock, version); err != nil {
+		if errors.Is(err, filestore.ErrVersionMismatch) {
+			return fmt.Errorf("%w: another machine took the lock at the same time", ErrRemoteLocked)
+		}
+		return err
+	}
+	s.holdsRemoteLock = true
+	s.remoteLockExpiresAt = lock.ExpiresAt
+	return nil
+}
+
+// renewRemoteLockIfExpiring renews the remote lease once more than half of it has elapsed, so that long syncs keep
+// the lock.
+func (s *Syncer) renewRemoteLockIfExpiring() error {
+	if !s.holdsRemoteLock || s.remoteLockExpiresAt.Sub(s.now()) > remoteLockDuration/2 {
+		return nil
+	}
+	return s.renewRemoteLock()
+}
+
+// renewRemoteLock extends the remote lease. It returns ErrRemoteLockLost if another machine has taken it over, in
+// which case the remote state must not be written.
+func (s *Syncer) renewRemoteLock() error {
+	if !s.holdsRemoteLock {
+		return nil
+	}
+	current, _, err := s.readRemoteLock()
+	if err != nil {
+		return err
+	}
+	if current == nil || current.ID != s.remoteLockID {
+		s.holdsRemoteLock = false
+		return ErrRemoteLockLost
+	}
+	err = s.acquireRemoteLock()
+	if errors.Is(err, ErrRemoteLocked) {
+		s.holdsRemoteLock = false
+		return ErrRemoteLockLost
+	}
+	return err
+}
+
+// releaseRemoteLock deletes the remote lease if this process holds it.
+func (s *Syncer) releaseRemoteLock() error {
+	if !s.holdsRemoteLock {
+		return nil
+	}
+	s.holdsRemoteLock = false
+	current, _, err := s.readRemoteLock()
+	if err != nil {
+		return err
+	}
+	if current == nil || current.ID != s.remoteLockID {
+		return nil
+	}
+	return s.RemoteFileStore.DeleteFile(remoteLockFilePath)
+}
+
+// readRemoteLock returns the current remote lease and its version, or nil if there is none. The version is only set
+// if the remote file store is a filestore.VersionedFileStore.
+func (s *Syncer) readRemoteLock() (*remoteLock, string, error) {
+	var contents io.ReadCloser
+	var version string
+	var err error
+	if versionedStore, ok := s.RemoteFileStore.(filestore.VersionedFileStore); ok {
+		contents, version, err = versionedStore.GetVersionedFileContents(remoteLockFilePath)
+	} else {
+		var exists bool
+		exists, err = s.RemoteFileStore.FileExists(remoteLockFilePath)
+		if err == nil && exists {
+			contents, err = s.RemoteFileStore.GetFileContents(remoteLockFilePath)
+		}
+	}
+	if err != nil || contents == nil {
+		return nil, "", err
+	}
+	defer contents.Close()
+	data, err := ioutil.ReadAll(contents)
+	if err != nil {
+		return nil, "", err
+	}
+	var lock remoteLock
+	if err := json.Unmarshal(data, &lock); err != nil {
+		s.Logger.Warnf("Ignoring unreadable remote lock: %v", err)
+		return nil, version, nil
+	}
+	return &lock, version, nil
+}
+
+// writeRemoteLock writes the remote lease. If the remote file store supports it, the write only succeeds if the lock
+// file is still at version. Otherwise the lock is read back to check that no other machine overwrote it.
+func (s *Syncer) writeRemoteLock(lock *remoteLock, version string) error {
+	data, err := json.Marshal(lock)
+	if err != nil {
+		return err
+	}
+	if versionedStore, ok := s.RemoteFileStore.(filestore.VersionedFileStore); ok {
+		return versionedStore.WriteFileContentsIfVersion(remoteLockFilePath, bytes.NewReader(data), version)
+	}
+	err = s.RemoteFileStore.WriteFileContents(remoteLockFilePath, bytes.NewReader(data), &filestore.FileMetadata{
+		ModTime: s.now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	written, _, err := s.readRemoteLock()
+	if err != nil {
+		return err
+	}
+	if written == nil || written.ID != lock.ID {
+		return filestore.ErrVersionMismatch
+	}
+	return nil
+}
+
+func getHostname() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return hostname
+}
@@ -0,0 +1,232 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+
+	"github.com/ristomcgehee/lyncser/filestore"
+	"github.com/ristomcgehee/lyncser/filestore/fakedrive"
+	"github.com/ristomcgehee/lyncser/utils"
+)
+
+// newDriveSimulation returns a simulation whose machines sync with a fake Google Drive, each through its own
+// DriveFileStore.
+func newDriveSimulation(t *testing.T, machineNames ...string) (*simulation, *fakedrive.Server) {
+	t.Helper()
+	sim := newSimulation(t)
+	fake := fakedrive.New()
+	fake.Now = sim.Now
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	service, err := drive.NewService(context.Background(), option.WithEndpoint(server.URL+"/"),
+		option.WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range machineNames {
+		sim.machine(name).remote = &filestore.DriveFileStore{
+			Logger:   zap.NewNop().Sugar(),
+			RootName: "Lyncser-Root",
+			NewService: func(*filestore.TokenStore) (*drive.Service, *http.Client, error) {
+				return service, server.Client(), nil
+			},
+		}
+	}
+	return sim, fake
+}
+
+// takeRemoteLock takes the remote lease for the machine without syncing, as a sync that is still running would have.
+func takeRemoteLock(t *testing.T, sim *simulation, m *machine) *Syncer {
+	t.Helper()
+	syncer := sim.newSyncer(m)
+	if _, err := syncer.RemoteFileStore.GetFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if err := syncer.acquireRemoteLock(); err != nil {
+		t.Fatal(err)
+	}
+	return syncer
+}
+
+// hookedFileStore calls onRead before the contents of a file are read.
+type hookedFileStore struct {
+	*filestore.MemoryFileStore
+	onRead func(path string)
+}
+
+func (h *hookedFileStore) GetFileContents(path string) (io.ReadCloser, error) {
+	h.onRead(path)
+	return h.MemoryFileStore.GetFileContents(path)
+}
+
+// existsRemotely returns true if the file is in the remote file store as the machine currently sees it.
+func existsRemotely(t *testing.T, m *machine, path string) bool {
+	t.Helper()
+	files, err := m.remote.GetFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if file.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+func writeSimulatedFile(t *testing.T, sim *simulation, m *machine, path, contents string) {
+	t.Helper()
+	realPath, err := utils.RealPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.local.WriteFileContents(realPath, strings.NewReader(contents), &filestore.FileMetadata{
+		ModTime: sim.tick().Add(m.clockOffset),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoteLockIsRefusedWhileHeldAndTakenOverOnceExpired(t *testing.T) {
+	t.Parallel()
+	sim, _ := newDriveSimulation(t, "A", "B")
+	sim.globalConfig.TagPaths["all"] = []string{"~/docs"}
+	a, b := sim.machine("A"), sim.machine("B")
+	if _, err := sim.sync(a); err != nil {
+		t.Fatal(err)
+	}
+	writeSimulatedFile(t, sim, b, "~/docs/notes", "from B")
+	holder := takeRemoteLock(t, sim, a)
+
+	if _, err := sim.sync(b); !errors.Is(err, ErrRemoteLocked) {
+		t.Fatalf("expected the sync to be refused while A holds the lock, got %v", err)
+	}
+	if existsRemotely(t, b, "~/docs/notes") {
+		t.Error("B uploaded its file while A held the lock")
+	}
+
+	sim.now = sim.now.Add(remoteLockDuration)
+	if _, err := sim.sync(b); err != nil {
+		t.Fatalf("expected B to take over the expired lock, got %v", err)
+	}
+	if !existsRemotely(t, b, "~/docs/notes") {
+		t.Error("B didn't upload its file after taking over the lock")
+	}
+	lock, _, err := sim.newSyncer(b).readRemoteLock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lock != nil {
+		t.Errorf("expected B to release the lock after its sync, but %s holds it", lock.Hostname)
+	}
+	if err := holder.renewRemoteLock(); !errors.Is(err, ErrRemoteLockLost) {
+		t.Errorf("expected A to find that its lock was taken over, got %v", err)
+	}
+}
+
+func TestRemoteLockLostDuringLongSync(t *testing.T) {
+	t.Parallel()
+	sim, _ := newDriveSimulation(t, "A", "B")
+	sim.globalConfig.TagPaths["all"] = []string{"~/docs"}
+	a, b := sim.machine("A"), sim.machine("B")
+	if _, err := sim.sync(a); err != nil {
+		t.Fatal(err)
+	}
+	writeSimulatedFile(t, sim, a, "~/docs/large", "takes a long time to upload")
+	largePath, err := utils.RealPath("~/docs/large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateSavedAt, err := a.remote.GetModifiedTime(stateRemoteFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// While A uploads the large file, its lease expires and B takes the lock over.
+	taker := sim.newSyncer(b)
+	var takeoverErr error
+	tookOver := false
+	syncer := sim.newSyncer(a)
+	syncer.Parallelism = 1
+	syncer.LocalFileStore = &hookedFileStore{
+		MemoryFileStore: a.local,
+		onRead: func(path string) {
+			if path != largePath || tookOver {
+				return
+			}
+			tookOver = true
+			sim.now = sim.now.Add(remoteLockDuration + time.Minute)
+			if _, takeoverErr = taker.RemoteFileStore.GetFiles(); takeoverErr == nil {
+				takeoverErr = taker.acquireRemoteLock()
+			}
+		},
+	}
+	_, err = syncer.PerformSync()
+	if !tookOver || takeoverErr != nil {
+		t.Fatalf("B didn't take over the lock during the upload: %v", takeoverErr)
+	}
+	if !errors.Is(err, ErrRemoteLockLost) {
+		t.Fatalf("expected A to notice that it lost the lock, got %v", err)
+	}
+
+	lock, _, err := taker.readRemoteLock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lock == nil || lock.ID != taker.remoteLockID {
+		t.Error("A released or overwrote the lock that B took over")
+	}
+	if _, err := b.remote.GetFiles(); err != nil {
+		t.Fatal(err)
+	}
+	modTime, err := b.remote.GetModifiedTime(stateRemoteFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !modTime.Equal(stateSavedAt) {
+		t.Error("A saved the remote state after losing the lock")
+	}
+}
+
+func TestSyncGlobalConfigTakesRemoteLock(t *testing.T) {
+	t.Parallel()
+	sim, _ := newDriveSimulation(t, "A", "B")
+	sim.globalConfig.TagPaths["all"] = []string{"~/docs"}
+	a, b := sim.machine("A"), sim.machine("B")
+	for _, m := range []*machine{a, b} {
+		if _, err := sim.sync(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	holder := takeRemoteLock(t, sim, a)
+
+	if _, err := sim.newSyncer(b).SyncGlobalConfig(); !errors.Is(err, ErrRemoteLocked) {
+		t.Fatalf("expected the global config sync to be refused while A holds the lock, got %v", err)
+	}
+
+	if err := holder.releaseRemoteLock(); err != nil {
+		t.Fatal(err)
+	}
+	syncer := sim.newSyncer(b)
+	if _, err := syncer.SyncGlobalConfig(); err != nil {
+		t.Fatal(err)
+	}
+	lock, _, err := syncer.readRemoteLock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lock != nil {
+		t.Errorf("expected B to release the lock after syncing the global config, but %s holds it", lock.Hostname)
+	}
+}
@@ -0,0 +1,58 @@
+package sync
+
+import (
+	"sort"
+	"time"
+
+	"github.com/ristomcgehee/lyncser/filestore"
+)
+
+type RemoteFileInfo struct {
+	*filestore.StoredFile
+	// The tags in the global config whose paths cover this file.
+	Tags []string
+	// When this file was marked for deletion because it is no longer in the global config. Nil if it is not marked.
+	MarkDeleted *time.Time
+	// When this file will be deleted remotely. Nil if it is not marked for deletion or is only deleted by Prune.
+	DeleteAfter *time.Time
+	// Whether this file is pinned in the global config so that it is never deleted.
+	Pinned bool
+}
+
+// ListRemoteFiles returns every file in the remote file store along with the tags that cover it and whether it has
+// been marked for deletion. The files are sorted by path.
+func (s *Syncer) ListRemoteFiles() ([]*RemoteFileInfo, error) {
+	globalConfig, err := s.Config.GlobalConfig()
+	if err != nil {
+		return nil, err
+	}
+	remoteFiles, err := s.RemoteFileStore.GetFiles()
+	if err != nil {
+		return nil, err
+	}
+	remoteStateData, err := getRemoteStateData(s.RemoteFileStore)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]*RemoteFileInfo, 0, len(remoteFiles))
+	for _, remoteFile := range remoteFiles {
+		info := &RemoteFileInfo{
+			StoredFile: remoteFile,
+			Tags:       getCoveringTags(remoteFile.Path, globalConfig),
+			Pinned:     globalConfig.isPinned(remoteFile.Path),
+		}
+		if fileData, ok := remoteStateData.FileStateData[remoteFile.Path]; ok {
+			markDeleted := fileData.MarkDeleted
+			info.MarkDeleted = &markDeleted
+			if deleteAfter, ok := globalConfig.remoteDeletionTime(fileData.MarkDeleted); ok {
+				info.DeleteAfter = &deleteAfter
+			}
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Path < infos[j].Path
+	})
+	return infos, nil
+}
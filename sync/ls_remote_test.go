@@ -0,0 +1,80 @@
+package sync
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ristomcgehee/lyncser/filestore"
+)
+
+func TestListRemoteFiles(t *testing.T) {
+	t.Parallel()
+	sim := newSimulation(t)
+	sim.globalConfig.TagPaths["all"] = []string{"~/docs"}
+	sim.globalConfig.TagPaths["work"] = []string{"~/docs/work"}
+	sim.globalConfig.Pinned = []string{"~/old/keep"}
+	sim.globalConfig.RemoteRetentionDays = 30
+	a := sim.machine("A")
+	writeSimulatedFile(t, sim, a, "~/docs/notes", "notes")
+	writeSimulatedFile(t, sim, a, "~/docs/work/plan", "plan")
+	for _, path := range []string{"~/old/drop", "~/old/keep"} {
+		err := sim.remote.WriteFileContents(path, strings.NewReader(path), &filestore.FileMetadata{ModTime: sim.tick()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := sim.sync(a); err != nil {
+		t.Fatal(err)
+	}
+	markedAt := sim.now
+	sim.now = sim.now.AddDate(0, 0, 10)
+
+	infos, err := sim.newSyncer(a).ListRemoteFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]*RemoteFileInfo)
+	for _, info := range infos {
+		found[info.Path] = info
+	}
+	expectedTags := map[string][]string{
+		"~/docs":           {"all", "work"},
+		"~/docs/notes":     {"all"},
+		"~/docs/work/plan": {"all", "work"},
+		"~/old/drop":       {},
+		"~/old/keep":       {},
+	}
+	for path, tags := range expectedTags {
+		info, ok := found[path]
+		if !ok {
+			t.Errorf("%s: not listed", path)
+			continue
+		}
+		if !reflect.DeepEqual(info.Tags, tags) {
+			t.Errorf("%s: expected tags %v, got %v", path, tags, info.Tags)
+		}
+	}
+
+	drop := found["~/old/drop"]
+	if drop == nil || drop.MarkDeleted == nil || drop.DeleteAfter == nil || drop.Pinned {
+		t.Fatalf("expected ~/old/drop to be marked for deletion, got %+v", drop)
+	}
+	if !drop.MarkDeleted.Equal(markedAt) || !drop.DeleteAfter.Equal(markedAt.AddDate(0, 0, 30)) {
+		t.Errorf("expected ~/old/drop to be marked at %v and deleted 30 days later, got %v and %v", markedAt,
+			drop.MarkDeleted, drop.DeleteAfter)
+	}
+	for _, path := range []string{"~/docs/notes", "~/old/keep"} {
+		if info := found[path]; info != nil && (info.MarkDeleted != nil || info.DeleteAfter != nil) {
+			t.Errorf("%s: expected not to be marked for deletion", path)
+		}
+	}
+	if keep := found["~/old/keep"]; keep == nil || !keep.Pinned {
+		t.Error("expected ~/old/keep to be pinned")
+	}
+	for i := 1; i < len(infos); i++ {
+		if infos[i-1].Path >= infos[i].Path {
+			t.Errorf("expected the files to be sorted by path, got %s before %s", infos[i-1].Path, infos[i].Path)
+		}
+	}
+}
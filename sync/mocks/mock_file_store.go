@@ -109,6 +109,21 @@ func (mr *MockFileStoreMockRecorder) GetFiles() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetFiles", reflect.TypeOf((*MockFileStore)(nil).GetFiles))
 }
 
+// GetMetadata mocks base method.
+func (m *MockFileStore) GetMetadata(path string) (*filestore.FileMetadata, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetMetadata", path)
+	ret0, _ := ret[0].(*filestore.FileMetadata)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetMetadata indicates an expected call of GetMetadata.
+func (mr *MockFileStoreMockRecorder) GetMetadata(path interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetMetadata", reflect.TypeOf((*MockFileStore)(nil).GetMetadata), path)
+}
+
 // GetModifiedTime mocks base method.
 func (m *MockFileStore) GetModifiedTime(path string) (time.Time, error) {
 	m.ctrl.T.Helper()
@@ -125,15 +140,15 @@ func (mr *MockFileStoreMockRecorder) GetModifiedTime(path interface{}) *gomock.C
 }
 
 // WriteFileContents mocks base method.
-func (m *MockFileStore) WriteFileContents(path string, contentReader io.Reader) error {
+func (m *MockFileStore) WriteFileContents(path string, contentReader io.Reader, metadata *filestore.FileMetadata) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "WriteFileContents", path, contentReader)
+	ret := m.ctrl.Call(m, "WriteFileContents", path, contentReader, metadata)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // WriteFileContents indicates an expected call of WriteFileContents.
-func (mr *MockFileStoreMockRecorder) WriteFileContents(path, contentReader interface{}) *gomock.Call {
+func (mr *MockFileStoreMockRecorder) WriteFileContents(path, contentReader, metadata interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WriteFileContents", reflect.TypeOf((*MockFileStore)(nil).WriteFileContents), path, contentReader)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WriteFileContents", reflect.TypeOf((*MockFileStore)(nil).WriteFileContents), path, contentReader, metadata)
 }
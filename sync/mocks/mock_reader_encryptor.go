@@ -63,3 +63,122 @@ func (mr *MockReaderEncryptorMockRecorder) EncryptReader(reader interface{}) *go
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EncryptReader", reflect.TypeOf((*MockReaderEncryptor)(nil).EncryptReader), reader)
 }
+
+// MockEncryptionFormat is a mock of EncryptionFormat interface.
+type MockEncryptionFormat struct {
+	ctrl     *gomock.Controller
+	recorder *MockEncryptionFormatMockRecorder
+}
+
+// MockEncryptionFormatMockRecorder is the mock recorder for MockEncryptionFormat.
+type MockEncryptionFormatMockRecorder struct {
+	mock *MockEncryptionFormat
+}
+
+// NewMockEncryptionFormat creates a new mock instance.
+func NewMockEncryptionFormat(ctrl *gomock.Controller) *MockEncryptionFormat {
+	mock := &MockEncryptionFormat{ctrl: ctrl}
+	mock.recorder = &MockEncryptionFormatMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockEncryptionFormat) EXPECT() *MockEncryptionFormatMockRecorder {
+	return m.recorder
+}
+
+// FormatVersion mocks base method.
+func (m *MockEncryptionFormat) FormatVersion() int {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FormatVersion")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+// FormatVersion indicates an expected call of FormatVersion.
+func (mr *MockEncryptionFormatMockRecorder) FormatVersion() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FormatVersion", reflect.TypeOf((*MockEncryptionFormat)(nil).FormatVersion))
+}
+
+// HashContents mocks base method.
+func (m *MockEncryptionFormat) HashContents(reader io.Reader) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "HashContents", reader)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// HashContents indicates an expected call of HashContents.
+func (mr *MockEncryptionFormatMockRecorder) HashContents(reader interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HashContents", reflect.TypeOf((*MockEncryptionFormat)(nil).HashContents), reader)
+}
+
+// KeyID mocks base method.
+func (m *MockEncryptionFormat) KeyID() string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "KeyID")
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+// KeyID indicates an expected call of KeyID.
+func (mr *MockEncryptionFormatMockRecorder) KeyID() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "KeyID", reflect.TypeOf((*MockEncryptionFormat)(nil).KeyID))
+}
+
+// MockNonceEncryptor is a mock of NonceEncryptor interface.
+type MockNonceEncryptor struct {
+	ctrl     *gomock.Controller
+	recorder *MockNonceEncryptorMockRecorder
+}
+
+// MockNonceEncryptorMockRecorder is the mock recorder for MockNonceEncryptor.
+type MockNonceEncryptorMockRecorder struct {
+	mock *MockNonceEncryptor
+}
+
+// NewMockNonceEncryptor creates a new mock instance.
+func NewMockNonceEncryptor(ctrl *gomock.Controller) *MockNonceEncryptor {
+	mock := &MockNonceEncryptor{ctrl: ctrl}
+	mock.recorder = &MockNonceEncryptorMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockNonceEncryptor) EXPECT() *MockNonceEncryptorMockRecorder {
+	return m.recorder
+}
+
+// EncryptReaderWithNonce mocks base method.
+func (m *MockNonceEncryptor) EncryptReaderWithNonce(reader io.Reader, nonce []byte) (io.Reader, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "EncryptReaderWithNonce", reader, nonce)
+	ret0, _ := ret[0].(io.Reader)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// EncryptReaderWithNonce indicates an expected call of EncryptReaderWithNonce.
+func (mr *MockNonceEncryptorMockRecorder) EncryptReaderWithNonce(reader, nonce interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EncryptReaderWithNonce", reflect.TypeOf((*MockNonceEncryptor)(nil).EncryptReaderWithNonce), reader, nonce)
+}
+
+// NewNonce mocks base method.
+func (m *MockNonceEncryptor) NewNonce() ([]byte, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "NewNonce")
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// NewNonce indicates an expected call of NewNonce.
+func (mr *MockNonceEncryptorMockRecorder) NewNonce() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NewNonce", reflect.TypeOf((*MockNonceEncryptor)(nil).NewNonce))
+}
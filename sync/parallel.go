@@ -0,0 +1,110 @@
+package sync
+
+import (
+	gosync "sync"
+
+	"github.com/ristomcgehee/lyncser/utils"
+)
+
+// The number of files synced at the same time when neither Syncer.Parallelism nor the local config sets it.
+const DefaultParallelism = 4
+
+// fileJob is a file to sync in parallel with others, along with the outcome of syncing it.
+type fileJob struct {
+	path        string
+	isRemoteDir bool
+	outcome     HandleFileOutcome
+	err         error
+	// Holds the log messages written while syncing the file until it is the file's turn to write them.
+	logger *bufferedLogger
+	// Closed once the file has been synced.
+	done chan struct{}
+}
+
+func newFileJob(path string, isRemoteDir bool, logger utils.Logger) *fileJob {
+	return &fileJob{
+		path:        path,
+		isRemoteDir: isRemoteDir,
+		logger:      &bufferedLogger{logger: logger},
+		done:        make(chan struct{}),
+	}
+}
+
+// syncFiles syncs the files with up to parallelism workers. The log messages and results of the files are written in
+// the order of jobs, so the output reads the same as if the files were synced one at a time. The remote lock is renewed
+// as needed, and if that fails, the files that haven't been started are skipped and the error is returned.
+func (s *Syncer) syncFiles(jobs []*fileJob, parallelism int) error {
+	queue := make(chan *fileJob)
+	stop := make(chan struct{})
+	var wg gosync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				job.outcome, job.err = s.handleFile(job.path, job.isRemoteDir, job.logger)
+				close(job.done)
+			}
+		}()
+	}
+	go func() {
+		defer close(queue)
+		for _, job := range jobs {
+			select {
+			case queue <- job:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	defer wg.Wait()
+	defer close(stop)
+
+	for _, job := range jobs {
+		<-job.done
+		job.logger.flush()
+		if job.err != nil {
+			s.Logger.Errorf("Error syncing file '%s': %v", job.path, job.err)
+		}
+		s.result.addFile(job.path, job.outcome, job.err)
+		if err := s.renewRemoteLockIfExpiring(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bufferedLogger holds log messages until flush writes them to logger. It is used by one goroutine at a time.
+type bufferedLogger struct {
+	logger   utils.Logger
+	messages []func(logger utils.Logger)
+}
+
+func (b *bufferedLogger) Debugf(template string, args ...interface{}) {
+	b.messages = append(b.messages, func(logger utils.Logger) { logger.Debugf(template, args...) })
+}
+
+func (b *bufferedLogger) Infof(template string, args ...interface{}) {
+	b.messages = append(b.messages, func(logger utils.Logger) { logger.Infof(template, args...) })
+}
+
+func (b *bufferedLogger) Warnf(template string, args ...interface{}) {
+	b.messages = append(b.messages, func(logger utils.Logger) { logger.Warnf(template, args...) })
+}
+
+func (b *bufferedLogger) Errorf(template string, args ...interface{}) {
+	b.messages = append(b.messages, func(logger utils.Logger) { logger.Errorf(template, args...) })
+}
+
+// Panicf is not buffered, since it doesn't return.
+func (b *bufferedLogger) Panicf(template string, args ...interface{}) {
+	b.logger.Panicf(template, args...)
+}
+
+// flush writes the held messages.
+func (b *bufferedLogger) flush() {
+	for _, message := range b.messages {
+		message(b.logger)
+	}
+	b.messages = nil
+}
@@ -0,0 +1,94 @@
+package sync
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/ristomcgehee/lyncser/filestore"
+)
+
+// ListOrphans returns the paths of the remote files that no tag's paths cover and that are not pinned, sorted by
+// path. These are deleted once the retention period in the global config has passed, or by Prune. A file in an
+// orphaned directory is not listed separately.
+func (s *Syncer) ListOrphans() ([]string, error) {
+	globalConfig, err := s.Config.GlobalConfig()
+	if err != nil {
+		return nil, err
+	}
+	remoteFiles, err := s.RemoteFileStore.GetFiles()
+	if err != nil {
+		return nil, err
+	}
+	return getOrphans(remoteFiles, globalConfig), nil
+}
+
+// Prune deletes the given orphaned remote files now instead of waiting for their retention period to pass. Paths that
+// are no longer orphaned, for example because the global config changed since ListOrphans was called, are skipped.
+// It takes the same locks as a sync. It returns the paths that were deleted.
+func (s *Syncer) Prune(paths []string) ([]string, error) {
+	unlock, err := s.Config.Lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	defer func() {
+		if err := s.releaseRemoteLock(); err != nil {
+			s.Logger.Warnf("Unable to release the remote lock: %v", err)
+		}
+	}()
+
+	globalConfig, err := s.Config.GlobalConfig()
+	if err != nil {
+		return nil, err
+	}
+	remoteFiles, err := s.RemoteFileStore.GetFiles()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.acquireRemoteLock(); err != nil {
+		return nil, err
+	}
+	remoteStateData, err := getRemoteStateData(s.RemoteFileStore)
+	if err != nil {
+		return nil, err
+	}
+	orphans := make(map[string]bool)
+	for _, orphan := range getOrphans(remoteFiles, globalConfig) {
+		orphans[orphan] = true
+	}
+	deleted := make([]string, 0, len(paths))
+	for _, path := range paths {
+		if !orphans[path] {
+			s.Logger.Warnf("Not deleting '%s' because it is no longer orphaned", path)
+			continue
+		}
+		if err := s.deleteOrphanedFile(path, remoteStateData); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, path)
+	}
+	if err := s.renewRemoteLock(); err != nil {
+		return deleted, err
+	}
+	return deleted, saveRemoteStateData(remoteStateData, s.RemoteFileStore, s.now())
+}
+
+// getOrphans returns the paths of the remote files that no tag's paths cover and that are not pinned, leaving out
+// files in orphaned directories.
+func getOrphans(remoteFiles []*filestore.StoredFile, globalConfig *GlobalConfig) []string {
+	paths := make([]string, 0)
+	for _, remoteFile := range remoteFiles {
+		if globalConfig.isOrphaned(remoteFile.Path) {
+			paths = append(paths, remoteFile.Path)
+		}
+	}
+	sort.Strings(paths)
+	orphans := make([]string, 0, len(paths))
+	for _, path := range paths {
+		if len(orphans) > 0 && strings.HasPrefix(path, orphans[len(orphans)-1]+"/") {
+			continue
+		}
+		orphans = append(orphans, path)
+	}
+	return orphans
+}
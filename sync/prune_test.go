@@ -0,0 +1,51 @@
+package sync
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ristomcgehee/lyncser/filestore"
+)
+
+func TestPruneNestedOrphans(t *testing.T) {
+	t.Parallel()
+	sim := newSimulation(t)
+	sim.globalConfig.TagPaths["all"] = []string{"~/docs"}
+	sim.globalConfig.RemoteRetentionDays = -1
+	a := sim.machine("A")
+	for _, path := range []string{"~/old/plan", "~/old/sub/deep", "~/old/sub/deeper/notes"} {
+		err := sim.remote.WriteFileContents(path, strings.NewReader(path), &filestore.FileMetadata{ModTime: sim.tick()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The sync marks every file and directory under ~/old as orphaned in the remote state.
+	if _, err := sim.sync(a); err != nil {
+		t.Fatal(err)
+	}
+
+	syncer := sim.newSyncer(a)
+	orphans, err := syncer.ListOrphans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 1 || orphans[0] != "~/old" {
+		t.Fatalf("expected only ~/old to be listed as orphaned, got %v", orphans)
+	}
+	if _, err := syncer.Prune(orphans); err != nil {
+		t.Fatal(err)
+	}
+
+	remoteStateData, err := getRemoteStateData(sim.remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path := range remoteStateData.FileStateData {
+		if path == "~/old" || strings.HasPrefix(path, "~/old/") {
+			t.Errorf("expected the remote state of '%s' to be dropped with its directory", path)
+		}
+	}
+	if _, err := sim.sync(a); err != nil {
+		t.Fatal(err)
+	}
+}
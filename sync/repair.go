@@ -0,0 +1,49 @@
+package sync
+
+import (
+	"github.com/ristomcgehee/lyncser/filestore"
+)
+
+// Repair fixes inconsistencies in the remote file store, such as two files at the same path. It takes the same locks
+// as a sync so that no sync runs at the same time. It returns a description of each fix.
+func (s *Syncer) Repair() ([]string, error) {
+	unlock, err := s.Config.Lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	defer func() {
+		if err := s.releaseRemoteLock(); err != nil {
+			s.Logger.Warnf("Unable to release the remote lock: %v", err)
+		}
+	}()
+
+	repairer, ok := s.RemoteFileStore.(filestore.RepairableFileStore)
+	if !ok {
+		return nil, nil
+	}
+	if _, err := s.RemoteFileStore.GetFiles(); err != nil {
+		return nil, err
+	}
+	if err := s.acquireRemoteLock(); err != nil {
+		return nil, err
+	}
+	return repairer.Repair()
+}
+
+// repairRemoteFilesIfNeeded repairs the remote file store if listing its files found inconsistencies, and returns the
+// files listed again afterwards. The remote lock must be held.
+func (s *Syncer) repairRemoteFilesIfNeeded(remoteFiles []*filestore.StoredFile) ([]*filestore.StoredFile, error) {
+	repairer, ok := s.RemoteFileStore.(filestore.RepairableFileStore)
+	if !ok || !repairer.NeedsRepair() {
+		return remoteFiles, nil
+	}
+	repairs, err := repairer.Repair()
+	for _, repair := range repairs {
+		s.Logger.Warnf("Repaired the remote file store: %s", repair)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.RemoteFileStore.GetFiles()
+}
@@ -0,0 +1,165 @@
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// Holds one JSON sync report per line, newest last.
+	syncReportFileName = "syncReports.jsonl"
+	// The report file is rotated once it grows past this size.
+	maxSyncReportFileSize = 1 << 20
+	// The number of rotated report files to keep, e.g. syncReports.jsonl.1 through syncReports.jsonl.5.
+	maxSyncReportBackups = 5
+)
+
+// SyncReport is a machine-readable summary of a sync, meant for monitoring.
+type SyncReport struct {
+	Profile string `json:"profile"`
+	// Pass to `lyncser undo` to undo this sync.
+	RunID     string    `json:"runId"`
+	StartTime time.Time `json:"startTime"`
+	EndTime   time.Time `json:"endTime"`
+	// True if the sync ran to completion and every file was synced.
+	Success bool `json:"success"`
+	// The error that stopped the sync, if any.
+	Error           string `json:"error,omitempty"`
+	Downloaded      int    `json:"downloaded"`
+	Uploaded        int    `json:"uploaded"`
+	MarkedDeleted   int    `json:"markedDeleted"`
+	NoChange        int    `json:"noChange"`
+	Deferred        int    `json:"deferred"`
+	Failed          int    `json:"failed"`
+	BytesUploaded   int64  `json:"bytesUploaded"`
+	BytesDownloaded int64  `json:"bytesDownloaded"`
+	// The files that could not be synced.
+	Errors []*ReportedError `json:"errors"`
+	// The paths of the files deferred to the next sync because of the transfer limits in the local config.
+	DeferredFiles []string `json:"deferredFiles"`
+	// The paths of the files deleted from the remote file store.
+	RemoteDeletions []string `json:"remoteDeletions"`
+	// The time spent in each phase of the sync in milliseconds. Key is the phase name.
+	PhaseDurationsMs map[string]int64 `json:"phaseDurationsMs"`
+}
+
+type ReportedError struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// Report returns the sync report for this result.
+func (r *SyncResult) Report() *SyncReport {
+	failures := r.Failures()
+	report := &SyncReport{
+		Profile:          r.Profile,
+		RunID:            r.RunID,
+		StartTime:        r.StartTime,
+		EndTime:          r.EndTime,
+		Success:          r.Err == nil && len(failures) == 0,
+		Downloaded:       r.Count(DownloadedFile),
+		Uploaded:         r.Count(UploadedFile),
+		MarkedDeleted:    r.Count(MarkedDeleted),
+		NoChange:         r.Count(NoChange),
+		Deferred:         r.Count(DeferredFile),
+		Failed:           len(failures),
+		BytesUploaded:    r.BytesUploaded,
+		BytesDownloaded:  r.BytesDownloaded,
+		Errors:           make([]*ReportedError, 0, len(failures)),
+		DeferredFiles:    r.Deferred(),
+		RemoteDeletions:  r.RemoteDeletions,
+		PhaseDurationsMs: map[string]int64{},
+	}
+	if r.Err != nil {
+		report.Error = r.Err.Error()
+	}
+	for _, failure := range failures {
+		report.Errors = append(report.Errors, &ReportedError{
+			Path:  failure.Path,
+			Error: failure.Err.Error(),
+		})
+	}
+	for phase, duration := range r.PhaseDurations {
+		report.PhaseDurationsMs[phase] = duration.Milliseconds()
+	}
+	return report
+}
+
+// SyncReportPath returns the real path of the file that sync reports are appended to.
+func (c *ConfigFiles) SyncReportPath() string {
+	return filepath.Join(c.Dir, syncReportFileName)
+}
+
+// SaveSyncReport appends the report to the report file, rotating it first if it has grown too large.
+func (c *ConfigFiles) SaveSyncReport(report *SyncReport) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if err := os.MkdirAll(c.Dir, 0o700); err != nil {
+		return err
+	}
+	reportPath := c.SyncReportPath()
+	if err := rotateReportFile(reportPath, int64(len(data))); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(reportPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// LastSyncReport implements ConfigProvider. A new report file is only started when a report is saved, so the most
+// recent report is always the last line of the current file.
+func (c *ConfigFiles) LastSyncReport() (*SyncReport, error) {
+	data, err := os.ReadFile(c.SyncReportPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	lastLine := lines[len(lines)-1]
+	if lastLine == "" {
+		return nil, nil
+	}
+	report := &SyncReport{}
+	if err := json.Unmarshal([]byte(lastLine), report); err != nil {
+		return nil, fmt.Errorf("error parsing the last sync report in %s: %w", c.SyncReportPath(), err)
+	}
+	return report, nil
+}
+
+// rotateReportFile renames the report file to make room for a new one if writing another bytesToAdd bytes would
+// make it larger than maxSyncReportFileSize. The oldest backup is discarded.
+func rotateReportFile(reportPath string, bytesToAdd int64) error {
+	info, err := os.Stat(reportPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Size()+bytesToAdd <= maxSyncReportFileSize {
+		return nil
+	}
+	for i := maxSyncReportBackups - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", reportPath, i), fmt.Sprintf("%s.%d", reportPath, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(reportPath, reportPath+".1")
+}
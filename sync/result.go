@@ -0,0 +1,123 @@
+package sync
+
+import (
+	"fmt"
+	"time"
+)
+
+func (o HandleFileOutcome) String() string {
+	switch o {
+	case DownloadedFile:
+		return "downloaded"
+	case UploadedFile:
+		return "uploaded"
+	case MarkedDeleted:
+		return "marked deleted"
+	case NoChange:
+		return "no change"
+	case DeferredFile:
+		return "deferred"
+	}
+	return fmt.Sprintf("HandleFileOutcome(%d)", int(o))
+}
+
+// FileResult is the outcome of syncing a single file or path.
+type FileResult struct {
+	// The friendly path of the file. For errors that prevented a configured path from being synced at all, this is
+	// the path from the global config.
+	Path    string
+	Outcome HandleFileOutcome
+	// The error that occurred while syncing this file, or nil if it was synced successfully.
+	Err error
+}
+
+// SyncResult lists what happened to each file during a sync.
+type SyncResult struct {
+	Files []*FileResult
+	// Identifies this sync in the journal used to undo it.
+	RunID string
+	// The profile that was synced.
+	Profile   string
+	StartTime time.Time
+	EndTime   time.Time
+	// The error that stopped the sync, if any.
+	Err error
+	// The number of bytes sent to and received from the remote file store when uploading and downloading files.
+	BytesUploaded   int64
+	BytesDownloaded int64
+	// The paths of the files deleted from the remote file store.
+	RemoteDeletions []string
+	// The time spent in each phase of the sync. Key is the phase name.
+	PhaseDurations map[string]time.Duration
+	// Key is path. Value is the index of its result in Files.
+	indexByPath map[string]int
+}
+
+func newSyncResult(startTime time.Time) *SyncResult {
+	return &SyncResult{
+		Files:           []*FileResult{},
+		RunID:           newRunID(startTime),
+		StartTime:       startTime.UTC(),
+		RemoteDeletions: []string{},
+		PhaseDurations:  map[string]time.Duration{},
+		indexByPath:     map[string]int{},
+	}
+}
+
+// addPhase records the time spent in a phase. If the sync runs again because the global config
+// was downloaded, the durations of both runs are added together.
+func (r *SyncResult) addPhase(name string, duration time.Duration) {
+	r.PhaseDurations[name] += duration
+}
+
+// addFile records the outcome of syncing a file. A file can be handled twice when the global config is downloaded
+// and the sync runs again; in that case the earlier result is only replaced if the new one did something.
+func (r *SyncResult) addFile(path string, outcome HandleFileOutcome, err error) {
+	result := &FileResult{
+		Path:    path,
+		Outcome: outcome,
+		Err:     err,
+	}
+	i, ok := r.indexByPath[path]
+	if !ok {
+		r.indexByPath[path] = len(r.Files)
+		r.Files = append(r.Files, result)
+		return
+	}
+	if err != nil || outcome != NoChange {
+		r.Files[i] = result
+	}
+}
+
+// Failures returns the results of the files that could not be synced.
+func (r *SyncResult) Failures() []*FileResult {
+	failures := make([]*FileResult, 0)
+	for _, file := range r.Files {
+		if file.Err != nil {
+			failures = append(failures, file)
+		}
+	}
+	return failures
+}
+
+// Deferred returns the paths of the files that were deferred to the next sync.
+func (r *SyncResult) Deferred() []string {
+	deferred := make([]string, 0)
+	for _, file := range r.Files {
+		if file.Err == nil && file.Outcome == DeferredFile {
+			deferred = append(deferred, file.Path)
+		}
+	}
+	return deferred
+}
+
+// Count returns the number of files that were synced successfully with the given outcome.
+func (r *SyncResult) Count(outcome HandleFileOutcome) int {
+	count := 0
+	for _, file := range r.Files {
+		if file.Err == nil && file.Outcome == outcome {
+			count++
+		}
+	}
+	return count
+}
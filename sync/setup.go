@@ -0,0 +1,88 @@
+package sync
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+
+	"github.com/ristomcgehee/lyncser/utils"
+)
+
+var ErrInvalidEncryptionKey = errors.New("invalid encryption key")
+
+// EncryptionKeyExists returns true if an encryption key has already been generated or imported on this machine.
+func (c *ConfigFiles) EncryptionKeyExists() (bool, error) {
+	return utils.PathExists(c.EncryptionKeyPath())
+}
+
+// ImportEncryptionKey saves a hex-encoded encryption key, such as one copied from another machine.
+func (c *ConfigFiles) ImportEncryptionKey(keyHex string) error {
+	keyHex = strings.TrimSpace(keyHex)
+	keyBytes, err := hex.DecodeString(keyHex)
+	if err != nil || len(keyBytes) != keyLengthBits/8 {
+		return fmt.Errorf("%w: expected %d hex characters", ErrInvalidEncryptionKey, keyLengthBits/4)
+	}
+	if err := os.MkdirAll(c.Dir, 0o700); err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(c.EncryptionKeyPath(), strings.NewReader(keyHex), 0o600)
+}
+
+// GetRemoteGlobalConfig downloads and decrypts the global config stored remotely. It returns nil if there is no
+// remote global config.
+func (s *Syncer) GetRemoteGlobalConfig() ([]byte, error) {
+	if _, err := s.RemoteFileStore.GetFiles(); err != nil {
+		return nil, err
+	}
+	exists, err := s.RemoteFileStore.FileExists(globalConfigPath)
+	if err != nil || !exists {
+		return nil, err
+	}
+	return s.readRemoteFile(s.globalConfigFile())
+}
+
+// GetConfigTags returns the tags defined in a global config file's contents, sorted by name.
+func GetConfigTags(globalConfigData []byte) ([]string, error) {
+	var config GlobalConfig
+	if err := yaml.Unmarshal(globalConfigData, &config); err != nil {
+		return nil, err
+	}
+	tags := make([]string, 0, len(config.TagPaths))
+	for tag := range config.TagPaths {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// ReadGlobalConfig returns the contents of the local global config file, or nil if it does not exist.
+func (c *ConfigFiles) ReadGlobalConfig() ([]byte, error) {
+	return readConfigFile(c.GlobalConfigPath())
+}
+
+// SaveGlobalConfig replaces the local global config file with the given contents.
+func (c *ConfigFiles) SaveGlobalConfig(data []byte) error {
+	if _, err := GetConfigTags(data); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.Dir, 0o700); err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(c.GlobalConfigPath(), bytes.NewReader(data), 0o600)
+}
+
+// GetLocalTags returns the tags this machine is associated with. The local config file is created if it does not
+// exist.
+func (c *ConfigFiles) GetLocalTags() ([]string, error) {
+	localConfig, err := c.LocalConfig()
+	if err != nil {
+		return nil, err
+	}
+	return localConfig.Tags, nil
+}
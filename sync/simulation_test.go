@@ -0,0 +1,567 @@
+package sync
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-bdd/gobdd"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+
+	"github.com/ristomcgehee/lyncser/filestore"
+	"github.com/ristomcgehee/lyncser/utils"
+)
+
+// simulation is a group of machines that sync with one remote file store. The machines share a clock that moves
+// forward a minute with every change, so changes made one after another have increasing modified times.
+type simulation struct {
+	t            *testing.T
+	now          time.Time
+	remote       *filestore.MemoryFileStore
+	globalConfig *GlobalConfig
+	machines     map[string]*machine
+}
+
+// machine is a simulated machine with its own config, state data and local files.
+type machine struct {
+	name   string
+	tags   []string
+	config *memoryConfig
+	local  *filestore.MemoryFileStore
+	// The machine's connection to the remote file store. If nil, the simulation's remote file store is used.
+	remote filestore.FileStore
+	// How far the machine's clock is ahead of the simulation's.
+	clockOffset time.Duration
+	// The machine's encryptor. If nil, files are not encrypted.
+	encryptor utils.ReaderEncryptor
+}
+
+// machineClock is a machine's clock, which can be off from the simulation's.
+type machineClock struct {
+	sim *simulation
+	m   *machine
+}
+
+// Now implements Clock.
+func (c machineClock) Now() time.Time {
+	return c.sim.now.Add(c.m.clockOffset)
+}
+
+func newSimulation(t *testing.T) *simulation {
+	sim := &simulation{
+		t:            t,
+		now:          time.Date(2021, 10, 1, 7, 0, 0, 0, time.UTC),
+		globalConfig: &GlobalConfig{TagPaths: map[string][]string{}},
+		machines:     map[string]*machine{},
+	}
+	sim.remote = filestore.NewMemoryFileStore(sim.Now)
+	return sim
+}
+
+// Now implements Clock.
+func (sim *simulation) Now() time.Time {
+	return sim.now
+}
+
+// tick moves the clock forward and returns the new time.
+func (sim *simulation) tick() time.Time {
+	sim.now = sim.now.Add(time.Minute)
+	return sim.now
+}
+
+// machine returns the machine with the given name, adding it with the tag "all" if it doesn't exist yet.
+func (sim *simulation) machine(name string) *machine {
+	m, ok := sim.machines[name]
+	if !ok {
+		m = &machine{
+			name: name,
+			tags: []string{"all"},
+		}
+		m.local = filestore.NewMemoryFileStore(machineClock{sim: sim, m: m}.Now)
+		sim.machines[name] = m
+	}
+	return m
+}
+
+// sortedMachines returns the machines in order of name.
+func (sim *simulation) sortedMachines() []*machine {
+	machines := make([]*machine, 0, len(sim.machines))
+	for _, m := range sim.machines {
+		machines = append(machines, m)
+	}
+	sort.Slice(machines, func(i, j int) bool {
+		return machines[i].name < machines[j].name
+	})
+	return machines
+}
+
+// sync runs a full sync on the machine and returns its result. The config is written before the machine's first
+// sync, as `lyncser init` would.
+func (sim *simulation) sync(m *machine) (*SyncResult, error) {
+	if m.config == nil {
+		m.config = &memoryConfig{
+			local:       m.local,
+			localConfig: &LocalConfig{Tags: m.tags},
+			machineID:   m.name,
+		}
+		data, err := yaml.Marshal(sim.globalConfig)
+		if err != nil {
+			return nil, err
+		}
+		err = m.local.WriteFileContents(m.config.GlobalConfigPath(), bytes.NewReader(data), &filestore.FileMetadata{})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sim.newSyncer(m).PerformSync()
+}
+
+func (sim *simulation) newSyncer(m *machine) *Syncer {
+	var remote filestore.FileStore = sim.remote
+	if m.remote != nil {
+		remote = m.remote
+	}
+	var encryptor utils.ReaderEncryptor = &utils.NopEncryptor{}
+	if m.encryptor != nil {
+		encryptor = m.encryptor
+	}
+	return &Syncer{
+		RemoteFileStore: remote,
+		LocalFileStore:  m.local,
+		Logger:          zap.NewNop().Sugar(),
+		Config:          m.config,
+		Clock:           machineClock{sim: sim, m: m},
+		Encryptor:       encryptor,
+	}
+}
+
+// isSynced returns true if the global config syncs path for any of the tags.
+func (sim *simulation) isSynced(path string, tags []string) bool {
+	for _, tag := range tags {
+		for _, pathToSync := range sim.globalConfig.TagPaths[tag] {
+			if path == pathToSync || strings.HasPrefix(path, pathToSync+"/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// memoryConfig is a machine's config and state data, kept in memory. The global config is read from the machine's
+// local file store, where it is synced like any other file.
+type memoryConfig struct {
+	local       *filestore.MemoryFileStore
+	localConfig *LocalConfig
+	// Saved as JSON so that the syncer can't change it without saving it.
+	stateData []byte
+	machineID string
+	// Key is run ID, then the side and path of the entry.
+	journal    map[string]map[string]*journaledFile
+	lastReport *SyncReport
+}
+
+type journaledFile struct {
+	entry    *JournalEntry
+	contents []byte
+}
+
+func (c *memoryConfig) ProfileName() string {
+	return utils.DefaultProfile
+}
+
+func (c *memoryConfig) GlobalConfigPath() string {
+	return "/lyncser/globalConfig.yaml"
+}
+
+func (c *memoryConfig) GlobalConfig() (*GlobalConfig, error) {
+	config := GlobalConfig{TagPaths: map[string][]string{}}
+	reader, err := c.local.GetFileContents(c.GlobalConfigPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return &config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	return &config, decodeConfigStrict(data, &config)
+}
+
+func (c *memoryConfig) LocalConfig() (*LocalConfig, error) {
+	return c.localConfig, nil
+}
+
+func (c *memoryConfig) LocalStateData() (*LocalStateData, bool, error) {
+	stateData := &LocalStateData{FileStateData: map[string]*LocalFileStateData{}}
+	if c.stateData == nil {
+		return stateData, false, nil
+	}
+	return stateData, false, json.Unmarshal(c.stateData, stateData)
+}
+
+func (c *memoryConfig) SaveLocalStateData(stateData *LocalStateData) error {
+	data, err := json.Marshal(stateData)
+	if err != nil {
+		return err
+	}
+	c.stateData = data
+	return nil
+}
+
+func (c *memoryConfig) MachineID() (string, error) {
+	return c.machineID, nil
+}
+
+func (c *memoryConfig) Lock() (func(), error) {
+	return func() {}, nil
+}
+
+func (c *memoryConfig) SaveSyncReport(report *SyncReport) error {
+	c.lastReport = report
+	return nil
+}
+
+func (c *memoryConfig) LastSyncReport() (*SyncReport, error) {
+	return c.lastReport, nil
+}
+
+func (c *memoryConfig) SaveJournalEntry(runID string, entry *JournalEntry, contents io.Reader) error {
+	var data []byte
+	if contents != nil {
+		var err error
+		if data, err = ioutil.ReadAll(contents); err != nil {
+			return err
+		}
+	}
+	if c.journal == nil {
+		c.journal = map[string]map[string]*journaledFile{}
+	}
+	if c.journal[runID] == nil {
+		c.journal[runID] = map[string]*journaledFile{}
+	}
+	c.journal[runID][string(entry.Side)+":"+entry.Path] = &journaledFile{entry: entry, contents: data}
+	return nil
+}
+
+func (c *memoryConfig) JournalEntries(runID string) ([]*JournalEntry, error) {
+	if len(c.journal[runID]) == 0 {
+		return nil, ErrRunNotFound
+	}
+	entries := make([]*JournalEntry, 0, len(c.journal[runID]))
+	for _, file := range c.journal[runID] {
+		entries = append(entries, file.entry)
+	}
+	sortJournalEntries(entries)
+	return entries, nil
+}
+
+func (c *memoryConfig) JournalContents(runID string, entry *JournalEntry) (io.ReadCloser, error) {
+	file := c.journal[runID][string(entry.Side)+":"+entry.Path]
+	return ioutil.NopCloser(bytes.NewReader(file.contents)), nil
+}
+
+func (c *memoryConfig) JournalRuns() ([]string, error) {
+	runIDs := make([]string, 0, len(c.journal))
+	for runID := range c.journal {
+		runIDs = append(runIDs, runID)
+	}
+	sort.Strings(runIDs)
+	return runIDs, nil
+}
+
+func (c *memoryConfig) DeleteJournalRun(runID string) error {
+	delete(c.journal, runID)
+	return nil
+}
+
+// readFile returns the contents of the file, or false if it doesn't exist.
+func readFile(store filestore.FileStore, path string) (string, bool) {
+	if exists, err := store.FileExists(path); err != nil || !exists {
+		return "", false
+	}
+	reader, err := store.GetFileContents(path)
+	if err != nil {
+		return "", false
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", false
+	}
+	return string(data), true
+}
+
+// Steps ===========================================================================================
+
+func getSimulation(ctx gobdd.Context) *simulation {
+	iface, _ := ctx.Get("simulation")
+	return iface.(*simulation)
+}
+
+func globalConfigSyncsPath(t gobdd.StepTest, ctx gobdd.Context, path, tag string) {
+	sim := getSimulation(ctx)
+	sim.globalConfig.TagPaths[tag] = append(sim.globalConfig.TagPaths[tag], path)
+}
+
+func globalConfigKeepsOrphans(t gobdd.StepTest, ctx gobdd.Context, days string) {
+	var err error
+	if getSimulation(ctx).globalConfig.RemoteRetentionDays, err = strconv.Atoi(days); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func globalConfigPinsPath(t gobdd.StepTest, ctx gobdd.Context, path string) {
+	sim := getSimulation(ctx)
+	sim.globalConfig.Pinned = append(sim.globalConfig.Pinned, path)
+}
+
+func machineHasTags(t gobdd.StepTest, ctx gobdd.Context, name, tags string) {
+	getSimulation(ctx).machine(name).tags = strings.Split(tags, ",")
+}
+
+func machineWritesFile(t gobdd.StepTest, ctx gobdd.Context, name, path, contents string) {
+	sim := getSimulation(ctx)
+	realPath, err := utils.RealPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := sim.machine(name)
+	err = m.local.WriteFileContents(realPath, strings.NewReader(contents), &filestore.FileMetadata{
+		ModTime: sim.tick().Add(m.clockOffset),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func machineClockIsAhead(t gobdd.StepTest, ctx gobdd.Context, name, minutes string) {
+	n, err := strconv.Atoi(minutes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getSimulation(ctx).machine(name).clockOffset = time.Duration(n) * time.Minute
+}
+
+func machineDeletesFile(t gobdd.StepTest, ctx gobdd.Context, name, path string) {
+	sim := getSimulation(ctx)
+	realPath, err := utils.RealPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.machine(name).local.DeleteFile(realPath); err != nil {
+		t.Fatal(err)
+	}
+	sim.tick()
+}
+
+// machineStopsSyncingPath removes path from the machine's copy of the global config. The machine's next sync uploads
+// the change.
+func machineStopsSyncingPath(t gobdd.StepTest, ctx gobdd.Context, name, path string) {
+	sim := getSimulation(ctx)
+	m := sim.machine(name)
+	globalConfig, err := m.config.GlobalConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for tag, paths := range globalConfig.TagPaths {
+		kept := make([]string, 0, len(paths))
+		for _, pathToSync := range paths {
+			if pathToSync != path {
+				kept = append(kept, pathToSync)
+			}
+		}
+		globalConfig.TagPaths[tag] = kept
+	}
+	data, err := yaml.Marshal(globalConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.local.WriteFileContents(m.config.GlobalConfigPath(), bytes.NewReader(data), &filestore.FileMetadata{
+		ModTime: sim.tick(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func daysPass(t gobdd.StepTest, ctx gobdd.Context, days string) {
+	n, err := strconv.Atoi(days)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim := getSimulation(ctx)
+	sim.now = sim.now.AddDate(0, 0, n)
+}
+
+func machinePrunes(t gobdd.StepTest, ctx gobdd.Context, name string) {
+	sim := getSimulation(ctx)
+	syncer := sim.newSyncer(sim.machine(name))
+	orphans, err := syncer.ListOrphans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := syncer.Prune(orphans); err != nil {
+		t.Fatal(err)
+	}
+	sim.tick()
+}
+
+// machineUndoesLastSync undoes the machine's last sync.
+func machineUndoesLastSync(t gobdd.StepTest, ctx gobdd.Context, name string) {
+	sim := getSimulation(ctx)
+	undone, err := sim.newSyncer(sim.machine(name)).Undo("", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range undone {
+		if file.Err != nil {
+			t.Errorf("unable to restore the %s copy of '%s': %v", file.Side, file.Path, file.Err)
+		}
+	}
+	sim.tick()
+}
+
+// machineShouldHaveNothingToUndo checks that the machine's last sync can't be undone, and that trying changes nothing.
+func machineShouldHaveNothingToUndo(t gobdd.StepTest, ctx gobdd.Context, name string) {
+	sim := getSimulation(ctx)
+	if _, err := sim.newSyncer(sim.machine(name)).Undo("", false); !errors.Is(err, ErrNothingToUndo) {
+		t.Errorf("expected nothing to undo, got %v", err)
+	}
+}
+
+func machineSyncs(t gobdd.StepTest, ctx gobdd.Context, name string) {
+	sim := getSimulation(ctx)
+	if _, err := sim.sync(sim.machine(name)); err != nil {
+		t.Fatal(err)
+	}
+	sim.tick()
+}
+
+func everyMachineSyncs(t gobdd.StepTest, ctx gobdd.Context) {
+	sim := getSimulation(ctx)
+	for _, m := range sim.sortedMachines() {
+		machineSyncs(t, ctx, m.name)
+	}
+}
+
+func machineShouldHaveFile(t gobdd.StepTest, ctx gobdd.Context, name, path, expected string) {
+	realPath, err := utils.RealPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, exists := readFile(getSimulation(ctx).machine(name).local, realPath)
+	if !exists || contents != expected {
+		t.Errorf("expected machine %s to have '%s' containing '%s', got '%s' (exists: %v)", name, path, expected,
+			contents, exists)
+	}
+}
+
+func machineShouldNotHaveFile(t gobdd.StepTest, ctx gobdd.Context, name, path string) {
+	realPath, err := utils.RealPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contents, exists := readFile(getSimulation(ctx).machine(name).local, realPath); exists {
+		t.Errorf("expected machine %s not to have '%s', but it contains '%s'", name, path, contents)
+	}
+}
+
+func remoteShouldHaveFile(t gobdd.StepTest, ctx gobdd.Context, path, expected string) {
+	contents, exists := readFile(getSimulation(ctx).remote, path)
+	if !exists || contents != expected {
+		t.Errorf("expected the remote to have '%s' containing '%s', got '%s' (exists: %v)", path, expected, contents,
+			exists)
+	}
+}
+
+func remoteShouldNotHaveFile(t gobdd.StepTest, ctx gobdd.Context, path string) {
+	if contents, exists := readFile(getSimulation(ctx).remote, path); exists {
+		t.Errorf("expected the remote not to have '%s', but it contains '%s'", path, contents)
+	}
+}
+
+// machinesShouldBeInSync syncs every machine once more and checks that nothing changes, then checks that every
+// machine has the remote copy of each file it syncs unless it deleted the file.
+func machinesShouldBeInSync(t gobdd.StepTest, ctx gobdd.Context) {
+	sim := getSimulation(ctx)
+	for _, m := range sim.sortedMachines() {
+		result, err := sim.sync(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range result.Files {
+			if file.Outcome != NoChange || file.Err != nil {
+				t.Errorf("machine %s: '%s' was %s (error: %v) after every machine had synced", m.name, file.Path,
+					file.Outcome, file.Err)
+			}
+		}
+	}
+	remoteFiles, err := sim.remote.GetFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range sim.sortedMachines() {
+		for _, remoteFile := range remoteFiles {
+			if remoteFile.IsDir || !sim.isSynced(remoteFile.Path, m.tags) {
+				continue
+			}
+			remoteContents, _ := readFile(sim.remote, remoteFile.Path)
+			realPath, err := utils.RealPath(remoteFile.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			localContents, exists := readFile(m.local, realPath)
+			stateData, _, err := m.config.LocalStateData()
+			if err != nil {
+				t.Fatal(err)
+			}
+			fileStateData, ok := stateData.FileStateData[remoteFile.Path]
+			deleted := ok && fileStateData.DeletedLocal
+			if (!exists && !deleted) || (exists && localContents != remoteContents) {
+				t.Errorf("machine %s: expected '%s' to contain '%s' or be deleted, got '%s' (exists: %v)", m.name,
+					remoteFile.Path, remoteContents, localContents, exists)
+			}
+		}
+	}
+}
+
+func TestSimulation(t *testing.T) {
+	t.Parallel()
+	suite := gobdd.NewSuite(t, gobdd.WithBeforeScenario(func(ctx gobdd.Context) {
+		iface, _ := ctx.Get(gobdd.TestingTKey{})
+		ctx.Set("simulation", newSimulation(iface.(*testing.T)))
+	}), gobdd.WithFeaturesPath("features/simulation.feature"))
+	suite.AddParameterTypes(`{quoted}`, []string{`"([^"]*)"`})
+	suite.AddStep(`^the global config syncs {quoted} for tag {quoted}$`, globalConfigSyncsPath)
+	suite.AddStep(`^the global config keeps orphaned files for {quoted} days$`, globalConfigKeepsOrphans)
+	suite.AddStep(`^the global config pins {quoted}$`, globalConfigPinsPath)
+	suite.AddStep(`^machine {quoted} has tags {quoted}$`, machineHasTags)
+	suite.AddStep(`^machine {quoted} writes {quoted} containing {quoted}$`, machineWritesFile)
+	suite.AddStep(`^machine {quoted}'s clock is {quoted} minutes ahead$`, machineClockIsAhead)
+	suite.AddStep(`^machine {quoted} deletes {quoted}$`, machineDeletesFile)
+	suite.AddStep(`^machine {quoted} stops syncing {quoted}$`, machineStopsSyncingPath)
+	suite.AddStep(`^{quoted} days pass$`, daysPass)
+	suite.AddStep(`^machine {quoted} prunes$`, machinePrunes)
+	suite.AddStep(`^machine {quoted} undoes its last sync$`, machineUndoesLastSync)
+	suite.AddStep(`^machine {quoted} should have nothing to undo$`, machineShouldHaveNothingToUndo)
+	suite.AddStep(`^machine {quoted} syncs$`, machineSyncs)
+	suite.AddStep(`^every machine syncs$`, everyMachineSyncs)
+	suite.AddStep(`^machine {quoted} should have {quoted} containing {quoted}$`, machineShouldHaveFile)
+	suite.AddStep(`^machine {quoted} should not have {quoted}$`, machineShouldNotHaveFile)
+	suite.AddStep(`^the remote should have {quoted} containing {quoted}$`, remoteShouldHaveFile)
+	suite.AddStep(`^the remote should not have {quoted}$`, remoteShouldNotHaveFile)
+	suite.AddStep(`^the machines should be in sync$`, machinesShouldBeInSync)
+	suite.Run()
+}
@@ -0,0 +1,247 @@
+package sync
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ristomcgehee/lyncser/utils"
+)
+
+type FileStatus string
+
+const (
+	// The local and remote copies are the same as of the last sync.
+	StatusInSync FileStatus = "in sync"
+	// The file has changed locally and will be uploaded on the next sync.
+	StatusLocallyModified FileStatus = "locally modified"
+	// The file has changed remotely and will be downloaded on the next sync.
+	StatusRemotelyModified FileStatus = "remotely modified"
+	// The file has changed both locally and remotely since the last sync.
+	StatusConflicted FileStatus = "conflicted"
+	// The file was deleted locally and will not be downloaded again.
+	StatusDeletedLocal FileStatus = "deleted locally"
+	// The file is no longer in the global config and will be deleted remotely.
+	StatusPendingRemoteDeletion FileStatus = "pending remote deletion"
+	// The file is in the global config but not for any of this machine's tags.
+	StatusExcluded FileStatus = "excluded by tags"
+	// The file is not in the global config at all.
+	StatusUntracked FileStatus = "untracked"
+)
+
+type PathStatus struct {
+	// The friendly path of the file, e.g. "~/.bashrc".
+	Path   string     `json:"path"`
+	Status FileStatus `json:"status"`
+	// The tags in the global config whose paths include this file.
+	Tags []string `json:"tags,omitempty"`
+	// The modified time of both copies of the file when it was last uploaded/downloaded from the cloud. Nil if it has
+	// never been synced.
+	LastCloudUpdate *time.Time `json:"lastCloudUpdate,omitempty"`
+	// When this file was last uploaded/downloaded from the cloud, by this machine's clock. Nil if it has never been
+	// synced.
+	LastSynced *time.Time `json:"lastSynced,omitempty"`
+	// When this file was marked for deletion in the remote state data. Only set for StatusPendingRemoteDeletion.
+	MarkDeleted *time.Time `json:"markDeleted,omitempty"`
+}
+
+// GetStatus compares local files, the local state data and the remote file store without changing any of them.
+// If filterPaths is not empty, only files under those paths are returned. Filter paths may be either friendly paths
+// or real paths.
+func (s *Syncer) GetStatus(filterPaths []string) ([]*PathStatus, error) {
+	globalConfig, err := s.Config.GlobalConfig()
+	if err != nil {
+		return nil, err
+	}
+	localConfig, err := s.Config.LocalConfig()
+	if err != nil {
+		return nil, err
+	}
+	err = s.loadLocalStateData()
+	if err != nil {
+		return nil, err
+	}
+	remoteFiles, err := s.RemoteFileStore.GetFiles()
+	if err != nil {
+		return nil, err
+	}
+	remoteStateData, err := getRemoteStateData(s.RemoteFileStore)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := map[string]*PathStatus{}
+	for tag, paths := range globalConfig.TagPaths {
+		for _, pathToSync := range paths {
+			filesToSync, err := s.getFilesToSync(pathToSync, remoteFiles)
+			if err != nil {
+				return nil, err
+			}
+			for _, file := range filesToSync {
+				if file.IsDir {
+					continue
+				}
+				status, ok := statuses[file.Path]
+				if !ok {
+					status = &PathStatus{
+						Path:   file.Path,
+						Status: StatusExcluded,
+					}
+					statuses[file.Path] = status
+				}
+				if !utils.InSlice(tag, status.Tags) {
+					status.Tags = append(status.Tags, tag)
+				}
+			}
+		}
+	}
+	if _, ok := statuses[globalConfigPath]; !ok {
+		statuses[globalConfigPath] = &PathStatus{
+			Path: globalConfigPath,
+		}
+	}
+	for _, remoteFile := range remoteFiles {
+		fileData, ok := remoteStateData.FileStateData[remoteFile.Path]
+		if !ok || remoteFile.IsDir {
+			continue
+		}
+		markDeleted := fileData.MarkDeleted
+		statuses[remoteFile.Path] = &PathStatus{
+			Path:        remoteFile.Path,
+			Status:      StatusPendingRemoteDeletion,
+			MarkDeleted: &markDeleted,
+		}
+	}
+
+	result := make([]*PathStatus, 0, len(statuses))
+	matchedFilterPaths := map[string]bool{}
+	for _, status := range statuses {
+		file, err := newSyncedFile(status.Path, false)
+		if err != nil {
+			return nil, err
+		}
+		if status.Path == globalConfigPath {
+			file = s.globalConfigFile()
+		}
+		matched := len(filterPaths) == 0
+		for _, filterPath := range filterPaths {
+			if matchesFilterPaths(file, []string{filterPath}) {
+				matched = true
+				matchedFilterPaths[filterPath] = true
+			}
+		}
+		if !matched {
+			continue
+		}
+		if status.Status == StatusPendingRemoteDeletion {
+			result = append(result, status)
+			continue
+		}
+		if status.Path == globalConfigPath || hasActiveTag(status.Tags, localConfig.Tags) {
+			if status.Status, err = s.getFileStatus(file); err != nil {
+				return nil, err
+			}
+		}
+		if fileState, ok := s.stateData.FileStateData[status.Path]; ok && utils.HasBeenSynced(fileState.LastCloudUpdate) {
+			lastCloudUpdate, lastSynced := fileState.LastCloudUpdate, fileState.lastSyncedAt()
+			status.LastCloudUpdate, status.LastSynced = &lastCloudUpdate, &lastSynced
+		}
+		result = append(result, status)
+	}
+	// Paths that were asked for explicitly but are not in the global config.
+	for _, filterPath := range filterPaths {
+		if !matchedFilterPaths[filterPath] {
+			result = append(result, &PathStatus{
+				Path:   filterPath,
+				Status: StatusUntracked,
+			})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Path < result[j].Path
+	})
+	return result, nil
+}
+
+// getFileStatus determines the status of a file that is synced on this machine. It uses the same rules as syncFile
+// to decide whether the file would be uploaded or downloaded.
+func (s *Syncer) getFileStatus(file SyncedFile) (FileStatus, error) {
+	friendlyPath, realPath := file.FriendlyPath, file.RealPath
+	fileExistsLocally, err := s.LocalFileStore.FileExists(realPath)
+	if err != nil {
+		return "", err
+	}
+	fileExistsRemotely, err := s.RemoteFileStore.FileExists(friendlyPath)
+	if err != nil {
+		return "", err
+	}
+	fileState, ok := s.stateData.FileStateData[friendlyPath]
+	if !ok {
+		fileState = &LocalFileStateData{LastCloudUpdate: utils.GetNeverSynced()}
+	}
+	if !fileExistsLocally && fileState.DeletedLocal {
+		return StatusDeletedLocal, nil
+	}
+	lastCloudUpdate := fileState.LastCloudUpdate
+	if doMarkDeleted(fileExistsLocally, lastCloudUpdate) {
+		return StatusDeletedLocal, nil
+	}
+
+	var modTimeCloud, modTimeLocal time.Time
+	if fileExistsRemotely {
+		if modTimeCloud, err = s.RemoteFileStore.GetModifiedTime(friendlyPath); err != nil {
+			return "", err
+		}
+	}
+	if fileExistsLocally {
+		if modTimeLocal, err = s.LocalFileStore.GetModifiedTime(realPath); err != nil {
+			return "", err
+		}
+		modTimeLocal = modTimeLocal.UTC()
+	}
+
+	if fileExistsLocally && fileExistsRemotely && utils.HasBeenSynced(lastCloudUpdate) &&
+		fileState.isLocallyModified(modTimeLocal) && fileState.isRemotelyModified(modTimeCloud) {
+		return StatusConflicted, nil
+	}
+	if doDownloadFile(fileExistsLocally, false, false, modTimeLocal, modTimeCloud, fileState) {
+		return StatusRemotelyModified, nil
+	}
+	if doUploadFile(fileExistsLocally, fileExistsRemotely, modTimeLocal, modTimeCloud, fileState) {
+		return StatusLocallyModified, nil
+	}
+	return StatusInSync, nil
+}
+
+// hasActiveTag returns true if any of fileTags is one of this machine's tags.
+func hasActiveTag(fileTags, localTags []string) bool {
+	for _, tag := range fileTags {
+		if utils.InSlice(tag, localTags) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesFilterPaths returns true if the file's friendly path or real path is equal to or under any of filterPaths.
+// An empty filterPaths matches everything.
+func matchesFilterPaths(file SyncedFile, filterPaths []string) bool {
+	if len(filterPaths) == 0 {
+		return true
+	}
+	for _, filterPath := range filterPaths {
+		filterPath = strings.TrimSuffix(filterPath, "/")
+		if !strings.HasPrefix(filterPath, "~") {
+			if absPath, err := filepath.Abs(filterPath); err == nil {
+				filterPath = absPath
+			}
+		}
+		for _, candidate := range []string{file.FriendlyPath, file.RealPath} {
+			if candidate != "" && (candidate == filterPath || strings.HasPrefix(candidate, filterPath+"/")) {
+				return true
+			}
+		}
+	}
+	return false
+}
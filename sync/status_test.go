@@ -0,0 +1,112 @@
+package sync
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ristomcgehee/lyncser/utils"
+)
+
+func TestGetStatus(t *testing.T) {
+	t.Parallel()
+	sim := newSimulation(t)
+	sim.globalConfig.TagPaths["all"] = []string{"~/docs"}
+	sim.globalConfig.TagPaths["work"] = []string{"~/work"}
+	a, b := sim.machine("A"), sim.machine("B")
+	b.tags = []string{"all", "work"}
+	syncMachine := func(m *machine) {
+		t.Helper()
+		if _, err := sim.sync(m); err != nil {
+			t.Fatal(err)
+		}
+		sim.tick()
+	}
+
+	for _, name := range []string{"same", "local", "remote", "both", "deleted"} {
+		writeSimulatedFile(t, sim, a, "~/docs/"+name, "v1")
+	}
+	writeSimulatedFile(t, sim, b, "~/work/plan", "v1")
+	syncMachine(a)
+	syncMachine(b)
+	syncMachine(a)
+
+	writeSimulatedFile(t, sim, a, "~/docs/local", "v2")
+	writeSimulatedFile(t, sim, b, "~/docs/remote", "v2")
+	writeSimulatedFile(t, sim, a, "~/docs/both", "v2 from A")
+	writeSimulatedFile(t, sim, b, "~/docs/both", "v2 from B")
+	syncMachine(b)
+	realPath, err := utils.RealPath("~/docs/deleted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.local.DeleteFile(realPath); err != nil {
+		t.Fatal(err)
+	}
+
+	statuses, err := sim.newSyncer(a).GetStatus(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]FileStatus{
+		globalConfigPath: StatusInSync,
+		"~/docs/same":    StatusInSync,
+		"~/docs/local":   StatusLocallyModified,
+		"~/docs/remote":  StatusRemotelyModified,
+		"~/docs/both":    StatusConflicted,
+		"~/docs/deleted": StatusDeletedLocal,
+		"~/work/plan":    StatusExcluded,
+	}
+	for _, status := range statuses {
+		if status.Status != expected[status.Path] {
+			t.Errorf("%s: expected %q, got %q", status.Path, expected[status.Path], status.Status)
+		}
+		delete(expected, status.Path)
+	}
+	for path := range expected {
+		t.Errorf("%s: no status", path)
+	}
+
+	// Paths that are asked for but not in the global config are untracked.
+	statuses, err = sim.newSyncer(a).GetStatus([]string{"~/docs/local", "~/notes"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 2 || statuses[0].Path != "~/docs/local" || statuses[0].Status != StatusLocallyModified ||
+		statuses[1].Path != "~/notes" || statuses[1].Status != StatusUntracked {
+		for _, status := range statuses {
+			t.Errorf("unexpected statuses for the filter paths: %s is %q", status.Path, status.Status)
+		}
+	}
+}
+
+func TestGetStatusWithClockSkew(t *testing.T) {
+	t.Parallel()
+	sim := newSimulation(t)
+	sim.globalConfig.TagPaths["all"] = []string{"~/docs"}
+	a, b := sim.machine("A"), sim.machine("B")
+	a.clockOffset = time.Hour
+	writeSimulatedFile(t, sim, a, "~/docs/notes", "v1")
+	for _, m := range []*machine{a, b} {
+		if _, err := sim.sync(m); err != nil {
+			t.Fatal(err)
+		}
+		sim.tick()
+	}
+
+	// B's copy has A's modified time, which is later than anything on B's clock.
+	checkStatus := func(expected FileStatus) {
+		t.Helper()
+		statuses, err := sim.newSyncer(b).GetStatus([]string{"~/docs/notes"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, status := range statuses {
+			if status.Status != expected {
+				t.Errorf("expected %s to be %q, got %q", status.Path, expected, status.Status)
+			}
+		}
+	}
+	checkStatus(StatusInSync)
+	writeSimulatedFile(t, sim, b, "~/docs/notes", "v2")
+	checkStatus(StatusLocallyModified)
+}
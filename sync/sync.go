@@ -1,23 +1,68 @@
 package sync
 
 import (
+	"encoding/hex"
 	"errors"
-	"io/fs"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
-	"path/filepath"
+	"sort"
 	"strings"
+	gosync "sync"
 	"time"
 
 	"github.com/ristomcgehee/lyncser/filestore"
 	"github.com/ristomcgehee/lyncser/utils"
 )
 
+var (
+	// Returned when a remote file was encrypted with a different key than this machine's.
+	ErrKeyMismatch      = errors.New("the file was encrypted with a different encryption key")
+	errLocalNotWalkable = errors.New("the local file store can't list the files in a directory")
+)
+
 type SyncedFile struct {
 	FriendlyPath string
 	RealPath     string
 	IsRemoteDir  bool
 }
 
+// globalConfigFile returns the SyncedFile for the global config. It is stored locally in the config directory and
+// remotely at globalConfigPath.
+func (s *Syncer) globalConfigFile() SyncedFile {
+	return SyncedFile{
+		FriendlyPath: globalConfigPath,
+		RealPath:     s.Config.GlobalConfigPath(),
+	}
+}
+
+// loadLocalStateData loads the local state data into s.stateData, falling back to the backup if it is corrupt.
+func (s *Syncer) loadLocalStateData() error {
+	stateData, recovered, err := s.Config.LocalStateData()
+	if err != nil {
+		return err
+	}
+	if recovered {
+		s.Logger.Warnf("The local state data is corrupt. Using the backup from the previous sync instead.")
+	}
+	s.stateData = stateData
+	return nil
+}
+
+// newSyncedFile creates a SyncedFile for the given friendly path.
+func newSyncedFile(friendlyPath string, isRemoteDir bool) (SyncedFile, error) {
+	realPath, err := utils.RealPath(friendlyPath)
+	if err != nil {
+		return SyncedFile{}, err
+	}
+	return SyncedFile{
+		FriendlyPath: friendlyPath,
+		RealPath:     realPath,
+		IsRemoteDir:  isRemoteDir,
+	}, nil
+}
+
 type HandleFileOutcome int
 
 const (
@@ -25,87 +70,239 @@ const (
 	UploadedFile
 	MarkedDeleted
 	NoChange
+	// The file was not transferred because of a limit in the local config. It is tried again in the next sync.
+	DeferredFile
 )
 
+// Clock tells the current time. It can be replaced to control time in tests.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
 type Syncer struct {
 	RemoteFileStore filestore.FileStore
 	LocalFileStore  filestore.FileStore
 	Logger          utils.Logger
+	// Loads and saves the config and state data.
+	Config ConfigProvider
+	// Tells the current time. If nil, the system clock is used.
+	Clock Clock
 	// Used to encrypt files stored in the remote file store.
 	Encryptor utils.ReaderEncryptor
 	// ForceDownload will download a file even if the local modified time is after the remote modified time.
 	ForceDownload bool
-	stateData     *LocalStateData
+	// BreakLock takes over the remote lock even if another machine's lease on it has not expired.
+	BreakLock bool
+	// The number of files synced at the same time. If 0, the local config's parallelism or DefaultParallelism is
+	// used.
+	Parallelism int
+	// Guards stateData, machineID and the byte counts in result while files are synced in parallel.
+	mu        gosync.Mutex
+	stateData *LocalStateData
+	// Limit the rate of uploads and downloads. Nil if there is no limit.
+	uploadLimiter   *utils.RateLimiter
+	downloadLimiter *utils.RateLimiter
+	// Decides which files are too large to transfer during PerformSync. Nil when files are synced outside of it.
+	transferLimits *transferLimits
+	// Identifies this machine in the metadata of uploaded files. Loaded when the first file is uploaded.
+	machineID string
+	// Identifies this process in the remote lock.
+	remoteLockID        string
+	holdsRemoteLock     bool
+	remoteLockExpiresAt time.Time
+	// Records what happens during PerformSync. Nil when files are synced outside of PerformSync.
+	result *SyncResult
 }
 
-// PerformSync does the entire sync from end to end.
-func (s *Syncer) PerformSync() error {
-	globalConfig, err := getGlobalConfig()
+// Names of the phases of a sync, used in the sync report.
+const (
+	phaseLoadConfig = "loadConfig"
+	phaseListRemote = "listRemoteFiles"
+	phaseSyncFiles  = "syncFiles"
+	phaseCleanup    = "cleanupRemoteFiles"
+	phaseSaveState  = "saveState"
+	phaseSaveReport = "saveReport"
+)
+
+// PerformSync does the entire sync from end to end. Failures to sync individual files are recorded in the returned
+// result rather than stopping the sync. An error is returned if the sync could not be performed at all.
+// The result is also saved as a sync report in the config directory.
+func (s *Syncer) PerformSync() (*SyncResult, error) {
+	unlock, err := s.Config.Lock()
+	if err != nil {
+		return newSyncResult(s.now()), err
+	}
+	defer unlock()
+	defer func() {
+		if err := s.releaseRemoteLock(); err != nil {
+			s.Logger.Warnf("Unable to release the remote lock: %v", err)
+		}
+	}()
+
+	s.result = newSyncResult(s.now())
+	defer func() {
+		s.result = nil
+		s.transferLimits = nil
+	}()
+	result := s.result
+	result.Profile = s.Config.ProfileName()
+	result.Err = s.performSync()
+	result.EndTime = s.now().UTC()
+
+	phaseStart := s.now()
+	if err := s.Config.SaveSyncReport(result.Report()); err != nil {
+		s.Logger.Warnf("Unable to save the sync report: %v", err)
+	}
+	result.addPhase(phaseSaveReport, s.now().Sub(phaseStart))
+	return result, result.Err
+}
+
+func (s *Syncer) performSync() error {
+	phaseStart := s.now()
+	globalConfig, err := s.Config.GlobalConfig()
 	if err != nil {
 		return err
 	}
-	localConfig, err := getLocalConfig()
+	localConfig, err := s.Config.LocalConfig()
 	if err != nil {
 		return err
 	}
-	s.stateData, err = getLocalStateData()
+	err = s.loadLocalStateData()
 	if err != nil {
 		return err
 	}
+	if resumable, ok := s.RemoteFileStore.(filestore.ResumableFileStore); ok {
+		resumable.SetUploadSessionStore(&uploadSessionStore{syncer: s})
+	}
+	if err := s.pruneJournal(localConfig); err != nil {
+		s.Logger.Warnf("Unable to delete old journal entries: %v", err)
+	}
+	s.uploadLimiter, s.downloadLimiter = newRateLimiters(localConfig)
+	if limited, ok := s.RemoteFileStore.(filestore.RateLimitedFileStore); ok {
+		limited.SetUploadLimiter(s.uploadLimiter)
+	}
+	if s.transferLimits == nil {
+		// The transfer cap covers the whole sync, including when it runs again after downloading the global config.
+		s.transferLimits = newTransferLimits(localConfig, globalConfig)
+	}
+	s.result.addPhase(phaseLoadConfig, s.now().Sub(phaseStart))
 
+	phaseStart = s.now()
 	remoteFiles, err := s.RemoteFileStore.GetFiles()
 	if err != nil {
 		return err
 	}
+	if err := s.acquireRemoteLock(); err != nil {
+		return err
+	}
+	if remoteFiles, err = s.repairRemoteFilesIfNeeded(remoteFiles); err != nil {
+		return err
+	}
+	s.result.addPhase(phaseListRemote, s.now().Sub(phaseStart))
 
+	phaseStart = s.now()
+	jobs := make([]*fileJob, 0)
+	queued := make(map[string]bool)
 	for tag, paths := range globalConfig.TagPaths {
 		if !utils.InSlice(tag, localConfig.Tags) {
 			continue
 		}
 		for _, pathToSync := range paths {
-			if err := s.syncPath(pathToSync, remoteFiles); err != nil {
+			filesToSync, err := s.getFilesToSync(pathToSync, remoteFiles)
+			if err != nil {
 				s.Logger.Errorf("Error syncing path '%s': %s", pathToSync, err)
+				s.result.addFile(pathToSync, NoChange, err)
+				continue
+			}
+			for _, file := range filesToSync {
+				// A file covered by more than one path is only synced once.
+				if !queued[file.Path] {
+					queued[file.Path] = true
+					jobs = append(jobs, newFileJob(file.Path, file.IsDir, s.Logger))
+				}
 			}
 		}
 	}
+	if err := s.syncFiles(jobs, s.getParallelism(localConfig)); err != nil {
+		return err
+	}
 	// globalConfigPath gets uploaded even if it's not explicitly listed
-	handleFileOutcome, err := s.handleFile(globalConfigPath, false)
+	handleFileOutcome, err := s.handleSyncedFile(s.globalConfigFile(), s.Logger)
 	if err != nil {
 		s.Logger.Errorf("Error syncing file '%s': %v", globalConfigPath, err)
 	}
+	s.result.addFile(globalConfigPath, handleFileOutcome, err)
+	s.result.addPhase(phaseSyncFiles, s.now().Sub(phaseStart))
 	if handleFileOutcome == DownloadedFile {
-		err = s.PerformSync()
-		if err != nil {
+		// The sync runs again with the new global config. It reloads the state data, so the download is saved first.
+		// The remote files are cleaned up by that sync, which knows which paths the new global config covers.
+		if err := s.Config.SaveLocalStateData(s.stateData); err != nil {
 			return err
 		}
+		return s.performSync()
 	}
+	phaseStart = s.now()
 	if _, err = s.cleanupRemoteFiles(remoteFiles, globalConfig); err != nil {
 		return err
 	}
+	s.result.addPhase(phaseCleanup, s.now().Sub(phaseStart))
 
-	return saveLocalStateData(s.stateData)
+	phaseStart = s.now()
+	err = s.Config.SaveLocalStateData(s.stateData)
+	s.result.addPhase(phaseSaveState, s.now().Sub(phaseStart))
+	return err
 }
 
-// syncPath syncs the given path, recursively if it's a directory.
-func (s *Syncer) syncPath(pathToSync string, remoteFiles []*filestore.StoredFile) error {
+// now returns the current time according to s.Clock.
+func (s *Syncer) now() time.Time {
+	if s.Clock == nil {
+		return systemClock{}.Now()
+	}
+	return s.Clock.Now()
+}
+
+// getParallelism returns the number of files to sync at the same time.
+func (s *Syncer) getParallelism(localConfig *LocalConfig) int {
+	if s.Parallelism > 0 {
+		return s.Parallelism
+	}
+	if localConfig.Parallelism > 0 {
+		return localConfig.Parallelism
+	}
+	return DefaultParallelism
+}
+
+// getFilesToSync returns every file under pathToSync that exists locally or remotely. The returned paths are friendly
+// paths, and IsDir is set when the file is a directory in the remote file store.
+func (s *Syncer) getFilesToSync(pathToSync string, remoteFiles []*filestore.StoredFile) ([]*filestore.StoredFile,
+	error) {
 	realPath, err := utils.RealPath(pathToSync)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	realPath, err = filepath.EvalSymlinks(realPath)
-	if err != nil && !errors.Is(err, fs.ErrNotExist) {
-		return err
+	localFileStore, ok := s.LocalFileStore.(filestore.WalkableFileStore)
+	if !ok {
+		return nil, errLocalNotWalkable
 	}
-	remoteFilesToHandle := getMatchingRemoteFiles(pathToSync, realPath, remoteFiles)
+	localPaths, isDir, err := localFileStore.WalkFiles(realPath)
+	if err != nil {
+		s.Logger.Errorf("Error walking directory '%s': %v", pathToSync, err)
+	}
+	isFile := !isDir && len(localPaths) > 0
+	if !isDir && len(localPaths) == 0 {
+		// pathToSync doesn't exist locally. It is still synced so that it can be downloaded.
+		localPaths = []string{realPath}
+	}
+	remoteFilesToHandle := getMatchingRemoteFiles(pathToSync, isFile, remoteFiles)
+	filesToSync := make([]*filestore.StoredFile, 0)
 
-	// Recursively sync pathToSync.
-	err = filepath.WalkDir(realPath, func(path string, d fs.DirEntry, err error) error {
-		if err != nil && !errors.Is(err, fs.ErrNotExist) {
-			return err
-		}
-		if d != nil && (d.IsDir() || !d.Type().IsRegular()) {
-			return nil
-		}
+	for _, path := range localPaths {
 		path = strings.Replace(path, realPath, pathToSync, 1)
 		var remoteFile *filestore.StoredFile
 		idxRemoteFile := -1
@@ -116,35 +313,25 @@ func (s *Syncer) syncPath(pathToSync string, remoteFiles []*filestore.StoredFile
 				break
 			}
 		}
-		isRemoteDir := remoteFile != nil && remoteFile.IsDir
-		if _, err = s.handleFile(path, isRemoteDir); err != nil {
-			s.Logger.Errorf("Error syncing file '%s': %v", path, err)
-		}
+		filesToSync = append(filesToSync, &filestore.StoredFile{
+			Path:  path,
+			IsDir: remoteFile != nil && remoteFile.IsDir,
+		})
 		if remoteFile != nil {
 			remoteFilesToHandle = append(remoteFilesToHandle[:idxRemoteFile], remoteFilesToHandle[idxRemoteFile+1:]...)
 		}
-		return nil
-	})
-	if err != nil {
-		s.Logger.Errorf("Error walking directory '%s': %v", pathToSync, err)
-	}
-
-	// For any files that were not found locally, we'll download them now.
-	for _, remoteFile := range remoteFilesToHandle {
-		if _, err = s.handleFile(remoteFile.Path, remoteFile.IsDir); err != nil {
-			s.Logger.Errorf("Error syncing remote file '%s': %v", remoteFile, err)
-		}
 	}
 
-	return nil
+	// Any files that were not found locally only exist remotely.
+	filesToSync = append(filesToSync, remoteFilesToHandle...)
+	return filesToSync, nil
 }
 
-// Get all the remote files that start with pathToSync if it is a directory.
-func getMatchingRemoteFiles(pathToSync, realPath string, remoteFiles []*filestore.StoredFile) []*filestore.StoredFile {
+// Get all the remote files that start with pathToSync, unless it is a file locally.
+func getMatchingRemoteFiles(pathToSync string, isFile bool,
+	remoteFiles []*filestore.StoredFile) []*filestore.StoredFile {
 	remoteFilesToHandle := make([]*filestore.StoredFile, 0)
-	//nolint:errcheck
-	stat, _ := os.Stat(realPath)
-	if stat != nil && !stat.IsDir() {
+	if isFile {
 		return remoteFilesToHandle
 	}
 	for _, remoteFile := range remoteFiles {
@@ -156,76 +343,107 @@ func getMatchingRemoteFiles(pathToSync, realPath string, remoteFiles []*filestor
 	return remoteFilesToHandle
 }
 
-// Creates the file if it does not exist in the cloud, otherwise downloads or uploads the file to the cloud.
-func (s *Syncer) handleFile(fileName string, isRemoteDir bool) (HandleFileOutcome, error) {
-	realPath, err := utils.RealPath(fileName)
+// Creates the file if it does not exist in the cloud, otherwise downloads or uploads the file to the cloud. Messages
+// about the file are written to logger. Files may be handled in parallel as long as each file is only handled once at a
+// time.
+func (s *Syncer) handleFile(fileName string, isRemoteDir bool, logger utils.Logger) (HandleFileOutcome, error) {
+	file, err := newSyncedFile(fileName, isRemoteDir)
 	if err != nil {
 		return NoChange, err
 	}
-	file := SyncedFile{
-		FriendlyPath: fileName,
-		RealPath:     realPath,
-		IsRemoteDir:  isRemoteDir,
-	}
+	return s.handleSyncedFile(file, logger)
+}
+
+// handleSyncedFile is like handleFile but takes a SyncedFile whose real path may not be the friendly path expanded.
+func (s *Syncer) handleSyncedFile(file SyncedFile, logger utils.Logger) (HandleFileOutcome, error) {
 	fileExistsLocally, err := s.LocalFileStore.FileExists(file.RealPath)
 	if err != nil {
 		return NoChange, err
 	}
-	if _, ok := s.stateData.FileStateData[file.FriendlyPath]; !ok {
-		s.stateData.FileStateData[file.FriendlyPath] = &LocalFileStateData{
-			LastCloudUpdate: utils.GetNeverSynced(),
-		}
-	}
+	fileStateData := s.getFileStateData(file.FriendlyPath)
 	// Once a file is deleted locally, it's not downloaded again.
-	if !fileExistsLocally && s.stateData.FileStateData[file.FriendlyPath].DeletedLocal {
+	if !fileExistsLocally && fileStateData.DeletedLocal {
 		return NoChange, nil
 	}
 	if fileExistsLocally {
-		s.stateData.FileStateData[file.FriendlyPath].DeletedLocal = false
+		s.mu.Lock()
+		fileStateData.DeletedLocal = false
+		s.mu.Unlock()
 	}
-	s.Logger.Infof("Syncing %s", file.FriendlyPath)
+	logger.Infof("Syncing %s", file.FriendlyPath)
 	fileExistsRemotely, err := s.RemoteFileStore.FileExists(file.FriendlyPath)
 	if err != nil {
 		return NoChange, err
 	}
 	if !fileExistsRemotely && !fileExistsLocally {
-		s.Logger.Warnf("File '%s' does not exist locally or remotely", file.FriendlyPath) // ¯\_(ツ)_/¯
+		logger.Warnf("File '%s' does not exist locally or remotely", file.FriendlyPath) // ¯\_(ツ)_/¯
 		return NoChange, nil
 	}
-	handleFileOutcome, err := s.syncFile(file, fileExistsLocally, fileExistsRemotely)
-	if err != nil {
-		return handleFileOutcome, err
+	return s.syncFile(file, fileExistsLocally, fileExistsRemotely, logger)
+}
+
+// getFileStateData returns the state data of the file, adding it if the file has none yet. Its fields may only be
+// changed while s.mu is held.
+func (s *Syncer) getFileStateData(friendlyPath string) *LocalFileStateData {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fileStateData, ok := s.stateData.FileStateData[friendlyPath]
+	if !ok {
+		fileStateData = &LocalFileStateData{
+			LastCloudUpdate: utils.GetNeverSynced(),
+		}
+		s.stateData.FileStateData[friendlyPath] = fileStateData
 	}
-	s.stateData.FileStateData[file.FriendlyPath].LastCloudUpdate = time.Now().UTC()
-	return handleFileOutcome, nil
+	return fileStateData
 }
 
-// Returns true if the file should be uploaded.
-func doUploadFile(fileExistsLocally, fileExistsRemotely bool, modTimeLocal, modTimeCloud,
-	lastCloudUpdate time.Time) bool {
+// isLocallyModified returns true if the local copy of the file changed since it was last synced. LastSynced is from
+// this machine's clock, like the local modified time. A file that still has the modified time it was synced with is
+// unchanged, even if another machine's clock put that time after LastSynced.
+func (f *LocalFileStateData) isLocallyModified(modTimeLocal time.Time) bool {
+	return modTimeLocal.After(f.lastSyncedAt()) && !modTimeLocal.Equal(f.LastCloudUpdate)
+}
+
+// isRemotelyModified returns true if the remote copy of the file changed since it was last synced. The remote modified
+// time may be from a machine whose clock is behind this one's, so any other modified time counts as a change. Times
+// are compared to the millisecond, which is all that Google Drive keeps. Older versions of lyncser recorded the time of
+// the sync as LastCloudUpdate, so for their state data only a later modified time counts.
+func (f *LocalFileStateData) isRemotelyModified(modTimeCloud time.Time) bool {
+	if f.LastSynced.IsZero() {
+		return modTimeCloud.After(f.LastCloudUpdate)
+	}
+	return !modTimeCloud.Truncate(time.Millisecond).Equal(f.LastCloudUpdate.Truncate(time.Millisecond))
+}
+
+// Returns true if the file should be uploaded. When both copies changed since the last sync, the one with the later
+// modified time is kept.
+func doUploadFile(fileExistsLocally, fileExistsRemotely bool, modTimeLocal, modTimeCloud time.Time,
+	fileState *LocalFileStateData) bool {
 	if !fileExistsRemotely {
 		return true
 	}
-	if !fileExistsLocally {
+	if !fileExistsLocally || !utils.HasBeenSynced(fileState.LastCloudUpdate) || !fileState.isLocallyModified(modTimeLocal) {
 		return false
 	}
-	return modTimeLocal.After(modTimeCloud) && utils.HasBeenSynced(lastCloudUpdate) &&
-		modTimeLocal.After(lastCloudUpdate)
+	return !fileState.isRemotelyModified(modTimeCloud) || modTimeLocal.After(modTimeCloud)
 }
 
 // Returns true if the file should be downloaded.
-func doDownloadFile(fileExistsLocally, isRemoteDir, forceDownload bool, modTimeLocal, modTimeCloud,
-	lastCloudUpdate time.Time) bool {
+func doDownloadFile(fileExistsLocally, isRemoteDir, forceDownload bool, modTimeLocal, modTimeCloud time.Time,
+	fileState *LocalFileStateData) bool {
 	if isRemoteDir {
 		return false
 	}
 	if forceDownload {
 		return true
 	}
-	if !fileExistsLocally && !utils.HasBeenSynced(lastCloudUpdate) {
+	if !fileExistsLocally && !utils.HasBeenSynced(fileState.LastCloudUpdate) {
 		return true
 	}
-	return fileExistsLocally && modTimeCloud.After(modTimeLocal) && lastCloudUpdate.Before(modTimeCloud)
+	if !fileExistsLocally || !fileState.isRemotelyModified(modTimeCloud) {
+		return false
+	}
+	return !fileState.isLocallyModified(modTimeLocal) || modTimeCloud.After(modTimeLocal)
 }
 
 // Returns true if the files should be marked as deleted.
@@ -234,7 +452,8 @@ func doMarkDeleted(fileExistsLocally bool, lastCloudUpdate time.Time) bool {
 }
 
 // syncFile uploads/downloads the file as necessary.
-func (s *Syncer) syncFile(file SyncedFile, fileExistsLocally, fileExistsRemotely bool) (HandleFileOutcome, error) {
+func (s *Syncer) syncFile(file SyncedFile, fileExistsLocally, fileExistsRemotely bool,
+	logger utils.Logger) (HandleFileOutcome, error) {
 	var err error
 	var modTimeCloud time.Time
 	if fileExistsRemotely {
@@ -251,69 +470,220 @@ func (s *Syncer) syncFile(file SyncedFile, fileExistsLocally, fileExistsRemotely
 		}
 		modTimeLocal = modTimeLocal.UTC()
 	}
-	lastCloudUpdate := s.stateData.FileStateData[file.FriendlyPath].LastCloudUpdate
+	fileStateData := s.getFileStateData(file.FriendlyPath)
+	s.mu.Lock()
+	lastSync := *fileStateData
+	s.mu.Unlock()
+	lastCloudUpdate := lastSync.LastCloudUpdate
 
 	downloadFile := doDownloadFile(fileExistsLocally, file.IsRemoteDir, s.ForceDownload, modTimeLocal, modTimeCloud,
-		lastCloudUpdate)
-	uploadFile := doUploadFile(fileExistsLocally, fileExistsRemotely, modTimeLocal, modTimeCloud, lastCloudUpdate)
+		&lastSync)
+	uploadFile := doUploadFile(fileExistsLocally, fileExistsRemotely, modTimeLocal, modTimeCloud, &lastSync)
 	markDeleted := doMarkDeleted(fileExistsLocally, lastCloudUpdate)
 
+	// After an upload or download, both copies have the same modified time, which is recorded as the last cloud
+	// update, along with the time of the sync by this machine's clock. The time is taken before the file is read, so
+	// that a change made during an upload is uploaded by the next sync.
+	syncedAt := s.now().UTC()
 	switch {
 	case downloadFile:
-		if err := s.downloadFile(file); err != nil {
+		if err := s.downloadFile(file, modTimeCloud); errors.Is(err, errTransferDeferred) {
+			logger.Warnf("Download of '%s' %v", file.FriendlyPath, err)
+			return DeferredFile, nil
+		} else if err != nil {
 			return NoChange, err
 		}
-		s.Logger.Infof("File '%s' successfully downloaded", file.FriendlyPath)
+		s.mu.Lock()
+		fileStateData.LastCloudUpdate = modTimeCloud
+		fileStateData.LastSynced = syncedAt
+		s.mu.Unlock()
+		logger.Infof("File '%s' successfully downloaded", file.FriendlyPath)
 		return DownloadedFile, nil
 	case uploadFile:
-		if err := s.uploadFile(file); err != nil {
+		if err := s.uploadFile(file, modTimeLocal); errors.Is(err, errTransferDeferred) {
+			logger.Warnf("Upload of '%s' %v", file.FriendlyPath, err)
+			return DeferredFile, nil
+		} else if err != nil {
 			return NoChange, err
 		}
-		s.Logger.Infof("File '%s' successfully uploaded", file.FriendlyPath)
+		s.mu.Lock()
+		fileStateData.LastCloudUpdate = modTimeLocal
+		fileStateData.LastSynced = syncedAt
+		s.mu.Unlock()
+		logger.Infof("File '%s' successfully uploaded", file.FriendlyPath)
 		return UploadedFile, nil
 	case markDeleted:
 		// mark the file as deleted so it's not downloaded again
-		s.stateData.FileStateData[file.FriendlyPath].DeletedLocal = true
+		s.mu.Lock()
+		fileStateData.DeletedLocal = true
+		s.mu.Unlock()
 		return MarkedDeleted, nil
 	}
+	if !utils.HasBeenSynced(lastCloudUpdate) {
+		// Both copies exist and the local one is newer, but they have never been synced. Treat them as in sync so that
+		// the local copy is uploaded the next time it changes.
+		s.mu.Lock()
+		fileStateData.LastCloudUpdate = modTimeCloud
+		fileStateData.LastSynced = syncedAt
+		s.mu.Unlock()
+	}
 	return NoChange, nil
 }
 
-func (s *Syncer) uploadFile(file SyncedFile) error {
+// uploadFile uploads the file and sets its remote modified time to modTime, the local modified time.
+func (s *Syncer) uploadFile(file SyncedFile, modTime time.Time) error {
+	localMetadata, err := s.LocalFileStore.GetMetadata(file.RealPath)
+	if err != nil {
+		return err
+	}
+	if err := s.reserveTransfer(file.FriendlyPath, localMetadata.Size); err != nil {
+		return err
+	}
+	metadata, err := s.newFileMetadata(file.RealPath, modTime, localMetadata.Mode)
+	if err != nil {
+		return err
+	}
+	if err := s.journalRemoteFile(file, modTime); errors.Is(err, errTransferDeferred) {
+		s.releaseCapacity(localMetadata.Size)
+		return err
+	} else if err != nil {
+		return fmt.Errorf("unable to save the remote copy in the journal: %w", err)
+	}
+	// The file is read again as it is uploaded rather than kept in memory. If it changes in the meantime, its modified
+	// time is after the time of this sync, so it is uploaded again by the next one.
 	contentReader, err := s.LocalFileStore.GetFileContents(file.RealPath)
 	if err != nil {
 		return err
 	}
 	defer contentReader.Close()
-	readerEncrypted, err := s.Encryptor.EncryptReader(contentReader)
+	readerEncrypted, err := s.encryptForUpload(file.FriendlyPath, contentReader, metadata)
 	if err != nil {
 		return err
 	}
-	err = s.RemoteFileStore.WriteFileContents(file.FriendlyPath, readerEncrypted)
+	uploadLimiter := s.uploadLimiter
+	if _, ok := s.RemoteFileStore.(filestore.RateLimitedFileStore); ok {
+		// The file store limits the bytes as it sends them.
+		uploadLimiter = nil
+	}
+	countingReader := &utils.CountingReader{Reader: utils.LimitReader(readerEncrypted, uploadLimiter)}
+	err = s.RemoteFileStore.WriteFileContents(file.FriendlyPath, countingReader, metadata)
 	if err != nil {
 		return err
 	}
+	s.addBytesTransferred(countingReader.Count, 0)
 	return nil
 }
 
-func (s *Syncer) downloadFile(file SyncedFile) error {
+// encryptForUpload encrypts the contents of a file to upload. If the encryptor uses a random nonce, the one saved with
+// an unfinished upload of the same contents is used again so that the upload can be resumed. The nonce is recorded in
+// metadata.
+func (s *Syncer) encryptForUpload(friendlyPath string, reader io.Reader, metadata *filestore.FileMetadata) (io.Reader,
+	error) {
+	nonceEncryptor, ok := s.Encryptor.(utils.NonceEncryptor)
+	if !ok {
+		return s.Encryptor.EncryptReader(reader)
+	}
+	var nonce []byte
+	s.mu.Lock()
+	session := s.stateData.UploadSessions[friendlyPath]
+	s.mu.Unlock()
+	if session != nil && session.Nonce != "" && session.ContentHash == filestore.UploadContentID(metadata) {
+		nonce, _ = hex.DecodeString(session.Nonce)
+	}
+	if len(nonce) == 0 {
+		var err error
+		if nonce, err = nonceEncryptor.NewNonce(); err != nil {
+			return nil, err
+		}
+	}
+	metadata.UploadNonce = hex.EncodeToString(nonce)
+	return nonceEncryptor.EncryptReaderWithNonce(reader, nonce)
+}
+
+// newFileMetadata returns the metadata to upload along with the local file at realPath.
+func (s *Syncer) newFileMetadata(realPath string, modTime time.Time, mode os.FileMode) (*filestore.FileMetadata,
+	error) {
+	contentReader, err := s.LocalFileStore.GetFileContents(realPath)
+	if err != nil {
+		return nil, err
+	}
+	contentHash, err := utils.HashContents(s.Encryptor, contentReader)
+	contentReader.Close()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	if s.machineID == "" {
+		s.machineID, err = s.Config.MachineID()
+	}
+	machineID := s.machineID
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	metadata := &filestore.FileMetadata{
+		ContentHash: contentHash,
+		ModTime:     modTime,
+		Mode:        mode,
+		MachineID:   machineID,
+	}
+	if format, ok := s.Encryptor.(utils.EncryptionFormat); ok {
+		metadata.EncryptionVersion = format.FormatVersion()
+		metadata.KeyID = format.KeyID()
+	}
+	return metadata, nil
+}
+
+// downloadFile downloads the file and sets its local modified time to modTime, the remote modified time. The file
+// gets the permission bits it was uploaded with if it doesn't exist locally yet.
+func (s *Syncer) downloadFile(file SyncedFile, modTime time.Time) error {
+	remoteMetadata, err := s.RemoteFileStore.GetMetadata(file.FriendlyPath)
+	if err != nil {
+		return err
+	}
+	if format, ok := s.Encryptor.(utils.EncryptionFormat); ok && remoteMetadata.KeyID != "" &&
+		remoteMetadata.KeyID != format.KeyID() {
+		return fmt.Errorf("%w: key %s was used, but this machine has key %s", ErrKeyMismatch, remoteMetadata.KeyID,
+			format.KeyID())
+	}
+	if err := s.reserveTransfer(file.FriendlyPath, remoteMetadata.Size); err != nil {
+		return err
+	}
+	if err := s.journalLocalFile(file, modTime); err != nil {
+		return fmt.Errorf("unable to save the local copy in the journal: %w", err)
+	}
 	contentReader, err := s.RemoteFileStore.GetFileContents(file.FriendlyPath)
 	if err != nil {
 		return err
 	}
 	defer contentReader.Close()
-	decryptedReader, err := s.Encryptor.DecryptReader(contentReader)
+	countingReader := &utils.CountingReader{Reader: utils.LimitReader(contentReader, s.downloadLimiter)}
+	decryptedReader, err := s.Encryptor.DecryptReader(ioutil.NopCloser(countingReader))
 	if err != nil {
 		return err
 	}
 
-	err = s.LocalFileStore.WriteFileContents(file.RealPath, decryptedReader)
+	err = s.LocalFileStore.WriteFileContents(file.RealPath, decryptedReader, &filestore.FileMetadata{
+		ModTime: modTime,
+		Mode:    remoteMetadata.Mode,
+	})
 	if err != nil {
 		return err
 	}
+	s.addBytesTransferred(0, countingReader.Count)
 	return nil
 }
 
+// addBytesTransferred adds to the bytes uploaded and downloaded in the sync result, if there is one.
+func (s *Syncer) addBytesTransferred(uploaded, downloaded int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.result != nil {
+		s.result.BytesUploaded += uploaded
+		s.result.BytesDownloaded += downloaded
+	}
+}
+
 func (s *Syncer) cleanupRemoteFiles(remoteFiles []*filestore.StoredFile,
 	globalConfig *GlobalConfig) (*RemoteStateData, error) {
 	remoteStateData, err := getRemoteStateData(s.RemoteFileStore)
@@ -322,44 +692,66 @@ func (s *Syncer) cleanupRemoteFiles(remoteFiles []*filestore.StoredFile,
 	}
 
 	for _, remoteFile := range remoteFiles {
-		if strings.HasPrefix(globalConfigPath, remoteFile.Path) {
-			continue // Because globalConfigPath is not in globalConfig.TagPaths, we need to skip it here.
-		}
-		inGlobalConfig := false
-		for _, filesToSyncForTag := range globalConfig.TagPaths {
-			for _, fileToSync := range filesToSyncForTag {
-				if strings.HasPrefix(remoteFile.Path, fileToSync) || strings.HasPrefix(fileToSync, remoteFile.Path) {
-					inGlobalConfig = true
-				}
-			}
-		}
-		if inGlobalConfig {
+		if !globalConfig.isOrphaned(remoteFile.Path) {
 			delete(remoteStateData.FileStateData, remoteFile.Path)
-		} else {
-			_, exists := remoteStateData.FileStateData[remoteFile.Path]
-			if !exists {
-				remoteStateData.FileStateData[remoteFile.Path] = &RemoteFileStateData{
-					MarkDeleted: time.Now(),
-				}
+		} else if _, exists := remoteStateData.FileStateData[remoteFile.Path]; !exists {
+			remoteStateData.FileStateData[remoteFile.Path] = &RemoteFileStateData{
+				MarkDeleted: s.now(),
 			}
 		}
 	}
 
-	// Delete files remotely if marked deleted more than 30 days ago.
+	// Delete files remotely once their retention period has passed.
 	for filePath, fileData := range remoteStateData.FileStateData {
-		if fileData.MarkDeleted.After(time.Now().AddDate(0, 0, -30)) {
+		deleteAfter, ok := globalConfig.remoteDeletionTime(fileData.MarkDeleted)
+		if !ok || deleteAfter.After(s.now()) {
 			continue
 		}
-		if err := s.RemoteFileStore.DeleteFile(filePath); err != nil {
+		if err := s.deleteOrphanedFile(filePath, remoteStateData); err != nil {
 			return remoteStateData, err
 		}
-		delete(remoteStateData.FileStateData, filePath)
-		s.Logger.Infof("File '%s' deleted remotely", filePath)
 	}
 
-	if err := saveRemoteStateData(remoteStateData, s.RemoteFileStore); err != nil {
+	if err := s.renewRemoteLock(); err != nil {
+		return remoteStateData, err
+	}
+	if err := saveRemoteStateData(remoteStateData, s.RemoteFileStore, s.now()); err != nil {
 		return remoteStateData, err
 	}
 
 	return remoteStateData, nil
 }
+
+// getCoveringTags returns the tags in the global config that have a path covering remotePath, either because
+// remotePath is under that path or because remotePath is a parent directory of it.
+func getCoveringTags(remotePath string, globalConfig *GlobalConfig) []string {
+	tags := make([]string, 0)
+	for tag, filesToSyncForTag := range globalConfig.TagPaths {
+		for _, fileToSync := range filesToSyncForTag {
+			if strings.HasPrefix(remotePath, fileToSync) || strings.HasPrefix(fileToSync, remotePath) {
+				tags = append(tags, tag)
+				break
+			}
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// deleteOrphanedFile deletes a file that no tag's paths cover from the remote file store and from remoteStateData.
+// If it is a directory, the files in it are also removed from remoteStateData.
+func (s *Syncer) deleteOrphanedFile(filePath string, remoteStateData *RemoteStateData) error {
+	if err := s.RemoteFileStore.DeleteFile(filePath); err != nil {
+		return err
+	}
+	for statePath := range remoteStateData.FileStateData {
+		if statePath == filePath || strings.HasPrefix(statePath, filePath+"/") {
+			delete(remoteStateData.FileStateData, statePath)
+		}
+	}
+	s.Logger.Infof("File '%s' deleted remotely", filePath)
+	if s.result != nil {
+		s.result.RemoteDeletions = append(s.result.RemoteDeletions, filePath)
+	}
+	return nil
+}
@@ -2,6 +2,8 @@
 package sync
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
@@ -10,6 +12,7 @@ import (
 
 	"github.com/go-bdd/gobdd"
 	"github.com/golang/mock/gomock"
+	"gopkg.in/yaml.v3"
 
 	"github.com/ristomcgehee/lyncser/filestore"
 	"github.com/ristomcgehee/lyncser/sync/mocks"
@@ -163,20 +166,30 @@ func remoteStateDataFileDoesNotExist(t gobdd.StepTest, ctx gobdd.Context) {
 func fileUploadedCloud(t gobdd.StepTest, ctx gobdd.Context) {
 	syncer, syncedFile := unwrapContext(ctx)
 	localFileStore := syncer.LocalFileStore.(*mocks.MockFileStore)
+	localFileStore.EXPECT().
+		GetMetadata(gomock.Eq(syncedFile.RealPath)).
+		Return(&filestore.FileMetadata{Mode: 0o644}, nil)
+	// The file is read once to hash it and again to upload it.
 	localFileStore.EXPECT().
 		GetFileContents(gomock.Eq(syncedFile.RealPath)).
-		Return(io.NopCloser(strings.NewReader("string")), nil)
+		DoAndReturn(func(string) (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader("string")), nil
+		}).
+		Times(2)
 	encryptor := syncer.Encryptor.(*mocks.MockReaderEncryptor)
 	encryptor.EXPECT().
 		EncryptReader(gomock.Any())
 	cloudFileStore := syncer.RemoteFileStore.(*mocks.MockFileStore)
 	cloudFileStore.EXPECT().
-		WriteFileContents(gomock.Eq(syncedFile.FriendlyPath), gomock.Any())
+		WriteFileContents(gomock.Eq(syncedFile.FriendlyPath), gomock.Any(), gomock.Any())
 }
 
 func fileDownloadedFromCloud(t gobdd.StepTest, ctx gobdd.Context) {
 	syncer, syncedFile := unwrapContext(ctx)
 	cloudFileStore := syncer.RemoteFileStore.(*mocks.MockFileStore)
+	cloudFileStore.EXPECT().
+		GetMetadata(gomock.Eq(syncedFile.FriendlyPath)).
+		Return(&filestore.FileMetadata{}, nil)
 	cloudFileStore.EXPECT().
 		GetFileContents(gomock.Eq(syncedFile.FriendlyPath)).
 		Return(io.NopCloser(strings.NewReader("string")), nil)
@@ -185,7 +198,7 @@ func fileDownloadedFromCloud(t gobdd.StepTest, ctx gobdd.Context) {
 		DecryptReader(gomock.Any())
 	localFileStore := syncer.LocalFileStore.(*mocks.MockFileStore)
 	localFileStore.EXPECT().
-		WriteFileContents(gomock.Eq(syncedFile.RealPath), gomock.Any())
+		WriteFileContents(gomock.Eq(syncedFile.RealPath), gomock.Any(), gomock.Any())
 }
 
 func shouldBeDeletedLocally(t gobdd.StepTest, ctx gobdd.Context) {
@@ -275,6 +288,7 @@ func TestHandleFile(t *testing.T) {
 		t.Fatal(err)
 	}
 	syncer := &Syncer{
+		Config: &ConfigFiles{Dir: t.TempDir()},
 		stateData: &LocalStateData{
 			FileStateData: map[string]*LocalFileStateData{},
 		},
@@ -290,7 +304,7 @@ func TestHandleFile(t *testing.T) {
 		ctx.Set("syncedFile", syncedFile)
 		expectations = []assertExpectationFunc{}
 	}), gobdd.WithAfterScenario(func(ctx gobdd.Context) {
-		syncer.handleFile(syncedFile.FriendlyPath, false)
+		syncer.handleFile(syncedFile.FriendlyPath, false, syncer.Logger)
 		for _, assertExpectation := range expectations {
 			assertExpectation(t, ctx)
 		}
@@ -321,7 +335,7 @@ func TestCleanupRemoteFiles(t *testing.T) {
 		}
 		remoteFiles = []*filestore.StoredFile{}
 		remoteFileStore.EXPECT().
-			WriteFileContents(gomock.Eq(stateRemoteFilePath), gomock.Any())
+			WriteFileContents(gomock.Eq(stateRemoteFilePath), gomock.Any(), gomock.Any())
 		expectations = []assertExpectationFunc{}
 	}), gobdd.WithAfterScenario(func(ctx gobdd.Context) {
 		remoteStateData, _ := syncer.cleanupRemoteFiles(remoteFiles, globalConfig)
@@ -333,3 +347,172 @@ func TestCleanupRemoteFiles(t *testing.T) {
 	addCommonSetup(suite)
 	suite.Run()
 }
+
+// recordingLogger records the messages written to it.
+type recordingLogger struct {
+	utils.Logger
+	messages []string
+}
+
+func (r *recordingLogger) Infof(template string, args ...interface{}) {
+	r.messages = append(r.messages, fmt.Sprintf(template, args...))
+}
+
+func (r *recordingLogger) Warnf(template string, args ...interface{}) {
+	r.messages = append(r.messages, fmt.Sprintf(template, args...))
+}
+
+func TestSyncFilesKeepsOrder(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	localFileStore := mocks.NewMockFileStore(ctrl)
+	remoteFileStore := mocks.NewMockFileStore(ctrl)
+	// Earlier files take longer, so they finish after later ones.
+	localFileStore.EXPECT().FileExists(gomock.Any()).DoAndReturn(func(path string) (bool, error) {
+		var i int
+		fmt.Sscanf(path[strings.LastIndex(path, "file")+len("file"):], "%d", &i)
+		time.Sleep(time.Duration(20-i) * time.Millisecond)
+		return false, nil
+	}).AnyTimes()
+	remoteFileStore.EXPECT().FileExists(gomock.Any()).Return(false, nil).AnyTimes()
+	logger := &recordingLogger{}
+	syncer := &Syncer{
+		RemoteFileStore: remoteFileStore,
+		LocalFileStore:  localFileStore,
+		Logger:          logger,
+		stateData:       &LocalStateData{FileStateData: map[string]*LocalFileStateData{}},
+		result:          newSyncResult(time.Now()),
+	}
+
+	jobs := make([]*fileJob, 0)
+	expectedMessages := make([]string, 0)
+	for i := 0; i < 20; i++ {
+		path := fmt.Sprintf("~/dir/file%d", i)
+		jobs = append(jobs, newFileJob(path, false, logger))
+		expectedMessages = append(expectedMessages, "Syncing "+path,
+			fmt.Sprintf("File '%s' does not exist locally or remotely", path))
+	}
+	if err := syncer.syncFiles(jobs, 8); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(logger.messages, "\n") != strings.Join(expectedMessages, "\n") {
+		t.Errorf("messages are out of order:\n%s", strings.Join(logger.messages, "\n"))
+	}
+	for i, file := range syncer.result.Files {
+		if file.Path != jobs[i].path {
+			t.Errorf("result %d is for '%s', expected '%s'", i, file.Path, jobs[i].path)
+		}
+	}
+}
+
+func TestReserveTransfer(t *testing.T) {
+	t.Parallel()
+	localConfig := &LocalConfig{
+		TransferCapMiB: 10,
+		MaxFileSizeMiB: map[string]int{"~/videos": 1, "work": 2},
+	}
+	globalConfig := &GlobalConfig{TagPaths: map[string][]string{"work": {"~/code"}}}
+	syncer := &Syncer{transferLimits: newTransferLimits(localConfig, globalConfig)}
+	tests := []struct {
+		path     string
+		size     int64
+		deferred bool
+	}{
+		{"~/videos/big.mp4", 2 << 20, true},
+		{"~/videos/small.mp4", 1 << 20, false},
+		{"~/code/big.bin", 3 << 20, true},
+		{"~/documents/report.pdf", 8 << 20, false},
+		// Over the cap, since 9 MiB have been transferred.
+		{"~/documents/other.pdf", 2 << 20, true},
+		{"~/documents/notes.txt", 1 << 20, false},
+	}
+	for _, test := range tests {
+		err := syncer.reserveTransfer(test.path, test.size)
+		if deferred := errors.Is(err, errTransferDeferred); deferred != test.deferred {
+			t.Errorf("%s: expected deferred to be %v, got error %v", test.path, test.deferred, err)
+		}
+	}
+}
+
+func TestJournalRemoteFileCountsAsDownload(t *testing.T) {
+	t.Parallel()
+	remoteFileStore := filestore.NewMemoryFileStore(nil)
+	for _, path := range []string{"~/docs/a", "~/docs/b"} {
+		err := remoteFileStore.WriteFileContents(path, strings.NewReader(strings.Repeat("x", 100)),
+			&filestore.FileMetadata{ModTime: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	syncer := &Syncer{
+		RemoteFileStore: remoteFileStore,
+		Config:          &memoryConfig{},
+		result:          newSyncResult(time.Now()),
+		transferLimits:  &transferLimits{transferCap: 150},
+	}
+
+	if err := syncer.journalRemoteFile(SyncedFile{FriendlyPath: "~/docs/a"}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if syncer.result.BytesDownloaded != 100 {
+		t.Errorf("expected 100 bytes downloaded, got %d", syncer.result.BytesDownloaded)
+	}
+	// The second copy would take the sync over its transfer cap.
+	err := syncer.journalRemoteFile(SyncedFile{FriendlyPath: "~/docs/b"}, time.Now())
+	if !errors.Is(err, errTransferDeferred) {
+		t.Errorf("expected the second copy to be deferred, got %v", err)
+	}
+	err = syncer.journalRemoteFile(SyncedFile{FriendlyPath: "~/docs/new"}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := syncer.Config.JournalEntries(syncer.result.RunID)
+	if err != nil || len(entries) != 2 || entries[0].Created || !entries[1].Created {
+		t.Errorf("expected an overwritten and a created entry, got %v, %v", entries, err)
+	}
+}
+
+func TestDownloadedGlobalConfigIsUsedForCleanup(t *testing.T) {
+	t.Parallel()
+	sim := newSimulation(t)
+	sim.globalConfig.TagPaths["all"] = []string{"~/docs"}
+	a, b := sim.machine("A"), sim.machine("B")
+	for _, m := range []*machine{a, b} {
+		if _, err := sim.sync(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A starts syncing ~/extra, which B's global config doesn't cover until it downloads A's.
+	globalConfig, err := a.config.GlobalConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	globalConfig.TagPaths["all"] = append(globalConfig.TagPaths["all"], "~/extra")
+	data, err := yaml.Marshal(globalConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.local.WriteFileContents(a.config.GlobalConfigPath(), bytes.NewReader(data), &filestore.FileMetadata{
+		ModTime: sim.tick(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeSimulatedFile(t, sim, a, "~/extra/notes", "notes")
+	if _, err := sim.sync(a); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sim.sync(b); err != nil {
+		t.Fatal(err)
+	}
+	remoteStateData, err := getRemoteStateData(sim.remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path := range remoteStateData.FileStateData {
+		if strings.HasPrefix(path, "~/extra") {
+			t.Errorf("expected '%s' not to be marked as orphaned after B downloaded the global config", path)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ristomcgehee/lyncser/utils"
+)
+
+// Returned when a file is not transferred in this sync because of a limit in the local config. The file is tried again
+// in the next sync.
+var errTransferDeferred = errors.New("deferred to the next sync")
+
+// transferLimits decides which files are too large to transfer in this sync. It is safe to use from several
+// goroutines.
+type transferLimits struct {
+	// The most bytes to upload and download in one sync. 0 means no limit.
+	transferCap int64
+	// Key is a path or a tag. Value is the largest file in bytes to transfer under that path or for that tag.
+	maxFileSizes map[string]int64
+	globalConfig *GlobalConfig
+	// The bytes of the transfers allowed so far in this sync. Guarded by Syncer.mu.
+	reserved int64
+}
+
+func newTransferLimits(localConfig *LocalConfig, globalConfig *GlobalConfig) *transferLimits {
+	limits := &transferLimits{
+		transferCap:  int64(localConfig.TransferCapMiB) << 20,
+		maxFileSizes: make(map[string]int64, len(localConfig.MaxFileSizeMiB)),
+		globalConfig: globalConfig,
+	}
+	for pathOrTag, maxSize := range localConfig.MaxFileSizeMiB {
+		limits.maxFileSizes[pathOrTag] = int64(maxSize) << 20
+	}
+	return limits
+}
+
+// newRateLimiters returns the upload and download rate limiters for the local config. They are nil if there is no
+// limit.
+func newRateLimiters(localConfig *LocalConfig) (upload, download *utils.RateLimiter) {
+	if localConfig.UploadLimitKiBps > 0 {
+		upload = utils.NewRateLimiter(int64(localConfig.UploadLimitKiBps) << 10)
+	}
+	if localConfig.DownloadLimitKiBps > 0 {
+		download = utils.NewRateLimiter(int64(localConfig.DownloadLimitKiBps) << 10)
+	}
+	return upload, download
+}
+
+// reserveTransfer returns an error wrapping errTransferDeferred if the file at friendlyPath, which is size bytes, is
+// too large to transfer in this sync. Otherwise its size counts towards the transfer cap.
+func (s *Syncer) reserveTransfer(friendlyPath string, size int64) error {
+	limits := s.transferLimits
+	if limits == nil {
+		return nil
+	}
+	for pathOrTag, maxSize := range limits.maxFileSizes {
+		if size > maxSize && limits.appliesTo(pathOrTag, friendlyPath) {
+			return fmt.Errorf("%w: the file is %s, more than the maximum of %s for '%s'", errTransferDeferred,
+				formatMiB(size), formatMiB(maxSize), pathOrTag)
+		}
+	}
+	return s.reserveCapacity(size, "the file")
+}
+
+// reserveCapacity counts size bytes towards the transfer cap, or returns an error wrapping errTransferDeferred if
+// they don't fit. what describes the transfer in the error.
+func (s *Syncer) reserveCapacity(size int64, what string) error {
+	limits := s.transferLimits
+	if limits == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if limits.transferCap > 0 && limits.reserved+size > limits.transferCap {
+		return fmt.Errorf("%w: %s is %s, and this sync has already transferred %s of its %s cap",
+			errTransferDeferred, what, formatMiB(size), formatMiB(limits.reserved), formatMiB(limits.transferCap))
+	}
+	limits.reserved += size
+	return nil
+}
+
+// releaseCapacity gives back size bytes reserved for a transfer that didn't happen.
+func (s *Syncer) releaseCapacity(size int64) {
+	if s.transferLimits == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.transferLimits.reserved -= size
+}
+
+// appliesTo returns true if pathOrTag is a path that friendlyPath is under, or a tag with such a path.
+func (l *transferLimits) appliesTo(pathOrTag, friendlyPath string) bool {
+	if strings.HasPrefix(pathOrTag, "~") || strings.HasPrefix(pathOrTag, "/") {
+		return strings.HasPrefix(friendlyPath, pathOrTag)
+	}
+	return utils.InSlice(pathOrTag, getCoveringTags(friendlyPath, l.globalConfig))
+}
+
+func formatMiB(bytes int64) string {
+	return fmt.Sprintf("%.1f MiB", float64(bytes)/(1<<20))
+}
@@ -0,0 +1,155 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ristomcgehee/lyncser/filestore"
+)
+
+var (
+	// Returned for a file that was modified after the sync run being undone, so restoring it would lose that change.
+	ErrModifiedSinceSync = errors.New("the file has been modified since the sync")
+	// Returned when asked to undo the most recent sync, but it can't be undone.
+	ErrNothingToUndo = errors.New("there is nothing to undo")
+)
+
+// UndoneFile is the outcome of restoring a file from the journal.
+type UndoneFile struct {
+	*JournalEntry
+	// The reason the file was not restored, or nil if it was.
+	Err error
+}
+
+// Undo restores the files that the sync run overwrote, locally and remotely, from the journal, and deletes the files
+// it created. If runID is empty, the most recent sync is undone, and the error wraps ErrNothingToUndo if it changed
+// nothing that can be undone. Files modified since the run are skipped unless force is set. The restored files get
+// the current time as their modified time, so the next sync copies them to the other machines. The run is removed
+// from the journal once every file has been restored. It takes the same locks as a sync.
+func (s *Syncer) Undo(runID string, force bool) ([]*UndoneFile, error) {
+	unlock, err := s.Config.Lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	defer func() {
+		if err := s.releaseRemoteLock(); err != nil {
+			s.Logger.Warnf("Unable to release the remote lock: %v", err)
+		}
+	}()
+
+	if runID == "" {
+		if runID, err = LastRunID(s.Config); err != nil {
+			return nil, err
+		}
+	}
+	entries, err := s.Config.JournalEntries(runID)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.Side == JournalRemote {
+			if _, err := s.RemoteFileStore.GetFiles(); err != nil {
+				return nil, err
+			}
+			if err := s.acquireRemoteLock(); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	undone := make([]*UndoneFile, 0, len(entries))
+	restoredAll := true
+	for _, entry := range entries {
+		err := s.undoEntry(runID, entry, force)
+		if err != nil {
+			restoredAll = false
+		}
+		undone = append(undone, &UndoneFile{JournalEntry: entry, Err: err})
+	}
+	if restoredAll {
+		return undone, s.Config.DeleteJournalRun(runID)
+	}
+	return undone, nil
+}
+
+// undoEntry restores the previous contents of the file in entry.
+func (s *Syncer) undoEntry(runID string, entry *JournalEntry, force bool) error {
+	var store filestore.FileStore
+	var path string
+	switch entry.Side {
+	case JournalLocal:
+		file, err := s.journaledFile(entry.Path)
+		if err != nil {
+			return err
+		}
+		store, path = s.LocalFileStore, file.RealPath
+	case JournalRemote:
+		store, path = s.RemoteFileStore, entry.Path
+	}
+	if !force {
+		exists, err := store.FileExists(path)
+		if err != nil {
+			return err
+		}
+		if !exists && entry.Created {
+			// The file the sync created is already gone.
+			return nil
+		}
+		if !exists {
+			return ErrModifiedSinceSync
+		}
+		modTime, err := store.GetModifiedTime(path)
+		if err != nil {
+			return err
+		}
+		if !modTime.Truncate(time.Millisecond).Equal(entry.SyncedModTime.Truncate(time.Millisecond)) {
+			return ErrModifiedSinceSync
+		}
+	}
+	if entry.Created {
+		return store.DeleteFile(path)
+	}
+	contents, err := s.Config.JournalContents(runID, entry)
+	if err != nil {
+		return err
+	}
+	defer contents.Close()
+	metadata := *entry.Metadata
+	metadata.ModTime = s.now().UTC()
+	if entry.Side == JournalLocal {
+		// Only the modified time and permission bits are kept for local files.
+		metadata = filestore.FileMetadata{ModTime: metadata.ModTime, Mode: metadata.Mode}
+	}
+	return store.WriteFileContents(path, contents, &metadata)
+}
+
+// journaledFile returns the SyncedFile for a path in the journal. The global config is stored locally in the config
+// directory rather than at its friendly path.
+func (s *Syncer) journaledFile(friendlyPath string) (SyncedFile, error) {
+	if friendlyPath == globalConfigPath {
+		return s.globalConfigFile(), nil
+	}
+	return newSyncedFile(friendlyPath, false)
+}
+
+// LastRunID returns the run ID of the most recent sync. The error wraps ErrNothingToUndo if there has been no sync, or
+// if the most recent one has nothing in the journal because it changed no files or has already been undone.
+func LastRunID(config ConfigProvider) (string, error) {
+	report, err := config.LastSyncReport()
+	if err != nil {
+		return "", err
+	}
+	if report == nil {
+		return "", fmt.Errorf("%w: no sync has been run yet", ErrNothingToUndo)
+	}
+	if _, err := config.JournalEntries(report.RunID); errors.Is(err, ErrRunNotFound) {
+		return "", fmt.Errorf("%w: the last sync, %s, changed no files or has already been undone",
+			ErrNothingToUndo, report.RunID)
+	} else if err != nil {
+		return "", err
+	}
+	return report.RunID, nil
+}
@@ -0,0 +1,37 @@
+package sync
+
+import (
+	"github.com/ristomcgehee/lyncser/filestore"
+)
+
+// uploadSessionStore keeps the sessions of unfinished uploads in the local state data. Each change is saved right
+// away so that an upload interrupted by a crash can be resumed by the next sync.
+type uploadSessionStore struct {
+	syncer *Syncer
+}
+
+// GetUploadSession implements filestore.UploadSessionStore.
+func (u *uploadSessionStore) GetUploadSession(path string) *filestore.UploadSession {
+	u.syncer.mu.Lock()
+	defer u.syncer.mu.Unlock()
+	return u.syncer.stateData.UploadSessions[path]
+}
+
+// SaveUploadSession implements filestore.UploadSessionStore.
+func (u *uploadSessionStore) SaveUploadSession(path string, session *filestore.UploadSession) error {
+	u.syncer.mu.Lock()
+	defer u.syncer.mu.Unlock()
+	stateData := u.syncer.stateData
+	if session == nil {
+		if _, ok := stateData.UploadSessions[path]; !ok {
+			return nil
+		}
+		delete(stateData.UploadSessions, path)
+	} else {
+		if stateData.UploadSessions == nil {
+			stateData.UploadSessions = make(map[string]*filestore.UploadSession)
+		}
+		stateData.UploadSessions[path] = session
+	}
+	return u.syncer.Config.SaveLocalStateData(stateData)
+}
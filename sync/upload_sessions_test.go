@@ -0,0 +1,72 @@
+package sync
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/ristomcgehee/lyncser/filestore"
+	"github.com/ristomcgehee/lyncser/filestore/fakedrive"
+	"github.com/ristomcgehee/lyncser/utils"
+)
+
+func TestInterruptedEncryptedUploadIsResumed(t *testing.T) {
+	t.Parallel()
+	sim, fake := newDriveSimulation(t, "A", "B")
+	sim.globalConfig.TagPaths["all"] = []string{"~/docs"}
+	a, b := sim.machine("A"), sim.machine("B")
+	const chunkSize = 256 << 10
+	for _, m := range []*machine{a, b} {
+		m.remote.(*filestore.DriveFileStore).UploadChunkSize = chunkSize
+		m.encryptor = &utils.AESGCMEncryptor{Key: bytes.Repeat([]byte("k"), 32)}
+	}
+	if _, err := sim.sync(a); err != nil {
+		t.Fatal(err)
+	}
+	contents := strings.Repeat("0123456789abcdef", 3*chunkSize/16)
+	writeSimulatedFile(t, sim, a, "~/docs/large", contents)
+
+	// The second chunk is refused, so the first sync leaves the upload unfinished.
+	fake.InjectFault(&fakedrive.Fault{Method: http.MethodPut, Path: "/upload/drive/v3/files", After: 1, Times: 1,
+		Status: http.StatusForbidden})
+	result, err := sim.sync(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fileResult := range result.Files {
+		if fileResult.Path == "~/docs/large" && fileResult.Err == nil {
+			t.Fatal("expected the upload to be interrupted")
+		}
+	}
+	stateData, _, err := a.config.LocalStateData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session := stateData.UploadSessions["~/docs/large"]; session == nil || session.Nonce == "" {
+		t.Fatalf("expected the upload session to be saved with its nonce, got %v", stateData.UploadSessions)
+	}
+	if _, err := sim.sync(a); err != nil {
+		t.Fatal(err)
+	}
+	if sessions := fake.UploadSessions(); sessions != 1 {
+		t.Errorf("expected the upload to be resumed in the same session, but %d were started", sessions)
+	}
+
+	if _, err := sim.sync(b); err != nil {
+		t.Fatal(err)
+	}
+	realPath, err := utils.RealPath("~/docs/large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := b.local.GetFileContents(realPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if downloaded, err := io.ReadAll(reader); err != nil || string(downloaded) != contents {
+		t.Errorf("B downloaded %d bytes, want %d, error %v", len(downloaded), len(contents), err)
+	}
+}
@@ -0,0 +1,322 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+
+	"github.com/ristomcgehee/lyncser/utils"
+)
+
+type ProblemSeverity string
+
+const (
+	// The config will not work as intended.
+	SeverityError ProblemSeverity = "error"
+	// The config works but is probably not what was intended.
+	SeverityWarning ProblemSeverity = "warning"
+)
+
+type ConfigProblem struct {
+	// The path of the config file.
+	File     string
+	Line     int
+	Column   int
+	Severity ProblemSeverity
+	Message  string
+}
+
+func (p *ConfigProblem) String() string {
+	return fmt.Sprintf("%s:%d:%d: %s: %s", p.File, p.Line, p.Column, p.Severity, p.Message)
+}
+
+// Matches the line number in errors returned by the yaml package, e.g. "yaml: line 3: mapping values are not allowed".
+var yamlErrorLineRegex = regexp.MustCompile(`^yaml: line (\d+): `)
+
+// configPath is a path listed under a tag in the global config.
+type configPath struct {
+	tag  string
+	node *yaml.Node
+}
+
+// ValidateConfig checks the global config and local config for problems. The problems are sorted by file and
+// location.
+func (c *ConfigFiles) ValidateConfig() ([]*ConfigProblem, error) {
+	globalData, err := readConfigFile(c.GlobalConfigPath())
+	if err != nil {
+		return nil, err
+	}
+	localData, err := readConfigFile(c.LocalConfigPath())
+	if err != nil {
+		return nil, err
+	}
+	problems, globalTags := validateGlobalConfig(c.GlobalConfigPath(), globalData)
+	problems = append(problems, validateLocalConfig(c.LocalConfigPath(), localData, globalTags)...)
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].File != problems[j].File {
+			return problems[i].File < problems[j].File
+		}
+		if problems[i].Line != problems[j].Line {
+			return problems[i].Line < problems[j].Line
+		}
+		return problems[i].Column < problems[j].Column
+	})
+	return problems, nil
+}
+
+// readConfigFile returns the contents of a config file, or nil if it does not exist.
+func readConfigFile(fullPath string) ([]byte, error) {
+	data, err := os.ReadFile(fullPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// validateGlobalConfig returns the problems in the global config and the tags it defines.
+func validateGlobalConfig(file string, data []byte) ([]*ConfigProblem, []string) {
+	root, problem := parseConfigRoot(file, data)
+	if root == nil {
+		return problemList(problem), nil
+	}
+	var problems []*ConfigProblem
+	newProblem := func(node *yaml.Node, severity ProblemSeverity, format string, args ...interface{}) {
+		problems = append(problems, newConfigProblem(file, node, severity, format, args...))
+	}
+
+	var tags []string
+	var paths []configPath
+	for i := 1; i < len(root.Content); i += 2 {
+		keyNode, valueNode := root.Content[i-1], root.Content[i]
+		switch keyNode.Value {
+		case "paths":
+			// Validated below.
+		case "remoteRetentionDays":
+			if _, err := strconv.Atoi(valueNode.Value); valueNode.Kind != yaml.ScalarNode || err != nil {
+				newProblem(valueNode, SeverityError, "'remoteRetentionDays' should be an integer")
+			}
+			continue
+		case "pinned":
+			problems = append(problems, validatePinnedPaths(file, valueNode)...)
+			continue
+		default:
+			newProblem(keyNode, SeverityError, "unknown field '%s'", keyNode.Value)
+			continue
+		}
+		if isNullNode(valueNode) {
+			continue
+		}
+		if valueNode.Kind != yaml.MappingNode {
+			newProblem(valueNode, SeverityError, "'paths' should map each tag to a list of paths")
+			continue
+		}
+		for j := 1; j < len(valueNode.Content); j += 2 {
+			tagNode, pathsNode := valueNode.Content[j-1], valueNode.Content[j]
+			tags = append(tags, tagNode.Value)
+			if isNullNode(pathsNode) {
+				continue
+			}
+			if pathsNode.Kind != yaml.SequenceNode {
+				newProblem(pathsNode, SeverityError, "the paths for tag '%s' should be a list", tagNode.Value)
+				continue
+			}
+			for _, pathNode := range pathsNode.Content {
+				if pathNode.Kind != yaml.ScalarNode {
+					newProblem(pathNode, SeverityError, "each path for tag '%s' should be a string", tagNode.Value)
+					continue
+				}
+				if !strings.HasPrefix(pathNode.Value, "~") && !strings.HasPrefix(pathNode.Value, "/") {
+					newProblem(pathNode, SeverityError, "path '%s' should start with '~' or '/'", pathNode.Value)
+				}
+				paths = append(paths, configPath{tag: tagNode.Value, node: pathNode})
+			}
+		}
+	}
+
+	// Look for duplicate and overlapping paths.
+	for i, path := range paths {
+		for _, otherPath := range paths[:i] {
+			location := fmt.Sprintf("tag '%s' at line %d", otherPath.tag, otherPath.node.Line)
+			switch {
+			case strings.TrimSuffix(path.node.Value, "/") == strings.TrimSuffix(otherPath.node.Value, "/"):
+				newProblem(path.node, SeverityWarning, "path '%s' is a duplicate of the path under %s",
+					path.node.Value, location)
+			case pathCovers(otherPath.node.Value, path.node.Value):
+				newProblem(path.node, SeverityWarning, "path '%s' is already covered by '%s' under %s",
+					path.node.Value, otherPath.node.Value, location)
+			case pathCovers(path.node.Value, otherPath.node.Value):
+				newProblem(path.node, SeverityWarning, "path '%s' covers '%s' under %s",
+					path.node.Value, otherPath.node.Value, location)
+			}
+		}
+	}
+	return problems, tags
+}
+
+// validatePinnedPaths returns the problems in the list of pinned paths in the global config.
+func validatePinnedPaths(file string, pinnedNode *yaml.Node) []*ConfigProblem {
+	if isNullNode(pinnedNode) {
+		return nil
+	}
+	if pinnedNode.Kind != yaml.SequenceNode {
+		return problemList(newConfigProblem(file, pinnedNode, SeverityError, "'pinned' should be a list of paths"))
+	}
+	var problems []*ConfigProblem
+	for _, pathNode := range pinnedNode.Content {
+		switch {
+		case pathNode.Kind != yaml.ScalarNode:
+			problems = append(problems, newConfigProblem(file, pathNode, SeverityError,
+				"each pinned path should be a string"))
+		case !strings.HasPrefix(pathNode.Value, "~") && !strings.HasPrefix(pathNode.Value, "/"):
+			problems = append(problems, newConfigProblem(file, pathNode, SeverityError,
+				"pinned path '%s' should start with '~' or '/'", pathNode.Value))
+		}
+	}
+	return problems
+}
+
+// validateLocalConfig returns the problems in the local config. globalTags are the tags in the global config.
+func validateLocalConfig(file string, data []byte, globalTags []string) []*ConfigProblem {
+	root, problem := parseConfigRoot(file, data)
+	if root == nil {
+		return problemList(problem)
+	}
+	var problems []*ConfigProblem
+	newProblem := func(node *yaml.Node, severity ProblemSeverity, format string, args ...interface{}) {
+		problems = append(problems, newConfigProblem(file, node, severity, format, args...))
+	}
+	for i := 1; i < len(root.Content); i += 2 {
+		keyNode, valueNode := root.Content[i-1], root.Content[i]
+		switch keyNode.Value {
+		case "tags":
+			// Validated below.
+		case "backend":
+			if valueNode.Kind != yaml.ScalarNode || valueNode.Value != BackendGoogleDrive {
+				newProblem(valueNode, SeverityError, "unsupported backend '%s'; the only backend is '%s'",
+					valueNode.Value, BackendGoogleDrive)
+			}
+			continue
+		case "remoteRoot":
+			if valueNode.Kind != yaml.ScalarNode || valueNode.Value == "" || strings.Contains(valueNode.Value, "/") {
+				newProblem(valueNode, SeverityError, "'remoteRoot' should be a folder name")
+			}
+			continue
+		case "sharedDriveId":
+			if valueNode.Kind != yaml.ScalarNode || valueNode.Value == "" {
+				newProblem(valueNode, SeverityError, "'sharedDriveId' should be the id of a shared drive")
+			}
+			continue
+		case "encryptToken":
+			if valueNode.Kind != yaml.ScalarNode || valueNode.Tag != "!!bool" {
+				newProblem(valueNode, SeverityError, "'encryptToken' should be true or false")
+			}
+			continue
+		case "uploadChunkSizeMiB", "parallelism", "uploadLimitKiBps", "downloadLimitKiBps", "transferCapMiB",
+			"journalRetentionDays":
+			if !isPositiveInt(valueNode) {
+				newProblem(valueNode, SeverityError, "'%s' should be a positive integer", keyNode.Value)
+			}
+			continue
+		case "maxFileSizeMiB":
+			if valueNode.Kind != yaml.MappingNode {
+				newProblem(valueNode, SeverityError, "'maxFileSizeMiB' should map paths and tags to sizes")
+				continue
+			}
+			for j := 1; j < len(valueNode.Content); j += 2 {
+				pathOrTag, size := valueNode.Content[j-1], valueNode.Content[j]
+				if !isPositiveInt(size) {
+					newProblem(size, SeverityError, "the maximum size for '%s' should be a positive integer",
+						pathOrTag.Value)
+				}
+				isPath := strings.HasPrefix(pathOrTag.Value, "~") || strings.HasPrefix(pathOrTag.Value, "/")
+				if !isPath && !utils.InSlice(pathOrTag.Value, globalTags) {
+					newProblem(pathOrTag, SeverityWarning, "tag '%s' is not defined in the global config",
+						pathOrTag.Value)
+				}
+			}
+			continue
+		default:
+			newProblem(keyNode, SeverityError, "unknown field '%s'", keyNode.Value)
+			continue
+		}
+		if isNullNode(valueNode) {
+			continue
+		}
+		if valueNode.Kind != yaml.SequenceNode {
+			newProblem(valueNode, SeverityError, "'tags' should be a list")
+			continue
+		}
+		for _, tagNode := range valueNode.Content {
+			if tagNode.Kind != yaml.ScalarNode {
+				newProblem(tagNode, SeverityError, "each tag should be a string")
+				continue
+			}
+			if !utils.InSlice(tagNode.Value, globalTags) {
+				newProblem(tagNode, SeverityWarning, "tag '%s' is not defined in the global config", tagNode.Value)
+			}
+		}
+	}
+	return problems
+}
+
+// isPositiveInt returns true if node is a positive integer.
+func isPositiveInt(node *yaml.Node) bool {
+	n, err := strconv.Atoi(node.Value)
+	return node.Kind == yaml.ScalarNode && err == nil && n > 0
+}
+
+// parseConfigRoot parses a config file and returns its top-level mapping node. If the file can't be parsed or is not
+// a mapping, it returns nil and the problem. It returns nil for both if the file is empty.
+func parseConfigRoot(file string, data []byte) (*yaml.Node, *ConfigProblem) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		problem := &ConfigProblem{
+			File:     file,
+			Severity: SeverityError,
+			Message:  err.Error(),
+		}
+		if match := yamlErrorLineRegex.FindStringSubmatch(err.Error()); match != nil {
+			//nolint:errcheck // The regex only matches digits.
+			problem.Line, _ = strconv.Atoi(match[1])
+			problem.Message = strings.TrimPrefix(err.Error(), match[0])
+		}
+		return nil, problem
+	}
+	if doc.Kind == 0 || len(doc.Content) == 0 || isNullNode(doc.Content[0]) {
+		return nil, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, newConfigProblem(file, root, SeverityError, "the config should be a mapping of fields to values")
+	}
+	return root, nil
+}
+
+func newConfigProblem(file string, node *yaml.Node, severity ProblemSeverity, format string,
+	args ...interface{}) *ConfigProblem {
+	return &ConfigProblem{
+		File:     file,
+		Line:     node.Line,
+		Column:   node.Column,
+		Severity: severity,
+		Message:  fmt.Sprintf(format, args...),
+	}
+}
+
+func problemList(problem *ConfigProblem) []*ConfigProblem {
+	if problem == nil {
+		return nil
+	}
+	return []*ConfigProblem{problem}
+}
+
+// isNullNode returns true if the node has no value, e.g. "tags:" with nothing after it.
+func isNullNode(node *yaml.Node) bool {
+	return node.Kind == yaml.ScalarNode && node.Tag == "!!null"
+}
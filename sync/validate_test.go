@@ -0,0 +1,83 @@
+package sync
+
+import (
+	"testing"
+)
+
+func TestValidateGlobalConfig(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		config   string
+		expected []string
+	}{
+		{
+			name:     "valid",
+			config:   "paths:\n  all:\n    - \"~/.gitconfig\"\n  work:\n    - \"/etc/hosts\"\n",
+			expected: nil,
+		},
+		{
+			name:   "unknown field",
+			config: "path:\n  all:\n    - \"~/.gitconfig\"\n",
+			expected: []string{
+				"~/.config/lyncser/globalConfig.yaml:1:1: error: unknown field 'path'",
+			},
+		},
+		{
+			name:   "relative path",
+			config: "paths:\n  all:\n    - .gitconfig\n",
+			expected: []string{
+				"~/.config/lyncser/globalConfig.yaml:3:7: error: path '.gitconfig' should start with '~' or '/'",
+			},
+		},
+		{
+			name:   "overlapping paths",
+			config: "paths:\n  all:\n    - \"~/code/\"\n  work:\n    - \"~/code/lyncser\"\n",
+			expected: []string{
+				"~/.config/lyncser/globalConfig.yaml:5:7: warning: path '~/code/lyncser' is already covered by " +
+					"'~/code/' under tag 'all' at line 3",
+			},
+		},
+		{
+			name: "retention and pinned paths",
+			config: "paths:\n  all:\n    - \"~/.gitconfig\"\nremoteRetentionDays: soon\npinned:\n" +
+				"  - \"~/archive\"\n  - archive2\n",
+			expected: []string{
+				"~/.config/lyncser/globalConfig.yaml:4:22: error: 'remoteRetentionDays' should be an integer",
+				"~/.config/lyncser/globalConfig.yaml:7:5: error: pinned path 'archive2' should start with '~' or '/'",
+			},
+		},
+		{
+			name:   "syntax error",
+			config: "paths:\n  all: [\n",
+			expected: []string{
+				"~/.config/lyncser/globalConfig.yaml:2:0: error: did not find expected node content",
+			},
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			problems, _ := validateGlobalConfig("~/.config/lyncser/globalConfig.yaml", []byte(test.config))
+			if len(problems) != len(test.expected) {
+				t.Fatalf("expected %d problems, got %d: %v", len(test.expected), len(problems), problems)
+			}
+			for i, problem := range problems {
+				if problem.String() != test.expected[i] {
+					t.Errorf("expected '%s', got '%s'", test.expected[i], problem.String())
+				}
+			}
+		})
+	}
+}
+
+func TestValidateLocalConfig(t *testing.T) {
+	t.Parallel()
+	problems := validateLocalConfig("~/.config/lyncser/localConfig.yaml", []byte("tags:\n  - all\n  - persnal\n"),
+		[]string{"all", "personal"})
+	expected := "~/.config/lyncser/localConfig.yaml:3:5: warning: tag 'persnal' is not defined in the global config"
+	if len(problems) != 1 || problems[0].String() != expected {
+		t.Fatalf("expected '%s', got %v", expected, problems)
+	}
+}
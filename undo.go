@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	"github.com/ristomcgehee/lyncser/filestore"
+	"github.com/ristomcgehee/lyncser/sync"
+)
+
+func undoCmd(cmd *cobra.Command, args []string) {
+	logger, err := getLogger(cmd)
+	if err != nil {
+		exitWithoutLogger(err)
+	}
+	list, err := cmd.Flags().GetBool("list")
+	if err != nil {
+		logger.Warn("error getting list flag", zap.Error(err))
+	}
+	force, err := cmd.Flags().GetBool("force")
+	if err != nil {
+		logger.Warn("error getting force flag", zap.Error(err))
+	}
+	yes, err := cmd.Flags().GetBool("yes")
+	if err != nil {
+		logger.Warn("error getting yes flag", zap.Error(err))
+	}
+	breakLock, err := cmd.Flags().GetBool("break-lock")
+	if err != nil {
+		logger.Warn("error getting break-lock flag", zap.Error(err))
+	}
+	configFiles, err := getConfigFiles(cmd)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	if list {
+		runIDs, err := configFiles.JournalRuns()
+		if err != nil {
+			exitWithError(logger, err)
+		}
+		for _, runID := range runIDs {
+			entries, err := configFiles.JournalEntries(runID)
+			if err != nil {
+				exitWithError(logger, err)
+			}
+			fmt.Printf("%s  %d files\n", runID, len(entries))
+		}
+		return
+	}
+	var runID string
+	if len(args) > 0 {
+		runID = args[0]
+	} else if runID, err = sync.LastRunID(configFiles); errors.Is(err, sync.ErrNothingToUndo) {
+		message := err.Error()
+		fmt.Printf("%s%s. Pass a run ID from `lyncser undo --list` to undo an earlier sync.\n",
+			strings.ToUpper(message[:1]), message[1:])
+		return
+	} else if err != nil {
+		exitWithError(logger, err)
+	}
+	entries, err := configFiles.JournalEntries(runID)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	fmt.Printf("Undoing sync %s restores these files:\n", runID)
+	for _, entry := range entries {
+		if entry.Created {
+			fmt.Printf("  %s (%s, deleted because the sync created it)\n", entry.Path, entry.Side)
+		} else {
+			fmt.Printf("  %s (%s)\n", entry.Path, entry.Side)
+		}
+	}
+	if !yes {
+		fmt.Print("Continue? (y/n): ")
+		var input string
+		fmt.Scanln(&input)
+		if input != "y" {
+			return
+		}
+	}
+
+	remoteFileStore, err := getRemoteFileStore(logger, configFiles)
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	syncer := sync.Syncer{
+		RemoteFileStore: remoteFileStore,
+		LocalFileStore:  &filestore.LocalFileStore{},
+		Logger:          logger,
+		Config:          configFiles,
+		BreakLock:       breakLock,
+	}
+	undone, err := syncer.Undo(runID, force)
+	skipped := 0
+	for _, file := range undone {
+		if file.Err != nil {
+			skipped++
+			fmt.Printf("Skipped the %s copy of '%s': %v\n", file.Side, file.Path, file.Err)
+		}
+	}
+	if err != nil {
+		exitWithError(logger, err)
+	}
+	fmt.Printf("Restored %d files. Run `lyncser sync` to copy them to the other machines.\n", len(undone)-skipped)
+	if skipped > 0 {
+		fmt.Println("Use --force to restore the skipped files anyway. The sync stays in the journal until then.")
+	}
+}
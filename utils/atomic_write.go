@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic writes the contents of reader to path without ever leaving a partially written file behind. The
+// contents go to a temporary file in the same directory, which is synced to disk and then renamed over path. If path
+// already exists, its permissions are kept; otherwise the file is created with perm. If path is a symbolic link, the
+// file it points to is replaced and the link is kept.
+func WriteFileAtomic(path string, reader io.Reader, perm os.FileMode) (err error) {
+	if target, evalErr := filepath.EvalSymlinks(path); evalErr == nil {
+		path = target
+	} else if !errors.Is(evalErr, os.ErrNotExist) {
+		return evalErr
+	}
+	if info, statErr := os.Stat(path); statErr == nil {
+		perm = info.Mode().Perm()
+	} else if !errors.Is(statErr, os.ErrNotExist) {
+		return statErr
+	}
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	tempFile, err := os.CreateTemp(dir, "."+base+".lyncser-tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tempFile.Close()
+			os.Remove(tempFile.Name())
+		}
+	}()
+	if _, err = io.Copy(tempFile, reader); err != nil {
+		return err
+	}
+	if err = tempFile.Chmod(perm); err != nil {
+		return err
+	}
+	if err = tempFile.Sync(); err != nil {
+		return err
+	}
+	if err = tempFile.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tempFile.Name(), path); err != nil {
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// syncDir flushes a directory to disk so that a rename within it survives a crash. Not every platform supports
+// syncing directories, so errors are ignored.
+func syncDir(dir string) {
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	//nolint:errcheck
+	dirFile.Sync()
+	dirFile.Close()
+}
@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var errReadFailed = errors.New("read failed")
+
+// failingReader returns some data and then an error, like a download that is cut off.
+type failingReader struct {
+	read bool
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.read {
+		return 0, errReadFailed
+	}
+	r.read = true
+	return copy(p, "partial"), nil
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	if err := os.WriteFile(path, []byte("original"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteFileAtomic(path, &failingReader{}, 0o600); !errors.Is(err, errReadFailed) {
+		t.Fatalf("WriteFileAtomic() error = %v, want %v", err, errReadFailed)
+	}
+	assertFileContents(t, path, "original")
+
+	if err := WriteFileAtomic(path, strings.NewReader("updated"), 0o600); err != nil {
+		t.Fatalf("WriteFileAtomic() error = %v", err)
+	}
+	assertFileContents(t, path, "updated")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o640 {
+		t.Errorf("permissions = %o, want %o", info.Mode().Perm(), 0o640)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("found %d files in the directory, want only the written file", len(entries))
+	}
+}
+
+func TestWriteFileAtomicThroughSymlink(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	target := filepath.Join(dir, "dotfiles", "bashrc")
+	if err := os.Mkdir(filepath.Dir(target), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(target, []byte("original"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, ".bashrc")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteFileAtomic(link, strings.NewReader("updated"), 0o600); err != nil {
+		t.Fatalf("WriteFileAtomic() error = %v", err)
+	}
+	if linkTarget, err := os.Readlink(link); err != nil || linkTarget != target {
+		t.Errorf("Readlink() = %q, %v, want the link to still point to %q", linkTarget, err, target)
+	}
+	assertFileContents(t, target, "updated")
+	entries, err := os.ReadDir(filepath.Dir(target))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("found %d files in the target's directory, want only the written file", len(entries))
+	}
+}
+
+func assertFileContents(t *testing.T, path, expected string) {
+	t.Helper()
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != expected {
+		t.Errorf("contents = %q, want %q", contents, expected)
+	}
+}
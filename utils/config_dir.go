@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Environment variable that overrides the config directory.
+	ConfigDirEnvVar = "LYNCSER_CONFIG_DIR"
+	// Environment variable that selects the profile.
+	ProfileEnvVar = "LYNCSER_PROFILE"
+	// The profile used when none is specified. Its files are stored directly in the config directory.
+	DefaultProfile = "default"
+	// Name of the directory within the config directory that holds the other profiles.
+	profilesDirName = "profiles"
+)
+
+var ErrInvalidProfile = errors.New("invalid profile name")
+
+// GetConfigDir returns the real path of the directory holding the config, state and credentials for a profile.
+// configDir and profile are the values of the command line flags and may be empty. The base directory is, in order
+// of preference, configDir, $LYNCSER_CONFIG_DIR, $XDG_CONFIG_HOME/lyncser and ~/.config/lyncser. Profiles other than
+// the default one are stored in the "profiles" directory under the base directory.
+func GetConfigDir(configDir, profile string) (string, error) {
+	if configDir == "" {
+		configDir = os.Getenv(ConfigDirEnvVar)
+	}
+	if configDir == "" {
+		if xdgConfigHome := os.Getenv("XDG_CONFIG_HOME"); xdgConfigHome != "" {
+			configDir = filepath.Join(xdgConfigHome, "lyncser")
+		}
+	}
+	if configDir == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		configDir = filepath.Join(homeDir, ".config", "lyncser")
+	}
+	if strings.HasPrefix(configDir, "~") {
+		realPath, err := RealPath(configDir)
+		if err != nil {
+			return "", err
+		}
+		configDir = realPath
+	}
+	configDir, err := filepath.Abs(configDir)
+	if err != nil {
+		return "", err
+	}
+
+	profile = GetProfile(profile)
+	if profile == DefaultProfile {
+		return configDir, nil
+	}
+	if strings.ContainsAny(profile, `/\`) || strings.HasPrefix(profile, ".") {
+		return "", fmt.Errorf("%w: %s", ErrInvalidProfile, profile)
+	}
+	return filepath.Join(configDir, profilesDirName, profile), nil
+}
+
+// GetProfile returns the profile to use. profile is the value of the command line flag and may be empty.
+func GetProfile(profile string) string {
+	if profile == "" {
+		profile = os.Getenv(ProfileEnvVar)
+	}
+	if profile == "" {
+		profile = DefaultProfile
+	}
+	return profile
+}
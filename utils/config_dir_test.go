@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+//nolint:paralleltest // Sets environment variables.
+func TestGetConfigDir(t *testing.T) {
+	home := t.TempDir()
+	tests := []struct {
+		name        string
+		configDir   string
+		profile     string
+		env         map[string]string
+		expected    string
+		expectedErr error
+	}{
+		{
+			name:     "defaults to ~/.config",
+			expected: filepath.Join(home, ".config", "lyncser"),
+		},
+		{
+			name:     "XDG_CONFIG_HOME",
+			env:      map[string]string{"XDG_CONFIG_HOME": "/xdg"},
+			expected: "/xdg/lyncser",
+		},
+		{
+			name:     "environment override wins over XDG_CONFIG_HOME",
+			env:      map[string]string{"XDG_CONFIG_HOME": "/xdg", ConfigDirEnvVar: "/override"},
+			expected: "/override",
+		},
+		{
+			name:      "flag wins over the environment",
+			configDir: "/flag",
+			env:       map[string]string{ConfigDirEnvVar: "/override"},
+			expected:  "/flag",
+		},
+		{
+			name:      "tilde is expanded",
+			configDir: "~/lyncser",
+			expected:  filepath.Join(home, "lyncser"),
+		},
+		{
+			name:     "default profile",
+			profile:  DefaultProfile,
+			env:      map[string]string{ConfigDirEnvVar: "/override"},
+			expected: "/override",
+		},
+		{
+			name:     "profile flag",
+			profile:  "work",
+			env:      map[string]string{ConfigDirEnvVar: "/override", ProfileEnvVar: "home"},
+			expected: "/override/profiles/work",
+		},
+		{
+			name:     "profile from the environment",
+			env:      map[string]string{ConfigDirEnvVar: "/override", ProfileEnvVar: "home"},
+			expected: "/override/profiles/home",
+		},
+		{
+			name:        "profile with a slash",
+			profile:     "../work",
+			expectedErr: ErrInvalidProfile,
+		},
+		{
+			name:        "profile with a backslash",
+			profile:     `a\b`,
+			expectedErr: ErrInvalidProfile,
+		},
+		{
+			name:        "hidden profile",
+			profile:     ".work",
+			expectedErr: ErrInvalidProfile,
+		},
+		{
+			name:        "invalid profile from the environment",
+			env:         map[string]string{ProfileEnvVar: ".."},
+			expectedErr: ErrInvalidProfile,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("HOME", home)
+			t.Setenv("XDG_CONFIG_HOME", "")
+			t.Setenv(ConfigDirEnvVar, "")
+			t.Setenv(ProfileEnvVar, "")
+			for key, value := range test.env {
+				t.Setenv(key, value)
+			}
+			configDir, err := GetConfigDir(test.configDir, test.profile)
+			if !errors.Is(err, test.expectedErr) {
+				t.Fatalf("expected error %v, got %v", test.expectedErr, err)
+			}
+			if configDir != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, configDir)
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Number of unchanged lines shown around each change in a unified diff.
+const diffContextLines = 3
+
+type diffOpKind byte
+
+const (
+	diffEqual  diffOpKind = ' '
+	diffDelete diffOpKind = '-'
+	diffInsert diffOpKind = '+'
+)
+
+type diffOp struct {
+	kind diffOpKind
+	line string
+}
+
+// IsBinary returns true if data does not look like text.
+func IsBinary(data []byte) bool {
+	return bytes.IndexByte(data, 0) >= 0 || !utf8.Valid(data)
+}
+
+// UnifiedDiff returns a unified diff that turns a into b. It returns an empty string if they are the same.
+func UnifiedDiff(nameA, nameB string, a, b []byte) string {
+	if bytes.Equal(a, b) {
+		return ""
+	}
+	ops := diffLines(splitLines(string(a)), splitLines(string(b)))
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", nameA, nameB)
+	for start := 0; start < len(ops); {
+		// Find the next change.
+		for start < len(ops) && ops[start].kind == diffEqual {
+			start++
+		}
+		if start == len(ops) {
+			break
+		}
+		hunkStart := start - diffContextLines
+		if hunkStart < 0 {
+			hunkStart = 0
+		}
+		// Extend the hunk until there are more than 2*diffContextLines unchanged lines in a row.
+		hunkEnd := start
+		for equalRun := 0; hunkEnd < len(ops) && equalRun <= 2*diffContextLines; hunkEnd++ {
+			if ops[hunkEnd].kind == diffEqual {
+				equalRun++
+			} else {
+				equalRun = 0
+			}
+		}
+		for trailingEqual(ops[:hunkEnd]) > diffContextLines {
+			hunkEnd--
+		}
+		writeHunk(&sb, ops, hunkStart, hunkEnd)
+		start = hunkEnd
+	}
+	return sb.String()
+}
+
+// trailingEqual returns the number of unchanged lines at the end of ops.
+func trailingEqual(ops []diffOp) int {
+	count := 0
+	for i := len(ops) - 1; i >= 0 && ops[i].kind == diffEqual; i-- {
+		count++
+	}
+	return count
+}
+
+// writeHunk writes the header and lines for ops[start:end].
+func writeHunk(sb *strings.Builder, ops []diffOp, start, end int) {
+	lineA, lineB := 0, 0
+	for _, op := range ops[:start] {
+		if op.kind != diffInsert {
+			lineA++
+		}
+		if op.kind != diffDelete {
+			lineB++
+		}
+	}
+	countA, countB := 0, 0
+	for _, op := range ops[start:end] {
+		if op.kind != diffInsert {
+			countA++
+		}
+		if op.kind != diffDelete {
+			countB++
+		}
+	}
+	// Line numbers are 1-based, except that an empty range refers to the line before it.
+	if countA > 0 {
+		lineA++
+	}
+	if countB > 0 {
+		lineB++
+	}
+	fmt.Fprintf(sb, "@@ -%d,%d +%d,%d @@\n", lineA, countA, lineB, countB)
+	for _, op := range ops[start:end] {
+		sb.WriteByte(byte(op.kind))
+		sb.WriteString(op.line)
+		if !strings.HasSuffix(op.line, "\n") {
+			sb.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+// splitLines splits text into lines, keeping the line endings.
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines returns the shortest edit script that turns a into b. It uses the linear space variant of Myers'
+// algorithm, which finds the middle of an optimal path and recurses on both halves, so memory stays proportional to
+// the number of lines however different the files are.
+func diffLines(a, b []string) []diffOp {
+	d := &differ{ops: make([]diffOp, 0, len(a)+len(b))}
+	if !haveCommonLine(a, b) {
+		// Common when a file was rewritten entirely, and the search would find nothing to keep.
+		d.deleteAll(a)
+		d.insertAll(b)
+		return d.ops
+	}
+	d.diff(a, b)
+	return d.ops
+}
+
+// haveCommonLine returns true if a line of a is also in b.
+func haveCommonLine(a, b []string) bool {
+	linesA := make(map[string]bool, len(a))
+	for _, line := range a {
+		linesA[line] = true
+	}
+	for _, line := range b {
+		if linesA[line] {
+			return true
+		}
+	}
+	return false
+}
+
+// differ collects the edit script found by diffLines.
+type differ struct {
+	ops []diffOp
+}
+
+func (d *differ) equalAll(lines []string) {
+	for _, line := range lines {
+		d.ops = append(d.ops, diffOp{kind: diffEqual, line: line})
+	}
+}
+
+func (d *differ) deleteAll(lines []string) {
+	for _, line := range lines {
+		d.ops = append(d.ops, diffOp{kind: diffDelete, line: line})
+	}
+}
+
+func (d *differ) insertAll(lines []string) {
+	for _, line := range lines {
+		d.ops = append(d.ops, diffOp{kind: diffInsert, line: line})
+	}
+}
+
+// diff appends the edits that turn a into b.
+func (d *differ) diff(a, b []string) {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	d.equalAll(a[:prefix])
+	a, b = a[prefix:], b[prefix:]
+	suffix := 0
+	for suffix < len(a) && suffix < len(b) && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	common := a[len(a)-suffix:]
+	a, b = a[:len(a)-suffix], b[:len(b)-suffix]
+
+	switch {
+	case len(a) == 0:
+		d.insertAll(b)
+	case len(b) == 0:
+		d.deleteAll(a)
+	default:
+		x, y, ok := middleSnake(a, b)
+		if ok {
+			d.diff(a[:x], b[:y])
+			d.diff(a[x:], b[y:])
+		} else {
+			d.deleteAll(a)
+			d.insertAll(b)
+		}
+	}
+	d.equalAll(common)
+}
+
+// middleSnake searches for the shortest edit script from both ends at once, and returns the point where the two
+// searches meet, which lies on a shortest edit script. It returns false if a and b have nothing in common.
+func middleSnake(a, b []string) (x, y int, ok bool) {
+	n, m := len(a), len(b)
+	maxD := (n + m + 1) / 2
+	offset := maxD
+	// forward[offset+k] is the furthest x reached on diagonal k from the start, and backward[offset+k] the furthest
+	// distance from the end on diagonal k counted from the end. -1 means not reached yet.
+	forward := make([]int, 2*maxD+2)
+	backward := make([]int, 2*maxD+2)
+	for i := range forward {
+		forward[i] = -1
+		backward[i] = -1
+	}
+	forward[offset+1] = 0
+	backward[offset+1] = 0
+	delta := n - m
+	// If delta is odd, the forward search is the one that meets the other.
+	checkForward := delta%2 != 0
+	// Diagonals that have run off an edge of the grid are skipped.
+	forwardStart, forwardEnd, backwardStart, backwardEnd := 0, 0, 0, 0
+	for d := 0; d < maxD; d++ {
+		for k := -d + forwardStart; k <= d-forwardEnd; k += 2 {
+			var x1 int
+			if k == -d || (k != d && forward[offset+k-1] < forward[offset+k+1]) {
+				x1 = forward[offset+k+1]
+			} else {
+				x1 = forward[offset+k-1] + 1
+			}
+			y1 := x1 - k
+			for x1 < n && y1 < m && a[x1] == b[y1] {
+				x1++
+				y1++
+			}
+			forward[offset+k] = x1
+			switch {
+			case x1 > n:
+				forwardEnd += 2
+			case y1 > m:
+				forwardStart += 2
+			case checkForward:
+				backwardK := offset + delta - k
+				if backwardK >= 0 && backwardK < len(backward) && backward[backwardK] != -1 &&
+					x1 >= n-backward[backwardK] {
+					return x1, y1, true
+				}
+			}
+		}
+		for k := -d + backwardStart; k <= d-backwardEnd; k += 2 {
+			var x2 int
+			if k == -d || (k != d && backward[offset+k-1] < backward[offset+k+1]) {
+				x2 = backward[offset+k+1]
+			} else {
+				x2 = backward[offset+k-1] + 1
+			}
+			y2 := x2 - k
+			for x2 < n && y2 < m && a[n-x2-1] == b[m-y2-1] {
+				x2++
+				y2++
+			}
+			backward[offset+k] = x2
+			switch {
+			case x2 > n:
+				backwardEnd += 2
+			case y2 > m:
+				backwardStart += 2
+			case !checkForward:
+				forwardK := offset + delta - k
+				if forwardK >= 0 && forwardK < len(forward) && forward[forwardK] != -1 {
+					x1 := forward[forwardK]
+					if x1 >= n-x2 {
+						return x1, x1 - (forwardK - offset), true
+					}
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
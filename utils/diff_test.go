@@ -0,0 +1,153 @@
+package utils
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		a        string
+		b        string
+		expected string
+	}{
+		{
+			name:     "identical",
+			a:        "one\ntwo\n",
+			b:        "one\ntwo\n",
+			expected: "",
+		},
+		{
+			name:     "changed line",
+			a:        "one\ntwo\nthree\n",
+			b:        "one\n2\nthree\n",
+			expected: "--- a\n+++ b\n@@ -1,3 +1,3 @@\n one\n-two\n+2\n three\n",
+		},
+		{
+			name:     "new file",
+			a:        "",
+			b:        "one\n",
+			expected: "--- a\n+++ b\n@@ -0,0 +1,1 @@\n+one\n",
+		},
+		{
+			name:     "no trailing newline",
+			a:        "one\n",
+			b:        "one\ntwo",
+			expected: "--- a\n+++ b\n@@ -1,1 +1,2 @@\n one\n+two\n\\ No newline at end of file\n",
+		},
+		{
+			name: "separate hunks",
+			a:    "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n",
+			b:    "one\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\ntwelve\n",
+			expected: "--- a\n+++ b\n@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n" +
+				"@@ -9,4 +9,4 @@\n 9\n 10\n 11\n-12\n+twelve\n",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			actual := UnifiedDiff("a", "b", []byte(test.a), []byte(test.b))
+			if actual != test.expected {
+				t.Errorf("expected:\n%s\nactual:\n%s", test.expected, actual)
+			}
+		})
+	}
+}
+
+// checkEditScript checks that ops turns a into b with the fewest possible edits.
+func checkEditScript(t *testing.T, a, b []string, ops []diffOp) {
+	t.Helper()
+	var gotA, gotB []string
+	edits := 0
+	for _, op := range ops {
+		if op.kind != diffInsert {
+			gotA = append(gotA, op.line)
+		}
+		if op.kind != diffDelete {
+			gotB = append(gotB, op.line)
+		}
+		if op.kind != diffEqual {
+			edits++
+		}
+	}
+	if strings.Join(gotA, "") != strings.Join(a, "") || strings.Join(gotB, "") != strings.Join(b, "") {
+		t.Fatalf("the edit script doesn't turn %q into %q: %v", a, b, ops)
+	}
+	// The fewest edits keep the longest common subsequence.
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] > lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	if expected := len(a) + len(b) - 2*lcs[0][0]; edits != expected {
+		t.Errorf("expected %d edits to turn %q into %q, got %d", expected, a, b, edits)
+	}
+}
+
+func TestDiffLinesIsMinimal(t *testing.T) {
+	t.Parallel()
+	random := rand.New(rand.NewSource(1))
+	randomLines := func() []string {
+		lines := make([]string, random.Intn(20))
+		for i := range lines {
+			lines[i] = fmt.Sprintf("%d\n", random.Intn(4))
+		}
+		return lines
+	}
+	for i := 0; i < 500; i++ {
+		a, b := randomLines(), randomLines()
+		checkEditScript(t, a, b, diffLines(a, b))
+	}
+}
+
+//nolint:paralleltest // Measures the memory allocated.
+func TestDiffLinesLargeRewrite(t *testing.T) {
+	const lines = 10000
+	var a, b, alternating strings.Builder
+	for i := 0; i < lines; i++ {
+		fmt.Fprintf(&a, "old line %d\n", i)
+		fmt.Fprintf(&b, "new line %d\n", i)
+		if i%2 == 0 {
+			fmt.Fprintf(&alternating, "old line %d\n", i)
+		} else {
+			fmt.Fprintf(&alternating, "new line %d\n", i)
+		}
+	}
+	for _, test := range []struct {
+		name  string
+		b     string
+		edits int
+	}{
+		{"every line", b.String(), 2 * lines},
+		{"every other line", alternating.String(), lines},
+	} {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		diff := UnifiedDiff("a", "b", []byte(a.String()), []byte(test.b))
+		runtime.ReadMemStats(&after)
+		if edits := strings.Count(diff, "\n-") + strings.Count(diff, "\n+") - 1; edits != test.edits {
+			t.Errorf("%s: expected %d edits, got %d", test.name, test.edits, edits)
+		}
+		// Keeping the search state for every edit would take gigabytes.
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 64<<20 {
+			t.Errorf("%s: diffing allocated %d MiB", test.name, allocated>>20)
+		}
+	}
+}
@@ -0,0 +1,6 @@
+package utils
+
+import "errors"
+
+// Returned by LockFile when another process holds the lock.
+var ErrFileLocked = errors.New("file is locked by another process")
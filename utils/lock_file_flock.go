@@ -0,0 +1,28 @@
+//go:build !windows
+// +build !windows
+
+package utils
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// LockFile takes an exclusive lock on the file at path, creating the file if necessary. It returns ErrFileLocked
+// without waiting if another process holds the lock. The lock is released when the returned file is closed or the
+// process exits.
+func LockFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrFileLocked
+		}
+		return nil, err
+	}
+	return file, nil
+}
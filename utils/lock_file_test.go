@@ -0,0 +1,28 @@
+//go:build !windows
+// +build !windows
+
+package utils
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestLockFile(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "test.lock")
+	lockFile, err := LockFile(path)
+	if err != nil {
+		t.Fatalf("LockFile() error = %v", err)
+	}
+	if _, err := LockFile(path); !errors.Is(err, ErrFileLocked) {
+		t.Fatalf("LockFile() on a held lock error = %v, want %v", err, ErrFileLocked)
+	}
+	lockFile.Close()
+	lockFile, err = LockFile(path)
+	if err != nil {
+		t.Fatalf("LockFile() after release error = %v", err)
+	}
+	lockFile.Close()
+}
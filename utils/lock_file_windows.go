@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+package utils
+
+import "os"
+
+// LockFile opens the file at path, creating it if necessary. File locking is not implemented on Windows, so this
+// never returns ErrFileLocked.
+func LockFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+}
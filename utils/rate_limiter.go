@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter limits the rate at which bytes are transferred. Readers that share a RateLimiter share its rate, and it
+// is safe to use from several goroutines.
+type RateLimiter struct {
+	bytesPerSecond int64
+	mu             sync.Mutex
+	// The time at which the bytes allowed so far will have been transferred at the limited rate.
+	next time.Time
+	// Replaced in tests.
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// NewRateLimiter returns a RateLimiter that allows bytesPerSecond bytes per second. bytesPerSecond must be positive.
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	return &RateLimiter{
+		bytesPerSecond: bytesPerSecond,
+		now:            time.Now,
+		sleep:          time.Sleep,
+	}
+}
+
+// Wait blocks until n more bytes may be transferred without going over the rate.
+func (r *RateLimiter) Wait(n int) {
+	r.mu.Lock()
+	now := r.now()
+	if r.next.Before(now) {
+		// Time spent idle doesn't allow a burst later.
+		r.next = now
+	}
+	wait := r.next.Sub(now)
+	r.next = r.next.Add(time.Duration(int64(n) * int64(time.Second) / r.bytesPerSecond))
+	r.mu.Unlock()
+	if wait > 0 {
+		r.sleep(wait)
+	}
+}
@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimitedReader(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := NewRateLimiter(64 << 10)
+	limiter.now = func() time.Time {
+		return now
+	}
+	limiter.sleep = func(d time.Duration) {
+		now = now.Add(d)
+	}
+	start := now
+	contents := strings.Repeat("x", 256<<10)
+	var reader io.Reader = strings.NewReader(contents)
+	data, err := ioutil.ReadAll(LimitReader(reader, limiter))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != contents {
+		t.Error("the contents were changed")
+	}
+	// Reading to the end waits for everything before it, which takes 256 KiB / 64 KiB/s.
+	if elapsed := now.Sub(start); elapsed < 3900*time.Millisecond || elapsed > 4*time.Second {
+		t.Errorf("expected 256 KiB at 64 KiB/s to take 4s, took %v", elapsed)
+	}
+	if LimitReader(reader, nil) != reader {
+		t.Error("a nil limiter should not wrap the reader")
+	}
+}
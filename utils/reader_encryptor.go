@@ -1,12 +1,39 @@
 package utils
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+)
+
+const (
+	// The format version of files encrypted by AESGCMEncryptor. Version 1 sealed each file in one piece with a fixed
+	// nonce. Version 2 seals it in segments under a random nonce, see EncryptReaderWithNonce.
+	aesGCMFormatVersion = 2
+	// The size of the unencrypted contents of each segment but the last.
+	aesGCMSegmentSize = 64 << 10
+	// The size of the random nonce each file is encrypted with.
+	aesGCMFileNonceSize = 16
+)
+
+var (
+	// Starts contents encrypted in version 2, followed by the file's nonce. Version 1 contents start with their nonce.
+	aesGCMSegmentedMagic = []byte("lyncser\x02")
+
+	errInvalidNonce = errors.New("invalid nonce")
+	errTruncated    = errors.New("the encrypted data is truncated")
+	errTooLarge     = errors.New("the contents are too large to encrypt")
 )
 
 type ReaderEncryptor interface {
@@ -14,40 +41,135 @@ type ReaderEncryptor interface {
 	DecryptReader(reader io.ReadCloser) (io.ReadCloser, error)
 }
 
+// EncryptionFormat is implemented by encryptors that describe how they encrypt, so that it can be recorded with each
+// encrypted file. Encryptors that don't implement it are assumed to leave files unencrypted.
+type EncryptionFormat interface {
+	// FormatVersion identifies the format of the encrypted contents. It changes whenever that format changes.
+	FormatVersion() int
+	// KeyID identifies the encryption key without revealing it.
+	KeyID() string
+	// HashContents returns a hash of the unencrypted contents that reveals nothing about them without the key.
+	HashContents(reader io.Reader) (string, error)
+}
+
+// NonceEncryptor is implemented by encryptors that encrypt each file with a new random nonce. An interrupted upload can
+// only be resumed if the contents are encrypted to the same bytes again, so the nonce is saved with the upload session
+// and reused for the same contents. It must never be used for different contents.
+type NonceEncryptor interface {
+	// NewNonce returns a new random nonce.
+	NewNonce() ([]byte, error)
+	// EncryptReaderWithNonce encrypts the contents of reader with the nonce.
+	EncryptReaderWithNonce(reader io.Reader, nonce []byte) (io.Reader, error)
+}
+
+// HashContents returns the hex SHA-256 hash of the contents, or a keyed hash if encryptor implements EncryptionFormat.
+func HashContents(encryptor ReaderEncryptor, reader io.Reader) (string, error) {
+	if format, ok := encryptor.(EncryptionFormat); ok {
+		return format.HashContents(reader)
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, reader); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
 type AESGCMEncryptor struct {
 	Key []byte
 }
 
+// EncryptReader encrypts the contents of reader with a new random nonce.
 func (e *AESGCMEncryptor) EncryptReader(reader io.Reader) (io.Reader, error) {
-	plaintext, err := io.ReadAll(reader)
+	nonce, err := e.NewNonce()
 	if err != nil {
 		return nil, err
 	}
-	block, err := aes.NewCipher(e.Key)
-	if err != nil {
-		return nil, fmt.Errorf("error creating cipher: %w", err)
+	return e.EncryptReaderWithNonce(reader, nonce)
+}
+
+// NewNonce implements NonceEncryptor.
+func (e *AESGCMEncryptor) NewNonce() ([]byte, error) {
+	nonce := make([]byte, aesGCMFileNonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("error generating nonce: %w", err)
 	}
-	aesGCM, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, fmt.Errorf("error creating GCM: %w", err)
+	return nonce, nil
+}
+
+// EncryptReaderWithNonce implements NonceEncryptor. Each file is sealed with its own key, derived from the encryption
+// key and the nonce, so GCM nonces are never repeated across files. The contents are sealed in segments as they are
+// read, so only one segment is held in memory. Each segment's GCM nonce is its number and whether it is the last one,
+// so segments can't be reordered, dropped or truncated without the decryption failing.
+func (e *AESGCMEncryptor) EncryptReaderWithNonce(reader io.Reader, nonce []byte) (io.Reader, error) {
+	if len(nonce) != aesGCMFileNonceSize {
+		return nil, fmt.Errorf("%w: expected %d bytes, got %d", errInvalidNonce, aesGCMFileNonceSize, len(nonce))
 	}
-	nonce := make([]byte, aesGCM.NonceSize())
-	ciphertext := aesGCM.Seal(nonce, nonce, plaintext, nil)
-	readerEncrypted := bytes.NewReader(ciphertext)
+	aesGCM, err := newAESGCM(e.fileKey(nonce))
 	if err != nil {
-		return nil, fmt.Errorf("error creating encrypted reader: %w", err)
+		return nil, err
 	}
-
-	return readerEncrypted, nil
+	header := append(append([]byte{}, aesGCMSegmentedMagic...), nonce...)
+	return &segmentEncryptor{
+		aead:      aesGCM,
+		source:    bufio.NewReader(reader),
+		plaintext: make([]byte, aesGCMSegmentSize),
+		sealed:    make([]byte, 0, aesGCMSegmentSize+aesGCM.Overhead()),
+		pending:   header,
+	}, nil
 }
 
+// DecryptReader decrypts contents in either format version. Contents in the segmented format are decrypted as they
+// are read; contents in version 1 are read into memory first.
 func (e *AESGCMEncryptor) DecryptReader(reader io.ReadCloser) (io.ReadCloser, error) {
+	source := bufio.NewReader(reader)
+	if magic, err := source.Peek(len(aesGCMSegmentedMagic)); err != nil || !bytes.Equal(magic, aesGCMSegmentedMagic) {
+		aesGCM, err := newAESGCM(e.Key)
+		if err != nil {
+			return nil, err
+		}
+		return decryptVersion1(aesGCM, source)
+	}
+	header := make([]byte, len(aesGCMSegmentedMagic)+aesGCMFileNonceSize)
+	if _, err := io.ReadFull(source, header); err != nil {
+		return nil, fmt.Errorf("error reading encrypted data: %w", err)
+	}
+	aesGCM, err := newAESGCM(e.fileKey(header[len(aesGCMSegmentedMagic):]))
+	if err != nil {
+		return nil, err
+	}
+	return &segmentDecryptor{
+		aead:       aesGCM,
+		source:     source,
+		closer:     reader,
+		ciphertext: make([]byte, aesGCMSegmentSize+aesGCM.Overhead()),
+	}, nil
+}
+
+// decryptVersion1 decrypts contents sealed in one piece, with the nonce in front of them.
+func decryptVersion1(aesGCM cipher.AEAD, reader io.Reader) (io.ReadCloser, error) {
 	encryptedData, err := ioutil.ReadAll(reader)
 	if err != nil {
 		return nil, fmt.Errorf("error reading encrypted data: %w", err)
 	}
+	nonceSize := aesGCM.NonceSize()
+	if len(encryptedData) < nonceSize {
+		return nil, fmt.Errorf("%w: %d bytes", errTruncated, len(encryptedData))
+	}
+	nonce, ciphertext := encryptedData[:nonceSize], encryptedData[nonceSize:]
+	plaintext, err := aesGCM.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error opening GCM: %w", err)
+	}
+	return io.NopCloser(bytes.NewReader(plaintext)), nil
+}
+
+// fileKey derives the key of the file encrypted with nonce.
+func (e *AESGCMEncryptor) fileKey(nonce []byte) []byte {
+	return e.deriveKey("lyncser file key " + string(nonce))
+}
 
-	block, err := aes.NewCipher(e.Key)
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, fmt.Errorf("error creating cipher: %w", err)
 	}
@@ -55,15 +177,133 @@ func (e *AESGCMEncryptor) DecryptReader(reader io.ReadCloser) (io.ReadCloser, er
 	if err != nil {
 		return nil, fmt.Errorf("error creating GCM: %w", err)
 	}
-	nonceSize := aesGCM.NonceSize()
-	nonce, ciphertext := encryptedData[:nonceSize], encryptedData[nonceSize:]
-	plaintext, err := aesGCM.Open(nil, nonce, ciphertext, nil)
+	return aesGCM, nil
+}
+
+// segmentNonce returns the GCM nonce of a segment: zeros, then the segment's number and whether it is the last one.
+func segmentNonce(segment uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint32(nonce[7:11], segment)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// readSegment fills buffer from source and returns the number of bytes read and whether source has no more after them.
+func readSegment(source *bufio.Reader, buffer []byte) (int, bool, error) {
+	n, err := io.ReadFull(source, buffer)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return n, true, nil
+	}
 	if err != nil {
-		return nil, fmt.Errorf("error opening GCM: %w", err)
+		return n, false, err
+	}
+	if _, err := source.Peek(1); errors.Is(err, io.EOF) {
+		return n, true, nil
+	} else if err != nil {
+		return n, false, err
+	}
+	return n, false, nil
+}
+
+// segmentEncryptor seals the contents of source one segment at a time as they are read.
+type segmentEncryptor struct {
+	aead      cipher.AEAD
+	source    *bufio.Reader
+	segment   uint32
+	plaintext []byte
+	sealed    []byte
+	// The sealed bytes that haven't been read yet.
+	pending []byte
+	done    bool
+}
+
+func (s *segmentEncryptor) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if s.segment == math.MaxUint32 {
+			return 0, errTooLarge
+		}
+		n, last, err := readSegment(s.source, s.plaintext)
+		if err != nil {
+			return 0, err
+		}
+		s.pending = s.aead.Seal(s.sealed[:0], segmentNonce(s.segment, last), s.plaintext[:n], nil)
+		s.segment++
+		s.done = last
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// segmentDecryptor opens the segments read from source one at a time.
+type segmentDecryptor struct {
+	aead       cipher.AEAD
+	source     *bufio.Reader
+	closer     io.Closer
+	segment    uint32
+	ciphertext []byte
+	// The opened bytes that haven't been read yet.
+	pending []byte
+	done    bool
+}
+
+func (s *segmentDecryptor) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		n, last, err := readSegment(s.source, s.ciphertext)
+		if err != nil {
+			return 0, fmt.Errorf("error reading encrypted data: %w", err)
+		}
+		if n == 0 {
+			return 0, fmt.Errorf("%w: the last segment is missing", errTruncated)
+		}
+		plaintext, err := s.aead.Open(s.ciphertext[:0], segmentNonce(s.segment, last), s.ciphertext[:n], nil)
+		if err != nil {
+			return 0, fmt.Errorf("error opening GCM: %w", err)
+		}
+		s.pending = plaintext
+		s.segment++
+		s.done = last
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *segmentDecryptor) Close() error {
+	return s.closer.Close()
+}
+
+func (e *AESGCMEncryptor) FormatVersion() int {
+	return aesGCMFormatVersion
+}
+
+// KeyID returns the first 8 bytes of a hash derived from the key, in hex.
+func (e *AESGCMEncryptor) KeyID() string {
+	return hex.EncodeToString(e.deriveKey("lyncser key id")[:8])
+}
+
+// HashContents returns the hex HMAC-SHA256 of the contents, keyed with a key derived from the encryption key.
+func (e *AESGCMEncryptor) HashContents(reader io.Reader) (string, error) {
+	mac := hmac.New(sha256.New, e.deriveKey("lyncser content hash"))
+	if _, err := io.Copy(mac, reader); err != nil {
+		return "", err
 	}
-	decryptedReader := io.NopCloser(bytes.NewReader(plaintext))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
 
-	return decryptedReader, nil
+// deriveKey derives a key for a purpose other than encryption from the encryption key.
+func (e *AESGCMEncryptor) deriveKey(purpose string) []byte {
+	mac := hmac.New(sha256.New, e.Key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
 }
 
 type NopEncryptor struct{}
@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestHashContents(t *testing.T) {
+	t.Parallel()
+	key1 := &AESGCMEncryptor{Key: make([]byte, 32)}
+	key2 := &AESGCMEncryptor{Key: []byte(strings.Repeat("k", 32))}
+	hash := func(encryptor ReaderEncryptor, contents string) string {
+		h, err := HashContents(encryptor, strings.NewReader(contents))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	if hash(key1, "contents") != hash(key1, "contents") {
+		t.Error("the same contents and key should have the same hash")
+	}
+	if hash(key1, "contents") == hash(key1, "other contents") {
+		t.Error("different contents should have different hashes")
+	}
+	if hash(key1, "contents") == hash(key2, "contents") {
+		t.Error("different keys should give different hashes")
+	}
+	// SHA-256 of "contents".
+	expected := "d1b2a59fbea7e20077af9f91b27e95e865061b270be03ff539ab3b73587882e8"
+	if actual := hash(&NopEncryptor{}, "contents"); actual != expected {
+		t.Errorf("unencrypted hash: expected %s, got %s", expected, actual)
+	}
+	if key1.KeyID() == key2.KeyID() || len(key1.KeyID()) != 16 {
+		t.Errorf("unexpected key IDs %s and %s", key1.KeyID(), key2.KeyID())
+	}
+}
+
+func encryptWithNonce(t *testing.T, encryptor *AESGCMEncryptor, contents, nonce []byte) []byte {
+	t.Helper()
+	reader, err := encryptor.EncryptReaderWithNonce(bytes.NewReader(contents), nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encrypted
+}
+
+func decrypt(encryptor *AESGCMEncryptor, encrypted []byte) ([]byte, error) {
+	reader, err := encryptor.DecryptReader(io.NopCloser(bytes.NewReader(encrypted)))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+func TestAESGCMEncryptorRoundTrip(t *testing.T) {
+	t.Parallel()
+	encryptor := &AESGCMEncryptor{Key: make([]byte, 32)}
+	for _, size := range []int{0, 1, aesGCMSegmentSize, 3*aesGCMSegmentSize + 17} {
+		contents := bytes.Repeat([]byte("x"), size)
+		reader, err := encryptor.EncryptReader(bytes.NewReader(contents))
+		if err != nil {
+			t.Fatal(err)
+		}
+		encrypted, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decrypted, err := decrypt(encryptor, encrypted)
+		if err != nil || !bytes.Equal(decrypted, contents) {
+			t.Errorf("%d bytes: decrypted %d bytes, error %v", size, len(decrypted), err)
+		}
+		// Dropping the last segment must not go unnoticed, even when the rest ends on a segment boundary.
+		if size > aesGCMSegmentSize {
+			lastSegment := size%aesGCMSegmentSize + 16
+			if _, err := decrypt(encryptor, encrypted[:len(encrypted)-lastSegment]); err == nil {
+				t.Errorf("%d bytes: truncated contents were decrypted", size)
+			}
+		}
+	}
+}
+
+func TestAESGCMEncryptorNonce(t *testing.T) {
+	t.Parallel()
+	encryptor := &AESGCMEncryptor{Key: make([]byte, 32)}
+	contents := []byte("contents")
+	nonce, err := encryptor.NewNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherNonce, err := encryptor.NewNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(encryptWithNonce(t, encryptor, contents, nonce), encryptWithNonce(t, encryptor, contents, nonce)) {
+		t.Error("the same contents and nonce should be encrypted to the same bytes")
+	}
+	if bytes.Equal(encryptWithNonce(t, encryptor, contents, nonce), encryptWithNonce(t, encryptor, contents, otherNonce)) {
+		t.Error("different nonces should give different bytes")
+	}
+	if _, err := encryptor.EncryptReaderWithNonce(bytes.NewReader(contents), nonce[1:]); !errors.Is(err, errInvalidNonce) {
+		t.Errorf("expected %v for a short nonce, got %v", errInvalidNonce, err)
+	}
+}
+
+func TestAESGCMEncryptorDecryptsVersion1(t *testing.T) {
+	t.Parallel()
+	encryptor := &AESGCMEncryptor{Key: make([]byte, 32)}
+	aesGCM, err := newAESGCM(encryptor.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, aesGCM.NonceSize())
+	encrypted := aesGCM.Seal(nonce, nonce, []byte("version 1"), nil)
+	if decrypted, err := decrypt(encryptor, encrypted); err != nil || string(decrypted) != "version 1" {
+		t.Errorf("decrypted %q, error %v", decrypted, err)
+	}
+}
@@ -0,0 +1,42 @@
+package utils
+
+import "io"
+
+// CountingReader counts the bytes read from the underlying reader.
+type CountingReader struct {
+	Reader io.Reader
+	// The number of bytes read so far.
+	Count int64
+}
+
+func (r *CountingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.Count += int64(n)
+	return n, err
+}
+
+// The most bytes a RateLimitedReader reads at once, so that the rate stays smooth.
+const rateLimitedReadSize = 32 << 10
+
+// RateLimitedReader reads from Reader no faster than Limiter allows.
+type RateLimitedReader struct {
+	Reader  io.Reader
+	Limiter *RateLimiter
+}
+
+// LimitReader returns a reader that reads from reader no faster than limiter allows. A nil limiter means no limit.
+func LimitReader(reader io.Reader, limiter *RateLimiter) io.Reader {
+	if limiter == nil {
+		return reader
+	}
+	return &RateLimitedReader{Reader: reader, Limiter: limiter}
+}
+
+func (r *RateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > rateLimitedReadSize {
+		p = p[:rateLimitedReadSize]
+	}
+	n, err := r.Reader.Read(p)
+	r.Limiter.Wait(n)
+	return n, err
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -25,6 +26,29 @@ func RealPath(path string) (string, error) {
 	return out[0], nil
 }
 
+// FriendlyPath converts a path to the form used in the global config. Paths under the home directory start with
+// "~", and other paths are absolute. Paths that already start with "~" are returned unchanged.
+func FriendlyPath(path string) (string, error) {
+	if strings.HasPrefix(path, "~") {
+		return path, nil
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return absPath, nil //nolint:nilerr // Without a home directory, the absolute path is the friendly path.
+	}
+	if absPath == homeDir {
+		return "~", nil
+	}
+	if strings.HasPrefix(absPath, homeDir+string(filepath.Separator)) {
+		return "~" + strings.TrimPrefix(absPath, homeDir), nil
+	}
+	return absPath, nil
+}
+
 func PathExists(path string) (bool, error) {
 	_, err := os.Stat(path)
 	if os.IsNotExist(err) {